@@ -35,6 +35,9 @@ func CMP_immediate(v uint64, dest lib.Operand) lib.Instruction {
 	if reg, ok := dest.(*encoding.Register); ok && reg.Width() == lib.BYTE {
 		return CMP(encoding.Uint8(v), dest)
 	}
+	if reg, ok := dest.(*encoding.Register); ok && reg.Width() == lib.WORD {
+		return CMP(encoding.Uint16(v), dest)
+	}
 	return opcodes.OpcodesToInstruction("cmp", opcodes.CMP, 2, dest, encoding.Uint32(v))
 }
 
@@ -48,6 +51,16 @@ func CVTTSD2SI(src, dest lib.Operand) lib.Instruction {
 	return opcodes.OpcodesToInstruction("cvttsd2si", opcodes.CVTTSD2SI, 2, dest, src)
 }
 
+// Convert double precision float to single precision float
+func CVTSD2SS(src, dest lib.Operand) lib.Instruction {
+	return opcodes.OpcodesToInstruction("cvtsd2ss", opcodes.CVTSD2SS, 2, dest, src)
+}
+
+// Convert single precision float to double precision float
+func CVTSS2SD(src, dest lib.Operand) lib.Instruction {
+	return opcodes.OpcodesToInstruction("cvtss2sd", opcodes.CVTSS2SD, 2, dest, src)
+}
+
 // Convert Byte to Word; al:ah = sign extend(ah)
 func CBW() lib.Instruction {
 	return opcodes.OpcodesToInstruction("cbw", []*encoding.Opcode{opcodes.CBW}, 0)
@@ -136,6 +149,12 @@ func JNL(dest lib.Operand) lib.Instruction {
 func JNLE(dest lib.Operand) lib.Instruction {
 	return opcodes.OpcodesToInstruction("jnle", opcodes.JNLE, 1, dest)
 }
+func JNO(dest lib.Operand) lib.Instruction {
+	return opcodes.OpcodesToInstruction("jno", opcodes.JNO, 1, dest)
+}
+func JO(dest lib.Operand) lib.Instruction {
+	return opcodes.OpcodesToInstruction("jo", opcodes.JO, 1, dest)
+}
 func JMP(dest lib.Operand) lib.Instruction {
 	return opcodes.OpcodesToInstruction("jmp", opcodes.JMP, 1, dest)
 }
@@ -152,12 +171,30 @@ func MOV_immediate(v uint64, dest lib.Operand) lib.Instruction {
 	if reg, ok := dest.(*encoding.Register); ok && reg.Width() == lib.WORD {
 		return MOV(encoding.Uint16(v), dest)
 	}
+	if v < (1 << 31) {
+		return MOV(encoding.Uint32(v), dest)
+	}
+	// The 32 bit immediate gets sign extended when moved into a 64 bit
+	// register, so larger values need the full 64 bit immediate.
+	if reg, ok := dest.(*encoding.Register); ok && reg.Width() == lib.QUADWORD {
+		return MOV(encoding.Uint64(v), dest)
+	}
 	if v < (1 << 32) {
 		return MOV(encoding.Uint32(v), dest)
 	}
 	return MOV(encoding.Uint64(v), dest)
 }
 
+// Move quadword between a general purpose and an xmm register
+func MOVQ(src, dest lib.Operand) lib.Instruction {
+	return opcodes.OpcodesToInstruction("movq", opcodes.MOVQ, 2, dest, src)
+}
+
+// Move a single precision float between an xmm register and memory
+func MOVSS(src, dest lib.Operand) lib.Instruction {
+	return opcodes.OpcodesToInstruction("movss", opcodes.MOVSS, 2, dest, src)
+}
+
 // Move with sign-extend
 func MOVSX(src, dest lib.Operand) lib.Instruction {
 	return opcodes.OpcodesToInstruction("movsx", opcodes.MOVSX, 2, dest, src)
@@ -233,6 +270,9 @@ func SHL(src, dest lib.Operand) lib.Instruction {
 func SHR(src, dest lib.Operand) lib.Instruction {
 	return opcodes.OpcodesToInstruction("shr", opcodes.SHR, 2, dest, src)
 }
+func SAR(src, dest lib.Operand) lib.Instruction {
+	return opcodes.OpcodesToInstruction("sar", opcodes.SAR, 2, dest, src)
+}
 func SYSCALL() lib.Instruction {
 	return opcodes.OpcodeToInstruction("syscall", opcodes.SYSCALL, 0)
 }
@@ -145,6 +145,136 @@ func Test_MOV(t *testing.T) {
 	if unit.String() != expected {
 		t.Fatal("Expecting", expected, "got", unit)
 	}
+
+	unit, err = (MOV(encoding.Uint16(0xff81), encoding.R8w)).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "  66 41 b8 81 ff"
+	if unit.String() != expected {
+		t.Fatal("Expecting", expected, "got", unit)
+	}
+
+	unit, err = (MOV(encoding.R9d, encoding.Eax)).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "  41 8b c1"
+	if unit.String() != expected {
+		t.Fatal("Expecting", expected, "got", unit)
+	}
+}
+
+func Test_MOVSX_MOVZX(t *testing.T) {
+	table := [][]interface{}{
+		{MOVSX(encoding.Dx, encoding.Ecx), "  0f bf ca"},
+		{MOVSX(encoding.Al, encoding.Cx), "  66 0f be c8"},
+		{MOVSX(encoding.Eax, encoding.R9), "  4c 63 c8"},
+		{MOVZX(encoding.Al, encoding.Rcx), "  48 0f b6 c8"},
+		{MOVQ(encoding.Xmm1, encoding.Rax), "  66 48 0f 7e c8"},
+		{MOVQ(encoding.Rax, encoding.Xmm1), "  66 48 0f 6e c8"},
+	}
+	for _, testCase := range table {
+		unit, err := testCase[0].(lib.Instruction).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase[1].(string) {
+			t.Error("Expecting", testCase[1].(string), "got", unit, "in", testCase[0])
+		}
+	}
+}
+
+func Test_DisplacedRegister(t *testing.T) {
+	table := [][]interface{}{
+		{MOV(encoding.Rax, &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: 8}), "  48 89 44 24 08"},
+		{MOV(encoding.Rax, &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: 0x100}), "  48 89 84 24 00 01 00 00"},
+		{MOV(&encoding.DisplacedRegister{Register: encoding.Rcx, Displacement: -8}, encoding.Rdx), "  48 8b 51 f8"},
+		{MOV(&encoding.DisplacedRegister{Register: encoding.Rcx, Displacement: 0x200}, encoding.Rdx), "  48 8b 91 00 02 00 00"},
+		{MOVQ(&encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: 0x80}, encoding.Xmm1), "  66 48 0f 6e 8c 24 80 00 \n  00 00"},
+		{MOV(encoding.Xmm1, &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: 8}), "  f2 0f 11 4c 24 08"},
+	}
+	for _, testCase := range table {
+		unit, err := testCase[0].(lib.Instruction).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase[1].(string) {
+			t.Error("Expecting", testCase[1].(string), "got", unit, "in", testCase[0])
+		}
+	}
+}
+
+func Test_MOV_immediate(t *testing.T) {
+	table := [][]interface{}{
+		{MOV_immediate(0x7fffffff, encoding.Rax), "  48 c7 c0 ff ff ff 7f"},
+		{MOV_immediate(0xb504f334, encoding.Rax), "  48 b8 34 f3 04 b5 00 00 \n  00 00"},
+		{MOV_immediate(0xb504f334, encoding.Eax), "  b8 34 f3 04 b5"},
+	}
+	for _, testCase := range table {
+		unit, err := testCase[0].(lib.Instruction).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase[1].(string) {
+			t.Error("Expecting", testCase[1].(string), "got", unit, "in", testCase[0])
+		}
+	}
+}
+
+func Test_CMP_immediate(t *testing.T) {
+	table := [][]interface{}{
+		{CMP_immediate(0, encoding.Cl), "  40 80 f9 00"},
+		{CMP_immediate(0xffff, encoding.Cx), "  66 81 f9 ff ff"},
+		{CMP_immediate(0, encoding.R9d), "  41 81 f9 00 00 00 00"},
+		{CMP_immediate(0xffffffff, encoding.Rcx), "  48 81 f9 ff ff ff ff"},
+	}
+	for _, testCase := range table {
+		unit, err := testCase[0].(lib.Instruction).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase[1].(string) {
+			t.Error("Expecting", testCase[1].(string), "got", unit, "in", testCase[0])
+		}
+	}
+}
+
+func Test_SSE_extended_registers(t *testing.T) {
+	table := [][]interface{}{
+		{MOV(encoding.Xmm7, encoding.Xmm8), "  f2 41 0f 11 f8"},
+		{SUB(encoding.Xmm0, encoding.Xmm8), "  f2 44 0f 5c c0"},
+		{ADD(encoding.Xmm9, encoding.Xmm1), "  f2 41 0f 58 c9"},
+		{MOVQ(encoding.Xmm8, &encoding.DisplacedRegister{Register: encoding.Rsp}), "  66 4c 0f 7e 44 24 00"},
+	}
+	for _, testCase := range table {
+		unit, err := testCase[0].(lib.Instruction).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase[1].(string) {
+			t.Error("Expecting", testCase[1].(string), "got", unit, "in", testCase[0])
+		}
+	}
+}
+
+func Test_Float32_conversions(t *testing.T) {
+	sib := &encoding.SIBRegister{Register: encoding.Rdi, Index: encoding.Rsi, Scale: encoding.Scale4}
+	table := [][]interface{}{
+		{CVTSS2SD(sib, encoding.Xmm0), "  f3 0f 5a 04 b7"},
+		{CVTSD2SS(encoding.Xmm1, encoding.Xmm0), "  f2 0f 5a c1"},
+		{MOVSS(encoding.Xmm0, sib), "  f3 0f 11 04 b7"},
+		{MOVSS(encoding.Xmm8, sib), "  f3 44 0f 11 04 b7"},
+	}
+	for _, testCase := range table {
+		unit, err := testCase[0].(lib.Instruction).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase[1].(string) {
+			t.Error("Expecting", testCase[1].(string), "got", unit, "in", testCase[0])
+		}
+	}
 }
 
 func Test_JMP(t *testing.T) {
@@ -156,6 +286,14 @@ func Test_JMP(t *testing.T) {
 	if unit.String() != expected {
 		t.Fatal("Expecting", expected, "got", unit)
 	}
+	unit, err = JE(encoding.Uint32(0x100)).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "  0f 84 00 01 00 00"
+	if unit.String() != expected {
+		t.Fatal("Expecting", expected, "got", unit)
+	}
 }
 
 func Test_SIB_Addressing(t *testing.T) {
@@ -187,6 +325,45 @@ func Test_SIB_Addressing(t *testing.T) {
 	}
 }
 
+func Test_Shifts(t *testing.T) {
+	table := []struct {
+		instr    lib.Instruction
+		expected string
+	}{
+		{SHL(encoding.Uint8(3), encoding.Rax), "  48 c1 e0 03"},
+		{SHR(encoding.Uint8(3), encoding.Rax), "  48 c1 e8 03"},
+		{SAR(encoding.Uint8(3), encoding.Rax), "  48 c1 f8 03"},
+		{SAR(encoding.Uint8(63), encoding.R9), "  49 c1 f9 3f"},
+		{SAR(encoding.Uint8(31), encoding.Ecx), "  c1 f9 1f"},
+		{SAR(encoding.Uint8(1), encoding.Cx), "  66 c1 f9 01"},
+	}
+	for _, testCase := range table {
+		unit, err := testCase.instr.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase.expected {
+			t.Error("Expecting", testCase.expected, "got", unit, "in", testCase.instr)
+		}
+	}
+}
+
+func Test_LEA_SIB(t *testing.T) {
+	table := [][]interface{}{
+		{&encoding.SIBRegister{Register: encoding.Rcx, Index: encoding.Rcx, Scale: encoding.Scale2}, encoding.Rax, "  48 8d 04 49"},
+		{&encoding.SIBRegister{Register: encoding.R9, Index: encoding.R9, Scale: encoding.Scale8}, encoding.Rdx, "  4b 8d 14 c9"},
+	}
+	for _, testCase := range table {
+		unit, err := LEA(testCase[0].(lib.Operand), testCase[1].(lib.Operand)).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unit.String() != testCase[2].(string) {
+			t.Error("Expecting", testCase[2].(string), "got", unit, "in lea", testCase[0], testCase[1])
+		}
+	}
+}
+
 //goland:noinspection GoBoolExpressions
 func Test_DbgExecute(t *testing.T) {
 	units := [][]lib.Instruction{
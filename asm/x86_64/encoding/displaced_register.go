@@ -2,14 +2,14 @@ package encoding
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/bspaans/jit-compiler/lib"
 )
 
 type DisplacedRegister struct {
 	*Register
-	// TODO: also support the 16 bit form
-	Displacement uint8
+	Displacement int32
 }
 
 func (t *DisplacedRegister) Type() lib.Type {
@@ -19,3 +19,12 @@ func (t *DisplacedRegister) Type() lib.Type {
 func (t *DisplacedRegister) String() string {
 	return fmt.Sprintf("0x%x(%s)", t.Displacement, t.Register.String())
 }
+
+// EncodeDisplacement returns the addressing mode and the bytes of the
+// displacement, which only takes a single byte when it fits.
+func (t *DisplacedRegister) EncodeDisplacement() (Mode, []uint8) {
+	if t.Displacement >= math.MinInt8 && t.Displacement <= math.MaxInt8 {
+		return IndirectRegisterByteDisplacedMode, []uint8{uint8(t.Displacement)}
+	}
+	return IndirectRegisterDoubleDisplacedMode, Int32(t.Displacement).Encode()
+}
@@ -38,6 +38,8 @@ const (
 	OT_ymm1     OperandType = iota
 	OT_ymm2     OperandType = iota
 	OT_ymm2m128 OperandType = iota
+	OT_xmm1m32  OperandType = iota
+	OT_xmm2m32  OperandType = iota
 )
 
 //go:generate stringer -type=OperandEncoding
@@ -240,6 +242,20 @@ func (o *Opcode) Encode(ops []lib.Operand) ([]uint8, error) {
 		}
 		exts[ext] = true
 	}
+	// Opcodes without a REX extension still need a REX prefix when they
+	// address one of the extended registers r8-r15.
+	vex := exts[VEX128] || exts[VEX256]
+	needsREX := func(registers ...uint8) bool {
+		if vex {
+			return false
+		}
+		for _, r := range registers {
+			if r > 7 && instr.REXPrefix == nil {
+				instr.REXPrefix = &REXPrefix{}
+			}
+		}
+		return instr.REXPrefix != nil
+	}
 	for i, opcodeOperand := range o.Operands {
 		op := ops[i]
 		if opcodeOperand.TypeCheck(op) {
@@ -251,7 +267,7 @@ func (o *Opcode) Encode(ops []lib.Operand) ([]uint8, error) {
 					}
 					instr.ModRM.Mode = DirectRegisterMode
 					instr.ModRM.RM = oper.Encode()
-					if exts[RexW] || exts[Rex] {
+					if needsREX(oper.Register) {
 						instr.REXPrefix.B = oper.Register > 7
 					} else if exts[VEX128] || exts[VEX256] {
 						instr.VEXPrefix.B = oper.Register <= 7
@@ -262,14 +278,14 @@ func (o *Opcode) Encode(ops []lib.Operand) ([]uint8, error) {
 						instr.ModRM.Mode = DirectRegisterMode
 					}
 					instr.ModRM.Reg = oper.Encode()
-					if exts[RexW] || exts[Rex] {
+					if needsREX(oper.Register) {
 						instr.REXPrefix.R = oper.Register > 7
 					} else if exts[VEX128] || exts[VEX256] {
 						instr.VEXPrefix.R = oper.Register <= 7
 					}
 				} else if opcodeOperand.Encoding == Opcode_plus_rd_r {
 					instr.Opcode[0] += op.(*Register).Register & 7
-					if exts[RexW] || exts[Rex] {
+					if needsREX(op.(*Register).Register) {
 						instr.REXPrefix.B = op.(*Register).Register > 7
 					}
 				} else if opcodeOperand.Encoding == VEX_vvvv {
@@ -288,21 +304,23 @@ func (o *Opcode) Encode(ops []lib.Operand) ([]uint8, error) {
 					if instr.ModRM == nil {
 						instr.ModRM = &ModRM{}
 					}
-					instr.ModRM.Mode = IndirectRegisterByteDisplacedMode
+					mode, displacement := oper.EncodeDisplacement()
+					instr.ModRM.Mode = mode
 					instr.ModRM.RM = oper.Encode()
-					instr.SetDisplacement(oper.Register, []uint8{oper.Displacement})
+					instr.SetDisplacement(oper.Register, displacement)
 
-					if exts[RexW] || exts[Rex] {
+					if needsREX(oper.Register.Register) {
 						instr.REXPrefix.B = oper.Register.Register > 7
 					}
 				} else if opcodeOperand.Encoding == ModRM_reg_r || opcodeOperand.Encoding == ModRM_reg_rw {
+					mode, displacement := oper.EncodeDisplacement()
 					if instr.ModRM == nil {
 						instr.ModRM = &ModRM{}
-						instr.ModRM.Mode = IndirectRegisterByteDisplacedMode
+						instr.ModRM.Mode = mode
 					}
 					instr.ModRM.Reg = oper.Encode()
-					instr.SetDisplacement(oper.Register, []uint8{oper.Displacement})
-					if exts[RexW] || exts[Rex] {
+					instr.SetDisplacement(oper.Register, displacement)
+					if needsREX(oper.Register.Register) {
 						instr.REXPrefix.R = oper.Register.Register > 7
 					}
 				} else {
@@ -317,7 +335,7 @@ func (o *Opcode) Encode(ops []lib.Operand) ([]uint8, error) {
 					instr.ModRM.Mode = IndirectRegisterMode
 					instr.ModRM.RM = oper.Encode()
 
-					if exts[RexW] || exts[Rex] {
+					if needsREX(oper.Register.Register) {
 						instr.REXPrefix.B = oper.Register.Register > 7
 					}
 				} else if opcodeOperand.Encoding == ModRM_reg_r || opcodeOperand.Encoding == ModRM_reg_rw {
@@ -326,7 +344,7 @@ func (o *Opcode) Encode(ops []lib.Operand) ([]uint8, error) {
 						instr.ModRM.Mode = IndirectRegisterMode
 					}
 					instr.ModRM.Reg = oper.Encode()
-					if exts[RexW] || exts[Rex] {
+					if needsREX(oper.Register.Register) {
 						instr.REXPrefix.R = oper.Register.Register > 7
 					}
 				} else {
@@ -358,7 +376,7 @@ func (o *Opcode) Encode(ops []lib.Operand) ([]uint8, error) {
 					instr.ModRM.Mode = IndirectRegisterMode
 					instr.ModRM.RM = SIBFollowsRM
 					instr.SIB = NewSIB(oper.Scale, oper.Index.Encode(), oper.Register.Encode())
-					if exts[RexW] || exts[Rex] {
+					if needsREX(oper.Index.Register, oper.Register.Register) {
 						instr.REXPrefix.X = oper.Index.Register > 7
 						instr.REXPrefix.B = oper.Register.Register > 7
 					}
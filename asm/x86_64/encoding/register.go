@@ -87,7 +87,7 @@ var Registers8 []*Register = []*Register{
 
 var Registers128 []*Register = []*Register{
 	Xmm0, Xmm1, Xmm2, Xmm3, Xmm4, Xmm5, Xmm6, Xmm7,
-	Xmm8, Xmm9, Xmm10, Xmm11, Xmm11, Xmm12, Xmm13, Xmm14, Xmm15,
+	Xmm8, Xmm9, Xmm10, Xmm11, Xmm12, Xmm13, Xmm14, Xmm15,
 }
 
 var Registers256 []*Register = []*Register{
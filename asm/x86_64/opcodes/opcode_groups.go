@@ -42,11 +42,15 @@ var CMP = []*Opcode{
 	CMP_rm32_r32,
 	CMP_r64_rm64,
 	CMP_rm64_r64,
+	CMP_rm16_imm16,
+	CMP_rm32_imm32,
 	CMP_rm64_imm32,
 }
 var CVTSI2SD = []*Opcode{CVTSI2SD_xmm1_rm64}
 var CVTSD2SI = []*Opcode{CVTSD2SI_r64_xmm1m64}
 var CVTTSD2SI = []*Opcode{CVTTSD2SI_r64_xmm1m64}
+var CVTSD2SS = []*Opcode{CVTSD2SS_xmm1_xmm2m64}
+var CVTSS2SD = []*Opcode{CVTSS2SD_xmm1_xmm2m32}
 var DEC = []*Opcode{DEC_rm64}
 var IDIV1 = []*Opcode{
 	IDIV_rm8,
@@ -80,24 +84,26 @@ var MUL = []*Opcode{
 }
 var INC = []*Opcode{INC_rm64}
 var JMP = []*Opcode{JMP_rel8, JMP_rel32, JMP_rm64}
-var JA = []*Opcode{JA_rel8}
-var JAE = []*Opcode{JAE_rel8}
-var JB = []*Opcode{JB_rel8}
-var JBE = []*Opcode{JBE_rel8}
-var JE = []*Opcode{JE_rel8}
-var JG = []*Opcode{JG_rel8}
-var JGE = []*Opcode{JGE_rel8}
-var JL = []*Opcode{JL_rel8}
-var JLE = []*Opcode{JLE_rel8}
-var JNA = []*Opcode{JNA_rel8}
-var JNAE = []*Opcode{JNAE_rel8}
-var JNB = []*Opcode{JNB_rel8}
-var JNBE = []*Opcode{JNBE_rel8}
-var JNE = []*Opcode{JNE_rel8}
-var JNG = []*Opcode{JNG_rel8}
-var JNGE = []*Opcode{JNGE_rel8}
-var JNL = []*Opcode{JNL_rel8}
-var JNLE = []*Opcode{JNLE_rel8}
+var JA = []*Opcode{JA_rel8, JA_rel32}
+var JAE = []*Opcode{JAE_rel8, JAE_rel32}
+var JB = []*Opcode{JB_rel8, JB_rel32}
+var JBE = []*Opcode{JBE_rel8, JBE_rel32}
+var JE = []*Opcode{JE_rel8, JE_rel32}
+var JG = []*Opcode{JG_rel8, JG_rel32}
+var JGE = []*Opcode{JGE_rel8, JGE_rel32}
+var JL = []*Opcode{JL_rel8, JL_rel32}
+var JLE = []*Opcode{JLE_rel8, JLE_rel32}
+var JNA = []*Opcode{JNA_rel8, JNA_rel32}
+var JNAE = []*Opcode{JNAE_rel8, JNAE_rel32}
+var JNB = []*Opcode{JNB_rel8, JNB_rel32}
+var JNBE = []*Opcode{JNBE_rel8, JNBE_rel32}
+var JNE = []*Opcode{JNE_rel8, JNE_rel32}
+var JNG = []*Opcode{JNG_rel8, JNG_rel32}
+var JNGE = []*Opcode{JNGE_rel8, JNGE_rel32}
+var JNL = []*Opcode{JNL_rel8, JNL_rel32}
+var JNLE = []*Opcode{JNLE_rel8, JNLE_rel32}
+var JNO = []*Opcode{JNO_rel8, JNO_rel32}
+var JO = []*Opcode{JO_rel8, JO_rel32}
 var LEA = []*Opcode{LEA_r64_m}
 var MOV = []*Opcode{
 	MOV_r8_imm8_no_rex,
@@ -110,6 +116,8 @@ var MOV = []*Opcode{
 	MOV_r64_imm64, MOV_rm64_imm32,
 	MOVQ_xmm_rm64, MOVSD_xmm1m64_xmm2,
 }
+var MOVQ = []*Opcode{MOVQ_xmm_rm64, MOVQ_rm64_xmm}
+var MOVSS = []*Opcode{MOVSS_xmm1m32_xmm2}
 var MOVSX = []*Opcode{
 	MOVSX_r16_rm8,
 	MOVSX_r32_rm8,
@@ -193,6 +201,13 @@ var SHR = []*Opcode{
 	SHR_rm32_imm8,
 	SHR_rm64_imm8,
 }
+var SAR = []*Opcode{
+	SAR_rm8_imm8,
+	SAR_rm8_imm8_no_rex,
+	SAR_rm16_imm8,
+	SAR_rm32_imm8,
+	SAR_rm64_imm8,
+}
 var SUB = []*Opcode{
 	SUB_rm8_imm8, SUB_rm64_imm8,
 	SUB_r8_rm8,
@@ -22,8 +22,12 @@ func (o OpcodeMap) add(ty lib.Type, si lib.Size, op *Opcode) {
 
 type OpcodeMaps []OpcodeMap
 
+// ResolveOpcode returns the opcode that can encode the given operands. When
+// several opcodes match, the first one in the opcode group wins, so that
+// resolving the same operands always results in the same encoding (and
+// therefore the same instruction length).
 func (o OpcodeMaps) ResolveOpcode(operands []lib.Operand) *Opcode {
-	picks := map[*Opcode]bool{}
+	var picks []*Opcode
 
 	for i, opcodeMap := range o {
 		oper := operands[i]
@@ -35,41 +39,44 @@ func (o OpcodeMaps) ResolveOpcode(operands []lib.Operand) *Opcode {
 		if len(matches) == 0 {
 			return nil
 		}
-		newPick := map[*Opcode]bool{}
+		newPick := []*Opcode{}
 		for _, opcode := range matches {
 			if (oper == encoding.Ah || oper == encoding.Ch || oper == encoding.Dh || oper == encoding.Bh) && (opcode.HasExtension(Rex) || opcode.HasExtension(RexW)) {
 				continue
 			}
+			// Wider registers pick up a REX prefix during encoding when
+			// needed, but byte registers must not be mixed with ah-bh.
 			if (oper == encoding.Spl || oper == encoding.Bpl || oper == encoding.Sil || oper == encoding.Dil ||
-				(isRegister && reg.Register >= 8)) && !(opcode.HasExtension(Rex) || opcode.HasExtension(RexW) || opcode.HasExtension(VEX128) || opcode.HasExtension(VEX256)) {
+				(isRegister && reg.Register >= 8 && reg.Width() == lib.BYTE)) && !(opcode.HasExtension(Rex) || opcode.HasExtension(RexW) || opcode.HasExtension(VEX128) || opcode.HasExtension(VEX256)) {
 				continue
 			}
 
-			if i == 0 {
-				newPick[opcode] = true
-			} else {
-				if picks[opcode] {
-					newPick[opcode] = true
-				}
+			if i == 0 || containsOpcode(picks, opcode) {
+				newPick = append(newPick, opcode)
 			}
 		}
 		picks = newPick
 	}
-	opcodes := []*Opcode{}
-	for pick, _ := range picks {
-		opcodes = append(opcodes, pick)
-	}
 
-	sort.Slice(opcodes, func(i, j int) bool {
-		return opcodes[i].Operands[0].Type < opcodes[j].Operands[0].Type
+	sort.SliceStable(picks, func(i, j int) bool {
+		return picks[i].Operands[0].Type < picks[j].Operands[0].Type
 
 	})
-	for _, _ = range picks {
-		return opcodes[0]
+	if len(picks) > 0 {
+		return picks[0]
 	}
 	return nil
 }
 
+func containsOpcode(opcodes []*Opcode, opcode *Opcode) bool {
+	for _, o := range opcodes {
+		if o == opcode {
+			return true
+		}
+	}
+	return false
+}
+
 func NewOpcodeMap() OpcodeMap {
 	return map[lib.Type]map[lib.Size][]*Opcode{
 		lib.T_Register:          map[lib.Size][]*Opcode{},
@@ -135,6 +142,7 @@ func OpcodesToOpcodeMap(opcodes []*Opcode, operand int) OpcodeMap {
 		} else if opcode.Operands[operand].Type == OT_m {
 			opcodeMap.add(lib.T_DisplacedRegister, lib.QUADWORD, opcode)
 			opcodeMap.add(lib.T_RIPRelative, lib.QUADWORD, opcode)
+			opcodeMap.add(lib.T_SIBRegister, lib.QUADWORD, opcode)
 		} else if opcode.Operands[operand].Type == OT_m16 {
 			opcodeMap.add(lib.T_IndirectRegister, lib.WORD, opcode)
 		} else if opcode.Operands[operand].Type == OT_m32 {
@@ -166,14 +174,22 @@ func OpcodesToOpcodeMap(opcodes []*Opcode, operand int) OpcodeMap {
 			opcodeMap.add(lib.T_Register, lib.OWORD, opcode)
 			opcodeMap.add(lib.T_Register, lib.QUADWORD, opcode)
 			opcodeMap.add(lib.T_IndirectRegister, lib.QUADWORD, opcode)
+			opcodeMap.add(lib.T_DisplacedRegister, lib.QUADWORD, opcode)
 			opcodeMap.add(lib.T_RIPRelative, lib.QUADWORD, opcode)
 			opcodeMap.add(lib.T_SIBRegister, lib.QUADWORD, opcode)
 		} else if opcode.Operands[operand].Type == OT_xmm2m64 {
 			opcodeMap.add(lib.T_Register, lib.OWORD, opcode)
 			opcodeMap.add(lib.T_Register, lib.QUADWORD, opcode)
 			opcodeMap.add(lib.T_IndirectRegister, lib.QUADWORD, opcode)
+			opcodeMap.add(lib.T_DisplacedRegister, lib.QUADWORD, opcode)
 			opcodeMap.add(lib.T_RIPRelative, lib.QUADWORD, opcode)
 			opcodeMap.add(lib.T_SIBRegister, lib.QUADWORD, opcode)
+		} else if opcode.Operands[operand].Type == OT_xmm1m32 || opcode.Operands[operand].Type == OT_xmm2m32 {
+			opcodeMap.add(lib.T_Register, lib.OWORD, opcode)
+			opcodeMap.add(lib.T_IndirectRegister, lib.DOUBLE, opcode)
+			opcodeMap.add(lib.T_DisplacedRegister, lib.DOUBLE, opcode)
+			opcodeMap.add(lib.T_RIPRelative, lib.DOUBLE, opcode)
+			opcodeMap.add(lib.T_SIBRegister, lib.QUADWORD, opcode)
 		} else if opcode.Operands[operand].Type == OT_xmm2m128 {
 			opcodeMap.add(lib.T_Register, lib.OWORD, opcode)
 			opcodeMap.add(lib.T_Register, lib.QUADWORD, opcode)
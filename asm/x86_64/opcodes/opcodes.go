@@ -67,7 +67,7 @@ var (
 		},
 	}
 	// Add the low double-precision floating-point value from xmm2/mem to xmm1 and store the result in xmm1
-	ADDSD_xmm1_xmm2m64 = &Opcode{"addsd", []uint8{}, []uint8{0xf2, 0x0f, 0x58}, []OpcodeExtensions{SlashR},
+	ADDSD_xmm1_xmm2m64 = &Opcode{"addsd", []uint8{0xf2}, []uint8{0x0f, 0x58}, []OpcodeExtensions{SlashR},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_xmm1, ModRM_reg_rw},
 			OpcodeOperand{OT_xmm2m64, ModRM_rm_r},
@@ -151,6 +151,18 @@ var (
 			OpcodeOperand{OT_imm8, ImmediateValue},
 		},
 	}
+	CMP_rm16_imm16 = &Opcode{"cmp", []uint8{0x66}, []uint8{0x81}, []OpcodeExtensions{Slash7, ImmediateWord},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm16, ModRM_rm_r},
+			OpcodeOperand{OT_imm16, ImmediateValue},
+		},
+	}
+	CMP_rm32_imm32 = &Opcode{"cmp", []uint8{}, []uint8{0x81}, []OpcodeExtensions{Slash7, ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm32, ModRM_rm_r},
+			OpcodeOperand{OT_imm32, ImmediateValue},
+		},
+	}
 	CMP_rm64_imm32 = &Opcode{"cmp", []uint8{}, []uint8{0x81}, []OpcodeExtensions{RexW, Slash7, ImmediateDouble},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rm64, ModRM_rm_r},
@@ -224,6 +236,20 @@ var (
 			OpcodeOperand{OT_rm64, ModRM_rm_r},
 		},
 	}
+	// Convert Scalar Double precision floating point to Scalar Single precision floating point
+	CVTSD2SS_xmm1_xmm2m64 = &Opcode{"cvtsd2ss", []uint8{0xf2}, []uint8{0x0f, 0x5a}, []OpcodeExtensions{SlashR},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_xmm1, ModRM_reg_rw},
+			OpcodeOperand{OT_xmm2m64, ModRM_rm_r},
+		},
+	}
+	// Convert Scalar Single precision floating point to Scalar Double precision floating point
+	CVTSS2SD_xmm1_xmm2m32 = &Opcode{"cvtss2sd", []uint8{0xf3}, []uint8{0x0f, 0x5a}, []OpcodeExtensions{SlashR},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_xmm1, ModRM_reg_rw},
+			OpcodeOperand{OT_xmm2m32, ModRM_rm_r},
+		},
+	}
 	// Convert Scalar Double precision floating point to Doubleword integer
 	CVTSD2SI_r64_xmm1m64 = &Opcode{"cvtsd2si", []uint8{0xf2}, []uint8{0x0f, 0x2d}, []OpcodeExtensions{RexW, SlashR},
 		[]OpcodeOperand{
@@ -275,7 +301,7 @@ var (
 			OpcodeOperand{OT_rm64, ModRM_rm_r},
 		},
 	}
-	DIVSD_xmm1_xmm2m64 = &Opcode{"divsd", []uint8{}, []uint8{0xf2, 0x0f, 0x5e}, []OpcodeExtensions{SlashR},
+	DIVSD_xmm1_xmm2m64 = &Opcode{"divsd", []uint8{0xf2}, []uint8{0x0f, 0x5e}, []OpcodeExtensions{SlashR},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_xmm1, ModRM_reg_rw},
 			OpcodeOperand{OT_xmm2m64, ModRM_rm_r},
@@ -366,108 +392,240 @@ var (
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if above (CF=0 or ZF=0) (for unsigned)
+	JA_rel32 = &Opcode{"ja", []uint8{}, []uint8{0x0f, 0x87}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if above or equal (CF=0) (for unsigned)
 	JAE_rel8 = &Opcode{"jae", []uint8{}, []uint8{0x73}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if above or equal (CF=0) (for unsigned)
+	JAE_rel32 = &Opcode{"jae", []uint8{}, []uint8{0x0f, 0x83}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if below (CF=1)
 	JB_rel8 = &Opcode{"jb", []uint8{}, []uint8{0x72}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if below (CF=1)
+	JB_rel32 = &Opcode{"jb", []uint8{}, []uint8{0x0f, 0x82}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if below (CF=1 or ZF=0)
 	JBE_rel8 = &Opcode{"jbe", []uint8{}, []uint8{0x76}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if below (CF=1 or ZF=0)
+	JBE_rel32 = &Opcode{"jbe", []uint8{}, []uint8{0x0f, 0x86}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if equal (ZF=1)
 	JE_rel8 = &Opcode{"je", []uint8{}, []uint8{0x74}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if equal (ZF=1)
+	JE_rel32 = &Opcode{"je", []uint8{}, []uint8{0x0f, 0x84}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if greater (ZF=0 and SF=OF) (for signed)
 	JG_rel8 = &Opcode{"jg", []uint8{}, []uint8{0x7f}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if greater (ZF=0 and SF=OF) (for signed)
+	JG_rel32 = &Opcode{"jg", []uint8{}, []uint8{0x0f, 0x8f}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if greater or equal (SF=OF) (for signed)
 	JGE_rel8 = &Opcode{"jge", []uint8{}, []uint8{0x7d}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if greater or equal (SF=OF) (for signed)
+	JGE_rel32 = &Opcode{"jge", []uint8{}, []uint8{0x0f, 0x8d}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if less (SF!=OF) (for signed)
 	JL_rel8 = &Opcode{"jl", []uint8{}, []uint8{0x7c}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if less (SF!=OF) (for signed)
+	JL_rel32 = &Opcode{"jl", []uint8{}, []uint8{0x0f, 0x8c}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if less or equal (SF!=OF) (for signed)
 	JLE_rel8 = &Opcode{"jle", []uint8{}, []uint8{0x7e}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if less or equal (SF!=OF) (for signed)
+	JLE_rel32 = &Opcode{"jle", []uint8{}, []uint8{0x0f, 0x8e}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not above (ZF=0)
 	JNA_rel8 = &Opcode{"jna", []uint8{}, []uint8{0x76}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not above (ZF=0)
+	JNA_rel32 = &Opcode{"jna", []uint8{}, []uint8{0x0f, 0x86}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not above or equal (CF=1)
 	JNAE_rel8 = &Opcode{"jnae", []uint8{}, []uint8{0x72}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not above or equal (CF=1)
+	JNAE_rel32 = &Opcode{"jnae", []uint8{}, []uint8{0x0f, 0x82}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not below (CF=0)
 	JNB_rel8 = &Opcode{"jnb", []uint8{}, []uint8{0x73}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not below (CF=0)
+	JNB_rel32 = &Opcode{"jnb", []uint8{}, []uint8{0x0f, 0x83}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not below or equal (CF=0 or ZF=0)
 	JNBE_rel8 = &Opcode{"jnbe", []uint8{}, []uint8{0x77}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not below or equal (CF=0 or ZF=0)
+	JNBE_rel32 = &Opcode{"jnbe", []uint8{}, []uint8{0x0f, 0x87}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not equal (ZF=0)
 	JNE_rel8 = &Opcode{"jne", []uint8{}, []uint8{0x75}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not equal (ZF=0)
+	JNE_rel32 = &Opcode{"jne", []uint8{}, []uint8{0x0f, 0x85}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not greater (ZF=1 or SF!=0)
 	JNG_rel8 = &Opcode{"jng", []uint8{}, []uint8{0x7e}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not greater (ZF=1 or SF!=0)
+	JNG_rel32 = &Opcode{"jng", []uint8{}, []uint8{0x0f, 0x8e}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not greater or equal (SF!=0)
 	JNGE_rel8 = &Opcode{"jnge", []uint8{}, []uint8{0x7c}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not greater or equal (SF!=0)
+	JNGE_rel32 = &Opcode{"jnge", []uint8{}, []uint8{0x0f, 0x8c}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not less (SF=OF)
 	JNL_rel8 = &Opcode{"jnl", []uint8{}, []uint8{0x7d}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not less (SF=OF)
+	JNL_rel32 = &Opcode{"jnl", []uint8{}, []uint8{0x0f, 0x8d}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	// Jump short if not less or equal (ZF=0 and SF=OF)
 	JNLE_rel8 = &Opcode{"jnle", []uint8{}, []uint8{0x7f}, []OpcodeExtensions{ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rel8, ImmediateValue},
 		},
 	}
+	// Jump near if not less or equal (ZF=0 and SF=OF)
+	JNLE_rel32 = &Opcode{"jnle", []uint8{}, []uint8{0x0f, 0x8f}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
+	// Jump short if not overflow (OF=0)
+	JNO_rel8 = &Opcode{"jno", []uint8{}, []uint8{0x71}, []OpcodeExtensions{ImmediateByte},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel8, ImmediateValue},
+		},
+	}
+	// Jump near if not overflow (OF=0)
+	JNO_rel32 = &Opcode{"jno", []uint8{}, []uint8{0x0f, 0x81}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
+	// Jump short if overflow (OF=1)
+	JO_rel8 = &Opcode{"jo", []uint8{}, []uint8{0x70}, []OpcodeExtensions{ImmediateByte},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel8, ImmediateValue},
+		},
+	}
+	// Jump near if overflow (OF=1)
+	JO_rel32 = &Opcode{"jo", []uint8{}, []uint8{0x0f, 0x80}, []OpcodeExtensions{ImmediateDouble},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rel32, ImmediateValue},
+		},
+	}
 	LEA_r64_m = &Opcode{"lea", []uint8{}, []uint8{0x8d}, []OpcodeExtensions{RexW, SlashR},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_r64, ModRM_reg_rw},
@@ -564,17 +722,30 @@ var (
 			OpcodeOperand{OT_rm64, ModRM_rm_r},
 		},
 	}
+	MOVQ_rm64_xmm = &Opcode{"movq", []uint8{0x66}, []uint8{0x0f, 0x7e}, []OpcodeExtensions{RexW, SlashR},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm64, ModRM_rm_rw},
+			OpcodeOperand{OT_xmm1, ModRM_reg_r},
+		},
+	}
 	// Move or Merge Scalar Double-Precision Floating-Point Value
-	MOVSD_xmm1m64_xmm2 = &Opcode{"movsd", []uint8{}, []uint8{0xf2, 0x0f, 0x11}, []OpcodeExtensions{SlashR},
+	MOVSD_xmm1m64_xmm2 = &Opcode{"movsd", []uint8{0xf2}, []uint8{0x0f, 0x11}, []OpcodeExtensions{SlashR},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_xmm1m64, ModRM_rm_rw},
 			OpcodeOperand{OT_xmm2, ModRM_reg_r},
 		},
 	}
+	// Move or Merge Scalar Single-Precision Floating-Point Value
+	MOVSS_xmm1m32_xmm2 = &Opcode{"movss", []uint8{0xf3}, []uint8{0x0f, 0x11}, []OpcodeExtensions{SlashR},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_xmm1m32, ModRM_rm_rw},
+			OpcodeOperand{OT_xmm2, ModRM_reg_r},
+		},
+	}
 	// Move with sign-extend
 	MOVSX_r16_rm8 = &Opcode{"movsx", []uint8{0x66}, []uint8{0x0f, 0xbe}, []OpcodeExtensions{SlashR},
 		[]OpcodeOperand{
-			OpcodeOperand{OT_r32, ModRM_reg_rw},
+			OpcodeOperand{OT_r16, ModRM_reg_rw},
 			OpcodeOperand{OT_rm8, ModRM_rm_r},
 		},
 	}
@@ -587,7 +758,7 @@ var (
 	MOVSX_r32_rm16 = &Opcode{"movsx", []uint8{}, []uint8{0x0f, 0xbf}, []OpcodeExtensions{SlashR},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_r32, ModRM_reg_rw},
-			OpcodeOperand{OT_rm32, ModRM_rm_r},
+			OpcodeOperand{OT_rm16, ModRM_rm_r},
 		},
 	}
 	MOVSX_r64_rm8 = &Opcode{"movsx", []uint8{}, []uint8{0x0f, 0xbe}, []OpcodeExtensions{RexW, SlashR},
@@ -664,7 +835,7 @@ var (
 			OpcodeOperand{OT_rm64, ModRM_rm_r},
 		},
 	}
-	MULSD_xmm1_xmm2m64 = &Opcode{"mulsd", []uint8{}, []uint8{0xf2, 0x0f, 0x59}, []OpcodeExtensions{SlashR},
+	MULSD_xmm1_xmm2m64 = &Opcode{"mulsd", []uint8{0xf2}, []uint8{0x0f, 0x59}, []OpcodeExtensions{SlashR},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_xmm1, ModRM_reg_rw},
 			OpcodeOperand{OT_xmm2m64, ModRM_rm_r},
@@ -926,6 +1097,36 @@ var (
 			OpcodeOperand{OT_imm8, ImmediateValue},
 		},
 	}
+	SAR_rm8_imm8 = &Opcode{"sar", []uint8{}, []uint8{0xc0}, []OpcodeExtensions{RexW, Slash7, ImmediateByte},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm8, ModRM_rm_rw},
+			OpcodeOperand{OT_imm8, ImmediateValue},
+		},
+	}
+	SAR_rm8_imm8_no_rex = &Opcode{"sar", []uint8{}, []uint8{0xc0}, []OpcodeExtensions{Slash7, ImmediateByte},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm8, ModRM_rm_rw},
+			OpcodeOperand{OT_imm8, ImmediateValue},
+		},
+	}
+	SAR_rm16_imm8 = &Opcode{"sar", []uint8{0x66}, []uint8{0xc1}, []OpcodeExtensions{Slash7, ImmediateByte},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm16, ModRM_rm_rw},
+			OpcodeOperand{OT_imm8, ImmediateValue},
+		},
+	}
+	SAR_rm32_imm8 = &Opcode{"sar", []uint8{}, []uint8{0xc1}, []OpcodeExtensions{Slash7, ImmediateByte},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm32, ModRM_rm_rw},
+			OpcodeOperand{OT_imm8, ImmediateValue},
+		},
+	}
+	SAR_rm64_imm8 = &Opcode{"sar", []uint8{}, []uint8{0xc1}, []OpcodeExtensions{RexW, Slash7, ImmediateByte},
+		[]OpcodeOperand{
+			OpcodeOperand{OT_rm64, ModRM_rm_rw},
+			OpcodeOperand{OT_imm8, ImmediateValue},
+		},
+	}
 	SUB_rm8_imm8 = &Opcode{"sub", []uint8{}, []uint8{0x80}, []OpcodeExtensions{Rex, Slash5, ImmediateByte},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_rm8, ModRM_rm_rw},
@@ -992,7 +1193,7 @@ var (
 			OpcodeOperand{OT_imm32, ImmediateValue},
 		},
 	}
-	SUBSD_xmm1_xmm2m64 = &Opcode{"subsd", []uint8{}, []uint8{0xf2, 0x0f, 0x5c}, []OpcodeExtensions{SlashR},
+	SUBSD_xmm1_xmm2m64 = &Opcode{"subsd", []uint8{0xf2}, []uint8{0x0f, 0x5c}, []OpcodeExtensions{SlashR},
 		[]OpcodeOperand{
 			OpcodeOperand{OT_xmm1, ModRM_reg_rw},
 			OpcodeOperand{OT_xmm2m64, ModRM_rm_r},
@@ -28,6 +28,23 @@ func NewOpcodeMapsInstruction(name string, maps OpcodeMaps, operands []lib.Opera
 	return &opcodeMapsInstruction{name, maps, operands, opcodes}
 }
 
+// InstructionOperands returns the name and the operands of an instruction
+// made by OpcodesToInstruction, with the destination first.
+func InstructionOperands(instr lib.Instruction) (string, []lib.Operand, bool) {
+	o, ok := instr.(*opcodeMapsInstruction)
+	if !ok {
+		return "", nil, false
+	}
+	return o.Name, o.Operands, true
+}
+
+// WithOperands returns a copy of an instruction made by
+// OpcodesToInstruction with other operands.
+func WithOperands(instr lib.Instruction, operands ...lib.Operand) lib.Instruction {
+	o := instr.(*opcodeMapsInstruction)
+	return &opcodeMapsInstruction{o.Name, o.opcodeMaps, operands, o.Opcodes}
+}
+
 func (o *opcodeMapsInstruction) Encode() (lib.MachineCode, error) {
 	if len(o.Operands) == 0 {
 		return o.Opcodes[0].Encode([]lib.Operand{})
@@ -0,0 +1,573 @@
+package x86_64
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
+	"github.com/bspaans/jit-compiler/asm/x86_64/opcodes"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+/*
+	Peephole optimisation
+
+	The encoders emit code one IR node at a time, which leaves redundant
+	moves around on the boundaries. Peephole looks at a couple of
+	instructions at a time and removes or rewrites them:
+
+	  mov %r, %r                           removed (unless it zero extends)
+	  mov %a, %b; mov %b, %a               the second move is removed
+	  mov x, %r; mov y, %r                 the first move is removed
+	  mov %a, %t; mov %t, y                mov %a, y, when %t isn't read after
+	  mov $0, %r                           xor %r, %r, when the flags aren't read
+	  jmp next                             removed
+
+	The jumps and RIP relative operands are updated afterwards for the code
+	that moved, and jumps that now fit in a byte get the short encoding.
+	Rules don't match across the target of a jump, so every rule only sees
+	straight line code.
+*/
+
+// peepholeRules are applied to every instruction in turn, until none of
+// them changes anything.
+var peepholeRules = []func(p *peephole, i int) bool{
+	removeSelfMove,
+	removeMoveBack,
+	removeDeadMove,
+	forwardMove,
+	zeroIdiom,
+	removeJumpToNext,
+}
+
+// Peephole returns code without the redundant instructions that the rules
+// above match. code has to be laid out at the address that it was encoded
+// for: jumps out of the code and RIP relative operands are assumed to refer
+// to code and data before or after it that doesn't move.
+func Peephole(code []lib.Instruction) ([]lib.Instruction, error) {
+	p, err := newPeephole(code)
+	if err != nil || p == nil {
+		return code, err
+	}
+	for changed := true; changed; {
+		changed = false
+		p.findLabels()
+		for i := range p.code {
+			if p.code[i].removed {
+				continue
+			}
+			for _, rule := range peepholeRules {
+				if rule(p, i) {
+					changed = true
+					p.findLabels()
+					break
+				}
+			}
+		}
+	}
+	return p.layout()
+}
+
+type peepholeInstr struct {
+	lib.Instruction
+	name     string
+	operands []lib.Operand
+	// ok is whether the instruction was made by OpcodesToInstruction, so
+	// that its name and operands are known.
+	ok bool
+	// jump is whether the instruction is a relative jump. target is the
+	// index of the instruction that it goes to, len(code) for the end of
+	// the code and -1 for jumps that leave the code, which keep going to
+	// absolute: their offset from the start of the code.
+	jump     bool
+	target   int
+	absolute int
+	// rip is whether the instruction has a RIP relative operand, which
+	// refers to absolute as well.
+	rip     bool
+	label   bool
+	removed bool
+	offset  int
+}
+
+type peephole struct {
+	code []*peepholeInstr
+	size int
+}
+
+// newPeephole returns nil when a jump in code goes to the middle of an
+// instruction, or a RIP relative operand into the code itself.
+func newPeephole(code []lib.Instruction) (*peephole, error) {
+	p := &peephole{}
+	starts := map[int]int{}
+	for i, instr := range code {
+		in := &peepholeInstr{Instruction: instr, target: -1, offset: p.size}
+		in.name, in.operands, in.ok = opcodes.InstructionOperands(instr)
+		length, err := lib.InstructionLength(instr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := starts[p.size]; !ok && length > 0 {
+			starts[p.size] = i
+		}
+		p.size += length
+		p.code = append(p.code, in)
+	}
+	starts[p.size] = len(code)
+	for i, in := range p.code {
+		end := p.end(i)
+		if displacement, ok := in.jumpDisplacement(); ok {
+			in.jump, in.absolute = true, end+displacement
+			if in.absolute >= 0 && in.absolute <= p.size {
+				target, ok := starts[in.absolute]
+				if !ok {
+					return nil, nil
+				}
+				in.target = target
+			}
+		}
+		for _, op := range in.operands {
+			if rip, ok := op.(*encoding.RIPRelative); ok {
+				in.rip, in.absolute = true, end+int(rip.Displacement)
+				if in.absolute >= 0 && in.absolute < p.size {
+					return nil, nil
+				}
+			}
+		}
+	}
+	return p, nil
+}
+
+// end returns the offset of the end of instruction i, from the offsets of
+// the last layout.
+func (p *peephole) end(i int) int {
+	for j := i + 1; j < len(p.code); j++ {
+		if !p.code[j].removed {
+			return p.code[j].offset
+		}
+	}
+	return p.size
+}
+
+// jumpDisplacement returns the displacement of a relative jump.
+func (in *peepholeInstr) jumpDisplacement() (int, bool) {
+	if !in.ok || !strings.HasPrefix(in.name, "j") || len(in.operands) != 1 {
+		return 0, false
+	}
+	switch v := in.operands[0].(type) {
+	case encoding.Uint8:
+		return int(int8(v)), true
+	case encoding.Uint32:
+		return int(int32(v)), true
+	}
+	return 0, false
+}
+
+// next returns the index of the first instruction after i that hasn't been
+// removed and isn't a comment, or len(p.code).
+func (p *peephole) next(i int) int {
+	for j := i + 1; j < len(p.code); j++ {
+		if _, ok := p.code[j].Instruction.(encoding.Comment); !ok && !p.code[j].removed {
+			return j
+		}
+	}
+	return len(p.code)
+}
+
+// resolve returns the instruction that a jump to target ends up at.
+func (p *peephole) resolve(target int) int {
+	if target < 0 || target == len(p.code) {
+		return target
+	}
+	return p.next(target - 1)
+}
+
+func (p *peephole) findLabels() {
+	for _, in := range p.code {
+		in.label = false
+	}
+	for _, in := range p.code {
+		if in.jump && !in.removed && in.target >= 0 {
+			if target := p.resolve(in.target); target < len(p.code) {
+				p.code[target].label = true
+			}
+		}
+	}
+}
+
+// pair returns the instruction after i, if there's no jump to it.
+func (p *peephole) pair(i int) (int, bool) {
+	j := p.next(i)
+	return j, j < len(p.code) && !p.code[j].label
+}
+
+// layout returns the instructions that are left, with the displacements of
+// the jumps and RIP relative operands for their new offsets.
+//
+//goland:noinspection GoErrorStringFormat
+func (p *peephole) layout() ([]lib.Instruction, error) {
+	for shortened := true; shortened; {
+		shortened = false
+		p.size = 0
+		for _, in := range p.code {
+			if in.removed {
+				continue
+			}
+			in.offset = p.size
+			length, err := lib.InstructionLength(in.Instruction)
+			if err != nil {
+				return nil, err
+			}
+			p.size += length
+		}
+		for i, in := range p.code {
+			if in.removed || !in.jump && !in.rip {
+				continue
+			}
+			target := in.absolute
+			if in.jump && in.target >= 0 {
+				target = p.size
+				if t := p.resolve(in.target); t < len(p.code) {
+					target = p.code[t].offset
+				}
+			}
+			end := p.end(i)
+			if in.rip {
+				operands := make([]lib.Operand, len(in.operands))
+				for j, op := range in.operands {
+					if _, ok := op.(*encoding.RIPRelative); ok {
+						op = &encoding.RIPRelative{Displacement: encoding.Int32(int32(target - end))}
+					}
+					operands[j] = op
+				}
+				in.operands = operands
+				in.Instruction = opcodes.WithOperands(in.Instruction, operands...)
+				continue
+			}
+			// The short forms of jmp and jcc take two bytes.
+			short := target - (in.offset + 2)
+			if _, long := in.operands[0].(encoding.Uint32); long && short >= math.MinInt8 && short <= math.MaxInt8 {
+				in.operands = []lib.Operand{encoding.Uint8(uint8(int8(short)))}
+				shortened = true
+			} else if long {
+				in.operands = []lib.Operand{encoding.Uint32(uint32(int32(target - end)))}
+			} else if target-end >= math.MinInt8 && target-end <= math.MaxInt8 {
+				in.operands = []lib.Operand{encoding.Uint8(uint8(int8(target - end)))}
+			} else {
+				return nil, fmt.Errorf("Jump out of range after peephole optimisation: %s", in)
+			}
+			in.Instruction = opcodes.WithOperands(in.Instruction, in.operands...)
+		}
+	}
+	result := []lib.Instruction{}
+	for _, in := range p.code {
+		if !in.removed {
+			result = append(result, in.Instruction)
+		}
+	}
+	return result, nil
+}
+
+// replace replaces instruction i by instr.
+func (p *peephole) replace(i int, instr lib.Instruction) {
+	in := p.code[i]
+	in.Instruction = instr
+	in.name, in.operands, in.ok = opcodes.InstructionOperands(instr)
+}
+
+// generalRegister returns op if it's a general purpose register. The high
+// byte registers are left out, because they share their index with other
+// registers.
+func generalRegister(op lib.Operand) (*encoding.Register, bool) {
+	r, ok := op.(*encoding.Register)
+	if !ok || r.Size > lib.QUADWORD {
+		return nil, false
+	}
+	if r == encoding.Ah || r == encoding.Bh || r == encoding.Ch || r == encoding.Dh {
+		return nil, false
+	}
+	return r, true
+}
+
+// move returns the destination and the source of a mov, if it moves into a
+// general purpose register.
+func (in *peepholeInstr) move() (*encoding.Register, lib.Operand, bool) {
+	if !in.ok || in.name != "mov" || len(in.operands) != 2 {
+		return nil, nil, false
+	}
+	dest, ok := generalRegister(in.operands[0])
+	return dest, in.operands[1], ok
+}
+
+// registerMove returns the destination and source of a mov between two
+// general purpose registers.
+func (in *peepholeInstr) registerMove() (*encoding.Register, *encoding.Register, bool) {
+	dest, src, ok := in.move()
+	if !ok {
+		return nil, nil, false
+	}
+	r, ok := generalRegister(src)
+	return dest, r, ok
+}
+
+func sameRegister(a, b *encoding.Register) bool {
+	return a.Register == b.Register && a.Size == b.Size
+}
+
+// fullWrite returns whether writing to r sets all of its 64 bits: 32 bit
+// writes clear the upper half, but 8 and 16 bit writes keep it.
+func fullWrite(r *encoding.Register) bool {
+	return r.Size == lib.QUADWORD || r.Size == lib.DOUBLE
+}
+
+// mentions returns whether op is, or addresses memory with, the general
+// purpose register with the index of r.
+func mentions(op lib.Operand, r *encoding.Register) bool {
+	same := func(reg *encoding.Register) bool {
+		return reg != nil && reg.Size <= lib.QUADWORD && reg.Register == r.Register
+	}
+	switch v := op.(type) {
+	case *encoding.Register:
+		if _, ok := generalRegister(v); !ok && v.Size == lib.BYTE {
+			// ah, ch, dh and bh are the second byte of rax to rbx.
+			return v.Register-4 == r.Register
+		}
+		return same(v)
+	case *encoding.IndirectRegister:
+		return same(v.Register)
+	case *encoding.DisplacedRegister:
+		return same(v.Register)
+	case *encoding.SIBRegister:
+		return same(v.Register) || same(v.Index)
+	}
+	return false
+}
+
+// writesOnly are the instructions that write their destination without
+// reading it.
+var writesOnly = map[string]bool{
+	"mov": true, "movzx": true, "movsx": true, "movq": true, "movss": true, "lea": true, "pop": true,
+	"cvtsi2sd": true, "cvttsd2si": true, "cvtsd2ss": true, "cvtss2sd": true,
+}
+
+// explicit are the instructions that only read and write their operands
+// (and the stack pointer, for push and pop) and the flags.
+var explicit = map[string]bool{
+	"add": true, "and": true, "cmp": true, "dec": true, "inc": true, "or": true, "sub": true, "xor": true,
+	"shl": true, "shr": true, "sar": true, "push": true, "vpaddb": true, "vpaddw": true, "vpaddd": true,
+	"vpaddq": true, "vpand": true, "vpor": true,
+}
+
+// isExplicit returns whether in only uses the registers in its operands.
+func (in *peepholeInstr) isExplicit() bool {
+	if !in.ok {
+		return false
+	}
+	if in.name == "imul" {
+		// The one operand form multiplies rax into rdx:rax.
+		return len(in.operands) == 2
+	}
+	return writesOnly[in.name] || explicit[in.name] || strings.HasPrefix(in.name, "set")
+}
+
+// dead returns whether the value of the general purpose register r isn't
+// read after instruction i, before it's overwritten.
+func (p *peephole) dead(i int, r *encoding.Register) bool {
+	if r.Register == encoding.Rsp.Register {
+		return false
+	}
+	for k := p.next(i); k < len(p.code); k = p.next(k) {
+		in := p.code[k]
+		if in.ok && in.name == "return" {
+			return r.Register != encoding.Rax.Register
+		}
+		if in.jump || !in.isExplicit() {
+			return false
+		}
+		for j, op := range in.operands {
+			if j == 0 && writesOnly[in.name] {
+				if _, ok := op.(*encoding.Register); ok {
+					continue
+				}
+			}
+			if mentions(op, r) {
+				return false
+			}
+		}
+		if dest, ok := generalRegister(in.operands[0]); ok && writesOnly[in.name] && dest.Register == r.Register {
+			return fullWrite(dest) || in.name == "pop"
+		}
+	}
+	return false
+}
+
+// vector returns whether in has an xmm or wider register operand.
+func (in *peepholeInstr) vector() bool {
+	for _, op := range in.operands {
+		if r, ok := op.(*encoding.Register); ok && r.Size > lib.QUADWORD {
+			return true
+		}
+	}
+	return false
+}
+
+// flagsDead returns whether the flags aren't read after instruction i,
+// before they're overwritten.
+func (p *peephole) flagsDead(i int) bool {
+	for k := p.next(i); k < len(p.code); k = p.next(k) {
+		in := p.code[k]
+		switch {
+		case !in.ok:
+			return false
+		case in.name == "return" || in.name == "call" || in.name == "syscall":
+			// Calls don't preserve the flags.
+			return true
+		case strings.HasPrefix(in.name, "j") || strings.HasPrefix(in.name, "set") || in.name == "pushfq":
+			return false
+		case in.vector():
+			// addsd and the like don't touch the flags.
+		case in.name == "shl" || in.name == "shr" || in.name == "sar":
+			// Shifting by 0 keeps the flags.
+			if count, ok := in.operands[1].(encoding.Uint8); ok && count&63 != 0 {
+				return true
+			}
+		case in.name == "add" || in.name == "sub" || in.name == "and" || in.name == "or" || in.name == "xor" ||
+			in.name == "cmp" || in.name == "imul" || in.name == "mul" || in.name == "div":
+			return true
+		}
+	}
+	return false
+}
+
+// removeSelfMove removes mov %r, %r. 32 bit moves clear the upper half of
+// the register, so they're kept.
+func removeSelfMove(p *peephole, i int) bool {
+	dest, src, ok := p.code[i].registerMove()
+	if !ok || dest.Register != src.Register || dest.Size != src.Size || dest.Size == lib.DOUBLE {
+		return false
+	}
+	p.code[i].removed = true
+	return true
+}
+
+// removeMoveBack removes the second move of mov %a, %b; mov %b, %a.
+func removeMoveBack(p *peephole, i int) bool {
+	dest, src, ok := p.code[i].registerMove()
+	if !ok || dest.Size == lib.DOUBLE {
+		return false
+	}
+	j, ok := p.pair(i)
+	if !ok {
+		return false
+	}
+	dest2, src2, ok := p.code[j].registerMove()
+	if !ok || !sameRegister(dest2, src) || !sameRegister(src2, dest) {
+		return false
+	}
+	p.code[j].removed = true
+	return true
+}
+
+// removeDeadMove removes a move into a register that the next instruction
+// overwrites without reading it. Moves from memory are kept, because they
+// can fault.
+func removeDeadMove(p *peephole, i int) bool {
+	dest, src, ok := p.code[i].move()
+	if !ok {
+		return false
+	}
+	if _, ok := src.(encoding.Value); !ok {
+		if _, ok := generalRegister(src); !ok {
+			return false
+		}
+	}
+	j, ok := p.pair(i)
+	if !ok {
+		return false
+	}
+	next := p.code[j]
+	if !next.ok || !writesOnly[next.name] || len(next.operands) != 2 {
+		return false
+	}
+	dest2, ok := generalRegister(next.operands[0])
+	if !ok || dest2.Register != dest.Register || mentions(next.operands[1], dest) {
+		return false
+	}
+	if !fullWrite(dest2) && (fullWrite(dest) || dest2.Size < dest.Size) {
+		return false
+	}
+	p.code[i].removed = true
+	return true
+}
+
+// forwardMove turns mov %a, %t; mov %t, y into mov %a, y when %t isn't read
+// afterwards.
+func forwardMove(p *peephole, i int) bool {
+	t, a, ok := p.code[i].registerMove()
+	if !ok || t.Register == a.Register {
+		return false
+	}
+	j, ok := p.pair(i)
+	if !ok {
+		return false
+	}
+	next := p.code[j]
+	if !next.ok || next.name != "mov" || len(next.operands) != 2 {
+		return false
+	}
+	src, ok := generalRegister(next.operands[1])
+	if !ok || src.Register != t.Register || src.Size > t.Size || mentions(next.operands[0], t) {
+		return false
+	}
+	if r, ok := next.operands[0].(*encoding.Register); ok && r.Size == lib.BYTE {
+		if _, ok := generalRegister(r); !ok {
+			// The high byte registers can't be used with the registers
+			// that need a REX prefix.
+			return false
+		}
+	}
+	if !p.dead(j, t) {
+		return false
+	}
+	p.replace(i, MOV(encoding.Get64BitRegisterByIndex(a.Register).ForOperandWidth(src.Size), next.operands[0]))
+	next.removed = true
+	return true
+}
+
+// zeroIdiom turns mov $0, %r into the shorter xor %r, %r, which changes the
+// flags.
+func zeroIdiom(p *peephole, i int) bool {
+	dest, src, ok := p.code[i].move()
+	if !ok || !fullWrite(dest) {
+		return false
+	}
+	switch v := src.(type) {
+	case encoding.Uint8:
+		ok = v == 0
+	case encoding.Uint16:
+		ok = v == 0
+	case encoding.Uint32:
+		ok = v == 0
+	case encoding.Uint64:
+		ok = v == 0
+	default:
+		ok = false
+	}
+	if !ok || !p.flagsDead(i) {
+		return false
+	}
+	r := dest.Get32BitRegister()
+	p.replace(i, XOR(r, r))
+	return true
+}
+
+// removeJumpToNext removes jumps to the instruction after them.
+func removeJumpToNext(p *peephole, i int) bool {
+	in := p.code[i]
+	if !in.jump || in.target < 0 || p.resolve(in.target) != p.next(i) {
+		return false
+	}
+	in.removed = true
+	return true
+}
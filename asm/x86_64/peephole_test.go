@@ -0,0 +1,82 @@
+package x86_64
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+func Test_Peephole(t *testing.T) {
+	table := []struct {
+		name     string
+		code     []lib.Instruction
+		expected []string
+	}{
+		{"self move",
+			[]lib.Instruction{MOV(encoding.Rax, encoding.Rax), RETURN()},
+			[]string{"return"}},
+		{"32 bit self move zero extends",
+			[]lib.Instruction{MOV(encoding.Eax, encoding.Eax), RETURN()},
+			[]string{"mov %eax, %eax", "return"}},
+		{"move back",
+			[]lib.Instruction{MOV(encoding.Rax, encoding.Rcx), MOV(encoding.Rcx, encoding.Rax), ADD(encoding.Rcx, encoding.Rdx), RETURN()},
+			[]string{"mov %rax, %rcx", "add %rcx, %rdx", "return"}},
+		{"dead move",
+			[]lib.Instruction{MOV(encoding.Uint32(1), encoding.Rax), MOV(encoding.Rcx, encoding.Rax), RETURN()},
+			[]string{"mov %rcx, %rax", "return"}},
+		{"move that's read by the next move",
+			[]lib.Instruction{MOV(encoding.Rcx, encoding.Rax), MOV(&encoding.IndirectRegister{Register: encoding.Rax}, encoding.Rax), RETURN()},
+			[]string{"mov %rcx, %rax", "mov (%rax), %rax", "return"}},
+		{"move that's partially overwritten",
+			[]lib.Instruction{MOV(encoding.Rcx, encoding.Rax), MOV(encoding.Dl, encoding.Al), RETURN()},
+			[]string{"mov %rcx, %rax", "mov %dl, %al", "return"}},
+		{"forward move",
+			[]lib.Instruction{MOV(encoding.Rax, encoding.Rdx), MOV(encoding.Edx, encoding.Ecx), RETURN()},
+			[]string{"mov %eax, %ecx", "return"}},
+		{"forward move to memory",
+			[]lib.Instruction{MOV(encoding.Rax, encoding.Rdx), MOV(encoding.Rdx, &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: 8}), RETURN()},
+			[]string{"mov %rax, 0x8(%rsp)", "return"}},
+		{"forward move of a register that's read later",
+			[]lib.Instruction{MOV(encoding.Rax, encoding.Rdx), MOV(encoding.Rdx, encoding.Rcx), ADD(encoding.Rdx, encoding.Rcx), RETURN()},
+			[]string{"mov %rax, %rdx", "mov %rdx, %rcx", "add %rdx, %rcx", "return"}},
+		{"forward move of the return register",
+			[]lib.Instruction{MOV(encoding.Rcx, encoding.Rax), MOV(encoding.Rax, encoding.Rdx), RETURN()},
+			[]string{"mov %rcx, %rax", "mov %rax, %rdx", "return"}},
+		{"zero idiom",
+			[]lib.Instruction{MOV(encoding.Uint64(0), encoding.Rax), CMP(encoding.Rcx, encoding.Rax), SETE(encoding.Al), RETURN()},
+			[]string{"xor %eax, %eax", "cmp %rcx, %rax", "sete %al", "return"}},
+		{"zero idiom when the flags are read",
+			[]lib.Instruction{CMP(encoding.Rcx, encoding.Rdx), MOV(encoding.Uint32(0), encoding.Rax), SETE(encoding.Al), RETURN()},
+			[]string{"cmp %rcx, %rdx", "mov u32$0, %rax", "sete %al", "return"}},
+		{"jump to the next instruction",
+			[]lib.Instruction{JMP(encoding.Uint8(0)), RETURN()},
+			[]string{"return"}},
+		{"jump over removed code",
+			[]lib.Instruction{JNE(encoding.Uint8(10)), MOV(encoding.Rax, encoding.Rax), MOV(encoding.Uint32(1), encoding.Rcx), RETURN()},
+			[]string{"jne u8$7", "mov u32$1, %rcx", "return"}},
+		{"backward jump over removed code",
+			[]lib.Instruction{MOV(encoding.Uint32(1), encoding.Rcx), MOV(encoding.Rax, encoding.Rax), JMP(encoding.Uint8(uint8(0xf4))), RETURN()},
+			[]string{"mov u32$1, %rcx", "jmp u8$247", "return"}},
+		{"short jump",
+			[]lib.Instruction{JMP(encoding.Uint32(7)), MOV(encoding.Uint32(1), encoding.Rcx), RETURN()},
+			[]string{"jmp u8$7", "mov u32$1, %rcx", "return"}},
+		{"RIP relative operand after removed code",
+			[]lib.Instruction{MOV(encoding.Rax, encoding.Rax), LEA(&encoding.RIPRelative{Displacement: -100}, encoding.Rcx), RETURN()},
+			[]string{"lea -$0x61(%rip), %rcx", "return"}},
+		{"jump between the instructions of a rule",
+			[]lib.Instruction{JE(encoding.Uint8(3)), MOV(encoding.Rax, encoding.Rcx), MOV(encoding.Rcx, encoding.Rax), ADD(encoding.Rcx, encoding.Rdx), RETURN()},
+			[]string{"je u8$3", "mov %rax, %rcx", "mov %rcx, %rax", "add %rcx, %rdx", "return"}},
+	}
+	for _, testCase := range table {
+		result, err := Peephole(testCase.code)
+		if err != nil {
+			t.Fatal(err, "in", testCase.name)
+		}
+		expected := strings.Join(testCase.expected, "\n")
+		if lib.Instructions(result).String() != expected {
+			t.Errorf("Expecting\n%s\ngot\n%s\nin %s", expected, lib.Instructions(result), testCase.name)
+		}
+	}
+}
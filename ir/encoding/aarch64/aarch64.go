@@ -31,6 +31,16 @@ func (x *AArch64) EncodeDataSection(stmts []IR, ctx *IR_Context) (*Segments, err
 	return segments, nil
 }
 
+//goland:noinspection GoErrorStringFormat
+func (x *AArch64) EncodeFunction(fn IRExpression, ctx *IR_Context, segments *Segments) error {
+	return fmt.Errorf("Functions are not supported in the aarch64 encoder")
+}
+
+// Peephole leaves the code as it is; there are no rules for aarch64 yet.
+func (x *AArch64) Peephole(code []lib.Instruction) ([]lib.Instruction, error) {
+	return code, nil
+}
+
 func encodeExpression(e IRExpression, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
 	switch v := e.(type) {
 	case *expr.IR_Add:
@@ -55,8 +65,11 @@ func encodeExpression(e IRExpression, ctx *IR_Context, target lib.Operand) ([]li
 	case *expr.IR_LT:
 	case *expr.IR_LTE:
 	case *expr.IR_Mul:
+	case *expr.IR_MulHigh:
 	case *expr.IR_Not:
 	case *expr.IR_Or:
+	case *expr.IR_ShiftLeft:
+	case *expr.IR_ShiftRight:
 	case *expr.IR_StaticArray:
 	case *expr.IR_Struct:
 	case *expr.IR_StructField:
@@ -153,6 +166,8 @@ func encodeExpressionForDataSection(i IRExpression, ctx *IR_Context, segments *S
 		return encodeOperators(v.Op1, v.Op2)
 	case *expr.IR_GTE:
 		return encodeOperators(v.Op1, v.Op2)
+	case *expr.IR_Len:
+		return encodeExpressionForDataSection(v.Array, ctx, segments)
 	case *expr.IR_LT:
 		return encodeOperators(v.Op1, v.Op2)
 	case *expr.IR_LTE:
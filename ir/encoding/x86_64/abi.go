@@ -25,86 +25,158 @@ type ABI_AMDSystemV struct {
 //goland:noinspection GoSnakeCaseUsage
 func NewABI_AMDSystemV() *ABI_AMDSystemV {
 	return &ABI_AMDSystemV{
-		intTargets:   []*encoding.Register{encoding.Rdi, encoding.Rsi, encoding.Rdx, encoding.Rcx, encoding.R10, encoding.R8, encoding.R9},
-		floatTargets: []*encoding.Register{encoding.Xmm0, encoding.Xmm1, encoding.Xmm2, encoding.Xmm3, encoding.Xmm4, encoding.Xmm5},
+		intTargets:   []*encoding.Register{encoding.Rdi, encoding.Rsi, encoding.Rdx, encoding.Rcx, encoding.R8, encoding.R9},
+		floatTargets: []*encoding.Register{encoding.Xmm0, encoding.Xmm1, encoding.Xmm2, encoding.Xmm3, encoding.Xmm4, encoding.Xmm5, encoding.Xmm6, encoding.Xmm7},
 	}
 }
+
+// GetRegistersForArgs returns the registers that args are passed in. The
+// result is shorter than args when they don't all fit in registers.
 func (a *ABI_AMDSystemV) GetRegistersForArgs(args []Type) []*encoding.Register {
+	return assignRegisters(args, a.intTargets, a.floatTargets)
+}
+
+func (a *ABI_AMDSystemV) ReturnTypeToOperand(arg Type) lib.Operand {
+	if arg.Type() == T_Float64 {
+		return encoding.Xmm0
+	}
+	return encoding.Rax
+}
+
+// syscallTargets are the registers that the Linux kernel expects syscall
+// arguments in.
+var syscallTargets = []*encoding.Register{encoding.Rdi, encoding.Rsi, encoding.Rdx, encoding.R10, encoding.R8, encoding.R9}
+
+func getRegistersForSyscallArgs(args []Type) []*encoding.Register {
+	return assignRegisters(args, syscallTargets, nil)
+}
+
+func assignRegisters(args []Type, intTargets, floatTargets []*encoding.Register) []*encoding.Register {
 	intRegisterIx := 0
 	floatRegisterIx := 0
 	var result []*encoding.Register
-
-	var reg *encoding.Register
 	for _, arg := range args {
 		if arg.Type() == T_Float64 {
-			reg = a.floatTargets[floatRegisterIx]
+			if floatRegisterIx >= len(floatTargets) {
+				break
+			}
+			result = append(result, floatTargets[floatRegisterIx])
 			floatRegisterIx += 1
 		} else {
-			reg = a.intTargets[intRegisterIx]
+			if intRegisterIx >= len(intTargets) {
+				break
+			}
+			result = append(result, intTargets[intRegisterIx])
 			intRegisterIx += 1
 		}
-		result = append(result, reg)
 	}
 	return result
 }
 
-func (a *ABI_AMDSystemV) ReturnTypeToOperand(arg Type) lib.Operand {
-	if arg.Type() == T_Float64 {
-		return encoding.Xmm0
-	}
-	return encoding.Rax
+// isReservedRegister returns whether reg is never handed out by the
+// allocators: the stack and frame pointers, and the callEngine register.
+func isReservedRegister(reg uint8) bool {
+	return reg == encoding.Rsp.Register || reg == encoding.Rbp.Register || reg == callEngineRegister.Register
 }
 
-// PreserveRegisters returns instructions and clobbered registers
-func PreserveRegisters(ctx *IR_Context, argTypes []Type, returnType Type) (lib.Instructions, map[lib.Operand]lib.Operand, []lib.Operand) {
-	var clobbered []lib.Operand
-	var result []lib.Instruction
-	mapping := map[lib.Operand]lib.Operand{}
+// clobbersAll is used for calls to compiled functions, which are free to use
+// any register that isn't reserved.
+func clobbersAll(*encoding.Register) bool {
+	return true
+}
 
-	// push the return register; TODO: check if in use?
-	returnOp := ctx.ABI.ReturnTypeToOperand(returnType)
-	push := x86_64.PUSH(returnOp)
-	result = append(result, push)
-	clobbered = append(clobbered, returnOp)
-	ctx.AddInstruction(push)
+// PreserveRegisters pushes the registers that are in use and either get
+// clobbered by the call or are needed for its arguments, so that
+// RestoreRegisters can pop them afterwards. It returns the instructions, a
+// mapping from the pushed registers and the stack slots of variables to their
+// location on the stack after the pushes, and the pushed registers in push
+// order.
+func PreserveRegisters(ctx *IR_Context, argRegs []*encoding.Register, clobbers func(*encoding.Register) bool) (lib.Instructions, map[lib.Operand]lib.Operand, []lib.Operand) {
+	isArg := map[*encoding.Register]bool{}
+	for _, reg := range argRegs {
+		isArg[reg] = true
+	}
 
 	allocator := ctx.Allocator.(*X86_64_Allocator)
-	// Push registers that are already in use
-	regs := ctx.ABI.GetRegistersForArgs(argTypes)
-	var inUse bool
-	for i, arg := range argTypes {
-		reg := regs[i]
-		if arg.Type() == T_Float64 {
-			inUse = allocator.FloatRegisters[reg.Register]
-		} else {
-			inUse = allocator.Registers[reg.Register]
+	var inUse []*encoding.Register
+	for j, allocated := range allocator.Registers {
+		if allocated && !isReservedRegister(uint8(j)) {
+			inUse = append(inUse, encoding.Get64BitRegisterByIndex(uint8(j)))
+		}
+	}
+	for j, allocated := range allocator.FloatRegisters {
+		if allocated {
+			inUse = append(inUse, encoding.GetFloatingPointRegisterByIndex(uint8(j)))
 		}
-		if inUse {
-			result = append(result, x86_64.PUSH(reg))
-			ctx.AddInstruction(x86_64.PUSH(reg))
+	}
+
+	var result []lib.Instruction
+	var clobbered []lib.Operand
+	for _, reg := range inUse {
+		if clobbers(reg) || isArg[reg] {
+			push := pushRegister(reg)
+			ctx.AddInstruction(push...)
+			result = append(result, push...)
 			clobbered = append(clobbered, reg)
 		}
 	}
-	// Build the register -> location on the stack mapping
-	mappedClobbered := 1 // set to 1, to account for the return op TODO
-	for i, arg := range argTypes {
-		reg := regs[i]
-		if arg.Type() == T_Float64 {
-			inUse = allocator.FloatRegisters[reg.Register]
-		} else {
-			inUse = allocator.Registers[reg.Register]
+
+	// Argument registers get overwritten while the arguments are set up,
+	// so values that live in them have to be read from the stack instead.
+	// The same goes for the other pushed registers, so that they can be
+	// used for the arguments too. Values that were on the stack already
+	// moved up by the pushed registers.
+	mapping := map[lib.Operand]lib.Operand{}
+	for k, op := range clobbered {
+		location := &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: int32((len(clobbered) - 1 - k) * 8)}
+		for _, variant := range registerVariants(op.(*encoding.Register)) {
+			mapping[variant] = location
 		}
-		if inUse {
-			offset := (len(clobbered) - mappedClobbered) * int(arg.Width())
-			mapping[reg] = &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: uint8(offset)}
-			mappedClobbered += 1
+	}
+	for _, location := range ctx.VariableMap {
+		if slot, ok := location.(*encoding.DisplacedRegister); ok && slot.Register == encoding.Rsp {
+			mapping[slot] = &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: slot.Displacement + int32(len(clobbered)*8)}
 		}
 	}
 	return result, mapping, clobbered
 }
 
+// registerVariants returns reg at every operand width.
+func registerVariants(reg *encoding.Register) []*encoding.Register {
+	if reg.Size == lib.OWORD {
+		return []*encoding.Register{reg}
+	}
+	return []*encoding.Register{reg.Get64BitRegister(), reg.Get32BitRegister(), reg.Get16BitRegister(), reg.Get8BitRegister()}
+}
+
+// pushRegister pushes reg on the stack. There's no push for xmm registers,
+// so those are moved into a new stack slot instead.
+func pushRegister(reg *encoding.Register) []lib.Instruction {
+	if reg.Size == lib.OWORD {
+		return []lib.Instruction{
+			x86_64.SUB(encoding.Uint32(8), encoding.Rsp),
+			x86_64.MOVQ(reg, &encoding.DisplacedRegister{Register: encoding.Rsp}),
+		}
+	}
+	return []lib.Instruction{x86_64.PUSH(reg)}
+}
+
+func popRegister(reg *encoding.Register) []lib.Instruction {
+	if reg.Size == lib.OWORD {
+		return []lib.Instruction{
+			x86_64.MOVQ(&encoding.DisplacedRegister{Register: encoding.Rsp}, reg),
+			x86_64.ADD(encoding.Uint32(8), encoding.Rsp),
+		}
+	}
+	return []lib.Instruction{x86_64.POP(reg)}
+}
+
+// ABI_Call_Setup preserves the registers that the call clobbers and moves
+// args into argRegs, which should be the result of ctx.ABI.GetRegistersForArgs
+// or getRegistersForSyscallArgs.
+//
 //goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
-func ABI_Call_Setup(ctx *IR_Context, args []IRExpression, returnType Type) (lib.Instructions, map[lib.Operand]lib.Operand, []lib.Operand, error) {
+func ABI_Call_Setup(ctx *IR_Context, args []IRExpression, getRegisters func([]Type) []*encoding.Register, clobbers func(*encoding.Register) bool) (lib.Instructions, map[lib.Operand]lib.Operand, []lib.Operand, error) {
 	argTypes := make([]Type, len(args))
 	for i, arg := range args {
 		argTypes[i] = arg.ReturnType(ctx)
@@ -113,15 +185,28 @@ func ABI_Call_Setup(ctx *IR_Context, args []IRExpression, returnType Type) (lib.
 			return nil, nil, nil, fmt.Errorf("Unknown type for value: %s", arg)
 		}
 	}
-	result, mapping, clobbered := PreserveRegisters(ctx, argTypes, returnType)
-	regs := ctx.ABI.GetRegistersForArgs(argTypes)
+	regs := getRegisters(argTypes)
+	if len(regs) != len(args) {
+		return nil, nil, nil, fmt.Errorf("Too many arguments; only %d fit in registers", len(regs))
+	}
+	result, mapping, clobbered := PreserveRegisters(ctx, regs, clobbers)
 
 	ctx_ := ctx.Copy()
+	for variable, location := range ctx_.VariableMap {
+		if newLocation, found := mapping[location]; found {
+			ctx_.VariableMap[variable] = newLocation
+		}
+	}
 	allocator := ctx_.Allocator.(*X86_64_Allocator)
+	for _, reg := range clobbered {
+		allocator.DeallocateRegister(reg)
+	}
 	for _, reg := range regs {
 		if reg.Size == lib.OWORD {
-			allocator.FloatRegisters[reg.Register] = true
-			allocator.FloatRegistersAllocated += 1
+			if !allocator.FloatRegisters[reg.Register] {
+				allocator.FloatRegisters[reg.Register] = true
+				allocator.FloatRegistersAllocated += 1
+			}
 		} else {
 			if !allocator.Registers[reg.Register] {
 				allocator.Registers[reg.Register] = true
@@ -135,30 +220,28 @@ func ABI_Call_Setup(ctx *IR_Context, args []IRExpression, returnType Type) (lib.
 		if ctx.Architecture == nil {
 			return nil, nil, nil, fmt.Errorf("Missing Architecture in IR_Context")
 		}
-		instr, err := ctx.Architecture.EncodeExpression(arg, ctx_, regs[i])
+		target := regs[i]
+		if !IsFloat(argTypes[i]) {
+			target = target.ForOperandWidth(argTypes[i].Width())
+		}
+		instr, err := ctx.Architecture.EncodeExpression(arg, ctx_, target)
 		if err != nil {
 			return nil, nil, nil, err
 		}
 		ctx.AddInstruction(instr...)
 		result = result.Add(instr)
 	}
-	for variable, location := range ctx_.VariableMap {
-		if newLocation, found := mapping[location]; found {
-			ctx_.VariableMap[variable] = newLocation
-		}
-	}
-
 	return result, mapping, clobbered, nil
-
 }
 
+// RestoreRegisters pops the registers pushed by PreserveRegisters.
 func RestoreRegisters(ctx *IR_Context, clobbered []lib.Operand) lib.Instructions {
 	// Pop in reverse order
 	var result []lib.Instruction
 	for j := len(clobbered) - 1; j >= 0; j-- {
-		reg := clobbered[j]
-		result = append(result, x86_64.POP(reg))
-		ctx.AddInstruction(x86_64.POP(reg))
+		pop := popRegister(clobbered[j].(*encoding.Register))
+		result = append(result, pop...)
+		ctx.AddInstruction(pop...)
 	}
 	return result
 }
@@ -3,7 +3,6 @@ package x86_64
 import (
 	"fmt"
 
-	"github.com/bspaans/jit-compiler/asm/x86_64"
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	"github.com/bspaans/jit-compiler/ir/expr"
 	. "github.com/bspaans/jit-compiler/ir/shared"
@@ -21,21 +20,7 @@ func encode_IR_And(i *expr.IR_And, ctx *IR_Context, target lib.Operand) ([]lib.I
 		return nil, fmt.Errorf("Unsupported types (%s, %s) in && IR operation: %s", returnType1, returnType2, i.String())
 	}
 
-	reg := ctx.AllocateRegister(returnType1)
-	defer ctx.DeallocateRegister(reg)
-
-	result, err := encodeExpression(i.Op1, ctx, reg)
-	if err != nil {
-		return nil, err
-	}
-	expr2, err := encodeExpression(i.Op2, ctx, target)
-	if err != nil {
-		return nil, err
-	}
-	result = lib.Instructions(result).Add(expr2)
-	// TODO: should be using test?
-	and := x86_64.AND(reg, target)
-	result = append(result, and)
-	ctx.AddInstruction(and)
-	return result, nil
+	// The right operand is only evaluated when the left operand doesn't
+	// decide the outcome.
+	return encodeBooleanValue(ctx, i, target)
 }
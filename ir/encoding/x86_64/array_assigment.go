@@ -30,13 +30,35 @@ func encode_IR_ArrayAssignment(i *statements.IR_ArrayAssignment, ctx *IR_Context
 	if err != nil {
 		return nil, fmt.Errorf("Failed to encode array index in %s: %s", i.String(), err.Error())
 	}
+	if _, inRegister := reg.(*encoding.Register); !inRegister {
+		// Load the address of a spilled array.
+		arrayReg := ctx.AllocateRegister(TUint64)
+		defer ctx.DeallocateRegister(arrayReg)
+		mov := x86_64.MOV(reg, arrayReg)
+		ctx.AddInstruction(mov)
+		result = append(result, mov)
+		reg = arrayReg
+	}
 
 	exprInstr, err := encodeExpression(i.Expr, ctx, exprReg)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to encode expr in %s: %s", i.String(), err.Error())
 	}
 	result = lib.Instructions(result).Add(exprInstr)
+	check, err := boundsCheck(ctx, i.Variable, indexReg, PositionOf(i.Index))
+	if err != nil {
+		return nil, err
+	}
+	result = lib.Instructions(result).Add(check)
 
+	if array, ok := ctx.VariableTypes[i.Variable].(*TArray); ok && array.ItemType.Type() == T_Float32 {
+		// Round the value to float32 before storing it.
+		target := &encoding.SIBRegister{reg.(*encoding.Register), indexReg.(*encoding.Register), encoding.ScaleForItemWidth(lib.DOUBLE)}
+		cvt := x86_64.CVTSD2SS(exprReg, exprReg)
+		mov := x86_64.MOVSS(exprReg, target)
+		ctx.AddInstruction(cvt, mov)
+		return append(result, cvt, mov), nil
+	}
 	target := &encoding.SIBRegister{reg.(*encoding.Register), indexReg.(*encoding.Register), encoding.ScaleForItemWidth(itemWidth)}
 	mov := x86_64.MOV(exprReg.(*encoding.Register).ForOperandWidth(itemWidth), target)
 	ctx.AddInstruction(mov)
@@ -13,10 +13,11 @@ import (
 func encode_IR_ArrayIndex(i *expr.IR_ArrayIndex, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
 	ctx.AddInstruction("array_index " + encoding.Comment(i.String()))
 
-	itemWidth := i.ReturnType(ctx).Width()
+	itemType := i.Array.ReturnType(ctx).(*TArray).ItemType
+	itemWidth := itemType.Width()
 
 	var arrayReg, indexReg lib.Operand
-	if i.Array.Type() == Variable {
+	if isRegisterVariable(i.Array, ctx) {
 		variable := i.Array.(*expr.IR_Variable).Value
 		reg, ok := ctx.VariableMap[variable]
 		if !ok {
@@ -33,15 +34,21 @@ func encode_IR_ArrayIndex(i *expr.IR_ArrayIndex, ctx *IR_Context, target lib.Ope
 		return nil, fmt.Errorf("Array encoding issue: %s", err.Error())
 	}
 
+	arrayVariable := ""
+	if v, ok := i.Array.(*expr.IR_Variable); ok {
+		arrayVariable = v.Value
+	}
+	_, checked := ctx.VariableMap[LengthVariable(arrayVariable)]
+
 	// Specialise for integers
-	if i.Index.Type() == Uint64 {
+	if i.Index.Type() == Uint64 && itemType.Type() != T_Float32 && !checked {
 		op := i.Index.(*expr.IR_Uint64)
 		if op.Value == 0 {
 			mov := x86_64.MOV(&encoding.IndirectRegister{
 				arrayReg.(*encoding.Register).ForOperandWidth(itemWidth)},
 				target.(*encoding.Register).ForOperandWidth(itemWidth))
 			// Move 0 into target register if going from a wider to narrower register
-			mov0 := x86_64.MOV(encoding.Uint64(0), target.(*encoding.Register).Get64BitRegister()) // TODO use xor reg, reg
+			mov0 := x86_64.MOV(encoding.Uint64(0), target.(*encoding.Register).Get64BitRegister())
 			if itemWidth < lib.QUADWORD {
 				ctx.AddInstruction(mov0)
 				result = append(result, mov0)
@@ -54,7 +61,7 @@ func encode_IR_ArrayIndex(i *expr.IR_ArrayIndex, ctx *IR_Context, target lib.Ope
 		}
 	}
 
-	if i.Index.Type() == Variable {
+	if isRegisterVariable(i.Index, ctx) {
 		variable := i.Index.(*expr.IR_Variable).Value
 		reg, ok := ctx.VariableMap[variable]
 		if !ok {
@@ -71,11 +78,21 @@ func encode_IR_ArrayIndex(i *expr.IR_ArrayIndex, ctx *IR_Context, target lib.Ope
 		return nil, fmt.Errorf("Array index encoding issue: %s", err.Error())
 	}
 	result = lib.Instructions(result).Add(index)
-	mov := x86_64.MOV(&encoding.SIBRegister{
+	check, err := boundsCheck(ctx, arrayVariable, indexReg, i.Position())
+	if err != nil {
+		return nil, err
+	}
+	result = lib.Instructions(result).Add(check)
+	item := &encoding.SIBRegister{
 		arrayReg.(*encoding.Register),
 		indexReg.(*encoding.Register),
-		encoding.ScaleForItemWidth(itemWidth)},
-		target.(*encoding.Register).ForOperandWidth(itemWidth))
+		encoding.ScaleForItemWidth(itemWidth)}
+	if itemType.Type() == T_Float32 {
+		cvt := x86_64.CVTSS2SD(item, target)
+		ctx.AddInstruction(cvt)
+		return append(result, cvt), nil
+	}
+	mov := x86_64.MOV(item, target.(*encoding.Register).ForOperandWidth(itemWidth))
 
 	// Move 0 into target register if going from a wider to narrower register
 	mov0 := x86_64.MOV(encoding.Uint64(0), target.(*encoding.Register).Get64BitRegister())
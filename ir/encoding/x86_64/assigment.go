@@ -3,6 +3,7 @@ package x86_64
 import (
 	"fmt"
 
+	"github.com/bspaans/jit-compiler/asm/x86_64"
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	. "github.com/bspaans/jit-compiler/ir/shared"
 	"github.com/bspaans/jit-compiler/ir/statements"
@@ -14,14 +15,34 @@ func encode_IR_Assignment(i *statements.IR_Assignment, ctx *IR_Context) ([]lib.I
 	ctx.AddInstruction("assignment " + encoding.Comment(i.String()))
 	returnType := i.Expr.ReturnType(ctx)
 	reg, found := ctx.VariableMap[i.Variable]
+	if global, ok := ctx.Globals[i.Variable]; !found && ok {
+		return encodeGlobalStore(i, global, ctx)
+	}
 	if !found {
 		reg = ctx.AllocateRegister(returnType)
 		ctx.VariableMap[i.Variable] = reg
 		ctx.VariableTypes[i.Variable] = returnType
 	}
+	if _, inRegister := reg.(*encoding.Register); !inRegister {
+		return encodeSpillStore(i.Expr, returnType, reg, ctx)
+	}
 	expr, err := encodeExpression(i.Expr, ctx, reg)
 	if err != nil {
 		return nil, fmt.Errorf("Error in assignment: %s", err.Error())
 	}
 	return expr, nil
 }
+
+// encodeSpillStore stores the value of e in the stack slot of a spilled
+// variable. Slots are 8 bytes wide, so the whole register gets stored.
+func encodeSpillStore(e IRExpression, typ Type, slot lib.Operand, ctx *IR_Context) ([]lib.Instruction, error) {
+	value := ctx.AllocateRegister(typ).(*encoding.Register)
+	defer ctx.DeallocateRegister(value)
+	result, err := encodeExpression(e, ctx, value)
+	if err != nil {
+		return nil, fmt.Errorf("Error in assignment: %s", err.Error())
+	}
+	mov := x86_64.MOV(fullRegister(value), slot)
+	ctx.AddInstruction(mov)
+	return append(result, mov), nil
+}
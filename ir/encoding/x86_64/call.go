@@ -7,32 +7,90 @@ import (
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	"github.com/bspaans/jit-compiler/ir/expr"
 	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
 	"github.com/bspaans/jit-compiler/lib"
 )
 
+// Calls to externs exit to the Go caller through the callEngine, which
+// calls the host function and then resumes the code after the call. Calls
+// to the other functions of a module go through the module's function
+// table, so that they can be replaced.
+//
+//goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
 func encode_IR_Call(i *expr.IR_Call, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
-	result, mapping, clobbered, err := ABI_Call_Setup(ctx, i.Args, ctx.VariableTypes[i.Function].(*TFunction).ReturnType)
+	extern, isExtern := ctx.Externs[i.Function]
+	slot, isSlot := ctx.Globals[i.Function]
+	if _, ok := ctx.VariableTypes[i.Function]; ok {
+		isExtern, isSlot = false, false
+	}
+	signature, ok := ctx.VariableTypes[i.Function].(*TFunction)
+	if isExtern {
+		signature, ok = extern.Signature, true
+	} else if isSlot {
+		signature, ok = slot.Type.(*TFunction)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Not a function: %s", i.Function)
+	}
+	if len(i.Args) != len(signature.Args) {
+		return nil, fmt.Errorf("Expecting %d arguments in call to %s, got %d", len(signature.Args), i.Function, len(i.Args))
+	}
+	if target != nil && signature.ReturnType == TVoid {
+		return nil, fmt.Errorf("Function %s doesn't return a value", i.Function)
+	}
+	// Arrays are passed with their length.
+	args := []IRExpression{}
+	for j, arg := range i.Args {
+		args = append(args, arg)
+		if signature.Args[j].Type() == T_Array {
+			args = append(args, expr.NewIR_Len(arg))
+		}
+	}
+	result, mapping, clobbered, err := ABI_Call_Setup(ctx, args, ctx.ABI.GetRegistersForArgs, clobbersAll)
 	if err != nil {
 		return nil, err
 	}
 
-	function := ctx.VariableMap[i.Function]
-	if function == nil {
-		return nil, fmt.Errorf("Unknown function:" + i.Function)
-	}
+	var call []lib.Instruction
+	if isExtern {
+		call = []lib.Instruction{
+			x86_64.MOV(encoding.Uint32(extern.Index), callEngineField(lib.CallEngineHostFunctionOffset)),
+			x86_64.CALL(callEngineField(lib.CallEngineHostExitOffset)),
+		}
+	} else if isSlot {
+		// rax isn't used for arguments, and was saved if it's in use.
+		lea := encodeGlobalAddress(slot, ctx, encoding.Rax)
+		result = append(result, lea)
+		call = []lib.Instruction{
+			x86_64.ADD(&encoding.IndirectRegister{Register: encoding.Rax}, encoding.Rax),
+			x86_64.CALL(encoding.Rax),
+		}
+	} else {
+		function := ctx.VariableMap[i.Function]
+		if function == nil {
+			return nil, fmt.Errorf("Unknown function:" + i.Function)
+		}
 
-	// Use a different address for function if its location has been clobbered
-	if movedTarget, found := mapping[function]; found {
-		function = movedTarget
+		// Use a different address for function if its location has been clobbered
+		if movedTarget, found := mapping[function]; found {
+			function = movedTarget
+		}
+		call = []lib.Instruction{x86_64.CALL(function)}
+	}
+	ctx.AddInstruction(call...)
+	result = append(result, call...)
+	if target == nil {
+		return result.Add(RestoreRegisters(ctx, clobbered)), nil
 	}
 
-	call := x86_64.CALL(function)
-	tmpReg := ctx.AllocateRegister(TUint64)
+	returnOperand := ctx.ABI.ReturnTypeToOperand(signature.ReturnType)
+	tmpReg := ctx.AllocateRegister(signature.ReturnType)
 	defer ctx.DeallocateRegister(tmpReg)
-	mov := x86_64.MOV(encoding.Rax, tmpReg)
-	ctx.AddInstruction(call)
+	mov := x86_64.MOV(returnOperand, tmpReg)
+	if !IsFloat(signature.ReturnType) {
+		mov = x86_64.MOV(encoding.Rax, tmpReg.(*encoding.Register).Get64BitRegister())
+	}
 	ctx.AddInstruction(mov)
-	result = append(result, call)
 	result = append(result, mov)
 
 	restore := RestoreRegisters(ctx, clobbered)
@@ -43,3 +101,10 @@ func encode_IR_Call(i *expr.IR_Call, ctx *IR_Context, target lib.Operand) ([]lib
 	result = append(result, mov)
 	return result, nil
 }
+
+// The result of the call, if any, is discarded.
+//
+//goland:noinspection GoSnakeCaseUsage
+func encode_IR_CallStatement(i *statements.IR_CallStatement, ctx *IR_Context) ([]lib.Instruction, error) {
+	return encode_IR_Call(i.Call, ctx, nil)
+}
@@ -2,6 +2,7 @@ package x86_64
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/bspaans/jit-compiler/asm/x86_64"
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
@@ -10,97 +11,167 @@ import (
 	"github.com/bspaans/jit-compiler/lib"
 )
 
+// encode_IR_Cast converts between any two of the integer types, bool and
+// float64. Integers are truncated or sign/zero-extended depending on the
+// signedness of the source type, floats are truncated towards zero and
+// conversions to bool compare the value against zero.
+//
 //goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
 func encode_IR_Cast(i *expr.IR_Cast, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
 	ctx.AddInstruction("cast " + encoding.Comment(i.String()))
-	var result []lib.Instruction
 	valueType := i.Value.ReturnType(ctx)
 	if valueType == nil {
 		return nil, fmt.Errorf("nil return type in %s", i.Value.String())
 	}
-	// TODO: use movsx and movzx
-	if i.CastToType == TUint64 {
-		if valueType == TUint64 {
-			return encodeExpression(i.Value, ctx, target)
-		} else if valueType == TUint32 {
-			tmpReg := ctx.AllocateRegister(valueType)
-			defer ctx.DeallocateRegister(tmpReg)
-			exprs, err := encodeExpression(i.Value, ctx, tmpReg)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, exprs...)
-			mov := x86_64.MOV(tmpReg.(*encoding.Register).Get64BitRegister(), target)
-			ctx.AddInstruction(mov)
-			result = append(result, mov)
-			return result, nil
-		} else if valueType == TUint16 || valueType == TUint8 {
-			tmpReg := ctx.AllocateRegister(valueType)
-			defer ctx.DeallocateRegister(tmpReg)
-			exprs, err := encodeExpression(i.Value, ctx, tmpReg)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, exprs...)
-			mov := x86_64.MOVZX(tmpReg, target)
-			ctx.AddInstruction(mov)
-			result = append(result, mov)
-			return result, nil
-		} else if valueType == TFloat64 {
-			tmpReg := ctx.AllocateRegister(TFloat64)
-			defer ctx.DeallocateRegister(tmpReg)
+	if valueType == i.CastToType {
+		return encodeExpression(i.Value, ctx, target)
+	}
+	targetReg, ok := target.(*encoding.Register)
+	if !isScalarType(valueType) || !isScalarType(i.CastToType) || !ok {
+		return nil, fmt.Errorf("Unsupported cast operation %s -> (%s) in: %s", valueType.String(), i.CastToType.String(), i.String())
+	}
 
-			exprs, err := encodeExpression(i.Value, ctx, tmpReg)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, exprs...)
-			cvt := x86_64.CVTTSD2SI(tmpReg, target)
-			ctx.AddInstruction(cvt)
-			result = append(result, cvt)
-			return result, nil
-		}
-	} else if i.CastToType == TUint8 {
-		if valueType == TUint64 || valueType == TUint32 || valueType == TUint16 || valueType == TUint8 {
-			result, err := encodeExpression(i.Value, ctx, target)
-			if err != nil {
-				return nil, err
-			}
-			return result, nil
-		}
-	} else if i.CastToType == TUint16 {
-		if valueType == TUint64 || valueType == TUint32 || valueType == TUint16 || valueType == TUint8 {
-			result, err := encodeExpression(i.Value, ctx, target)
-			if err != nil {
-				return nil, err
-			}
-			return result, nil
-		}
-	} else if i.CastToType == TUint32 {
-		if valueType == TUint64 || valueType == TUint32 || valueType == TUint16 || valueType == TUint8 {
-			result, err := encodeExpression(i.Value, ctx, target)
-			if err != nil {
-				return nil, err
-			}
-			return result, nil
-		}
+	tmpReg := ctx.AllocateRegister(valueType)
+	defer ctx.DeallocateRegister(tmpReg)
+	result, err := encodeExpression(i.Value, ctx, tmpReg)
+	if err != nil {
+		return nil, err
+	}
+	src := tmpReg.(*encoding.Register)
+
+	var instr []lib.Instruction
+	if i.CastToType == TBool {
+		instr = castToBool(valueType, src, targetReg)
 	} else if i.CastToType == TFloat64 {
-		if valueType == TFloat64 {
-			return encodeExpression(i.Value, ctx, target)
-		} else if valueType == TUint64 {
-			tmpReg := ctx.AllocateRegister(TUint64)
-			defer ctx.DeallocateRegister(tmpReg)
+		instr, err = castToFloat64(ctx, valueType, src, targetReg)
+	} else if valueType == TFloat64 {
+		instr, err = castFromFloat64(ctx, i.CastToType, src, targetReg)
+	} else {
+		instr = castInteger(valueType, src, targetReg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctx.AddInstruction(instr...)
+	return append(result, instr...), nil
+}
+
+func isScalarType(typ Type) bool {
+	return IsNumber(typ) || typ == TBool
+}
+
+// castInteger converts between integer types, treating bool as an unsigned
+// byte. Narrowing truncates, widening sign extends signed types and zero
+// extends unsigned types.
+func castInteger(valueType Type, src, target *encoding.Register) []lib.Instruction {
+	from, to := src.Width(), target.Width()
+	if to <= from {
+		return []lib.Instruction{x86_64.MOV(src.ForOperandWidth(to), target)}
+	}
+	if IsSignedInteger(valueType) {
+		return []lib.Instruction{x86_64.MOVSX(src, target)}
+	}
+	if from == lib.DOUBLE {
+		// 32 bit moves zero the upper half of the 64 bit register.
+		return []lib.Instruction{x86_64.MOV(src, target.ForOperandWidth(lib.DOUBLE))}
+	}
+	return []lib.Instruction{x86_64.MOVZX(src, target)}
+}
 
-			exprs, err := encodeExpression(i.Value, ctx, tmpReg)
-			if err != nil {
-				return nil, err
-			}
-			result = append(result, exprs...)
-			cvt := x86_64.CVTSI2SD(tmpReg, target)
-			ctx.AddInstruction(cvt)
-			result = append(result, cvt)
-			return result, nil
+// castToBool sets target to 1 if src is non-zero. The sign bit of floats is
+// shifted out, so that -0.0 converts to false as well.
+func castToBool(valueType Type, src, target *encoding.Register) []lib.Instruction {
+	target64 := target.Get64BitRegister()
+	var result []lib.Instruction
+	if valueType == TFloat64 {
+		result = []lib.Instruction{
+			x86_64.MOVQ(src, target64),
+			x86_64.SHL(encoding.Uint8(1), target64),
 		}
+	} else {
+		result = castInteger(valueType, src, target64)
+	}
+	return append(result,
+		x86_64.CMP_immediate(0, target64),
+		x86_64.SETNE(target),
+	)
+}
+
+// castToFloat64 widens src to 64 bits and converts it with CVTSI2SD.
+// CVTSI2SD only handles signed integers, so uint64 values that have their top
+// bit set are halved first (keeping the lowest bit to round correctly),
+// converted and doubled again.
+func castToFloat64(ctx *IR_Context, valueType Type, src, target *encoding.Register) ([]lib.Instruction, error) {
+	src64 := src.Get64BitRegister()
+	var result []lib.Instruction
+	if src.Width() != lib.QUADWORD {
+		result = castInteger(valueType, src, src64)
+	}
+	if valueType != TUint64 {
+		return append(result, x86_64.CVTSI2SD(src64, target)), nil
+	}
+
+	tmpReg := ctx.AllocateRegister(TUint64)
+	defer ctx.DeallocateRegister(tmpReg)
+	large := []lib.Instruction{
+		x86_64.MOV(src64, tmpReg),
+		x86_64.SHR(encoding.Uint8(1), tmpReg),
+		x86_64.SHL(encoding.Uint8(63), src64),
+		x86_64.SHR(encoding.Uint8(63), src64),
+		x86_64.OR(src64, tmpReg),
+		x86_64.CVTSI2SD(tmpReg, target),
+		x86_64.ADD(target, target),
+	}
+	largeLen, err := instructionsLength(large...)
+	if err != nil {
+		return nil, err
+	}
+	small := []lib.Instruction{
+		x86_64.CVTSI2SD(src64, target),
+		relativeJump(x86_64.JMP, largeLen),
+	}
+	smallLen, err := instructionsLength(small...)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result,
+		x86_64.CMP_immediate(0, src64),
+		relativeJump(x86_64.JL, smallLen),
+	)
+	result = append(result, small...)
+	return append(result, large...), nil
+}
+
+// castFromFloat64 truncates src towards zero with CVTTSD2SI, which only
+// produces signed 64 bit integers. Values that don't fit in an int64 result in
+// 0x8000000000000000; for uint64 targets those get converted again after
+// subtracting 2^63, which is then added back.
+func castFromFloat64(ctx *IR_Context, castToType Type, src, target *encoding.Register) ([]lib.Instruction, error) {
+	target64 := target.Get64BitRegister()
+	result := []lib.Instruction{x86_64.CVTTSD2SI(src, target64)}
+	if castToType != TUint64 {
+		return result, nil
+	}
+
+	tmpReg := ctx.AllocateRegister(TUint64)
+	defer ctx.DeallocateRegister(tmpReg)
+	floatReg := ctx.AllocateRegister(TFloat64)
+	defer ctx.DeallocateRegister(floatReg)
+	large := []lib.Instruction{
+		x86_64.MOV_immediate(math.Float64bits(1<<63), tmpReg),
+		x86_64.MOVQ(tmpReg, floatReg),
+		x86_64.SUB(floatReg, src),
+		x86_64.CVTTSD2SI(src, target64),
+		x86_64.MOV_immediate(1<<63, tmpReg),
+		x86_64.XOR(tmpReg, target64),
+	}
+	largeLen, err := instructionsLength(large...)
+	if err != nil {
+		return nil, err
 	}
-	return nil, fmt.Errorf("Unsupported cast operation %s -> (%s) in: %s", valueType.String(), i.CastToType.String(), i.String())
+	result = append(result,
+		x86_64.CMP_immediate(0, target64),
+		relativeJump(x86_64.JNL, largeLen),
+	)
+	return append(result, large...), nil
 }
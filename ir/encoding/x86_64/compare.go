@@ -20,7 +20,7 @@ func compare(op1, op2 IRExpression, ctx *IR_Context) ([]lib.Instruction, error)
 
 	var reg1, reg2 lib.Operand
 
-	if op1.Type() == Variable {
+	if isRegisterVariable(op1, ctx) {
 		variable := op1.(*expr.IR_Variable).Value
 		reg1 = ctx.VariableMap[variable]
 	} else {
@@ -33,7 +33,7 @@ func compare(op1, op2 IRExpression, ctx *IR_Context) ([]lib.Instruction, error)
 		result = lib.Instructions(result).Add(expr1)
 	}
 
-	if op2.Type() == Variable {
+	if isRegisterVariable(op2, ctx) {
 		variable := op2.(*expr.IR_Variable).Value
 		reg2 = ctx.VariableMap[variable]
 	} else {
@@ -4,99 +4,106 @@ import (
 	"fmt"
 
 	"github.com/bspaans/jit-compiler/asm/x86_64"
-	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	"github.com/bspaans/jit-compiler/ir/expr"
 	. "github.com/bspaans/jit-compiler/ir/shared"
 	"github.com/bspaans/jit-compiler/lib"
 )
 
-func conditionalJump(ctx *IR_Context, condition IRExpression, stmtLen int) ([]lib.Instruction, error) {
+// conditionalJump encodes condition so that execution falls through when it
+// holds, and jumps offset bytes past the end of the generated code when it
+// doesn't.
+func conditionalJump(ctx *IR_Context, condition IRExpression, offset int) ([]lib.Instruction, error) {
+	return branch(ctx, condition, false, offset)
+}
+
+// branch encodes condition so that execution jumps offset bytes past the end
+// of the generated code when the condition evaluates to jumpIf, and falls
+// through otherwise.
+//
+// && and || short-circuit: their right operand is only evaluated when the
+// left operand doesn't decide the outcome on its own, and both operands branch
+// straight to the true or false target.
+//
+//goland:noinspection GoErrorStringFormat
+func branch(ctx *IR_Context, condition IRExpression, jumpIf bool, offset int) ([]lib.Instruction, error) {
+
+	if condition.ReturnType(ctx) != TBool {
+		return nil, fmt.Errorf("Unsupported condition %s (type: %v)", condition.String(), condition.Type())
+	}
+
+	switch c := condition.(type) {
+	case *expr.IR_And:
+		return shortCircuitBranch(ctx, c.Op1, c.Op2, false, jumpIf, offset, c.String())
+	case *expr.IR_Or:
+		return shortCircuitBranch(ctx, c.Op1, c.Op2, true, jumpIf, offset, c.String())
+	case *expr.IR_Not:
+		return branch(ctx, c.Op1, !jumpIf, offset)
+	}
 
-	jmpSize := 2
 	reg := ctx.AllocateRegister(TBool)
 	defer ctx.DeallocateRegister(reg)
 
 	var result []lib.Instruction
 	var instr []lib.Instruction
 	var err error
-	switch condition.(type) {
+	switch c := condition.(type) {
 	case *expr.IR_Equals:
-		c := condition.(*expr.IR_Equals)
 		result, err = encode_IR_Equals(c, ctx, reg, false)
 		instr = []lib.Instruction{
-			x86_64.JNE(encoding.Uint8(stmtLen + jmpSize)),
+			relativeJump(chooseJump(jumpIf, x86_64.JE, x86_64.JNE), offset),
 		}
 	case *expr.IR_LT:
-		c := condition.(*expr.IR_LT)
 		result, err = encode_IR_LT(c, ctx, reg, false)
 		if IsSignedInteger(c.Op1.ReturnType(ctx)) {
 			instr = []lib.Instruction{
-				x86_64.JNL(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JL, x86_64.JNL), offset),
 			}
 		} else {
 			instr = []lib.Instruction{
-				x86_64.JNB(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JB, x86_64.JNB), offset),
 			}
 		}
 	case *expr.IR_LTE:
-		c := condition.(*expr.IR_LTE)
 		result, err = encode_IR_LTE(c, ctx, reg, false)
 		if IsSignedInteger(c.Op1.ReturnType(ctx)) {
 			instr = []lib.Instruction{
-				x86_64.JNLE(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JLE, x86_64.JNLE), offset),
 			}
 		} else {
 			instr = []lib.Instruction{
-				x86_64.JNBE(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JBE, x86_64.JNBE), offset),
 			}
 		}
 	case *expr.IR_GT:
-		c := condition.(*expr.IR_GT)
 		result, err = encode_IR_GT(c, ctx, reg, false)
 		if IsSignedInteger(c.Op1.ReturnType(ctx)) {
 			instr = []lib.Instruction{
-				x86_64.JNG(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JG, x86_64.JNG), offset),
 			}
 		} else {
 			instr = []lib.Instruction{
-				x86_64.JNA(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JA, x86_64.JNA), offset),
 			}
 		}
 	case *expr.IR_GTE:
-		c := condition.(*expr.IR_GTE)
 		result, err = encode_IR_GTE(c, ctx, reg, false)
 		if IsSignedInteger(c.Op1.ReturnType(ctx)) {
 			instr = []lib.Instruction{
-				x86_64.JNGE(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JGE, x86_64.JNGE), offset),
 			}
 		} else {
 			instr = []lib.Instruction{
-				x86_64.JNAE(encoding.Uint8(stmtLen + jmpSize)),
+				relativeJump(chooseJump(jumpIf, x86_64.JAE, x86_64.JNAE), offset),
 			}
 		}
-	case *expr.IR_Not:
-		result, err = encode_IR_Not(condition.(*expr.IR_Not), ctx, reg, false)
-		instr = []lib.Instruction{
-			x86_64.JE(encoding.Uint8(stmtLen + jmpSize)),
-		}
-	case *expr.IR_And:
-		result, err = encode_IR_And(condition.(*expr.IR_And), ctx, reg)
-		instr = []lib.Instruction{
-			x86_64.JE(encoding.Uint8(stmtLen + jmpSize)),
-		}
-	case *expr.IR_Or:
-		result, err = encode_IR_Or(condition.(*expr.IR_Or), ctx, reg)
-		instr = []lib.Instruction{
-			x86_64.JE(encoding.Uint8(stmtLen + jmpSize)),
-		}
-	case *expr.IR_Bool, *expr.IR_Variable:
+	default:
+		// Any other boolean valued expression (literals, variables, calls,
+		// array and struct lookups) gets evaluated and compared to false.
 		result, err = encodeExpression(condition, ctx, reg)
 		instr = []lib.Instruction{
-			x86_64.CMP_immediate(1, reg),
-			x86_64.JNE(encoding.Uint8(stmtLen + jmpSize)),
+			x86_64.CMP_immediate(0, reg),
+			relativeJump(chooseJump(jumpIf, x86_64.JNE, x86_64.JE), offset),
 		}
-	default:
-		return nil, fmt.Errorf("Unsupported condition %s (type: %v)", condition.String(), condition.Type())
 	}
 	if err != nil {
 		return nil, err
@@ -106,3 +113,78 @@ func conditionalJump(ctx *IR_Context, condition IRExpression, stmtLen int) ([]li
 	ctx.AddInstruction(instr...)
 	return result, nil
 }
+
+// shortCircuitBranch encodes op1 && op2 (decisive == false) or op1 || op2
+// (decisive == true). When op1 evaluates to decisive the outcome is known and
+// op2 is skipped: either by jumping to the target directly, or by jumping
+// past op2 to fall through.
+//
+//goland:noinspection GoErrorStringFormat
+func shortCircuitBranch(ctx *IR_Context, op1, op2 IRExpression, decisive, jumpIf bool, offset int, repr string) ([]lib.Instruction, error) {
+	returnType1, returnType2 := op1.ReturnType(ctx), op2.ReturnType(ctx)
+	if returnType1 != TBool || returnType2 != TBool {
+		return nil, fmt.Errorf("Unsupported types (%s, %s) in IR operation: %s", returnType1, returnType2, repr)
+	}
+	op2Len, err := branchLength(ctx, op2, jumpIf, offset)
+	if err != nil {
+		return nil, err
+	}
+	op1Offset := op2Len
+	if decisive == jumpIf {
+		op1Offset += offset
+	}
+	result, err := branch(ctx, op1, decisive, op1Offset)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := branch(ctx, op2, jumpIf, offset)
+	if err != nil {
+		return nil, err
+	}
+	return lib.Instructions(result).Add(rest), nil
+}
+
+// branchLength returns the length of the code generated by branch, without
+// committing it.
+func branchLength(ctx *IR_Context, condition IRExpression, jumpIf bool, offset int) (int, error) {
+	commit, ip := ctx.Commit, ctx.InstructionPointer
+	ctx.Commit = false
+	defer func() {
+		ctx.Commit, ctx.InstructionPointer = commit, ip
+	}()
+	instr, err := branch(ctx, condition, jumpIf, offset)
+	if err != nil {
+		return 0, err
+	}
+	return instructionsLength(instr...)
+}
+
+// encodeBooleanValue stores the outcome of condition in target as 0 or 1,
+// using the same short-circuiting branches as conditionalJump.
+func encodeBooleanValue(ctx *IR_Context, condition IRExpression, target lib.Operand) ([]lib.Instruction, error) {
+	setFalse := x86_64.MOV_immediate(0, target)
+	setFalseLen, err := instructionsLength(setFalse)
+	if err != nil {
+		return nil, err
+	}
+	setTrue := x86_64.MOV_immediate(1, target)
+	skipFalse := relativeJump(x86_64.JMP, setFalseLen)
+	setTrueLen, err := instructionsLength(setTrue, skipFalse)
+	if err != nil {
+		return nil, err
+	}
+	result, err := conditionalJump(ctx, condition, setTrueLen)
+	if err != nil {
+		return nil, err
+	}
+	instr := []lib.Instruction{setTrue, skipFalse, setFalse}
+	ctx.AddInstruction(instr...)
+	return append(result, instr...), nil
+}
+
+func chooseJump(jumpIf bool, ifTrue, ifFalse jumpOpcode) jumpOpcode {
+	if jumpIf {
+		return ifTrue
+	}
+	return ifFalse
+}
@@ -2,6 +2,7 @@ package x86_64
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/bspaans/jit-compiler/asm/x86_64"
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
@@ -37,12 +38,12 @@ func encode_IR_Div(i *expr.IR_Div, ctx *IR_Context, target lib.Operand) ([]lib.I
 			defer ctx.DeallocateRegister(tmpRdx)
 			preserveRdx := x86_64.MOV(encoding.Rdx, tmpRdx)
 			result = append(result, preserveRdx)
-			ctx.AddInstruction(result...)
+			ctx.AddInstruction(preserveRdx)
 			// Replace variables in the variablemap that point to rdx with the new register
 			ctxCopy = ctxCopy.Copy()
 			for v, vTarget := range ctxCopy.VariableMap {
 				if r, ok := vTarget.(*encoding.Register); ok && r.Register == 2 {
-					ctxCopy.VariableMap[v] = tmpRdx
+					ctxCopy.VariableMap[v] = tmpRdx.(*encoding.Register).ForOperandWidth(r.Width())
 				}
 			}
 		}
@@ -58,17 +59,22 @@ func encode_IR_Div(i *expr.IR_Div, ctx *IR_Context, target lib.Operand) ([]lib.I
 			defer ctxCopy.DeallocateRegister(tmpRax)
 			preserveRax := x86_64.MOV(encoding.Rax, tmpRax)
 			result = append(result, preserveRax)
-			ctx.AddInstruction(result...)
+			ctx.AddInstruction(preserveRax)
 			// Replace variables in the variablemap that point to rax with the new register
 			for v, vTarget := range ctxCopy.VariableMap {
 				if r, ok := vTarget.(*encoding.Register); ok && r.Register == 0 {
-					ctxCopy.VariableMap[v] = tmpRax
+					ctxCopy.VariableMap[v] = tmpRax.(*encoding.Register).ForOperandWidth(r.Width())
 				}
 			}
 		}
 
+		ctxCopy = reserveRaxRdx(ctxCopy, returnType1.Width())
 		rax := encoding.Rax.ForOperandWidth(returnType1.Width())
 
+		// The operands are encoded in ctxCopy, so keep both instruction
+		// pointers in sync.
+		ctxCopy.InstructionPointer = ctx.InstructionPointer
+
 		op1, err := encodeExpression(i.Op1, ctxCopy, rax)
 		if err != nil {
 			return nil, err
@@ -77,7 +83,7 @@ func encode_IR_Div(i *expr.IR_Div, ctx *IR_Context, target lib.Operand) ([]lib.I
 		result = result.Add(op1)
 
 		var reg lib.Operand
-		if i.Op2.Type() == Variable {
+		if isRegisterVariable(i.Op2, ctxCopy) {
 			variable := i.Op2.(*expr.IR_Variable).Value
 			reg = ctxCopy.VariableMap[variable]
 		} else {
@@ -90,6 +96,13 @@ func encode_IR_Div(i *expr.IR_Div, ctx *IR_Context, target lib.Operand) ([]lib.I
 			}
 			result = lib.Instructions(result).Add(expr)
 		}
+		ctx.InstructionPointer = ctxCopy.InstructionPointer
+
+		guards, err := divisionGuards(i, ctx, returnType1, reg, rax)
+		if err != nil {
+			return nil, err
+		}
+		result = result.Add(guards)
 
 		zeroRegisters := map[Type]*encoding.Register{
 			TUint8:  encoding.Ah,
@@ -109,12 +122,12 @@ func encode_IR_Div(i *expr.IR_Div, ctx *IR_Context, target lib.Operand) ([]lib.I
 				instr = x86_64.CBW()
 			}
 			result = append(result, instr)
-			ctx.AddInstruction(result...)
+			ctx.AddInstruction(instr)
 		} else {
 			zero := zeroRegisters[returnType1]
 			xor := x86_64.XOR(zero, zero)
 			result = append(result, xor)
-			ctx.AddInstruction(result...)
+			ctx.AddInstruction(xor)
 		}
 
 		instr := x86_64.DIV(reg)
@@ -136,8 +149,8 @@ func encode_IR_Div(i *expr.IR_Div, ctx *IR_Context, target lib.Operand) ([]lib.I
 			ctx.AddInstruction(restore)
 			result = append(result, restore)
 		}
-		// Restore %rdx
-		if shouldPreserveRdx {
+		// Restore %rdx, unless it holds the result
+		if shouldPreserveRdx && target.(*encoding.Register).Register != 2 {
 			restore := x86_64.MOV(tmpRdx, encoding.Rdx)
 			ctx.AddInstruction(restore)
 			result = append(result, restore)
@@ -146,3 +159,88 @@ func encode_IR_Div(i *expr.IR_Div, ctx *IR_Context, target lib.Operand) ([]lib.I
 	}
 	return nil, fmt.Errorf("Unsupported types (%s, %s) in / IR operation: %s", returnType1, returnType2, i.String())
 }
+
+// reserveRaxRdx returns a copy of ctx in which %rax, and %rdx unless width
+// is a byte, are allocated, so that the operands of DIV and MUL don't use
+// them for temporaries.
+func reserveRaxRdx(ctx *IR_Context, width lib.Size) *IR_Context {
+	ctx = ctx.Copy()
+	allocator := ctx.Allocator.(*X86_64_Allocator)
+	registers := []uint8{encoding.Rax.Register}
+	if width != lib.BYTE {
+		registers = append(registers, encoding.Rdx.Register)
+	}
+	for _, reg := range registers {
+		if !allocator.Registers[reg] {
+			allocator.Registers[reg] = true
+			allocator.RegistersAllocated += 1
+		}
+	}
+	return ctx
+}
+
+// divisionGuards traps before DIV and IDIV would raise a divide error: when
+// the divisor is zero, and for signed division when the dividend is the
+// smallest integer of its type and the divisor is -1, since the quotient
+// doesn't fit. Guards that can't fail for a literal divisor are left out.
+func divisionGuards(i *expr.IR_Div, ctx *IR_Context, typ Type, divisor, dividend lib.Operand) ([]lib.Instruction, error) {
+	value, isLiteral := integerLiteral(i.Op2)
+	result := lib.Instructions{}
+	if !isLiteral || value == 0 {
+		cmp := x86_64.CMP_immediate(0, divisor)
+		ctx.AddInstruction(cmp)
+		check, err := trapUnless(ctx, x86_64.JNE, lib.TrapDivideByZero, i.Position())
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, cmp)
+		result = result.Add(check)
+	}
+	if IsSignedInteger(typ) && (!isLiteral || value == -1) {
+		// Comparing the dividend with 1 only overflows for the smallest
+		// integer.
+		t := trap(lib.TrapIntegerOverflow, i.Position())
+		trapLen, err := instructionsLength(t...)
+		if err != nil {
+			return nil, err
+		}
+		isMin := append([]lib.Instruction{
+			x86_64.CMP_immediate(1, dividend),
+			relativeJump(x86_64.JNO, trapLen),
+		}, t...)
+		isMinLen, err := instructionsLength(isMin...)
+		if err != nil {
+			return nil, err
+		}
+		instr := append([]lib.Instruction{
+			x86_64.CMP_immediate(math.MaxUint64, divisor),
+			relativeJump(x86_64.JNE, isMinLen),
+		}, isMin...)
+		ctx.AddInstruction(instr...)
+		result = result.Add(instr)
+	}
+	return result, nil
+}
+
+// integerLiteral returns the value of integer literals.
+func integerLiteral(e IRExpression) (int64, bool) {
+	switch v := e.(type) {
+	case *expr.IR_Int8:
+		return int64(v.Value), true
+	case *expr.IR_Int16:
+		return int64(v.Value), true
+	case *expr.IR_Int32:
+		return int64(v.Value), true
+	case *expr.IR_Int64:
+		return v.Value, true
+	case *expr.IR_Uint8:
+		return int64(v.Value), true
+	case *expr.IR_Uint16:
+		return int64(v.Value), true
+	case *expr.IR_Uint32:
+		return int64(v.Value), true
+	case *expr.IR_Uint64:
+		return int64(v.Value), true
+	}
+	return 0, false
+}
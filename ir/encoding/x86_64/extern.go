@@ -0,0 +1,42 @@
+package x86_64
+
+import (
+	"fmt"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// Externs are bound when the code is loaded, so there's no code to run.
+//
+//goland:noinspection GoSnakeCaseUsage
+func encode_IR_Extern(i *statements.IR_Extern, ctx *IR_Context) ([]lib.Instruction, error) {
+	return []lib.Instruction{}, nil
+}
+
+// Externs are numbered in the order that they are declared in, which is the
+// order of the host functions that they are bound to.
+//
+//goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
+func encode_IR_Extern_for_DataSection(i *statements.IR_Extern, ctx *IR_Context) error {
+	if _, ok := ctx.Externs[i.Name]; ok {
+		return fmt.Errorf("Extern %s is declared more than once", i.Name)
+	}
+	if _, ok := ctx.Globals[i.Name]; ok {
+		return fmt.Errorf("Extern %s is already declared as a global", i.Name)
+	}
+	for _, arg := range i.Signature.Args {
+		if !IsNumber(arg) && arg.Type() != T_Bool {
+			return fmt.Errorf("Unsupported argument type %s for extern %s", arg, i.Name)
+		}
+	}
+	if returnType := i.Signature.ReturnType; !IsNumber(returnType) && returnType.Type() != T_Bool && returnType != TVoid {
+		return fmt.Errorf("Unsupported return type %s for extern %s", returnType, i.Name)
+	}
+	ctx.Externs[i.Name] = &ExternFunction{
+		Signature: i.Signature,
+		Index:     len(ctx.Externs),
+	}
+	return nil
+}
@@ -23,30 +23,65 @@ func encode_IR_Function(i *expr.IR_Function, ctx *IR_Context, target lib.Operand
 func encode_IR_Function_for_DataSection(b *expr.IR_Function, ctx *IR_Context, segments *Segments) error {
 
 	// TODO: restore rbx, rbp, r12-r15
-	targets := []*encoding.Register{encoding.Rdi, encoding.Rsi, encoding.Rdx, encoding.R10, encoding.R8, encoding.R9}
-	returnTarget := encoding.Rax
-	registers := make([]bool, 16)
-	registers[returnTarget.Register] = true
+	args := b.Signature.RegisterArgs()
+	targets := ctx.ABI.GetRegistersForArgs(args)
+	if len(targets) != len(args) {
+		return fmt.Errorf("Too many arguments; only %d fit in registers", len(targets))
+	}
+	returnTarget := ctx.ABI.ReturnTypeToOperand(b.Signature.ReturnType)
+	allocator := NewX86_64_Allocator()
+	if !IsFloat(b.Signature.ReturnType) {
+		allocator.Registers[encoding.Rax.Register] = true
+		allocator.RegistersAllocated += 1
+	}
+	base := allocator.Copy().(*X86_64_Allocator)
 	variableMap := map[string]lib.Operand{}
 	variableTypes := map[string]Type{}
+	next := 0
 	for i, arg := range b.Signature.Args {
-		if arg.Type() == T_Float64 {
-			return fmt.Errorf("Float arguments not supported")
-		}
 		v := b.Signature.ArgNames[i]
-		registers[targets[i].Register] = true
-		variableMap[v] = targets[i]
+		target := targets[next]
+		next++
+		if IsFloat(arg) {
+			allocator.FloatRegisters[target.Register] = true
+			allocator.FloatRegistersAllocated += 1
+			variableMap[v] = target
+		} else {
+			allocator.Registers[target.Register] = true
+			allocator.RegistersAllocated += 1
+			variableMap[v] = target.ForOperandWidth(arg.Width())
+		}
 		variableTypes[v] = arg
+		if arg.Type() == T_Array {
+			length := targets[next]
+			next++
+			allocator.Registers[length.Register] = true
+			allocator.RegistersAllocated += 1
+			variableMap[LengthVariable(v)] = length
+			variableTypes[LengthVariable(v)] = TInt64
+		}
 	}
 
 	ctx_ := ctx.Copy()
+	ctx_.InstructionPointer = uint(segments.CodeStart() + len(segments.Segments[Executable].Data))
 	ctx_.PushReturnOperand(returnTarget)
 	ctx_.Commit = false
-	ctx_.Allocator.(*X86_64_Allocator).Registers = registers
-	ctx_.Allocator.(*X86_64_Allocator).RegistersAllocated = uint8(len(b.Signature.Args) + 1)
+	ctx_.Allocator = allocator
 	ctx_.VariableMap = variableMap
 	ctx_.VariableTypes = variableTypes
-	instr, err := encodeStatement(b.Body, ctx_)
+	allocator.usePlan(planAllocation([]IR{b.Body}, ctx_, base), ctx_)
+
+	// Every call takes fuel on entry, when enabled.
+	instr, err := consumeFuel(ctx_, b.Position())
+	if err != nil {
+		return err
+	}
+	ctx_.AddInstruction(instr...)
+	body, err := encodeStatement(b.Body, ctx_)
+	if err != nil {
+		return err
+	}
+	instr, err = ctx.Peephole(lib.Instructions(instr).Add(body))
 	if err != nil {
 		return err
 	}
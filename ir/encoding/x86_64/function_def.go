@@ -1,16 +1,24 @@
 package x86_64
 
 import (
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	. "github.com/bspaans/jit-compiler/ir/shared"
 	"github.com/bspaans/jit-compiler/ir/statements"
 	"github.com/bspaans/jit-compiler/lib"
 )
 
-// Allocates a new register and assigns it the value of the expression.
+// Allocates a new register, unless the function already has a location, and
+// assigns it the address of the function.
 func encode_IR_FunctionDef(i *statements.IR_FunctionDef, ctx *IR_Context) ([]lib.Instruction, error) {
-	reg := ctx.AllocateRegister(TUint64)
 	returnType := i.Expr.ReturnType(ctx)
-	ctx.VariableTypes[i.Name] = returnType
-	ctx.VariableMap[i.Name] = reg
+	reg, found := ctx.VariableMap[i.Name]
+	if !found {
+		reg = ctx.AllocateRegister(TUint64)
+		ctx.VariableTypes[i.Name] = returnType
+		ctx.VariableMap[i.Name] = reg
+	}
+	if _, inRegister := reg.(*encoding.Register); !inRegister {
+		return encodeSpillStore(i.Expr, TUint64, reg, ctx)
+	}
 	return encodeExpression(i.Expr, ctx, reg)
 }
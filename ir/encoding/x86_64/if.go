@@ -5,7 +5,6 @@ import (
 	"fmt"
 
 	"github.com/bspaans/jit-compiler/asm/x86_64"
-	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	. "github.com/bspaans/jit-compiler/ir/shared"
 	"github.com/bspaans/jit-compiler/ir/statements"
 	"github.com/bspaans/jit-compiler/lib"
@@ -15,20 +14,35 @@ func encode_IR_If(i *statements.IR_If, ctx *IR_Context) ([]lib.Instruction, erro
 	if i.Condition.ReturnType(ctx) != TBool {
 		return nil, errors.New("Unsupported if IR condition")
 	}
-	reg := ctx.AllocateRegister(TBool)
-	defer ctx.DeallocateRegister(reg)
-
 	// Get the lengths of the true and false branches
 	stmt1Len, err := IR_Length(i.Stmt1, ctx)
 	if err != nil {
 		return nil, err
 	}
+	if i.Stmt2 == nil {
+		// Without an else branch, the condition jumps over the first one.
+		result, err := conditionalJump(ctx, i.Condition, stmt1Len)
+		if err != nil {
+			return nil, fmt.Errorf("%s in %s", err.Error(), i.String())
+		}
+		s1, err := encodeStatement(i.Stmt1, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return append(result, s1...), nil
+	}
 	stmt2Len, err := IR_Length(i.Stmt2, ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := conditionalJump(ctx, i.Condition, stmt1Len)
+	jmp := relativeJump(x86_64.JMP, stmt2Len)
+	jmpLen, err := instructionsLength(jmp)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := conditionalJump(ctx, i.Condition, stmt1Len+jmpLen)
 	if err != nil {
 		return nil, fmt.Errorf("%s in %s", err.Error(), i.String())
 	}
@@ -38,7 +52,6 @@ func encode_IR_If(i *statements.IR_If, ctx *IR_Context) ([]lib.Instruction, erro
 		return nil, err
 	}
 	result = append(result, s1...)
-	jmp := x86_64.JMP(encoding.Uint8(stmt2Len))
 	ctx.AddInstruction(jmp)
 	result = append(result, jmp)
 
@@ -0,0 +1,40 @@
+package x86_64
+
+import (
+	"math"
+
+	"github.com/bspaans/jit-compiler/asm/x86_64"
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+type jumpOpcode func(lib.Operand) lib.Instruction
+
+// relativeJump returns a jump over offset bytes, counted from the end of the
+// jump instruction. The short rel8 form is used whenever the offset fits in
+// a signed byte.
+func relativeJump(jump jumpOpcode, offset int) lib.Instruction {
+	if offset >= math.MinInt8 && offset <= math.MaxInt8 {
+		return jump(encoding.Uint8(uint8(int8(offset))))
+	}
+	return jump(encoding.Uint32(uint32(int32(offset))))
+}
+
+// backwardJump returns a JMP from the current instruction pointer back to
+// address.
+func backwardJump(ctx *IR_Context, address uint) lib.Instruction {
+	distance := int(ctx.InstructionPointer) - int(address)
+	if distance+2 <= -math.MinInt8 {
+		return relativeJump(x86_64.JMP, -(distance + 2))
+	}
+	return x86_64.JMP(encoding.Uint32(uint32(int32(-(distance + 5)))))
+}
+
+func instructionsLength(instr ...lib.Instruction) (int, error) {
+	code, err := lib.Instructions(instr).Encode()
+	if err != nil {
+		return 0, err
+	}
+	return len(code), nil
+}
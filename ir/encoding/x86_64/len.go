@@ -0,0 +1,31 @@
+package x86_64
+
+import (
+	"fmt"
+
+	"github.com/bspaans/jit-compiler/asm/x86_64"
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// Array arguments keep their length in a register of their own; the length
+// of other arrays is part of their type.
+//
+//goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
+func encode_IR_Len(i *expr.IR_Len, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	if v, ok := i.Array.(*expr.IR_Variable); ok {
+		if reg, ok := ctx.VariableMap[LengthVariable(v.Value)]; ok {
+			result := []lib.Instruction{x86_64.MOV(reg, target)}
+			ctx.AddInstruction(result...)
+			return result, nil
+		}
+	}
+	array, ok := i.Array.ReturnType(ctx).(*TArray)
+	if !ok {
+		return nil, fmt.Errorf("Not an array: %s", i.Array)
+	}
+	result := []lib.Instruction{x86_64.MOV_immediate(uint64(array.Size), target)}
+	ctx.AddInstruction(result...)
+	return result, nil
+}
@@ -0,0 +1,476 @@
+package x86_64
+
+import (
+	"sort"
+
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/ssa"
+	"github.com/bspaans/jit-compiler/ir/statements"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+/*
+
+Linear scan register allocation
+
+Before a function body or a program is encoded, its statements are numbered
+in the order in which they are encoded, and every variable gets the interval
+of statements in which it's live: from the first statement that assigns it
+to the last one that reads it. Intervals that overlap a loop are extended to
+the whole loop, because the variable can be read again in the next
+iteration. The arguments of a function are live from position 0, which is
+the entry of the function.
+
+The intervals are then visited in order of their start, and every variable
+gets a register that isn't used by the other variables that are live at the
+same time:
+
+  * A variable that is assigned the value of a variable that isn't used after
+    the assignment takes over its register, which makes the move redundant.
+  * Variables that are live across a DIV or a multiplication stay out of %rax
+    and %rdx, and variables that are live across a call or a syscall stay out
+    of the registers that the arguments are passed in and that the kernel
+    clobbers, when there are other registers left. Otherwise the registers are
+    preserved by the code for these expressions, like before.
+  * scratchRegisters general purpose and scratchFloatRegisters xmm registers
+    are kept free at every statement, for the temporaries of the expressions.
+  * When there are no registers left, the variable whose interval ends last
+    is spilled to a slot in the stack frame of the function, which is set up
+    on entry and taken down again by every return.
+
+While the body is encoded, the allocator keeps track of the statement that's
+being encoded, and only the registers of the variables that are live there
+are in use.
+
+*/
+
+const (
+	scratchRegisters      = 4
+	scratchFloatRegisters = 4
+)
+
+// The expressions at a position that use fixed registers.
+const (
+	usesRaxRdx = 1 << iota
+	usesCall
+	usesSyscall
+)
+
+// liveInterval is the range of positions in which a variable is live, and
+// the location that it was allocated.
+type liveInterval struct {
+	variable   string
+	typ        Type
+	start, end int
+	float      bool
+	// fixed intervals are the arguments of a function, which are passed in
+	// operand.
+	fixed bool
+	// hint is the interval of the variable that this one is assigned from
+	// at its start.
+	hint     *liveInterval
+	register uint8
+	spilled  bool
+	slot     int
+	operand  lib.Operand
+}
+
+func (l *liveInterval) isLiveAt(position int) bool {
+	return l.start <= position && position <= l.end
+}
+
+// allocationPlan holds the locations of the variables of a function body or
+// program.
+type allocationPlan struct {
+	positions map[IR]int
+	intervals []*liveInterval
+	// starts and ends hold the intervals by the position at which they start
+	// and end.
+	starts [][]*liveInterval
+	ends   [][]*liveInterval
+	// base has the registers that are never given to variables.
+	base      *X86_64_Allocator
+	frameSize int
+	// entry is the first statement, which sets up the stack frame.
+	entry IR
+}
+
+// liveness numbers the statements and builds the live intervals.
+type liveness struct {
+	ctx         *IR_Context
+	positions   map[IR]int
+	intervals   map[string]*liveInterval
+	order       []*liveInterval
+	position    int
+	loops       [][2]int
+	constraints []int
+	failed      bool
+}
+
+// planAllocation allocates the variables of stmts. The variables in
+// ctx.VariableMap are the arguments, which have to be in registers. It
+// returns nil if stmts can't be planned, in which case the variables are
+// allocated as they get assigned.
+func planAllocation(stmts []IR, ctx *IR_Context, base *X86_64_Allocator) *allocationPlan {
+	l := &liveness{
+		ctx:         ctx.Copy(),
+		positions:   map[IR]int{},
+		intervals:   map[string]*liveInterval{},
+		constraints: []int{0},
+	}
+	variables := make([]string, 0, len(ctx.VariableMap))
+	for variable := range ctx.VariableMap {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+	for _, variable := range variables {
+		reg, ok := ctx.VariableMap[variable].(*encoding.Register)
+		if !ok {
+			return nil
+		}
+		interval := &liveInterval{
+			variable: variable,
+			typ:      ctx.VariableTypes[variable],
+			float:    reg.Size == lib.OWORD,
+			fixed:    true,
+			register: reg.Register,
+			operand:  reg,
+		}
+		l.intervals[variable] = interval
+		l.order = append(l.order, interval)
+	}
+	for _, stmt := range stmts {
+		l.statement(stmt)
+	}
+	if l.failed {
+		return nil
+	}
+	l.extendOverLoops()
+
+	plan := &allocationPlan{
+		positions: l.positions,
+		intervals: l.order,
+		starts:    make([][]*liveInterval, l.position+1),
+		ends:      make([][]*liveInterval, l.position+1),
+		base:      base,
+	}
+	plan.scan(l, ctx)
+	for _, interval := range plan.intervals {
+		plan.starts[interval.start] = append(plan.starts[interval.start], interval)
+		plan.ends[interval.end] = append(plan.ends[interval.end], interval)
+	}
+	if len(stmts) > 0 && plan.frameSize > 0 {
+		plan.entry = stmts[0]
+	}
+	return plan
+}
+
+// next gives stmt the next position.
+func (l *liveness) next(stmt IR) int {
+	if _, ok := l.positions[stmt]; ok {
+		// The same statement can't be at two positions.
+		l.failed = true
+	}
+	l.position++
+	l.positions[stmt] = l.position
+	l.constraints = append(l.constraints, 0)
+	return l.position
+}
+
+func (l *liveness) statement(stmt IR) {
+	switch v := stmt.(type) {
+	case *statements.IR_AndThen:
+		l.statement(v.Stmt1)
+		l.statement(v.Stmt2)
+	case *statements.IR_ArrayAssignment:
+		p := l.next(stmt)
+		l.use(v.Variable, p)
+		l.expression(v.Index, p)
+		l.expression(v.Expr, p)
+	case *statements.IR_Assignment:
+		p := l.next(stmt)
+		l.expression(v.Expr, p)
+		l.define(v.Variable, v.Expr, p)
+	case *statements.IR_CallStatement:
+		l.expression(v.Call, l.next(stmt))
+	case *statements.IR_Extern, *statements.IR_Var:
+		l.next(stmt)
+	case *statements.IR_FunctionDef:
+		l.define(v.Name, v.Expr, l.next(stmt))
+	case *statements.IR_If:
+		l.expression(v.Condition, l.next(stmt))
+		l.statement(v.Stmt1)
+		if v.Stmt2 != nil {
+			l.statement(v.Stmt2)
+		}
+	case *statements.IR_Return:
+		l.expression(v.Expr, l.next(stmt))
+	case *statements.IR_While:
+		p := l.next(stmt)
+		l.expression(v.Condition, p)
+		l.statement(v.Stmt)
+		l.loops = append(l.loops, [2]int{p, l.position})
+	default:
+		l.failed = true
+	}
+}
+
+func (l *liveness) expression(e IRExpression, p int) {
+	switch v := e.(type) {
+	case *expr.IR_Variable:
+		l.use(v.Value, p)
+	case *expr.IR_Call:
+		l.use(v.Function, p)
+		l.constraints[p] |= usesCall
+	case *expr.IR_Syscall:
+		l.constraints[p] |= usesSyscall
+	case *expr.IR_Div, *expr.IR_Mul, *expr.IR_MulHigh:
+		l.constraints[p] |= usesRaxRdx
+	}
+	for _, op := range ssa.Operands(e) {
+		l.expression(op, p)
+	}
+}
+
+// use extends the interval of a variable that's read at p. Array arguments
+// are passed with their length, which is read with them.
+func (l *liveness) use(variable string, p int) {
+	for _, v := range []string{variable, LengthVariable(variable)} {
+		if interval, ok := l.intervals[v]; ok && interval.end < p {
+			interval.end = p
+		}
+	}
+}
+
+// define starts the interval of a variable that's assigned at p, unless
+// it's a global.
+func (l *liveness) define(variable string, value IRExpression, p int) {
+	typ := value.ReturnType(l.ctx)
+	if typ == nil {
+		l.failed = true
+		return
+	}
+	if interval, ok := l.intervals[variable]; ok {
+		if (typ == TFloat64) != interval.float {
+			l.failed = true
+		}
+		l.use(variable, p)
+		return
+	}
+	if _, ok := l.ctx.Globals[variable]; ok {
+		return
+	}
+	interval := &liveInterval{
+		variable: variable,
+		typ:      typ,
+		start:    p,
+		end:      p,
+		float:    typ == TFloat64,
+	}
+	if v, ok := value.(*expr.IR_Variable); ok {
+		interval.hint = l.intervals[v.Value]
+	}
+	l.intervals[variable] = interval
+	l.order = append(l.order, interval)
+	l.ctx.VariableTypes[variable] = typ
+}
+
+// extendOverLoops extends the intervals that overlap a loop to the whole
+// loop. Extending an interval over an inner loop can make it overlap an
+// outer one.
+func (l *liveness) extendOverLoops() {
+	for changed := true; changed; {
+		changed = false
+		for _, loop := range l.loops {
+			for _, interval := range l.order {
+				if interval.start > loop[1] || interval.end < loop[0] {
+					continue
+				}
+				if interval.start > loop[0] {
+					// The variable is no longer defined at the start of
+					// its interval, so the move can't be coalesced.
+					interval.start, interval.hint, changed = loop[0], nil, true
+				}
+				if interval.end < loop[1] {
+					interval.end, changed = loop[1], true
+				}
+			}
+		}
+	}
+}
+
+// scan allocates the intervals to registers and stack slots.
+func (plan *allocationPlan) scan(l *liveness, ctx *IR_Context) {
+	sort.SliceStable(l.order, func(i, j int) bool {
+		if l.order[i].start != l.order[j].start {
+			return l.order[i].start < l.order[j].start
+		}
+		return l.order[i].fixed && !l.order[j].fixed
+	})
+
+	// Prefix sums of the constraints, to find out which an interval spans.
+	sums := make([][3]int, len(l.constraints)+1)
+	for p, c := range l.constraints {
+		sums[p+1] = sums[p]
+		for k := 0; k < 3; k++ {
+			if c&(1<<k) != 0 {
+				sums[p+1][k]++
+			}
+		}
+	}
+	fixed := fixedRegisters(ctx)
+	avoided := func(interval *liveInterval) map[uint8]bool {
+		result := map[uint8]bool{}
+		for k, registers := range fixed {
+			if sums[interval.end+1][k]-sums[interval.start][k] == 0 {
+				continue
+			}
+			for _, reg := range registers {
+				if (reg.Size == lib.OWORD) == interval.float {
+					result[reg.Register] = true
+				}
+			}
+		}
+		return result
+	}
+
+	var pools [2][]uint8
+	for j := 0; j < 16; j++ {
+		if !plan.base.Registers[j] {
+			pools[0] = append(pools[0], uint8(j))
+		}
+		if !plan.base.FloatRegisters[j] {
+			pools[1] = append(pools[1], uint8(j))
+		}
+	}
+	capacity := [2]int{len(pools[0]) - scratchRegisters, len(pools[1]) - scratchFloatRegisters}
+
+	var active [2][]*liveInterval
+	var spilled []*liveInterval
+	remove := func(class int, interval *liveInterval) {
+		for j, a := range active[class] {
+			if a == interval {
+				active[class] = append(active[class][:j], active[class][j+1:]...)
+				return
+			}
+		}
+	}
+	for _, interval := range l.order {
+		class := 0
+		if interval.float {
+			class = 1
+		}
+		var expired []*liveInterval
+		for _, a := range active[class] {
+			if a.end < interval.start {
+				expired = append(expired, a)
+			}
+		}
+		for _, a := range expired {
+			remove(class, a)
+		}
+		if interval.fixed {
+			active[class] = append(active[class], interval)
+			continue
+		}
+		// Coalesce the move that the variable is defined with.
+		if h := interval.hint; h != nil && !h.spilled && h.float == interval.float && h.end == interval.start {
+			remove(class, h)
+			interval.register = h.register
+			active[class] = append(active[class], interval)
+			continue
+		}
+		if len(active[class]) >= capacity[class] {
+			var furthest *liveInterval
+			for _, a := range active[class] {
+				if !a.fixed && (furthest == nil || a.end > furthest.end) {
+					furthest = a
+				}
+			}
+			if furthest == nil || furthest.end <= interval.end {
+				interval.spilled = true
+				spilled = append(spilled, interval)
+				continue
+			}
+			remove(class, furthest)
+			furthest.spilled = true
+			spilled = append(spilled, furthest)
+			interval.register = furthest.register
+			active[class] = append(active[class], interval)
+			continue
+		}
+		used := map[uint8]bool{}
+		for _, a := range active[class] {
+			used[a.register] = true
+		}
+		avoid := avoided(interval)
+		found := false
+		for _, preferred := range []bool{true, false} {
+			for _, reg := range pools[class] {
+				if !used[reg] && (!preferred || !avoid[reg]) {
+					interval.register, found = reg, true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			interval.spilled = true
+			spilled = append(spilled, interval)
+			continue
+		}
+		active[class] = append(active[class], interval)
+	}
+
+	// Spilled intervals share the slots of the ones that ended before them.
+	sort.SliceStable(spilled, func(i, j int) bool {
+		return spilled[i].start < spilled[j].start
+	})
+	var slotEnds []int
+	for _, interval := range spilled {
+		interval.slot = -1
+		for slot, end := range slotEnds {
+			if end < interval.start {
+				interval.slot = slot
+				break
+			}
+		}
+		if interval.slot == -1 {
+			interval.slot = len(slotEnds)
+			slotEnds = append(slotEnds, 0)
+		}
+		slotEnds[interval.slot] = interval.end
+	}
+	plan.frameSize = 8 * len(slotEnds)
+
+	for _, interval := range plan.intervals {
+		switch {
+		case interval.fixed:
+		case interval.spilled:
+			interval.operand = &encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: int32(8 * interval.slot)}
+		case interval.float:
+			interval.operand = encoding.GetFloatingPointRegisterByIndex(interval.register)
+		default:
+			interval.operand = encoding.Get64BitRegisterByIndex(interval.register).ForOperandWidth(interval.typ.Width())
+		}
+	}
+}
+
+// fixedRegisters returns the registers that are used by the expressions
+// that set usesRaxRdx, usesCall and usesSyscall, in that order.
+func fixedRegisters(ctx *IR_Context) [3][]*encoding.Register {
+	args := make([]Type, 0, 16)
+	for j := 0; j < 8; j++ {
+		args = append(args, TUint64, TFloat64)
+	}
+	syscall := append([]*encoding.Register{encoding.Rax, encoding.Rcx, encoding.R11}, syscallTargets...)
+	return [3][]*encoding.Register{
+		{encoding.Rax, encoding.Rdx},
+		ctx.ABI.GetRegistersForArgs(args),
+		syscall,
+	}
+}
@@ -20,102 +20,152 @@ func encode_IR_Mul(i *expr.IR_Mul, ctx *IR_Context, target lib.Operand) ([]lib.I
 		return encode_Operator(i.Op1, i.Op2, x86_64.IMUL2, i.String(), ctx, target)
 	}
 	if IsInteger(returnType1) {
+		checked := isCheckedArithmetic(ctx, i.Checked, returnType1)
+		if scale, ok := leaScale(i.Op2, target); ok && !checked {
+			return encode_IR_Mul_LEA(i.Op1, scale, ctx, target)
+		}
+		return encodeIntegerMultiplication(i.Op1, i.Op2, checked, false, i, ctx, target)
+	}
+	return nil, fmt.Errorf("Unsupported types (%s, %s) in * IR operation: %s", returnType1, returnType2, i.String())
+}
 
-		allocator := ctx.Allocator.(*X86_64_Allocator)
-		raxInUse := allocator.Registers[0]
-
-		shouldPreserveRdx := (returnType1.Width() != lib.BYTE) && allocator.Registers[2]
-		shouldPreserveRax := target.(*encoding.Register).Register != 0 && raxInUse
-		var tmpRdx, tmpRax lib.Operand
-
-		result := lib.Instructions{}
-		ctxCopy := ctx
-
-		// Preserve the %rdx register
-		if shouldPreserveRdx {
-			tmpRdx = ctx.AllocateRegister(TUint64)
-			defer ctx.DeallocateRegister(tmpRdx)
-			preserveRdx := x86_64.MOV(encoding.Rdx, tmpRdx)
-			result = append(result, preserveRdx)
-			ctx.AddInstruction(result...)
-			// Replace variables in the variablemap that point to rdx with the new register
-			ctxCopy = ctxCopy.Copy()
-			for v, vTarget := range ctxCopy.VariableMap {
-				if r, ok := vTarget.(*encoding.Register); ok && r.Register == 2 {
-					ctxCopy.VariableMap[v] = tmpRdx
-				}
-			}
+// leaScale returns the scale for multiplying by the literal op with LEA,
+// which adds a register to itself scaled by 2, 4 or 8, so it multiplies by
+// 3, 5 or 9. Byte registers can't be used as addresses.
+func leaScale(op IRExpression, target lib.Operand) (encoding.Scale, bool) {
+	value, ok := integerLiteral(op)
+	scales := map[int64]encoding.Scale{3: encoding.Scale2, 5: encoding.Scale4, 9: encoding.Scale8}
+	scale, isScale := scales[value]
+	return scale, ok && isScale && target.Width() != lib.BYTE
+}
 
-		}
+//goland:noinspection GoSnakeCaseUsage
+func encode_IR_Mul_LEA(op IRExpression, scale encoding.Scale, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	result, err := encodeExpression(op, ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	reg := target.(*encoding.Register).Get64BitRegister()
+	lea := x86_64.LEA(&encoding.SIBRegister{Register: reg, Index: reg, Scale: scale}, reg)
+	ctx.AddInstruction(lea)
+	return append(result, lea), nil
+}
 
-		// Preserve the %rax register
-		if shouldPreserveRax {
-			ctxCopy = ctxCopy.Copy()
-			allocator = ctxCopy.Allocator.(*X86_64_Allocator)
-			// Make sure we don't allocate %rdx
-			if !allocator.Registers[2] && (returnType1.Width() != lib.BYTE) {
-				allocator.Registers[2] = true
-			}
-			tmpRax = ctxCopy.AllocateRegister(TUint64)
-			defer ctxCopy.DeallocateRegister(tmpRax)
-			preserveRax := x86_64.MOV(encoding.Rax, tmpRax)
-			result = append(result, preserveRax)
-			ctx.AddInstruction(result...)
-			// Replace variables in the variablemap that point to rax with the new register
-			for v, vTarget := range ctxCopy.VariableMap {
-				if r, ok := vTarget.(*encoding.Register); ok && r.Register == 0 {
-					ctxCopy.VariableMap[v] = tmpRax
-				}
+// encodeIntegerMultiplication multiplies op1 and op2 with MUL or IMUL, which
+// put the lower half of the product in %rax and the upper half in %rdx, and
+// moves the upper half into target if high is set, or the lower half
+// otherwise. e is the expression that is encoded.
+func encodeIntegerMultiplication(op1, op2 IRExpression, checked, high bool, e IRExpression, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	returnType1, returnType2 := op1.ReturnType(ctx), op2.ReturnType(ctx)
+	allocator := ctx.Allocator.(*X86_64_Allocator)
+	raxInUse := allocator.Registers[0]
+
+	shouldPreserveRdx := (returnType1.Width() != lib.BYTE) && allocator.Registers[2]
+	shouldPreserveRax := target.(*encoding.Register).Register != 0 && raxInUse
+	var tmpRdx, tmpRax lib.Operand
+
+	result := lib.Instructions{}
+	ctxCopy := ctx
+
+	// Preserve the %rdx register
+	if shouldPreserveRdx {
+		tmpRdx = ctx.AllocateRegister(TUint64)
+		defer ctx.DeallocateRegister(tmpRdx)
+		preserveRdx := x86_64.MOV(encoding.Rdx, tmpRdx)
+		result = append(result, preserveRdx)
+		ctx.AddInstruction(preserveRdx)
+		// Replace variables in the variablemap that point to rdx with the new register
+		ctxCopy = ctxCopy.Copy()
+		for v, vTarget := range ctxCopy.VariableMap {
+			if r, ok := vTarget.(*encoding.Register); ok && r.Register == 2 {
+				ctxCopy.VariableMap[v] = tmpRdx.(*encoding.Register).ForOperandWidth(r.Width())
 			}
 		}
 
-		rax := encoding.Rax.ForOperandWidth(returnType1.Width())
+	}
 
-		op1, err := encodeExpression(i.Op1, ctxCopy, rax)
-		if err != nil {
-			return nil, err
+	// Preserve the %rax register
+	if shouldPreserveRax {
+		ctxCopy = ctxCopy.Copy()
+		allocator = ctxCopy.Allocator.(*X86_64_Allocator)
+		// Make sure we don't allocate %rdx
+		if !allocator.Registers[2] && (returnType1.Width() != lib.BYTE) {
+			allocator.Registers[2] = true
 		}
+		tmpRax = ctxCopy.AllocateRegister(TUint64)
+		defer ctxCopy.DeallocateRegister(tmpRax)
+		preserveRax := x86_64.MOV(encoding.Rax, tmpRax)
+		result = append(result, preserveRax)
+		ctx.AddInstruction(preserveRax)
+		// Replace variables in the variablemap that point to rax with the new register
+		for v, vTarget := range ctxCopy.VariableMap {
+			if r, ok := vTarget.(*encoding.Register); ok && r.Register == 0 {
+				ctxCopy.VariableMap[v] = tmpRax.(*encoding.Register).ForOperandWidth(r.Width())
+			}
+		}
+	}
 
-		result = result.Add(op1)
+	ctxCopy = reserveRaxRdx(ctxCopy, returnType1.Width())
+	rax := encoding.Rax.ForOperandWidth(returnType1.Width())
 
-		var reg lib.Operand
-		if i.Op2.Type() == Variable {
-			variable := i.Op2.(*expr.IR_Variable).Value
-			reg = ctxCopy.VariableMap[variable]
-		} else {
-			reg = ctxCopy.AllocateRegister(returnType2)
-			defer ctxCopy.DeallocateRegister(reg.(*encoding.Register))
+	// The operands are encoded in ctxCopy, so keep both instruction
+	// pointers in sync.
+	ctxCopy.InstructionPointer = ctx.InstructionPointer
 
-			expr, err := encodeExpression(i.Op2, ctxCopy, reg)
-			if err != nil {
-				return nil, err
-			}
-			result = lib.Instructions(result).Add(expr)
-		}
-		instr := x86_64.MUL(reg)
-		if IsSignedInteger(returnType1) {
-			instr = x86_64.IMUL1(reg)
-		}
-		ctx.AddInstruction(instr)
-		result = append(result, instr)
-
-		mov := x86_64.MOV(rax, target)
-		ctx.AddInstruction(mov)
-		result = append(result, mov)
-
-		// Restore %rax
-		if shouldPreserveRax {
-			restore := x86_64.MOV(tmpRax, encoding.Rax)
-			ctx.AddInstruction(restore)
-			result = append(result, restore)
+	instrs, err := encodeExpression(op1, ctxCopy, rax)
+	if err != nil {
+		return nil, err
+	}
+
+	result = result.Add(instrs)
+
+	var reg lib.Operand
+	if isRegisterVariable(op2, ctxCopy) {
+		variable := op2.(*expr.IR_Variable).Value
+		reg = ctxCopy.VariableMap[variable]
+	} else {
+		reg = ctxCopy.AllocateRegister(returnType2)
+		defer ctxCopy.DeallocateRegister(reg.(*encoding.Register))
+
+		expr, err := encodeExpression(op2, ctxCopy, reg)
+		if err != nil {
+			return nil, err
 		}
-		// Restore %rdx
-		if shouldPreserveRdx {
-			restore := x86_64.MOV(tmpRdx, encoding.Rdx)
-			ctx.AddInstruction(restore)
-			result = append(result, restore)
+		result = lib.Instructions(result).Add(expr)
+	}
+	ctx.InstructionPointer = ctxCopy.InstructionPointer
+	instr := x86_64.MUL(reg)
+	if IsSignedInteger(returnType1) {
+		instr = x86_64.IMUL1(reg)
+	}
+	ctx.AddInstruction(instr)
+	result = append(result, instr)
+	if checked {
+		check, err := trapUnless(ctx, x86_64.JNO, lib.TrapIntegerOverflow, PositionOf(e))
+		if err != nil {
+			return nil, err
 		}
-		return result, nil
+		result = result.Add(check)
 	}
-	return nil, fmt.Errorf("Unsupported types (%s, %s) in * IR operation: %s", returnType1, returnType2, i.String())
+
+	var mov lib.Instruction = x86_64.MOV(rax, target)
+	if high {
+		mov = x86_64.MOV(encoding.Rdx.ForOperandWidth(returnType1.Width()), target)
+	}
+	ctx.AddInstruction(mov)
+	result = append(result, mov)
+
+	// Restore %rax
+	if shouldPreserveRax {
+		restore := x86_64.MOV(tmpRax, encoding.Rax)
+		ctx.AddInstruction(restore)
+		result = append(result, restore)
+	}
+	// Restore %rdx, unless it holds the result
+	if shouldPreserveRdx && target.(*encoding.Register).Register != 2 {
+		restore := x86_64.MOV(tmpRdx, encoding.Rdx)
+		ctx.AddInstruction(restore)
+		result = append(result, restore)
+	}
+	return result, nil
 }
@@ -0,0 +1,21 @@
+package x86_64
+
+import (
+	"fmt"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// encode_IR_MulHigh takes the upper half of the product from %rdx. Bytes
+// aren't supported, because MUL puts their product in %ax.
+//
+//goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
+func encode_IR_MulHigh(i *expr.IR_MulHigh, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	returnType1, returnType2 := i.Op1.ReturnType(ctx), i.Op2.ReturnType(ctx)
+	if returnType1 != returnType2 || !IsInteger(returnType1) || returnType1.Width() == lib.BYTE {
+		return nil, fmt.Errorf("Unsupported types (%s, %s) in IR operation: %s", returnType1, returnType2, i.String())
+	}
+	return encodeIntegerMultiplication(i.Op1, i.Op2, false, true, i, ctx, target)
+}
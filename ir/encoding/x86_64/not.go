@@ -20,8 +20,16 @@ func encode_IR_Not(i *expr.IR_Not, ctx *IR_Context, target lib.Operand, includeS
 
 	switch c := i.Op1.(type) {
 	case *expr.IR_Variable:
-		variable := c.Value
-		reg1 = ctx.VariableMap[variable]
+		if isRegisterVariable(c, ctx) {
+			reg1 = ctx.VariableMap[c.Value]
+		} else {
+			load, err := encode_IR_Variable(c, ctx, target)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, load...)
+			reg1 = target
+		}
 		if !includeSETE {
 			cmp := x86_64.CMP_immediate(1, reg1)
 			result = append(result, cmp)
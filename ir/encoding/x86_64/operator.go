@@ -3,6 +3,7 @@ package x86_64
 import (
 	"fmt"
 
+	"github.com/bspaans/jit-compiler/asm/x86_64"
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	"github.com/bspaans/jit-compiler/ir/expr"
 	. "github.com/bspaans/jit-compiler/ir/shared"
@@ -15,16 +16,28 @@ func encode_Operator(op1, op2 IRExpression, operator op, repr string, ctx *IR_Co
 	ctx.AddInstruction("operator " + encoding.Comment(repr))
 	returnType1, returnType2 := op1.ReturnType(ctx), op2.ReturnType(ctx)
 	if returnType1 == returnType2 && IsNumber(returnType1) {
-		result, err := encodeExpression(op1, ctx, target)
+		result := lib.Instructions{}
+		var reg lib.Operand
+		if isRegisterVariable(op2, ctx) {
+			variable := op2.(*expr.IR_Variable).Value
+			reg = ctx.VariableMap[variable]
+			if sameRegister(reg, target) && !isVariable(op1, variable) {
+				// op1 is encoded into target, which would overwrite op2.
+				tmp := ctx.AllocateRegister(returnType2)
+				defer ctx.DeallocateRegister(tmp.(*encoding.Register))
+				mov := x86_64.MOV(reg, tmp)
+				ctx.AddInstruction(mov)
+				result = append(result, mov)
+				reg = tmp
+			}
+		}
+		instrs, err := encodeExpression(op1, ctx, target)
 		if err != nil {
 			return nil, err
 		}
+		result = result.Add(instrs)
 
-		var reg lib.Operand
-		if op2.Type() == Variable {
-			variable := op2.(*expr.IR_Variable).Value
-			reg = ctx.VariableMap[variable]
-		} else {
+		if reg == nil {
 			reg = ctx.AllocateRegister(returnType2)
 			defer ctx.DeallocateRegister(reg.(*encoding.Register))
 
@@ -32,7 +45,7 @@ func encode_Operator(op1, op2 IRExpression, operator op, repr string, ctx *IR_Co
 			if err != nil {
 				return nil, err
 			}
-			result = lib.Instructions(result).Add(expr)
+			result = result.Add(expr)
 		}
 		instr := operator(reg, target)
 		ctx.AddInstruction(instr)
@@ -41,3 +54,17 @@ func encode_Operator(op1, op2 IRExpression, operator op, repr string, ctx *IR_Co
 	}
 	return nil, fmt.Errorf("Unsupported types (%s, %s) in IR operation: %s", returnType1, returnType2, repr)
 }
+
+// sameRegister returns whether a and b are the same register, of any width.
+// The xmm registers are the only ones that are 128 bits wide.
+func sameRegister(a, b lib.Operand) bool {
+	r1, ok1 := a.(*encoding.Register)
+	r2, ok2 := b.(*encoding.Register)
+	return ok1 && ok2 && r1.Register == r2.Register && (r1.Size == lib.OWORD) == (r2.Size == lib.OWORD)
+}
+
+// isVariable returns whether e is the variable name.
+func isVariable(e IRExpression, name string) bool {
+	v, ok := e.(*expr.IR_Variable)
+	return ok && v.Value == name
+}
@@ -16,7 +16,7 @@ func encode_IR_Return(i *statements.IR_Return, ctx *IR_Context) ([]lib.Instructi
 	var result []lib.Instruction
 	var reg lib.Operand
 	var ok bool
-	if i.Expr.Type() == Variable {
+	if isRegisterVariable(i.Expr, ctx) {
 		reg, ok = ctx.VariableMap[i.Expr.(*expr.IR_Variable).Value]
 		if !ok {
 			return nil, fmt.Errorf("Unknown variable '%s' in return expression: %s", i.Expr.(*expr.IR_Variable).Value, i.String())
@@ -30,11 +30,27 @@ func encode_IR_Return(i *statements.IR_Return, ctx *IR_Context) ([]lib.Instructi
 		}
 		result = result_
 	}
+	target := ctx.PeekReturn()
+	if target.Width() == lib.OWORD {
+		// floats are returned in xmm0 by functions
+		if reg.Width() != lib.OWORD {
+			return nil, fmt.Errorf("Expecting a float64 in return expression: %s", i.String())
+		}
+		instr := append(takeDownFrame(ctx), x86_64.MOV(reg, target), x86_64.RETURN())
+		result = append(result, instr...)
+		ctx.AddInstruction(instr...)
+		return result, nil
+	}
 	if reg.Width() != lib.QUADWORD {
 		cast := ctx.AllocateRegister(TUint64)
 		defer ctx.DeallocateRegister(cast)
 
-		if reg.Width() == lib.BYTE || reg.Width() == lib.WORD {
+		if reg.Width() == lib.OWORD {
+			// floats are returned as their IEEE 754 bit pattern
+			movq := x86_64.MOVQ(reg, cast)
+			result = append(result, movq)
+			ctx.AddInstruction(movq)
+		} else if reg.Width() == lib.BYTE || reg.Width() == lib.WORD {
 			movzx := x86_64.MOVZX(reg, cast)
 			// TODO? use movsx for signed integers?
 			//if shared.IsSignedInteger(i.Expr.ReturnType(ctx)) {
@@ -52,7 +68,6 @@ func encode_IR_Return(i *statements.IR_Return, ctx *IR_Context) ([]lib.Instructi
 		}
 		reg = cast
 	}
-	target := ctx.PeekReturn()
 
 	if r, ok := ctx.LastReturn.(*statements.IR_Return); ok && r == i {
 		if t, ok := target.(*encoding.DisplacedRegister); ok && t.Name == "rsp" {
@@ -60,12 +75,19 @@ func encode_IR_Return(i *statements.IR_Return, ctx *IR_Context) ([]lib.Instructi
 		}
 	}
 
-	instr := []lib.Instruction{
-		x86_64.MOV(reg.(*encoding.Register).Get64BitRegister(), target),
-		x86_64.RETURN(),
-	}
+	instr := append(takeDownFrame(ctx), x86_64.MOV(reg.(*encoding.Register).Get64BitRegister(), target), x86_64.RETURN())
 
 	result = append(result, instr...)
 	ctx.AddInstruction(instr...)
 	return result, nil
 }
+
+// takeDownFrame returns the instruction that frees the stack slots of the
+// spilled variables, if there are any. It doesn't add it to ctx.
+func takeDownFrame(ctx *IR_Context) []lib.Instruction {
+	allocator, ok := ctx.Allocator.(*X86_64_Allocator)
+	if !ok || allocator.plan == nil || allocator.plan.frameSize == 0 {
+		return nil
+	}
+	return []lib.Instruction{x86_64.ADD(encoding.Uint32(allocator.plan.frameSize), encoding.Rsp)}
+}
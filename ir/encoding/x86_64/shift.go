@@ -0,0 +1,42 @@
+package x86_64
+
+import (
+	"fmt"
+
+	"github.com/bspaans/jit-compiler/asm/x86_64"
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+//goland:noinspection GoSnakeCaseUsage
+func encode_IR_ShiftLeft(i *expr.IR_ShiftLeft, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	return encodeShift(i.Op1, i.Shift, x86_64.SHL, i.String(), ctx, target)
+}
+
+// encode_IR_ShiftRight shifts signed integers with SAR, which shifts in the
+// sign bit, and unsigned integers with SHR.
+//
+//goland:noinspection GoSnakeCaseUsage
+func encode_IR_ShiftRight(i *expr.IR_ShiftRight, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	if IsSignedInteger(i.Op1.ReturnType(ctx)) {
+		return encodeShift(i.Op1, i.Shift, x86_64.SAR, i.String(), ctx, target)
+	}
+	return encodeShift(i.Op1, i.Shift, x86_64.SHR, i.String(), ctx, target)
+}
+
+//goland:noinspection GoErrorStringFormat
+func encodeShift(op1 IRExpression, shift uint8, operator op, repr string, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	ctx.AddInstruction("operator " + encoding.Comment(repr))
+	if !IsInteger(op1.ReturnType(ctx)) {
+		return nil, fmt.Errorf("Unsupported type %s in IR operation: %s", op1.ReturnType(ctx), repr)
+	}
+	result, err := encodeExpression(op1, ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	instr := operator(encoding.Uint8(shift), target)
+	ctx.AddInstruction(instr)
+	return append(result, instr), nil
+}
@@ -8,5 +8,13 @@ import (
 )
 
 func encode_IR_Sub(i *expr.IR_Sub, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
-	return encode_Operator(i.Op1, i.Op2, x86_64.SUB, i.String(), ctx, target)
+	result, err := encode_Operator(i.Op1, i.Op2, x86_64.SUB, i.String(), ctx, target)
+	if err != nil || !isCheckedArithmetic(ctx, i.Checked, i.ReturnType(ctx)) {
+		return result, err
+	}
+	check, err := overflowTrap(ctx, i.ReturnType(ctx), i.Position())
+	if err != nil {
+		return nil, err
+	}
+	return append(result, check...), nil
 }
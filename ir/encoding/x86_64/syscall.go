@@ -8,16 +8,31 @@ import (
 	"github.com/bspaans/jit-compiler/lib"
 )
 
+// clobberedBySyscall reports the registers that the kernel overwrites: rax
+// holds the result, and rcx and r11 the return address and flags.
+func clobberedBySyscall(reg *encoding.Register) bool {
+	return reg.Register == encoding.Rax.Register || reg.Register == encoding.Rcx.Register || reg.Register == encoding.R11.Register
+}
+
+//goland:noinspection GoSnakeCaseUsage
 func encode_IR_Syscall(i *expr.IR_Syscall, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
 
-	result, _, clobbered, err := ABI_Call_Setup(ctx, i.Args, TUint64)
+	result, mapping, clobbered, err := ABI_Call_Setup(ctx, i.Args, getRegistersForSyscallArgs, clobberedBySyscall)
 	if err != nil {
 		return nil, err
 	}
-	instr, err := encodeExpression(i.Syscall, ctx, encoding.Rax)
+	// The variables on the stack moved while the arguments were set up.
+	ctx_ := ctx.Copy()
+	for variable, location := range ctx_.VariableMap {
+		if newLocation, found := mapping[location]; found {
+			ctx_.VariableMap[variable] = newLocation
+		}
+	}
+	instr, err := encodeExpression(i.Syscall, ctx_, encoding.Rax)
 	if err != nil {
 		return nil, err
 	}
+	ctx.AddInstruction(instr...)
 	result = append(result, instr...)
 	tmpTarget := ctx.AllocateRegister(TUint64)
 	defer ctx.DeallocateRegister(tmpTarget)
@@ -0,0 +1,87 @@
+package x86_64
+
+import (
+	"github.com/bspaans/jit-compiler/asm/x86_64"
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// callEngineRegister holds the address of the lib.callEngine of the running
+// code. The allocators never hand it out.
+var callEngineRegister = encoding.R13
+
+func callEngineField(offset uint8) *encoding.DisplacedRegister {
+	return &encoding.DisplacedRegister{Register: callEngineRegister, Displacement: int32(offset)}
+}
+
+// trap returns the code that stores code and position in the callEngine and
+// jumps to the shared trap handler, which returns to the Go caller.
+func trap(code lib.TrapCode, position Position) []lib.Instruction {
+	return []lib.Instruction{
+		x86_64.MOV(encoding.Uint32(code), callEngineField(lib.CallEngineTrapCodeOffset)),
+		x86_64.MOV(encoding.Uint32(lib.PackTrapPosition(position.Line, position.Column)), callEngineField(lib.CallEngineTrapPositionOffset)),
+		x86_64.JMP(callEngineField(lib.CallEngineTrapHandlerOffset)),
+	}
+}
+
+// trapUnless traps with code unless the skip jump is taken.
+func trapUnless(ctx *IR_Context, skip jumpOpcode, code lib.TrapCode, position Position) ([]lib.Instruction, error) {
+	t := trap(code, position)
+	trapLen, err := instructionsLength(t...)
+	if err != nil {
+		return nil, err
+	}
+	result := append([]lib.Instruction{relativeJump(skip, trapLen)}, t...)
+	ctx.AddInstruction(result...)
+	return result, nil
+}
+
+// overflowTrap traps when the preceding add, sub or mul of typ overflowed,
+// which is signalled by the overflow flag for signed integers and the carry
+// flag for unsigned integers. Single operand multiplications set both.
+func overflowTrap(ctx *IR_Context, typ Type, position Position) ([]lib.Instruction, error) {
+	if IsSignedInteger(typ) {
+		return trapUnless(ctx, x86_64.JNO, lib.TrapIntegerOverflow, position)
+	}
+	return trapUnless(ctx, x86_64.JNB, lib.TrapIntegerOverflow, position)
+}
+
+// boundsCheck traps unless the unsigned index is smaller than the length of
+// the array argument array, whose length is kept in a register of its own.
+// Arrays without one have a fixed size, and aren't checked.
+func boundsCheck(ctx *IR_Context, array string, index lib.Operand, position Position) ([]lib.Instruction, error) {
+	length, ok := ctx.VariableMap[LengthVariable(array)]
+	if !ok {
+		return nil, nil
+	}
+	cmp := x86_64.CMP(length, index.(*encoding.Register).Get64BitRegister())
+	ctx.AddInstruction(cmp)
+	check, err := trapUnless(ctx, x86_64.JB, lib.TrapIndexOutOfRange, position)
+	if err != nil {
+		return nil, err
+	}
+	return append([]lib.Instruction{cmp}, check...), nil
+}
+
+func isCheckedArithmetic(ctx *IR_Context, checked bool, typ Type) bool {
+	return (checked || ctx.CheckedArithmetic) && IsInteger(typ)
+}
+
+// consumeFuel returns the code that takes one unit of fuel from the
+// callEngine and traps when there's none left, or nil when ctx.Fuel isn't
+// set. It doesn't add the instructions to ctx.
+func consumeFuel(ctx *IR_Context, position Position) ([]lib.Instruction, error) {
+	if !ctx.Fuel {
+		return nil, nil
+	}
+	t := trap(lib.TrapFuelExhausted, position)
+	trapLen, err := instructionsLength(t...)
+	if err != nil {
+		return nil, err
+	}
+	return append([]lib.Instruction{
+		x86_64.DEC(callEngineField(lib.CallEngineFuelOffset)),
+		relativeJump(x86_64.JNL, trapLen),
+	}, t...), nil
+}
@@ -0,0 +1,135 @@
+package x86_64
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/bspaans/jit-compiler/asm/x86_64"
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// Globals are initialised in the data section, so there's no code to run.
+//
+//goland:noinspection GoSnakeCaseUsage
+func encode_IR_Var(i *statements.IR_Var, ctx *IR_Context) ([]lib.Instruction, error) {
+	return []lib.Instruction{}, nil
+}
+
+//goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
+func encode_IR_Var_for_DataSection(i *statements.IR_Var, ctx *IR_Context, segments *Segments) error {
+	if _, ok := ctx.Globals[i.Name]; ok {
+		return fmt.Errorf("Global %s is declared more than once", i.Name)
+	}
+	if _, ok := ctx.Externs[i.Name]; ok {
+		return fmt.Errorf("Global %s is already declared as an extern", i.Name)
+	}
+	typ := i.VariableType
+	// Globals of function type are the slots of a module's function table,
+	// which hold the offset of the function's code relative to the slot.
+	isSlot := typ.Type() == T_Function && i.Value == nil
+	if !IsNumber(typ) && typ.Type() != T_Bool && !isSlot {
+		return fmt.Errorf("Unsupported type %s for global %s", typ, i.Name)
+	}
+	var value uint64
+	switch c := i.Value.(type) {
+	case nil:
+	case *expr.IR_Int64:
+		// Integer literals can initialise any integer type.
+		value = uint64(c.Value)
+	case *expr.IR_Int8:
+		value = uint64(c.Value)
+	case *expr.IR_Int16:
+		value = uint64(c.Value)
+	case *expr.IR_Int32:
+		value = uint64(c.Value)
+	case *expr.IR_Uint8:
+		value = uint64(c.Value)
+	case *expr.IR_Uint16:
+		value = uint64(c.Value)
+	case *expr.IR_Uint32:
+		value = uint64(c.Value)
+	case *expr.IR_Uint64:
+		value = c.Value
+	case *expr.IR_Float64:
+		value = math.Float64bits(c.Value)
+	case *expr.IR_Bool:
+		if c.Value {
+			value = 1
+		}
+	default:
+		return fmt.Errorf("Global %s has to be initialised with a constant, got %s", i.Name, i.Value)
+	}
+	if i.Value != nil && i.Value.ReturnType(ctx) != typ && !(i.Value.Type() == Int64 && IsInteger(typ)) {
+		return fmt.Errorf("Can't initialise %s global %s with %s", typ, i.Name, i.Value)
+	}
+	// Align the global to its width.
+	width := int(typ.Width())
+	for len(segments.Segments[ReadWrite].Data)%width != 0 {
+		segments.Add(ReadWrite, 0)
+	}
+	ctx.Globals[i.Name] = &GlobalVariable{
+		Type:    typ,
+		Address: segments.Add(ReadWrite, encoding.Uint64(value).Encode()[:width]...),
+	}
+	return nil
+}
+
+// encodeGlobalAddress loads the address of the global into reg, relative to
+// the instruction pointer.
+func encodeGlobalAddress(global *GlobalVariable, ctx *IR_Context, reg lib.Operand) lib.Instruction {
+	ownLength := uint(7)
+	diff := ctx.InstructionPointer + ownLength - uint(ctx.Segments.GetAddress(global.Address))
+	lea := x86_64.LEA(&encoding.RIPRelative{Displacement: encoding.Int32(int32(-diff))}, reg)
+	ctx.AddInstruction(lea)
+	return lea
+}
+
+// Loads the value of the global into target.
+//
+//goland:noinspection GoErrorStringFormat
+func encodeGlobalLoad(global *GlobalVariable, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
+	if global.Type.Type() == T_Function {
+		return nil, fmt.Errorf("Can't use a function as a value")
+	}
+	address := ctx.AllocateRegister(TUint64).(*encoding.Register)
+	defer ctx.DeallocateRegister(address)
+	result := []lib.Instruction{encodeGlobalAddress(global, ctx, address)}
+
+	width := global.Type.Width()
+	// Move 0 into target register if going from a wider to narrower register
+	if width < lib.QUADWORD {
+		mov0 := x86_64.MOV(encoding.Uint64(0), target.(*encoding.Register).Get64BitRegister())
+		ctx.AddInstruction(mov0)
+		result = append(result, mov0)
+	}
+	mov := x86_64.MOV(&encoding.IndirectRegister{address.ForOperandWidth(width)}, target.(*encoding.Register).ForOperandWidth(width))
+	ctx.AddInstruction(mov)
+	return append(result, mov), nil
+}
+
+// Stores the value of the assignment in the global.
+//
+//goland:noinspection GoErrorStringFormat
+func encodeGlobalStore(i *statements.IR_Assignment, global *GlobalVariable, ctx *IR_Context) ([]lib.Instruction, error) {
+	if returnType := i.Expr.ReturnType(ctx); returnType != global.Type {
+		return nil, fmt.Errorf("Can't assign %s to %s global %s", returnType, global.Type, i.Variable)
+	}
+	value := ctx.AllocateRegister(global.Type).(*encoding.Register)
+	defer ctx.DeallocateRegister(value)
+	result, err := encodeExpression(i.Expr, ctx, value)
+	if err != nil {
+		return nil, fmt.Errorf("Error in assignment: %s", err.Error())
+	}
+	address := ctx.AllocateRegister(TUint64).(*encoding.Register)
+	defer ctx.DeallocateRegister(address)
+	result = append(result, encodeGlobalAddress(global, ctx, address))
+
+	width := global.Type.Width()
+	mov := x86_64.MOV(value.ForOperandWidth(width), &encoding.IndirectRegister{address.ForOperandWidth(width)})
+	ctx.AddInstruction(mov)
+	return append(result, mov), nil
+}
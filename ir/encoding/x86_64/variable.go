@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/bspaans/jit-compiler/asm/x86_64"
+	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	"github.com/bspaans/jit-compiler/ir/expr"
 	. "github.com/bspaans/jit-compiler/ir/shared"
 	"github.com/bspaans/jit-compiler/lib"
@@ -11,10 +12,43 @@ import (
 
 func encode_IR_Variable(i *expr.IR_Variable, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
 	reg, ok := ctx.VariableMap[i.Value]
+	if global, isGlobal := ctx.Globals[i.Value]; !ok && isGlobal {
+		return encodeGlobalLoad(global, ctx, target)
+	}
 	if !ok || reg == nil {
 		return nil, fmt.Errorf("Unknown variable '%s'", i.Value)
 	}
+	if _, inRegister := reg.(*encoding.Register); !inRegister {
+		// Variables on the stack take a whole slot.
+		if t, ok := target.(*encoding.Register); ok {
+			target = fullRegister(t)
+		}
+	}
 	result := []lib.Instruction{x86_64.MOV(reg, target)}
 	ctx.AddInstruction(result...)
 	return result, nil
 }
+
+// isRegisterVariable returns whether e is a variable that lives in a
+// register. Globals and variables on the stack are loaded from memory like
+// other expressions instead.
+func isRegisterVariable(e IRExpression, ctx *IR_Context) bool {
+	v, ok := e.(*expr.IR_Variable)
+	if !ok {
+		return false
+	}
+	if location, found := ctx.VariableMap[v.Value]; found {
+		_, inRegister := location.(*encoding.Register)
+		return inRegister
+	}
+	return ctx.Globals[v.Value] == nil
+}
+
+// fullRegister returns the 64 bit register of reg, or reg itself if it's an
+// xmm register.
+func fullRegister(reg *encoding.Register) *encoding.Register {
+	if reg.Size == lib.OWORD {
+		return reg
+	}
+	return reg.Get64BitRegister()
+}
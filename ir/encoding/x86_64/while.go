@@ -3,9 +3,8 @@ package x86_64
 import (
 	"errors"
 	"fmt"
+	"math"
 
-	"github.com/bspaans/jit-compiler/asm/x86_64"
-	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	. "github.com/bspaans/jit-compiler/ir/shared"
 	"github.com/bspaans/jit-compiler/ir/statements"
 	"github.com/bspaans/jit-compiler/lib"
@@ -13,7 +12,6 @@ import (
 
 //goland:noinspection GoSnakeCaseUsage,GoErrorStringFormat
 func encode_IR_While(i *statements.IR_While, ctx *IR_Context) ([]lib.Instruction, error) {
-	jmpSize := uint(2)
 	if i.Condition.ReturnType(ctx) != TBool {
 		return nil, errors.New("Unsupported if IR expression")
 	}
@@ -24,9 +22,31 @@ func encode_IR_While(i *statements.IR_While, ctx *IR_Context) ([]lib.Instruction
 		return nil, err
 	}
 
+	// Every iteration takes fuel before jumping back, when enabled.
+	fuel, err := consumeFuel(ctx, PositionOf(i.Condition))
+	if err != nil {
+		return nil, err
+	}
+	fuelLen, err := instructionsLength(fuel...)
+	if err != nil {
+		return nil, err
+	}
+	stmtLen += fuelLen
+
+	// The jump back to the condition can use the short encoding if the
+	// whole loop fits in a signed byte.
+	jmpSize := 2
+	conditionLen, err := branchLength(ctx, i.Condition, false, stmtLen+jmpSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s in %s", err.Error(), i.String())
+	}
+	if conditionLen+stmtLen+jmpSize > -math.MinInt8 {
+		jmpSize = 5
+	}
+
 	beginning := ctx.InstructionPointer
 
-	result, err := conditionalJump(ctx, i.Condition, stmtLen)
+	result, err := conditionalJump(ctx, i.Condition, stmtLen+jmpSize)
 	if err != nil {
 		return nil, fmt.Errorf("%s in %s", err.Error(), i.String())
 	}
@@ -35,10 +55,9 @@ func encode_IR_While(i *statements.IR_While, ctx *IR_Context) ([]lib.Instruction
 		return nil, err
 	}
 	result = lib.Instructions(result).Add(s1)
-	jump := uint8((ctx.InstructionPointer + jmpSize) - beginning)
-	// two's complement
-	jump = (^jump) + 1
-	jmp := x86_64.JMP(encoding.Uint8(jump))
+	ctx.AddInstruction(fuel...)
+	result = lib.Instructions(result).Add(fuel)
+	jmp := backwardJump(ctx, beginning)
 	result = append(result, jmp)
 	ctx.AddInstruction(jmp)
 	return result, nil
@@ -3,6 +3,7 @@ package x86_64
 import (
 	"fmt"
 
+	"github.com/bspaans/jit-compiler/asm/x86_64"
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	"github.com/bspaans/jit-compiler/ir/expr"
 	. "github.com/bspaans/jit-compiler/ir/shared"
@@ -24,14 +25,53 @@ func (x *X86_64) EncodeStatement(stmt IR, ctx *IR_Context) ([]lib.Instruction, e
 
 func (x *X86_64) EncodeDataSection(stmts []IR, ctx *IR_Context) (*Segments, error) {
 	segments := NewSegments()
+	ctx.Segments = segments
+	functions := []*expr.IR_Function{}
 	for _, stmt := range stmts {
-		if err := encodeDataSection(stmt, ctx, segments); err != nil {
+		if err := encodeDataSection(stmt, ctx, segments, &functions); err != nil {
 			return nil, err
 		}
 	}
+	// Functions address the data relative to their own code, so they can
+	// only be encoded once all the data is in place.
+	if err := encodeFunctions(functions, ctx, segments); err != nil {
+		return nil, err
+	}
+	// The variables of the program are allocated now that the types of the
+	// globals are known.
+	if allocator, ok := ctx.Allocator.(*X86_64_Allocator); ok && len(ctx.VariableMap) == 0 {
+		allocator.usePlan(planAllocation(stmts, ctx, allocator.Copy().(*X86_64_Allocator)), ctx)
+	}
 	return segments, nil
 }
 
+//goland:noinspection GoErrorStringFormat
+func (x *X86_64) EncodeFunction(fn IRExpression, ctx *IR_Context, segments *Segments) error {
+	f, ok := fn.(*expr.IR_Function)
+	if !ok {
+		return fmt.Errorf("Expecting a function, got %s", fn)
+	}
+	ctx.Segments = segments
+	functions := []*expr.IR_Function{}
+	if err := encodeExpressionForDataSection(f, ctx, segments, &functions); err != nil {
+		return err
+	}
+	return encodeFunctions(functions, ctx, segments)
+}
+
+func (x *X86_64) Peephole(code []lib.Instruction) ([]lib.Instruction, error) {
+	return x86_64.Peephole(code)
+}
+
+func encodeFunctions(functions []*expr.IR_Function, ctx *IR_Context, segments *Segments) error {
+	for _, f := range functions {
+		if err := encode_IR_Function_for_DataSection(f, ctx, segments); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //goland:noinspection GoErrorStringFormat
 func encodeExpression(e IRExpression, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error) {
 	switch v := e.(type) {
@@ -69,16 +109,24 @@ func encodeExpression(e IRExpression, ctx *IR_Context, target lib.Operand) ([]li
 		return encode_IR_Int32(v, ctx, target)
 	case *expr.IR_Int64:
 		return encode_IR_Int64(v, ctx, target)
+	case *expr.IR_Len:
+		return encode_IR_Len(v, ctx, target)
 	case *expr.IR_LT:
 		return encode_IR_LT(v, ctx, target, true)
 	case *expr.IR_LTE:
 		return encode_IR_LTE(v, ctx, target, true)
 	case *expr.IR_Mul:
 		return encode_IR_Mul(v, ctx, target)
+	case *expr.IR_MulHigh:
+		return encode_IR_MulHigh(v, ctx, target)
 	case *expr.IR_Not:
 		return encode_IR_Not(v, ctx, target, true)
 	case *expr.IR_Or:
 		return encode_IR_Or(v, ctx, target)
+	case *expr.IR_ShiftLeft:
+		return encode_IR_ShiftLeft(v, ctx, target)
+	case *expr.IR_ShiftRight:
+		return encode_IR_ShiftRight(v, ctx, target)
 	case *expr.IR_StaticArray:
 		return encode_IR_StaticArray(v, ctx, target)
 	case *expr.IR_Struct:
@@ -104,8 +152,29 @@ func encodeExpression(e IRExpression, ctx *IR_Context, target lib.Operand) ([]li
 	}
 }
 
-//goland:noinspection GoErrorStringFormat
+// encodeStatement encodes stmt with the variables that are live at stmt in
+// registers. The first statement of a function body or program sets up the
+// stack frame.
 func encodeStatement(stmt IR, ctx *IR_Context) ([]lib.Instruction, error) {
+	allocator, ok := ctx.Allocator.(*X86_64_Allocator)
+	if !ok {
+		return encodeStatementAt(stmt, ctx)
+	}
+	defer allocator.enterStatement(stmt, ctx)()
+	if allocator.plan == nil || stmt != allocator.plan.entry {
+		return encodeStatementAt(stmt, ctx)
+	}
+	result := []lib.Instruction{x86_64.SUB(encoding.Uint32(allocator.plan.frameSize), encoding.Rsp)}
+	ctx.AddInstruction(result...)
+	instr, err := encodeStatementAt(stmt, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(result, instr...), nil
+}
+
+//goland:noinspection GoErrorStringFormat
+func encodeStatementAt(stmt IR, ctx *IR_Context) ([]lib.Instruction, error) {
 	switch v := stmt.(type) {
 	case *statements.IR_AndThen:
 		return encode_IR_AndThen(v, ctx)
@@ -113,12 +182,18 @@ func encodeStatement(stmt IR, ctx *IR_Context) ([]lib.Instruction, error) {
 		return encode_IR_ArrayAssignment(v, ctx)
 	case *statements.IR_Assignment:
 		return encode_IR_Assignment(v, ctx)
+	case *statements.IR_CallStatement:
+		return encode_IR_CallStatement(v, ctx)
+	case *statements.IR_Extern:
+		return encode_IR_Extern(v, ctx)
 	case *statements.IR_FunctionDef:
 		return encode_IR_FunctionDef(v, ctx)
 	case *statements.IR_If:
 		return encode_IR_If(v, ctx)
 	case *statements.IR_Return:
 		return encode_IR_Return(v, ctx)
+	case *statements.IR_Var:
+		return encode_IR_Var(v, ctx)
 	case *statements.IR_While:
 		return encode_IR_While(v, ctx)
 	default:
@@ -127,33 +202,46 @@ func encodeStatement(stmt IR, ctx *IR_Context) ([]lib.Instruction, error) {
 }
 
 //goland:noinspection GoErrorStringFormat
-func encodeDataSection(i IR, ctx *IR_Context, segments *Segments) error {
+func encodeDataSection(i IR, ctx *IR_Context, segments *Segments, functions *[]*expr.IR_Function) error {
 	switch v := i.(type) {
 	case *statements.IR_AndThen:
-		if err := encodeDataSection(v.Stmt1, ctx, segments); err != nil {
+		if err := encodeDataSection(v.Stmt1, ctx, segments, functions); err != nil {
 			return err
 		}
-		return encodeDataSection(v.Stmt2, ctx, segments)
+		return encodeDataSection(v.Stmt2, ctx, segments, functions)
 	case *statements.IR_ArrayAssignment:
-		if err := encodeExpressionForDataSection(v.Index, ctx, segments); err != nil {
+		if err := encodeExpressionForDataSection(v.Index, ctx, segments, functions); err != nil {
 			return err
 		}
-		return encodeExpressionForDataSection(v.Expr, ctx, segments)
+		return encodeExpressionForDataSection(v.Expr, ctx, segments, functions)
 	case *statements.IR_Assignment:
-		return encodeExpressionForDataSection(v.Expr, ctx, segments)
+		return encodeExpressionForDataSection(v.Expr, ctx, segments, functions)
+	case *statements.IR_CallStatement:
+		return encodeExpressionForDataSection(v.Call, ctx, segments, functions)
+	case *statements.IR_Extern:
+		return encode_IR_Extern_for_DataSection(v, ctx)
 	case *statements.IR_FunctionDef:
-		return encodeExpressionForDataSection(v.Expr, ctx, segments)
+		return encodeExpressionForDataSection(v.Expr, ctx, segments, functions)
 	case *statements.IR_If:
-		if err := encodeExpressionForDataSection(v.Condition, ctx, segments); err != nil {
+		if err := encodeExpressionForDataSection(v.Condition, ctx, segments, functions); err != nil {
 			return err
 		}
-		if err := encodeDataSection(v.Stmt2, ctx, segments); err != nil {
+		if err := encodeDataSection(v.Stmt1, ctx, segments, functions); err != nil {
 			return err
 		}
-		return encodeDataSection(v.Stmt2, ctx, segments)
+		if v.Stmt2 == nil {
+			return nil
+		}
+		return encodeDataSection(v.Stmt2, ctx, segments, functions)
 	case *statements.IR_Return:
-		return encodeExpressionForDataSection(v.Expr, ctx, segments)
+		return encodeExpressionForDataSection(v.Expr, ctx, segments, functions)
+	case *statements.IR_Var:
+		return encode_IR_Var_for_DataSection(v, ctx, segments)
 	case *statements.IR_While:
+		if err := encodeExpressionForDataSection(v.Condition, ctx, segments, functions); err != nil {
+			return err
+		}
+		return encodeDataSection(v.Stmt, ctx, segments, functions)
 	default:
 		return fmt.Errorf("Unsupported '%s' statement in x86_64 data section encoder", i.String())
 	}
@@ -161,12 +249,12 @@ func encodeDataSection(i IR, ctx *IR_Context, segments *Segments) error {
 }
 
 //goland:noinspection GoErrorStringFormat
-func encodeExpressionForDataSection(i IRExpression, ctx *IR_Context, segments *Segments) error {
+func encodeExpressionForDataSection(i IRExpression, ctx *IR_Context, segments *Segments, functions *[]*expr.IR_Function) error {
 	encodeOperators := func(op1, op2 IRExpression) error {
-		if err := encodeExpressionForDataSection(op1, ctx, segments); err != nil {
+		if err := encodeExpressionForDataSection(op1, ctx, segments, functions); err != nil {
 			return err
 		}
-		return encodeExpressionForDataSection(op2, ctx, segments)
+		return encodeExpressionForDataSection(op2, ctx, segments, functions)
 	}
 	switch v := i.(type) {
 	case *expr.IR_ByteArray:
@@ -180,7 +268,7 @@ func encodeExpressionForDataSection(i IRExpression, ctx *IR_Context, segments *S
 		return encodeOperators(v.Array, v.Index)
 	case *expr.IR_Call:
 		for _, arg := range v.Args {
-			if err := encodeExpressionForDataSection(arg, ctx, segments); err != nil {
+			if err := encodeExpressionForDataSection(arg, ctx, segments, functions); err != nil {
 				return err
 			}
 		}
@@ -190,33 +278,42 @@ func encodeExpressionForDataSection(i IRExpression, ctx *IR_Context, segments *S
 	case *expr.IR_Equals:
 		return encodeOperators(v.Op1, v.Op2)
 	case *expr.IR_Function:
-		if err := encodeDataSection(v.Body, ctx, segments); err != nil {
+		if err := encodeDataSection(v.Body, ctx, segments, functions); err != nil {
 			return err
 		}
-		return encode_IR_Function_for_DataSection(v, ctx, segments)
+		*functions = append(*functions, v)
+		return nil
 	case *expr.IR_GT:
 		return encodeOperators(v.Op1, v.Op2)
 	case *expr.IR_GTE:
 		return encodeOperators(v.Op1, v.Op2)
+	case *expr.IR_Len:
+		return encodeExpressionForDataSection(v.Array, ctx, segments, functions)
 	case *expr.IR_LT:
 		return encodeOperators(v.Op1, v.Op2)
 	case *expr.IR_LTE:
 		return encodeOperators(v.Op1, v.Op2)
 	case *expr.IR_Mul:
 		return encodeOperators(v.Op1, v.Op2)
+	case *expr.IR_MulHigh:
+		return encodeOperators(v.Op1, v.Op2)
 	case *expr.IR_Not:
-		return encodeExpressionForDataSection(v.Op1, ctx, segments)
+		return encodeExpressionForDataSection(v.Op1, ctx, segments, functions)
 	case *expr.IR_Or:
 		return encodeOperators(v.Op1, v.Op2)
+	case *expr.IR_ShiftLeft:
+		return encodeExpressionForDataSection(v.Op1, ctx, segments, functions)
+	case *expr.IR_ShiftRight:
+		return encodeExpressionForDataSection(v.Op1, ctx, segments, functions)
 	case *expr.IR_StaticArray:
 		return encode_IR_StaticArray_for_DataSection(v, segments)
 	case *expr.IR_Struct:
 		return encode_IR_Struct_for_DataSection(v, ctx, segments)
 	case *expr.IR_StructField:
-		return encodeExpressionForDataSection(v.Struct, ctx, segments)
+		return encodeExpressionForDataSection(v.Struct, ctx, segments, functions)
 	case *expr.IR_Syscall:
 		for _, arg := range v.Args {
-			if err := encodeExpressionForDataSection(arg, ctx, segments); err != nil {
+			if err := encodeExpressionForDataSection(arg, ctx, segments, functions); err != nil {
 				return err
 			}
 		}
@@ -238,12 +335,23 @@ func (x *X86_64) GetAllocator() Allocator {
 	return NewX86_64_Allocator()
 }
 
+// X86_64_Allocator hands out the registers for temporaries and, when the
+// body that's encoded has an allocationPlan, keeps the registers of the
+// variables that are live at the current statement allocated.
+//
 //goland:noinspection GoSnakeCaseUsage,GoNameStartsWithPackageName
 type X86_64_Allocator struct {
 	Registers               []bool
 	RegistersAllocated      uint8
 	FloatRegisters          []bool
 	FloatRegistersAllocated uint8
+
+	plan     *allocationPlan
+	position int
+	// users counts the live variables in each register, which can be two
+	// when a move was coalesced.
+	users      [16]uint8
+	floatUsers [16]uint8
 }
 
 //goland:noinspection GoSnakeCaseUsage
@@ -258,7 +366,8 @@ func NewX86_64_Allocator() *X86_64_Allocator {
 	// get overwritten. We could be smarter here, but meh.
 	x.Registers[4] = true // stack pointer
 	x.Registers[5] = true // frame pointer
-	x.RegistersAllocated = 2
+	x.Registers[callEngineRegister.Register] = true
+	x.RegistersAllocated = 3
 	return x
 }
 
@@ -331,5 +440,108 @@ func (i *X86_64_Allocator) Copy() Allocator {
 		RegistersAllocated:      i.RegistersAllocated,
 		FloatRegisters:          floatRegs,
 		FloatRegistersAllocated: i.FloatRegistersAllocated,
+		plan:                    i.plan,
+		position:                i.position,
+		users:                   i.users,
+		floatUsers:              i.floatUsers,
+	}
+}
+
+// usePlan makes the allocator allocate the variables according to plan,
+// starting at position 0. The arguments in ctx.VariableMap have to be
+// allocated already.
+func (i *X86_64_Allocator) usePlan(plan *allocationPlan, ctx *IR_Context) {
+	if plan == nil {
+		return
+	}
+	i.plan, i.position = plan, 0
+	for _, interval := range plan.starts[0] {
+		i.addVariable(interval, ctx)
+	}
+}
+
+// enterStatement moves the allocator to the position of stmt, if it has
+// one, so that only the variables that are live there are in
+// ctx.VariableMap and in registers. The returned function moves it back.
+func (i *X86_64_Allocator) enterStatement(stmt IR, ctx *IR_Context) func() {
+	if i.plan == nil {
+		return func() {}
+	}
+	position, ok := i.plan.positions[stmt]
+	if !ok {
+		return func() {}
+	}
+	from := i.position
+	var added, removed []*liveInterval
+	if position >= from {
+		for p := from; p < position; p++ {
+			for _, interval := range i.plan.ends[p] {
+				if interval.isLiveAt(from) {
+					removed = append(removed, interval)
+				}
+			}
+		}
+		for p := from + 1; p <= position; p++ {
+			for _, interval := range i.plan.starts[p] {
+				if interval.isLiveAt(position) {
+					added = append(added, interval)
+				}
+			}
+		}
+	} else {
+		for _, interval := range i.plan.intervals {
+			if interval.isLiveAt(from) && !interval.isLiveAt(position) {
+				removed = append(removed, interval)
+			} else if !interval.isLiveAt(from) && interval.isLiveAt(position) {
+				added = append(added, interval)
+			}
+		}
+	}
+	move := func(remove, add []*liveInterval, to int) {
+		for _, interval := range remove {
+			i.removeVariable(interval, ctx)
+		}
+		for _, interval := range add {
+			i.addVariable(interval, ctx)
+		}
+		i.position = to
+	}
+	move(removed, added, position)
+	return func() {
+		move(added, removed, from)
+	}
+}
+
+func (i *X86_64_Allocator) addVariable(interval *liveInterval, ctx *IR_Context) {
+	ctx.VariableMap[interval.variable] = interval.operand
+	ctx.VariableTypes[interval.variable] = interval.typ
+	if interval.spilled {
+		return
+	}
+	registers, allocated, users := i.registersOf(interval)
+	users[interval.register]++
+	if !registers[interval.register] {
+		registers[interval.register] = true
+		*allocated += 1
+	}
+}
+
+func (i *X86_64_Allocator) removeVariable(interval *liveInterval, ctx *IR_Context) {
+	delete(ctx.VariableMap, interval.variable)
+	if interval.spilled {
+		return
+	}
+	registers, allocated, users := i.registersOf(interval)
+	users[interval.register]--
+	if users[interval.register] == 0 && registers[interval.register] {
+		registers[interval.register] = false
+		*allocated -= 1
+	}
+}
+
+func (i *X86_64_Allocator) registersOf(interval *liveInterval) ([]bool, *uint8, *[16]uint8) {
+	if interval.float {
+		return i.FloatRegisters, &i.FloatRegistersAllocated, &i.floatUsers
 	}
+	return i.Registers, &i.RegistersAllocated, &i.users
 }
@@ -10,6 +10,8 @@ type IR_Add struct {
 	*BaseIRExpression
 	Op1 IRExpression
 	Op2 IRExpression
+	// Checked makes integer overflow trap instead of wrapping around.
+	Checked bool
 }
 
 func NewIR_Add(op1, op2 IRExpression) *IR_Add {
@@ -20,14 +22,36 @@ func NewIR_Add(op1, op2 IRExpression) *IR_Add {
 	}
 }
 
+// NewIR_CheckedAdd returns the checked_add builtin, which traps on integer
+// overflow regardless of the CheckedArithmetic compile option.
+func NewIR_CheckedAdd(op1, op2 IRExpression) *IR_Add {
+	result := NewIR_Add(op1, op2)
+	result.Checked = true
+	return result
+}
+
 func (i *IR_Add) ReturnType(ctx *IR_Context) Type {
 	return i.Op1.ReturnType(ctx)
 }
 
 func (i *IR_Add) String() string {
+	if i.Checked {
+		return fmt.Sprintf("checked_add(%s, %s)", i.Op1.String(), i.Op2.String())
+	}
 	return fmt.Sprintf("%s + %s", i.Op1.String(), i.Op2.String())
 }
 
+// withOperands returns a copy of i with new operands, keeping its position
+// and checked flag.
+func (i *IR_Add) withOperands(op1, op2 IRExpression) *IR_Add {
+	return &IR_Add{
+		BaseIRExpression: i.BaseIRExpression,
+		Op1:              op1,
+		Op2:              op2,
+		Checked:          i.Checked,
+	}
+}
+
 func (b *IR_Add) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 	if IsLiteralOrVariable(b.Op1) {
 		if IsLiteralOrVariable(b.Op2) {
@@ -36,14 +60,14 @@ func (b *IR_Add) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 			rewrites, expr := b.Op2.SSA_Transform(ctx)
 			v := ctx.GenerateVariable()
 			rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
-			return rewrites, NewIR_Add(b.Op1, NewIR_Variable(v))
+			return rewrites, b.withOperands(b.Op1, NewIR_Variable(v))
 		}
 	}
 	rewrites, expr := b.Op1.SSA_Transform(ctx)
 	v := ctx.GenerateVariable()
 	rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
 	if IsLiteralOrVariable(b.Op2) {
-		return rewrites, NewIR_Add(NewIR_Variable(v), b.Op2)
+		return rewrites, b.withOperands(NewIR_Variable(v), b.Op2)
 	} else {
 		rewrites2, expr2 := b.Op2.SSA_Transform(ctx)
 		for _, rw := range rewrites2 {
@@ -51,7 +75,7 @@ func (b *IR_Add) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 		}
 		v2 := ctx.GenerateVariable()
 		rewrites = append(rewrites, NewSSA_Rewrite(v2, expr2))
-		return rewrites, NewIR_Add(NewIR_Variable(v), NewIR_Variable(v2))
+		return rewrites, b.withOperands(NewIR_Variable(v), NewIR_Variable(v2))
 	}
 
 }
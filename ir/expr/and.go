@@ -28,32 +28,15 @@ func (i *IR_And) String() string {
 	return fmt.Sprintf("%s && %s", i.Op1.String(), i.Op2.String())
 }
 
+// SSA_Transform only flattens the left operand. The right operand is left in
+// place, because hoisting it out of the expression would evaluate it even
+// when the left operand already decides the outcome.
 func (b *IR_And) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 	if IsLiteralOrVariable(b.Op1) {
-		if IsLiteralOrVariable(b.Op2) {
-			return nil, b
-		} else {
-			rewrites, expr := b.Op2.SSA_Transform(ctx)
-			v := ctx.GenerateVariable()
-			rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
-			return rewrites, NewIR_And(b.Op1, NewIR_Variable(v))
-		}
-	} else {
-		rewrites, expr := b.Op1.SSA_Transform(ctx)
-		v := ctx.GenerateVariable()
-		rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
-		if IsLiteralOrVariable(b.Op2) {
-			return rewrites, NewIR_And(NewIR_Variable(v), b.Op2)
-		} else {
-			rewrites2, expr2 := b.Op2.SSA_Transform(ctx)
-			for _, rw := range rewrites2 {
-				rewrites = append(rewrites, rw)
-			}
-			v2 := ctx.GenerateVariable()
-			rewrites = append(rewrites, NewSSA_Rewrite(v2, expr2))
-			return rewrites, NewIR_And(NewIR_Variable(v), NewIR_Variable(v2))
-		}
-
+		return nil, b
 	}
-	return nil, b
+	rewrites, expr := b.Op1.SSA_Transform(ctx)
+	v := ctx.GenerateVariable()
+	rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
+	return rewrites, NewIR_And(NewIR_Variable(v), b.Op2)
 }
@@ -29,7 +29,11 @@ func (i *IR_ArrayIndex) ReturnType(ctx *IR_Context) Type {
 	if ty.Type() != T_Array {
 		panic("Not an array")
 	}
-	return ty.(*TArray).ItemType
+	// float32 items are read as float64
+	if itemType := ty.(*TArray).ItemType; itemType.Type() != T_Float32 {
+		return itemType
+	}
+	return TFloat64
 }
 
 func (i *IR_ArrayIndex) String() string {
@@ -23,6 +23,12 @@ func NewIR_Call(function string, args []IRExpression) *IR_Call {
 
 func (i *IR_Call) ReturnType(ctx *IR_Context) Type {
 	signature := ctx.VariableTypes[i.Function]
+	if extern, ok := ctx.Externs[i.Function]; signature == nil && ok {
+		return extern.Signature.ReturnType
+	}
+	if global, ok := ctx.Globals[i.Function]; signature == nil && ok {
+		signature = global.Type
+	}
 	if signature == nil {
 		panic("Unknown function: " + i.Function)
 	}
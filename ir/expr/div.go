@@ -28,6 +28,15 @@ func (i *IR_Div) String() string {
 	return fmt.Sprintf("%s / %s", i.Op1.String(), i.Op2.String())
 }
 
+// withOperands returns a copy of i with new operands, keeping its position.
+func (i *IR_Div) withOperands(op1, op2 IRExpression) *IR_Div {
+	return &IR_Div{
+		BaseIRExpression: i.BaseIRExpression,
+		Op1:              op1,
+		Op2:              op2,
+	}
+}
+
 func (b *IR_Div) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 	if IsLiteralOrVariable(b.Op1) {
 		if IsLiteralOrVariable(b.Op2) {
@@ -36,14 +45,14 @@ func (b *IR_Div) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 			rewrites, expr := b.Op2.SSA_Transform(ctx)
 			v := ctx.GenerateVariable()
 			rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
-			return rewrites, NewIR_Div(b.Op1, NewIR_Variable(v))
+			return rewrites, b.withOperands(b.Op1, NewIR_Variable(v))
 		}
 	} else {
 		rewrites, expr := b.Op1.SSA_Transform(ctx)
 		v := ctx.GenerateVariable()
 		rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
 		if IsLiteralOrVariable(b.Op2) {
-			return rewrites, NewIR_Div(NewIR_Variable(v), b.Op2)
+			return rewrites, b.withOperands(NewIR_Variable(v), b.Op2)
 		} else {
 			rewrites2, expr2 := b.Op2.SSA_Transform(ctx)
 			for _, rw := range rewrites2 {
@@ -51,7 +60,7 @@ func (b *IR_Div) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 			}
 			v2 := ctx.GenerateVariable()
 			rewrites = append(rewrites, NewSSA_Rewrite(v2, expr2))
-			return rewrites, NewIR_Div(NewIR_Variable(v), NewIR_Variable(v2))
+			return rewrites, b.withOperands(NewIR_Variable(v), NewIR_Variable(v2))
 		}
 	}
 }
@@ -7,11 +7,33 @@ import (
 	. "github.com/bspaans/jit-compiler/ir/shared"
 )
 
+// InlineHint is the annotation of a function that tells the inliner
+// whether to replace calls to it by its body.
+type InlineHint int
+
+const (
+	// InlineAuto leaves it to the size of the function.
+	InlineAuto InlineHint = iota
+	InlineAlways
+	InlineNever
+)
+
+func (h InlineHint) String() string {
+	switch h {
+	case InlineAlways:
+		return "inline "
+	case InlineNever:
+		return "noinline "
+	}
+	return ""
+}
+
 type IR_Function struct {
 	*BaseIRExpression
 	Signature *TFunction
 	Body      IR
 	Address   *SegmentPointer
+	Inline    InlineHint
 }
 
 func NewIR_Function(signature *TFunction, body IR) *IR_Function {
@@ -31,10 +53,12 @@ func (i *IR_Function) String() string {
 	for j, arg := range i.Signature.ArgNames {
 		args = append(args, arg+" "+i.Signature.Args[j].String())
 	}
-	return fmt.Sprintf("func(%s) %s { %s }", strings.Join(args, ", "), i.Signature.ReturnType.String(), i.Body.String())
+	return fmt.Sprintf("%sfunc(%s) %s { %s }", i.Inline, strings.Join(args, ", "), i.Signature.ReturnType.String(), i.Body.String())
 }
 
 func (b *IR_Function) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
 	newBody := b.Body.SSA_Transform(ctx)
-	return nil, NewIR_Function(b.Signature, newBody)
+	f := NewIR_Function(b.Signature, newBody)
+	f.Inline = b.Inline
+	return nil, f
 }
@@ -0,0 +1,37 @@
+package expr
+
+import (
+	"fmt"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+type IR_Len struct {
+	*BaseIRExpression
+	Array IRExpression
+}
+
+func NewIR_Len(array IRExpression) *IR_Len {
+	return &IR_Len{
+		BaseIRExpression: NewBaseIRExpression(Len),
+		Array:            array,
+	}
+}
+
+func (i *IR_Len) ReturnType(ctx *IR_Context) Type {
+	return TInt64
+}
+
+func (i *IR_Len) String() string {
+	return fmt.Sprintf("len(%s)", i.Array.String())
+}
+
+func (b *IR_Len) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
+	if IsLiteralOrVariable(b.Array) {
+		return nil, b
+	}
+	rewrites, expr := b.Array.SSA_Transform(ctx)
+	v := ctx.GenerateVariable()
+	rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
+	return rewrites, NewIR_Len(NewIR_Variable(v))
+}
@@ -0,0 +1,69 @@
+package expr
+
+import (
+	"fmt"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// IR_MulHigh is the upper half of the product of two integers, which has
+// twice their width: the bits that multiplying them loses. The product is
+// signed for signed integers.
+type IR_MulHigh struct {
+	*BaseIRExpression
+	Op1 IRExpression
+	Op2 IRExpression
+}
+
+func NewIR_MulHigh(op1, op2 IRExpression) *IR_MulHigh {
+	return &IR_MulHigh{
+		BaseIRExpression: NewBaseIRExpression(MulHigh),
+		Op1:              op1,
+		Op2:              op2,
+	}
+}
+
+func (i *IR_MulHigh) ReturnType(ctx *IR_Context) Type {
+	return i.Op1.ReturnType(ctx)
+}
+
+func (i *IR_MulHigh) String() string {
+	return fmt.Sprintf("mul_high(%s, %s)", i.Op1.String(), i.Op2.String())
+}
+
+// withOperands returns a copy of i with new operands, keeping its position.
+func (i *IR_MulHigh) withOperands(op1, op2 IRExpression) *IR_MulHigh {
+	return &IR_MulHigh{
+		BaseIRExpression: i.BaseIRExpression,
+		Op1:              op1,
+		Op2:              op2,
+	}
+}
+
+func (b *IR_MulHigh) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
+	if IsLiteralOrVariable(b.Op1) {
+		if IsLiteralOrVariable(b.Op2) {
+			return nil, b
+		} else {
+			rewrites, expr := b.Op2.SSA_Transform(ctx)
+			v := ctx.GenerateVariable()
+			rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
+			return rewrites, b.withOperands(b.Op1, NewIR_Variable(v))
+		}
+	} else {
+		rewrites, expr := b.Op1.SSA_Transform(ctx)
+		v := ctx.GenerateVariable()
+		rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
+		if IsLiteralOrVariable(b.Op2) {
+			return rewrites, b.withOperands(NewIR_Variable(v), b.Op2)
+		} else {
+			rewrites2, expr2 := b.Op2.SSA_Transform(ctx)
+			for _, rw := range rewrites2 {
+				rewrites = append(rewrites, rw)
+			}
+			v2 := ctx.GenerateVariable()
+			rewrites = append(rewrites, NewSSA_Rewrite(v2, expr2))
+			return rewrites, b.withOperands(NewIR_Variable(v), NewIR_Variable(v2))
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package expr
+
+import (
+	"fmt"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// IR_ShiftLeft shifts the bits of an integer Shift places to the left,
+// shifting in zeros. The bits shifted out are lost, like multiplying by
+// 2^Shift wraps around.
+type IR_ShiftLeft struct {
+	*BaseIRExpression
+	Op1   IRExpression
+	Shift uint8
+}
+
+func NewIR_ShiftLeft(op1 IRExpression, shift uint8) *IR_ShiftLeft {
+	return &IR_ShiftLeft{
+		BaseIRExpression: NewBaseIRExpression(ShiftLeft),
+		Op1:              op1,
+		Shift:            shift,
+	}
+}
+
+func (i *IR_ShiftLeft) ReturnType(ctx *IR_Context) Type {
+	return i.Op1.ReturnType(ctx)
+}
+
+func (i *IR_ShiftLeft) String() string {
+	return fmt.Sprintf("%s << %d", i.Op1.String(), i.Shift)
+}
+
+func (b *IR_ShiftLeft) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
+	if IsLiteralOrVariable(b.Op1) {
+		return nil, b
+	}
+	rewrites, expr := b.Op1.SSA_Transform(ctx)
+	v := ctx.GenerateVariable()
+	rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
+	return rewrites, NewIR_ShiftLeft(NewIR_Variable(v), b.Shift)
+}
@@ -0,0 +1,43 @@
+package expr
+
+import (
+	"fmt"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// IR_ShiftRight shifts the bits of an integer Shift places to the right.
+// Signed integers shift in copies of the sign bit (an arithmetic shift),
+// which rounds towards negative infinity, and unsigned integers shift in
+// zeros.
+type IR_ShiftRight struct {
+	*BaseIRExpression
+	Op1   IRExpression
+	Shift uint8
+}
+
+func NewIR_ShiftRight(op1 IRExpression, shift uint8) *IR_ShiftRight {
+	return &IR_ShiftRight{
+		BaseIRExpression: NewBaseIRExpression(ShiftRight),
+		Op1:              op1,
+		Shift:            shift,
+	}
+}
+
+func (i *IR_ShiftRight) ReturnType(ctx *IR_Context) Type {
+	return i.Op1.ReturnType(ctx)
+}
+
+func (i *IR_ShiftRight) String() string {
+	return fmt.Sprintf("%s >> %d", i.Op1.String(), i.Shift)
+}
+
+func (b *IR_ShiftRight) SSA_Transform(ctx *SSA_Context) (SSA_Rewrites, IRExpression) {
+	if IsLiteralOrVariable(b.Op1) {
+		return nil, b
+	}
+	rewrites, expr := b.Op1.SSA_Transform(ctx)
+	v := ctx.GenerateVariable()
+	rewrites = append(rewrites, NewSSA_Rewrite(v, expr))
+	return rewrites, NewIR_ShiftRight(NewIR_Variable(v), b.Shift)
+}
@@ -17,10 +17,13 @@ func NewIR_Variable(v string) *IR_Variable {
 }
 
 func (i *IR_Variable) ReturnType(ctx *IR_Context) Type {
-	if _, ok := ctx.VariableTypes[i.Value]; !ok {
-		panic("Unknown variable: " + i.Value)
+	if ty, ok := ctx.VariableTypes[i.Value]; ok {
+		return ty
 	}
-	return ctx.VariableTypes[i.Value]
+	if global, ok := ctx.Globals[i.Value]; ok {
+		return global.Type
+	}
+	panic("Unknown variable: " + i.Value)
 }
 
 func (i *IR_Variable) String() string {
@@ -0,0 +1,89 @@
+package ir
+
+import (
+	"fmt"
+	"reflect"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// hostFunctions binds the externs to the Go functions in imports, ordered by
+// their index.
+//
+//goland:noinspection GoErrorStringFormat
+func hostFunctions(externs map[string]*ExternFunction, imports map[string]interface{}) ([]lib.HostFunction, error) {
+	result := make([]lib.HostFunction, len(externs))
+	for name, extern := range externs {
+		fn, ok := imports[name]
+		if !ok {
+			return nil, fmt.Errorf("Missing import for extern %s", name)
+		}
+		host, err := hostFunction(extern.Signature, reflect.ValueOf(fn))
+		if err != nil {
+			return nil, fmt.Errorf("Extern %s: %s", name, err.Error())
+		}
+		result[extern.Index] = host
+	}
+	return result, nil
+}
+
+// hostFunction wraps fn, which has to take the Go types of the arguments of
+// signature and return the Go type of its return type, if any.
+//
+//goland:noinspection GoErrorStringFormat
+func hostFunction(signature *TFunction, fn reflect.Value) (lib.HostFunction, error) {
+	if !fn.IsValid() || fn.Kind() != reflect.Func || fn.IsNil() {
+		return nil, fmt.Errorf("Expecting a function, got %v", fn)
+	}
+	typ := fn.Type()
+	mismatch := fmt.Errorf("Type %s doesn't match %s", typ, signature)
+	if typ.NumIn() != len(signature.Args) || typ.IsVariadic() {
+		return nil, mismatch
+	}
+	for i, arg := range signature.Args {
+		if typ.In(i) != goTypes[arg.Type()] {
+			return nil, mismatch
+		}
+	}
+	returnType := signature.ReturnType
+	if returnType == TVoid && typ.NumOut() != 0 || returnType != TVoid && (typ.NumOut() != 1 || typ.Out(0) != goTypes[returnType.Type()]) {
+		return nil, mismatch
+	}
+	return func(intArgs []uint64, floatArgs []float64) (uint64, float64) {
+		args := make([]reflect.Value, len(signature.Args))
+		var ints, floats int
+		for i, arg := range signature.Args {
+			if IsFloat(arg) {
+				args[i] = resultValue(arg, 0, floatArgs[floats])
+				floats++
+			} else {
+				args[i] = resultValue(arg, intArgs[ints], 0)
+				ints++
+			}
+		}
+		results := fn.Call(args)
+		if returnType == TVoid {
+			return 0, 0
+		}
+		return registerValue(results[0])
+	}, nil
+}
+
+// registerValue returns the values of rax and xmm0 that return v from a
+// function.
+func registerValue(v reflect.Value) (uint64, float64) {
+	switch v.Kind() {
+	case reflect.Float64:
+		return 0, v.Float()
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int()), 0
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint(), 0
+	default:
+		if v.Bool() {
+			return 1, 0
+		}
+		return 0, 0
+	}
+}
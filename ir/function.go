@@ -0,0 +1,334 @@
+package ir
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// Func is a compiled function that can be called from Go with arguments.
+// Integer, bool and pointer arguments are passed in the integer argument
+// registers and float64 arguments in the xmm registers, following the ABI
+// it was compiled for. The code stays mapped until Close is called.
+//
+// Array arguments, e.g. buf []float64, take a Go slice, which is passed as
+// the address of its first item followed by its length, which len(buf)
+// returns. The compiled code reads and writes the slice in place, and traps
+// with lib.ErrIndexOutOfRange outside of it. Go's garbage collector doesn't
+// move heap memory, and the slices escape to the heap when they're passed to
+// Call; they are kept alive until the call returns. The compiled code must
+// not hold on to the address after that.
+//
+// The compiled code runs on a stack of its own of lib.JITStackSize bytes,
+// and traps with lib.ErrStackOverflow when it overflows. Calls to externs
+// run the Go function that they are bound to on the calling goroutine, while
+// the compiled code waits on that stack.
+type Func struct {
+	Signature *TFunction
+	code      *lib.Executable
+	entry     int
+	// module is the Module the function belongs to, if any.
+	module *Module
+}
+
+// CompileFunction compiles fn into a Func, which should be closed when it's
+// no longer needed.
+//
+//goland:noinspection GoErrorStringFormat
+func CompileFunction(targetArchitecture Architecture, abi ABI, fn *expr.IR_Function, opts Options) (*Func, error) {
+	if err := checkSignature(fn.Signature); err != nil {
+		return nil, err
+	}
+	passes := opts.passManager()
+	fn, err := optimiseFunction("f", fn, nil, passes, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx := NewIRContext(targetArchitecture, abi, func(c *IR_Context) *IR_Context {
+		c.Debug = opts.Debug
+		c.CheckedArithmetic = opts.CheckedArithmetic
+		c.Fuel = opts.Fuel
+		c.SkipPeephole = !passes.Enabled("peephole")
+		return c
+	})
+	segments, err := ctx.Architecture.EncodeDataSection([]IR{statements.NewIR_FunctionDef("f", fn)}, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Debug {
+		fmt.Println(segments.String())
+	}
+	hosts, err := hostFunctions(ctx.Externs, opts.Imports)
+	if err != nil {
+		return nil, err
+	}
+	program := &lib.Program{
+		MachineCode: segments.Encode(),
+		DataEnd:     segments.CodeStart(),
+		Entry:       segments.GetAddress(fn.Address),
+
+		HostFunctions: hosts,
+	}
+	code, err := load(program, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Func{
+		Signature: fn.Signature,
+		code:      code,
+		entry:     program.Entry,
+	}, nil
+}
+
+// optimiseFunction runs the passes on fn, as the only function called name
+// of a program that starts with the declarations decls. Functions that are
+// declared with var instead of defined aren't inlined into fn.
+//
+//goland:noinspection GoErrorStringFormat
+func optimiseFunction(name string, fn *expr.IR_Function, decls []IR, passes *PassManager, opts Options) (*expr.IR_Function, error) {
+	program := append(append([]IR{}, decls...), statements.NewIR_FunctionDef(name, fn))
+	stmts, err := passes.Run(program, opts, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range stmts {
+		if def, ok := stmt.(*statements.IR_FunctionDef); ok && def.Name == name {
+			return def.Expr, nil
+		}
+	}
+	return nil, fmt.Errorf("The passes removed function %s", name)
+}
+
+// checkSignature checks that functions with the signature can be called
+// from Go.
+//
+//goland:noinspection GoErrorStringFormat
+func checkSignature(signature *TFunction) error {
+	var ints, floats int
+	for _, arg := range signature.RegisterArgs() {
+		if array, ok := arg.(*TArray); ok && len(goKinds[array.ItemType.Type()]) == 0 {
+			return fmt.Errorf("Unsupported argument type %s", arg)
+		} else if IsFloat(arg) {
+			floats++
+		} else if !IsInteger(arg) && arg.Type() != T_Bool && arg.Type() != T_Array {
+			return fmt.Errorf("Unsupported argument type %s", arg)
+		} else {
+			ints++
+		}
+	}
+	if ints > lib.MaxIntArgs || floats > lib.MaxFloatArgs {
+		return fmt.Errorf("Too many arguments in %s", signature)
+	}
+	if returnType := signature.ReturnType; !IsNumber(returnType) && returnType.Type() != T_Bool {
+		return fmt.Errorf("Unsupported return type %s", returnType)
+	}
+	return nil
+}
+
+// load maps the program, into the arena if the options have one.
+func load(program *lib.Program, opts Options) (*lib.Executable, error) {
+	if opts.Arena != nil {
+		return opts.Arena.Load(program)
+	}
+	return program.Load()
+}
+
+// Close releases the memory of the compiled code. Calls after Close return
+// lib.ErrClosed. The functions of a Module share its code, which is only
+// released by Module.Close; Close does nothing for them.
+func (f *Func) Close() error {
+	if f.module != nil {
+		return nil
+	}
+	return f.code.Close()
+}
+
+// Call calls the function with args, which have to match the argument types
+// of the signature: int64 takes an int64 or int, uint64 a uint64, uint,
+// uintptr or pointer, and the other types their Go equivalent. The result
+// has the Go type that corresponds to the return type.
+func (f *Func) Call(args ...interface{}) (interface{}, error) {
+	return f.CallWithFuel(math.MaxInt64, args...)
+}
+
+// CallWithFuel is like Call, but a function that was compiled with
+// Options.Fuel traps with lib.ErrFuelExhausted after fuel loop iterations
+// and function calls.
+func (f *Func) CallWithFuel(fuel int64, args ...interface{}) (interface{}, error) {
+	values := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		values[i] = reflect.ValueOf(arg)
+	}
+	result, err := f.call(fuel, values)
+	if err != nil {
+		return nil, err
+	}
+	return result.Interface(), nil
+}
+
+//goland:noinspection GoErrorStringFormat
+func (f *Func) call(fuel int64, args []reflect.Value) (reflect.Value, error) {
+	if len(args) != len(f.Signature.Args) {
+		return reflect.Value{}, fmt.Errorf("Expecting %d arguments, got %d", len(f.Signature.Args), len(args))
+	}
+	var intArgs []uint64
+	var floatArgs []float64
+	for i, arg := range args {
+		typ := f.Signature.Args[i]
+		if !arg.IsValid() || !acceptsType(typ, arg.Type()) {
+			return reflect.Value{}, fmt.Errorf("Expecting %s for argument %s, got %v", typ, f.Signature.ArgNames[i], arg)
+		}
+		switch arg.Kind() {
+		case reflect.Float64:
+			floatArgs = append(floatArgs, arg.Float())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			intArgs = append(intArgs, uint64(arg.Int()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			intArgs = append(intArgs, arg.Uint())
+		case reflect.Bool:
+			if arg.Bool() {
+				intArgs = append(intArgs, 1)
+			} else {
+				intArgs = append(intArgs, 0)
+			}
+		case reflect.Ptr, reflect.UnsafePointer:
+			intArgs = append(intArgs, uint64(arg.Pointer()))
+		case reflect.Slice:
+			intArgs = append(intArgs, uint64(arg.Pointer()), uint64(arg.Len()))
+		}
+	}
+	entry := f.entry
+	if f.module != nil {
+		// The function may get replaced while it runs.
+		var epoch uint64
+		epoch, entry = f.module.enter(f)
+		defer f.module.exit(epoch)
+	}
+	intResult, floatResult, err := f.code.CallFunctionWithFuel(entry, fuel, intArgs, floatArgs)
+	// The pointers in intArgs don't keep the memory alive.
+	runtime.KeepAlive(args)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return resultValue(f.Signature.ReturnType, intResult, floatResult), nil
+}
+
+// goKinds are the kinds of Go values that can be passed for each type.
+var goKinds = map[TypeNr][]reflect.Kind{
+	T_Uint8:   {reflect.Uint8},
+	T_Uint16:  {reflect.Uint16},
+	T_Uint32:  {reflect.Uint32},
+	T_Uint64:  {reflect.Uint64, reflect.Uint, reflect.Uintptr, reflect.Ptr, reflect.UnsafePointer},
+	T_Int8:    {reflect.Int8},
+	T_Int16:   {reflect.Int16},
+	T_Int32:   {reflect.Int32},
+	T_Int64:   {reflect.Int64, reflect.Int},
+	T_Float64: {reflect.Float64},
+	T_Bool:    {reflect.Bool},
+	T_Float32: {reflect.Float32},
+}
+
+// goTypes are the Go types of the values returned for each type.
+var goTypes = map[TypeNr]reflect.Type{
+	T_Uint8:   reflect.TypeOf(uint8(0)),
+	T_Uint16:  reflect.TypeOf(uint16(0)),
+	T_Uint32:  reflect.TypeOf(uint32(0)),
+	T_Uint64:  reflect.TypeOf(uint64(0)),
+	T_Int8:    reflect.TypeOf(int8(0)),
+	T_Int16:   reflect.TypeOf(int16(0)),
+	T_Int32:   reflect.TypeOf(int32(0)),
+	T_Int64:   reflect.TypeOf(int64(0)),
+	T_Float64: reflect.TypeOf(float64(0)),
+	T_Bool:    reflect.TypeOf(false),
+}
+
+// acceptsType returns whether values of Go type t can be passed for typ.
+// Arrays take slices of their item type.
+func acceptsType(typ Type, t reflect.Type) bool {
+	if array, ok := typ.(*TArray); ok {
+		return t.Kind() == reflect.Slice && acceptsKind(array.ItemType, t.Elem().Kind())
+	}
+	return acceptsKind(typ, t.Kind())
+}
+
+func acceptsKind(typ Type, kind reflect.Kind) bool {
+	for _, k := range goKinds[typ.Type()] {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func resultValue(typ Type, intResult uint64, floatResult float64) reflect.Value {
+	result := reflect.New(goTypes[typ.Type()]).Elem()
+	switch {
+	case IsFloat(typ):
+		result.SetFloat(floatResult)
+	case IsSignedInteger(typ):
+		// Narrow results are zero extended; SetInt truncates them again.
+		result.SetInt(int64(intResult))
+	case IsInteger(typ):
+		result.SetUint(intResult)
+	default:
+		result.SetBool(intResult&0xff != 0)
+	}
+	return result
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// CompileFunc compiles fn into a Go function of type F, which has to match
+// the signature of fn, e.g. func(int64, float64) float64 for
+// func(a int64, b float64) float64. F may have an extra error result to
+// receive traps; otherwise the returned function panics when the compiled
+// code traps. The code is released when the function gets garbage collected.
+// The function has no way to pass a fuel budget, so functions compiled with
+// Options.Fuel never run out; use CompileFunction and Func.CallWithFuel to
+// meter them.
+//
+//goland:noinspection GoErrorStringFormat
+func CompileFunc[F any](targetArchitecture Architecture, abi ABI, fn *expr.IR_Function, opts Options) (F, error) {
+	var result F
+	typ := reflect.TypeOf(result)
+	if typ == nil || typ.Kind() != reflect.Func {
+		return result, fmt.Errorf("Expecting a function type, got %v", typ)
+	}
+	signature := fn.Signature
+	if typ.NumIn() != len(signature.Args) || typ.IsVariadic() {
+		return result, fmt.Errorf("Type %s doesn't match %s", typ, signature)
+	}
+	for i, arg := range signature.Args {
+		if !acceptsType(arg, typ.In(i)) {
+			return result, fmt.Errorf("Type %s doesn't match %s", typ, signature)
+		}
+	}
+	returnsError := typ.NumOut() == 2 && typ.Out(1) == errorType
+	if !(typ.NumOut() == 1 || returnsError) || typ.Out(0) != goTypes[signature.ReturnType.Type()] {
+		return result, fmt.Errorf("Type %s doesn't match %s", typ, signature)
+	}
+	f, err := CompileFunction(targetArchitecture, abi, fn, opts)
+	if err != nil {
+		return result, err
+	}
+	call := reflect.MakeFunc(typ, func(args []reflect.Value) []reflect.Value {
+		value, err := f.call(math.MaxInt64, args)
+		if err != nil && !returnsError {
+			panic(err)
+		}
+		if err != nil {
+			return []reflect.Value{reflect.Zero(typ.Out(0)), reflect.ValueOf(&err).Elem()}
+		}
+		if returnsError {
+			return []reflect.Value{value, reflect.Zero(errorType)}
+		}
+		return []reflect.Value{value}
+	})
+	return call.Interface().(F), nil
+}
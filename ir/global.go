@@ -0,0 +1,98 @@
+package ir
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// Global is a global variable of a Module. The accessors panic when the
+// type of the variable doesn't match, or when the module has been closed.
+// Accessing a global while the module's functions are running on another
+// goroutine is a data race.
+type Global struct {
+	Name   string
+	Type   Type
+	code   *lib.Executable
+	offset int
+}
+
+// Float64 returns the value of a float64 global.
+func (g *Global) Float64() float64 {
+	g.checkType("float64", IsFloat(g.Type))
+	return math.Float64frombits(g.read())
+}
+
+// SetFloat64 sets the value of a float64 global.
+func (g *Global) SetFloat64(value float64) {
+	g.checkType("float64", IsFloat(g.Type))
+	g.write(math.Float64bits(value))
+}
+
+// Int64 returns the value of a signed integer global.
+func (g *Global) Int64() int64 {
+	g.checkType("a signed integer", IsSignedInteger(g.Type))
+	shift := 64 - 8*uint(g.Type.Width())
+	return int64(g.read()<<shift) >> shift
+}
+
+// SetInt64 sets the value of a signed integer global, truncating it to the
+// width of the global.
+func (g *Global) SetInt64(value int64) {
+	g.checkType("a signed integer", IsSignedInteger(g.Type))
+	g.write(uint64(value))
+}
+
+// Uint64 returns the value of an unsigned integer global.
+func (g *Global) Uint64() uint64 {
+	g.checkType("an unsigned integer", IsInteger(g.Type) && !IsSignedInteger(g.Type))
+	return g.read()
+}
+
+// SetUint64 sets the value of an unsigned integer global, truncating it to
+// the width of the global.
+func (g *Global) SetUint64(value uint64) {
+	g.checkType("an unsigned integer", IsInteger(g.Type) && !IsSignedInteger(g.Type))
+	g.write(value)
+}
+
+// Bool returns the value of a bool global.
+func (g *Global) Bool() bool {
+	g.checkType("bool", g.Type.Type() == T_Bool)
+	return g.read() != 0
+}
+
+// SetBool sets the value of a bool global.
+func (g *Global) SetBool(value bool) {
+	g.checkType("bool", g.Type.Type() == T_Bool)
+	if value {
+		g.write(1)
+	} else {
+		g.write(0)
+	}
+}
+
+func (g *Global) checkType(expected string, ok bool) {
+	if !ok {
+		panic(fmt.Sprintf("Global %s is %s, not %s", g.Name, g.Type, expected))
+	}
+}
+
+func (g *Global) read() uint64 {
+	buf := make([]byte, 8)
+	if err := g.code.ReadData(g.offset, buf[:g.Type.Width()]); err != nil {
+		panic(err)
+	}
+	return binary.LittleEndian.Uint64(buf)
+}
+
+func (g *Global) write(value uint64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, value)
+	if err := g.code.WriteData(g.offset, buf[:g.Type.Width()]); err != nil {
+		panic(err)
+	}
+}
@@ -2,7 +2,6 @@ package ir
 
 import (
 	"fmt"
-	"github.com/bspaans/jit-compiler/asm/x86_64"
 	"github.com/bspaans/jit-compiler/asm/x86_64/encoding"
 	. "github.com/bspaans/jit-compiler/ir/shared"
 	"github.com/bspaans/jit-compiler/ir/statements"
@@ -10,10 +9,51 @@ import (
 	"github.com/bspaans/jit-compiler/lib/elf"
 )
 
-func Compile(targetArchitecture Architecture, abi ABI, stmts []IR, debug bool) (lib.MachineCode, error) {
+// Options configure how the IR gets compiled.
+type Options struct {
+	Debug bool
+	// CheckedArithmetic makes integer +, - and * trap with
+	// lib.ErrIntegerOverflow instead of wrapping around.
+	CheckedArithmetic bool
+	// Fuel makes every loop iteration and function call take one unit of
+	// the fuel passed to lib.Program.RunWithFuel, or to Func.CallWithFuel
+	// for functions and modules. The code traps with lib.ErrFuelExhausted
+	// when it runs out.
+	Fuel bool
+	// Arena makes CompileFunction load the code into a slot of the arena
+	// instead of mapping it separately.
+	Arena *lib.Arena
+	// Imports are the Go functions that extern declarations are bound to,
+	// by name. The function for
+	//
+	//	extern func lookup(note int64, velocity uint8) float64
+	//
+	// has to be a func(int64, uint8) float64, and externs without a return
+	// type take functions without a result. Externs are only supported by
+	// CompileFunction and CompileModule.
+	Imports map[string]interface{}
+	// Passes are the optimisations that run on the IR before it's compiled,
+	// e.g. NewPassManager(O2). Without a PassManager only the peephole
+	// optimiser runs. CompileModule and Module.Replace run the passes on
+	// every function on its own, so the functions of a module aren't
+	// inlined into each other and can still be replaced.
+	Passes *PassManager
+}
+
+// Compile runs the passes of opts on stmts, and compiles them into a
+// program.
+func Compile(targetArchitecture Architecture, abi ABI, stmts []IR, opts Options) (*lib.Program, error) {
+	passes := opts.passManager()
+	stmts, err := passes.Run(stmts, opts)
+	if err != nil {
+		return nil, err
+	}
 	fixedReturn := true
 	ctx := NewIRContext(targetArchitecture, abi, func(c *IR_Context) *IR_Context {
-		c.Debug = debug
+		c.Debug = opts.Debug
+		c.CheckedArithmetic = opts.CheckedArithmetic
+		c.Fuel = opts.Fuel
+		c.SkipPeephole = !passes.Enabled("peephole")
 		if fixedReturn && len(stmts) > 0 {
 			stmt := stmts[len(stmts)-1]
 
@@ -30,7 +70,7 @@ func Compile(targetArchitecture Architecture, abi ABI, stmts []IR, debug bool) (
 }
 
 //goland:noinspection GoUnusedExportedFunction
-func CompileOrigin(targetArchitecture Architecture, abi ABI, stmts []IR, debug bool) (lib.MachineCode, error) {
+func CompileOrigin(targetArchitecture Architecture, abi ABI, stmts []IR, debug bool) (*lib.Program, error) {
 	ctx := NewIRContext(targetArchitecture, abi, func(c *IR_Context) *IR_Context {
 		c.Debug = debug
 		return c
@@ -39,9 +79,15 @@ func CompileOrigin(targetArchitecture Architecture, abi ABI, stmts []IR, debug b
 }
 
 //goland:noinspection GoUnusedExportedFunction
-func CompileToBinary(targetArchitecture Architecture, abi ABI, stmts []IR, debug bool, path string) error {
+func CompileToBinary(targetArchitecture Architecture, abi ABI, stmts []IR, opts Options, path string) error {
+	passes := opts.passManager()
+	stmts, err := passes.Run(stmts, opts)
+	if err != nil {
+		return err
+	}
 	ctx := NewIRContext(targetArchitecture, abi, func(c *IR_Context) *IR_Context {
-		c.Debug = debug
+		c.Debug = opts.Debug
+		c.SkipPeephole = !passes.Enabled("peephole")
 		return c
 	})
 	ctx.ReturnOperandStack = []lib.Operand{encoding.Rax}
@@ -49,14 +95,13 @@ func CompileToBinary(targetArchitecture Architecture, abi ABI, stmts []IR, debug
 	if err != nil {
 		return err
 	}
-	return elf.CreateTinyBinary(code, path)
+	return elf.CreateTinyBinary(code.MachineCode, code.DataEnd, code.Entry, path)
 }
 
 //goland:noinspection GoErrorStringFormat
-func CompileWithContext(stmts []IR, ctx *IR_Context) (lib.MachineCode, error) {
+func CompileWithContext(stmts []IR, ctx *IR_Context) (*lib.Program, error) {
 	debug := ctx.Debug
 
-	var result []uint8
 	segments, err := ctx.Architecture.EncodeDataSection(stmts, ctx)
 	if err != nil {
 		return nil, err
@@ -64,38 +109,29 @@ func CompileWithContext(stmts []IR, ctx *IR_Context) (lib.MachineCode, error) {
 	if debug {
 		fmt.Println(segments.String())
 	}
+	if len(ctx.Externs) > 0 {
+		return nil, fmt.Errorf("Extern functions can only be called from functions and modules")
+	}
 	// TODO: do this properly
 	ctx.Segments = segments
-	dataSection := segments.Encode()
+	result := segments.Encode()
 
-	ctx.InstructionPointer += uint(len(dataSection))
+	// The code for stmts follows the functions in the executable segment.
+	ctx.InstructionPointer = uint(len(result))
 	if debug {
 		fmt.Println("_start:")
 	}
-	if len(dataSection) > 0 {
-		// TODO make Architecture dependent
-		jmp := x86_64.JMP(encoding.Uint8(len(dataSection)))
-		if debug {
-			fmt.Printf("0x%x: %s\n", 0, jmp.String())
-		}
-		result_, err := jmp.Encode()
-		if err != nil {
-			return nil, err
-		}
-		result = result_
-		if debug {
-			fmt.Println(result_)
-		}
-		result = append(result, dataSection...)
-	} else {
-		ctx.InstructionPointer = 0
-	}
-	address := uint(2 + len(dataSection))
+	entry := len(result)
+	address := uint(entry)
 	for _, stmt := range stmts {
 		code, err := ctx.Architecture.EncodeStatement(stmt, ctx)
 		if err != nil {
 			return nil, fmt.Errorf("Error encoding %s: %s", stmt, err.Error())
 		}
+		code, err = ctx.Peephole(code)
+		if err != nil {
+			return nil, fmt.Errorf("Error encoding %s: %s", stmt, err.Error())
+		}
 		if debug {
 			fmt.Println("\n:: " + stmt.String() + "\n")
 		}
@@ -113,9 +149,16 @@ func CompileWithContext(stmts []IR, ctx *IR_Context) (lib.MachineCode, error) {
 			}
 			result = append(result, buf...)
 		}
+		// The peephole optimiser shortened the code that the statement was
+		// encoded for.
+		ctx.InstructionPointer = address
 	}
 	if debug {
 		fmt.Println()
 	}
-	return result, nil
+	return &lib.Program{
+		MachineCode: result,
+		DataEnd:     segments.CodeStart(),
+		Entry:       entry,
+	}, nil
 }
@@ -1,12 +1,22 @@
 package ir
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"unsafe"
 
 	"github.com/bspaans/jit-compiler/ir/encoding/x86_64"
 	. "github.com/bspaans/jit-compiler/ir/expr"
 	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/ssa"
 	. "github.com/bspaans/jit-compiler/ir/statements"
+	"github.com/bspaans/jit-compiler/lib"
 )
 
 var TargetArch = &x86_64.X86_64{}
@@ -28,7 +38,7 @@ var ShouldRun = [][]IR{
 func Test_ShouldRun(t *testing.T) {
 	for _, ir := range ShouldRun {
 		debug := false
-		b, err := Compile(TargetArch, TargetABI, ir, debug)
+		b, err := Compile(TargetArch, TargetABI, ir, Options{Debug: debug})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -48,308 +58,545 @@ func Test_DbgParseExecute_Happy(t *testing.T) {
 			t.Fatal(err, "in", ir)
 		}
 		debug := false
-		b, err := Compile(TargetArch, TargetABI, []IR{i}, debug)
+		b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{Debug: debug})
 		if err != nil {
 			if !debug {
-				Compile(TargetArch, TargetABI, []IR{i}, true)
+				Compile(TargetArch, TargetABI, []IR{i}, Options{Debug: true})
 			}
 			t.Fatal(err, "in", ir)
 		}
 		value := b.Execute(debug)
 		if value != 53 {
 			if !debug {
-				Compile(TargetArch, TargetABI, []IR{i}, true)
+				Compile(TargetArch, TargetABI, []IR{i}, Options{Debug: true})
 				b.Execute(true)
 			}
 			t.Fatal("Expecting 53 got", value, "in", ir, "\n", b)
 		}
 
 		transformed := i.SSA_Transform(NewSSA_Context())
-		b2, err := Compile(TargetArch, TargetABI, []IR{transformed}, debug)
+		b2, err := Compile(TargetArch, TargetABI, []IR{transformed}, Options{Debug: debug})
 		if err != nil {
 			t.Fatal(err)
 		}
 		value = b2.Execute(debug)
 		if value != 53 {
 			if !debug {
-				Compile(TargetArch, TargetABI, []IR{transformed}, true)
+				Compile(TargetArch, TargetABI, []IR{transformed}, Options{Debug: true})
 			}
 			t.Fatal("Expecting 53 got", value, "in", ir, " after SSA transform\n", transformed)
 		}
 
+		// SSA_Transform changes some statements in place.
+		i, _ = ParseIR(ir + "; return f")
+		roundTrip, err := ssa.Transform([]IR{i}, func(f *ssa.Func) error {
+			if err := ssa.Inline(f); err != nil {
+				return err
+			}
+			if err := ssa.FoldConstants(f); err != nil {
+				return err
+			}
+			if err := ssa.ReduceStrength(f); err != nil {
+				return err
+			}
+			if err := ssa.NumberValues(f); err != nil {
+				return err
+			}
+			if err := ssa.HoistLoopInvariants(f); err != nil {
+				return err
+			}
+			if err := ssa.EliminateDeadCode(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", ir)
+		}
+		b3, err := Compile(TargetArch, TargetABI, roundTrip, Options{Debug: debug})
+		if err != nil {
+			t.Fatal(err, "in", ir, "after SSA round trip\n", roundTrip)
+		}
+		value = b3.Execute(debug)
+		if value != 53 {
+			t.Fatal("Expecting 53 got", value, "in", ir, "after SSA round trip\n", roundTrip)
+		}
 	}
 }
 
+// HappyUnits are programs that set f to 53.
+var HappyUnits = []string{
+
+	// int64 (default)
+	`f = 53`,
+	`f = 51 + 2`,
+	`f = 55 - 2`,
+	`f = 3 + 25 * 2`,
+	`f = (2 * 25) + 3`,
+	`f = 3 + (2 * 25)`,
+	`f = (100 / 2) + 3`,
+	`f = 3 + (100 / 2)`,
+	`h = 2; f = (h * 25) + 3`,
+	`h = 25; f = (2 * h) + 3`,
+	`h = 3; f = (2 * 25) + h`,
+	`f = -53 * -1`,
+	`f = -53 / -1`,
+	`h = 3; f = 50; f = h + f`,
+	`h = 56; f = 3; f = h - f`,
+	`h = 106; f = h / 2`,
+	`h = 371; f = h / 7`,
+	`h = -159; f = h / -3`,
+
+	// uint8
+	`f = uint8(51) + uint8(2)`,
+	`f = uint8(55) - uint8(2)`,
+	`f = (uint8(2) * uint8(25)) + uint8(3)`,
+	`f = uint8(3) + (uint8(2) * uint8(25))`,
+	`f = uint8(3) + (uint8(100) / uint8(2))`,
+	`f = (uint8(100) / uint8(2)) + uint8(3)`,
+
+	// int8
+	`f = int8(54) + int8(-1)`,
+	`f = int8(106) / int8(2)`,
+	`f = int8(-53) / int8(-1)`,
+	`f = int8(-53) / int8(-1)`,
+	`f = int8(-53) * int8(-1)`,
+	`g= 255552;f = int8(-53) / int8(-1)`,
+
+	// uint16
+	`f = uint16(51) + uint16(2)`,
+	`f = uint16(55) - uint16(2)`,
+	`f = (uint16(2) * uint16(25)) + uint16(3)`,
+	`f = uint16(3) + (uint16(2) * uint16(25))`,
+	`f = uint16(3) + (uint16(100) / uint16(2))`,
+	`f = (uint16(100) / uint16(2)) + uint16(3)`,
+
+	// int16
+	`f = int16(54) + int16(-1)`,
+	`f = int16(-53) * int16(-1)`,
+	`g= 25555212213;f = int16(-53) / int16(-1)`,
+
+	// uint32
+	`f = uint32(51) + uint32(2)`,
+	`f = uint32(55) - uint32(2)`,
+	`f = (uint32(2) * uint32(25)) + uint32(3)`,
+	`f = uint32(3) + (uint32(2) * uint32(25))`,
+	`f = uint32(3) + (uint32(100) / uint32(2))`,
+	`f = (uint32(100) / uint32(2)) + uint32(3)`,
+
+	// int32
+	`f = int32(54) + int32(-1)`,
+	`f = int32(-53) * int32(-1)`,
+	`f = int32(-53) / int32(-1)`,
+
+	// float64
+	`f = uint64(53.0)`,
+	`f = uint64(51.0 + 2.0)`,
+	`f = uint64(55.0 - 2.0)`,
+	`f = uint64(3.0 + 25.0 * 2.0)`,
+	`f = uint64((2.0 * 25.0) + 3.0)`,
+	`f = uint64(3.0 + (2.0 * 25.0))`,
+	`f = uint64((100.0/ 2.0) + 3.0)`,
+	`f = uint64(3.0 + (100.0 / 2.0))`,
+	`h = 2.0; f = uint64((h * 25.0) + 3.0)`,
+	`h = 25.0; f = uint64((2.0 * h) + 3.0)`,
+	`h = 3.0; f = uint64((2.0 * 25.0) + h)`,
+	`f = uint64(-53.0 * -1.0)`,
+	`f = uint64(-53.0 / -1.0)`,
+
+	// []uint64
+	`f = []uint64{53}[0]`,
+	`f = []uint64{42,52,53}[2]`,
+	`f = ([]uint64{42,52,53})[2]`,
+	`g = []uint64{42,52,53}; f = g[2]`,
+	`g = []uint64{42,52,53}; h = []uint64{42,52,53}; f = g[2]`,
+	`g = []uint64{42,52,53}; h = []uint64{42,52,53}; f = h[2]`,
+	`g = []uint64{13,13}; i = 0; while i != 53 { i = i + 1} ; f = i`,
+	`g = []uint64{13,13}; i = 0; while i != 53 { h = 2; i = i + 1} ; f = 53`,
+	`g = []uint64{42,52,53}; f = g[2]`,
+	`g = []uint64{42,52,53}; g[2] = g[2]; f = g[2]`,
+	`g = []uint64{42,52,53}; f = g[0] + uint64(11)`,
+	`g = []uint64{42,52,53}; g[0] = 53; f = g[0]`, // TODO this shouldn't actually work without auto casting
+	`g = []uint64{42,52,53}; g[1] = 53; f = g[1]`,
+	`g = []uint64{42,52,33}; g[2] = 53; f = g[2]`,
+	`g = []uint64{42,52,53}; g[0] = 42 + 11; f = g[0]`,
+	`g = []uint64{42,52,53}; g[0] = uint64(11) + g[0]; f = g[0]`,
+	`g = []uint64{42,52,53}; g[0] = uint64(1) + g[1]; f = g[0]`,
+	`g = []uint64{42,52,53}; g[0] = g[0] + uint64(11); f = g[0]`,
+	`g = []uint64{42,52,53}; g[1] = g[1] + uint64(1); f = g[1]`,
+
+	// []uint8
+	`g = []uint8{42,52,53}; g[0] = uint8(42) + uint8(11); f = g[0]`,
+	`g = []uint8{42,52,53}; g[0] = g[0] + uint8(11); f = g[0]`,
+	`g = []uint8{53} ; f = uint64(g[0])`,
+	`g = []uint8{52,53} ; f = uint64(g[1])`,
+	`g = []uint8{51} ; g[0] = g[0] + uint8(2); f = uint64(g[0])`,
+	`g = []uint8{51} ; f = uint64(2) + uint64(g[0])`,
+	// TODO `g = []uint8{51} ; f = 2 + uint64(g[0])`,
+
+	// []uint16
+	`g = []uint16{42,52,53}; g[0] = uint16(42) + uint16(11); f = g[0]`,
+	`g = []uint16{42,52,53}; g[0] = g[0] + uint16(11); f = g[0]`,
+	`g = []uint16{53} ; f = uint64(g[0])`,
+	`g = []uint16{52,53} ; f = uint64(g[1])`,
+	`g = []uint16{51} ; g[0] = g[0] + uint16(2); f = uint64(g[0])`,
+	`g = []uint16{51} ; f = uint64(2) + uint64(g[0])`,
+
+	// []uint32
+	`g = []uint32{42,52,53}; g[0] = uint32(42) + uint32(11); f = g[0]`,
+	`g = []uint32{42,52,53}; g[0] = g[0] + uint32(11); f = g[0]`,
+	`g = []uint32{53} ; f = uint64(g[0])`,
+	`g = []uint32{52,53} ; f = uint64(g[1])`,
+	`g = []uint32{51} ; g[0] = g[0] + uint32(2); f = uint64(g[0])`,
+	`g = []uint32{51} ; f = uint64(2) + uint64(g[0])`,
+
+	// []float64
+	`g = []float64{53.0}; h = uint64(g[0]) ; f = h`,
+	`g = []float64{53.0}; h =g[0] ; f = uint64(h)`,
+	`g = []float64{51.0}; g[0] = g[0] + 2.0 ; f = uint64(g[0])`,
+
+	// while loops with int64
+	`i = 0; while i != 53 { i = i + 1} ; f = i`,
+	`i = 0; while i < 53 { i = i + 1} ; f = i`,
+	`i = 0; while i <= 52 { i = i + 1} ; f = i`,
+	`i = 100; while i > 53 { i = i - 1} ; f = i`,
+	`i = 100; while i >= 54 { i = i - 1} ; f = i`,
+	`k = 2;j = 1; i = 0; while i != 53 { i = i + 1} ; f = i`,
+	`k = 2;j = 1; i = 0; while i != 53 { i = i + 1} ; f = 53`,
+	`f = 0; while f != 53 { f = f + 1 }`,
+	`j = 1; i = 5; while i == 5 { j = j + 1; if j == 5 { i = 53 } else { i = 5 }}; f = i`,
+
+	// if statements with int64
+	`if 15 == 15 { f = 53 } else { f = 100 }`,
+	`k = 21; j = 1; if 15 == 15 { f = 53 } else { f = 100 }`,
+	`if 13 != 15 { f = 53 } else { f = 100 }`,
+	`if 13 < 15 { f = 53 } else { f = 100 }`,
+	`if 14 <= 15 { f = 53 } else { f = 100 }`,
+	`if 15 <= 15 { f = 53 } else { f = 100 }`,
+	`if 13 == 15 { f = 100 } else { f = 53 }`,
+	`if 13 > 15 { f = 100 } else { f = 53 }`,
+	`if 13 >= 15 { f = 100 } else { f = 53 }`,
+	`if 16 > 15 { f = 53 } else { f = 100 }`,
+	`if 15 >= 15 { f = 53 } else { f = 100 }`,
+	`if (15 == 15) && (17 == 17) { f = 53 } else { f = 100 }`,
+	`if (14 < 15) && (14 <= 17) { f = 53 } else { f = 100 }`,
+	`if (16 > 15) && (19 >= 17) { f = 53 } else { f = 100 }`,
+	`if (15 == 15) && (17 == 14) { f = 100 } else { f = 53 }`,
+	`if (15 == 14) && (17 == 16) { f = 100 } else { f = 53 }`,
+	`if (15 == 14) && (17 == 17) { f = 100 } else { f = 53 }`,
+	`if (15 == 14) || (17 == 17) { f = 53 } else { f = 100 }`,
+	`if (15 == 15) || (17 == 14) { f = 53 } else { f = 100 }`,
+	`if (15 == 14) || (17 == 14) { f = 100} else { f = 53 }`,
+
+	// boolean variables and if
+	`b = true; if b { f = 53 } else { f = 100 }`,
+	`b = !false; if b { f = 53 } else { f = 100 }`,
+	`b = false; if !b { f = 53 } else { f = 100 }`,
+	`b = true || true; if b { f = 53 } else { f = 100 }`,
+	`b = true || false; if b { f = 53 } else { f = 100 }`,
+	`b = false || true; if b { f = 53 } else { f = 100 }`,
+	`b = false || false; if !b { f = 53 } else { f = 100 }`,
+	`b = true && true; if b { f = 53 } else { f = 100 }`,
+	`b = true && false; if !b { f = 53 } else { f = 100 }`,
+	`b = false && true; if !b { f = 53 } else { f = 100 }`,
+	`b = false && false; if !b { f = 53 } else { f = 100 }`,
+	`b = 10 > 9; if b { f = 53 } else { f = 100 }`,
+	`b = 10 >= 9; if b { f = 53 } else { f = 100 }`,
+	`b = 10 < 9; if !b { f = 53 } else { f = 100 }`,
+	`b = 10 <= 9; if !b { f = 53 } else { f = 100 }`,
+	`b = int8(15) < int8(-1); if !b { f = 53 } else { f = 100 }`,
+	`c = int8(127) <= int8(-127); if !c { f = 53 } else { f = 100 }`,
+	`b = int8(15) < int8(-1); c = int8(127) <= int8(-127); if (!b) && (!c) { f = 53 } else { f = 100 }`,
+	`b = int8(15) < int8(-1) ; c = !b ; d = int8(127) <= int8(-127) ; e = !d ; if c && e { f = 53 } else { f = 100 }`,
+
+	// short-circuit evaluation; g[i] would fault if it was evaluated
+	`g = []uint64{1}; i = 100000000000; if (i < 1) && (g[i] == uint64(1)) { f = 100 } else { f = 53 }`,
+	`g = []uint64{1}; i = 100000000000; if (i > 1) || (g[i] == uint64(1)) { f = 53 } else { f = 100 }`,
+	`g = []uint64{1}; i = 100000000000; if !((i < 1) && (g[i] == uint64(1))) { f = 53 } else { f = 100 }`,
+	`g = []uint64{1}; i = 100000000000; if ((i < 1) && (g[i] == uint64(1))) || (i == 100000000000) { f = 53 } else { f = 100 }`,
+	`g = []uint64{1}; i = 100000000000; b = (i < 1) && (g[i] == uint64(1)); if !b { f = 53 } else { f = 100 }`,
+	`g = []uint64{1}; i = 100000000000; b = (i > 1) || (g[i] == uint64(1)); if b { f = 53 } else { f = 100 }`,
+	`g = []uint64{1}; i = 0; b = (i < 1) && (g[i] == uint64(1)); if b { f = 53 } else { f = 100 }`,
+	`g = []uint64{1}; i = 0; b = (i > 1) || (g[i] == uint64(1)); if b { f = 53 } else { f = 100 }`,
+	`g = []uint64{5,5,5,0}; i = 0; while (i < 3) && (g[i] != uint64(0)) { i = i + 1 }; f = 50 + i`,
+	`g = []uint64{5,0}; i = 100000000000; while (i > 1) || (g[i] != uint64(0)) { i = i / 10 }; f = 52 + i`,
+
+	// if statements with uint8
+	`if uint8(13) < uint8(15) { f = 53 } else { f = 100 }`,
+	`if uint8(15) <= uint8(15) { f = 53 } else { f = 100 }`,
+	`if uint8(14) <= uint8(15) { f = 53 } else { f = 100 }`,
+	`if (uint8(13) < uint8(15)) && (uint8(15) <= uint8(15)) { f = 53 } else { f = 100 }`,
+
+	// if statements with uint16
+	`if uint16(13) < uint16(15) { f = 53 } else { f = 100 }`,
+	`if uint16(13) <= uint16(15) { f = 53 } else { f = 100 }`,
+	`if uint16(15) <= uint16(15) { f = 53 } else { f = 100 }`,
+
+	// if statements with uint32
+	`if uint32(13) < uint32(15) { f = 53 } else { f = 100 }`,
+	`if uint32(15) <= uint32(15) { f = 53 } else { f = 100 }`,
+	`if uint32(13) <= uint32(15) { f = 53 } else { f = 100 }`,
+
+	// if statements with int8
+	`if int8(13) < int8(15) { f = 53 } else { f = 100 }`,
+	`if int8(-1) < int8(15) { f = 53 } else { f = 100 }`,
+	`if int8(-1) <= int8(15) { f = 53 } else { f = 100 }`,
+	`if int8(15) <= int8(15) { f = 53 } else { f = 100 }`,
+	`if (int8(-1) < int8(15)) && (int8(-125) <= int8(15)) { f = 53 } else { f = 100 }`,
+	`if (int8(15) > int8(-1)) && (int8(127) >= int8(-127)) { f = 53 } else { f = 100 }`,
+	`if (!(int8(15) < int8(-1))) && (!(int8(127) <= int8(-127))) { f = 53 } else { f = 100 }`,
+
+	// if statements with int16
+	`if int16(13) < int16(15) { f = 53 } else { f = 100 }`,
+	`if int16(-1) < int16(15) { f = 53 } else { f = 100 }`,
+	`if int16(-1) <= int16(15) { f = 53 } else { f = 100 }`,
+	`if int16(15) <= int16(15) { f = 53 } else { f = 100 }`,
+	// TODO: fix operator precedence
+	`if (int16(-1) < int16(15)) && (int16(-127) <= int16(15)) { f = 53 } else { f = 100 }`,
+	`if (int16(15) > int16(-1)) && (int16(127) >= int16(-127)) { f = 53 } else { f = 100 }`,
+	`if (!(int16(15) < int16(-1))) && (!(int16(127) <= int16(-127))) { f = 53 } else { f = 100 }`,
+	`if (!(int16(-2) > int16(-1))) && (!(int16(17) >= int16(18))) { f = 53 } else { f = 100 }`,
+
+	// if statements with int32
+	`if int32(13) < int32(15) { f = 53 } else { f = 100 }`,
+	`if int32(-1) < int32(15) { f = 53 } else { f = 100 }`,
+	`if int32(15) <= int32(15) { f = 53 } else { f = 100 }`,
+	`if int32(-1) <= int32(15) { f = 53 } else { f = 100 }`,
+	`if (int32(-1) < int32(15)) && (int32(-127) <= int32(15)) { f = 53 } else { f = 100 }`,
+	`if (int32(15) > int32(-1)) && (int32(127) >= int32(-127)) { f = 53 } else { f = 100 }`,
+	`if (!(int32(15) < int32(-1))) && (!(int32(127) <= int32(-127))) { f = 53 } else { f = 100 }`,
+
+	// structs
+	`b = struct{Field int64}{53}; f = b.Field`,
+	`b = struct{Field int64
+	            Field2 int64}{51, 53}; f = b.Field2`,
+
+	// functions
+	`b = func(i uint64) uint64 { return i - uint64(2) }; f = b(55)`,
+	`func b(i uint64) uint64 { return i - uint64(2)}; f = b(55)`,
+}
+
 //goland:noinspection GoBoolExpressions,GoUnhandledErrorResult
 func Test_ParseExecute_Happy(t *testing.T) {
-	units := []string{
-
-		// int64 (default)
-		`f = 53`,
-		`f = 51 + 2`,
-		`f = 55 - 2`,
-		`f = 3 + 25 * 2`,
-		`f = (2 * 25) + 3`,
-		`f = 3 + (2 * 25)`,
-		`f = (100 / 2) + 3`,
-		`f = 3 + (100 / 2)`,
-		`h = 2; f = (h * 25) + 3`,
-		`h = 25; f = (2 * h) + 3`,
-		`h = 3; f = (2 * 25) + h`,
-		`f = -53 * -1`,
-		`f = -53 / -1`,
-
-		// uint8
-		`f = uint8(51) + uint8(2)`,
-		`f = uint8(55) - uint8(2)`,
-		`f = (uint8(2) * uint8(25)) + uint8(3)`,
-		`f = uint8(3) + (uint8(2) * uint8(25))`,
-		`f = uint8(3) + (uint8(100) / uint8(2))`,
-		`f = (uint8(100) / uint8(2)) + uint8(3)`,
-
-		// int8
-		`f = int8(54) + int8(-1)`,
-		`f = int8(106) / int8(2)`,
-		`f = int8(-53) / int8(-1)`,
-		`f = int8(-53) / int8(-1)`,
-		`f = int8(-53) * int8(-1)`,
-		`g= 255552;f = int8(-53) / int8(-1)`,
-
-		// uint16
-		`f = uint16(51) + uint16(2)`,
-		`f = uint16(55) - uint16(2)`,
-		`f = (uint16(2) * uint16(25)) + uint16(3)`,
-		`f = uint16(3) + (uint16(2) * uint16(25))`,
-		`f = uint16(3) + (uint16(100) / uint16(2))`,
-		`f = (uint16(100) / uint16(2)) + uint16(3)`,
-
-		// int16
-		`f = int16(54) + int16(-1)`,
-		`f = int16(-53) * int16(-1)`,
-		`g= 25555212213;f = int16(-53) / int16(-1)`,
-
-		// uint32
-		`f = uint32(51) + uint32(2)`,
-		`f = uint32(55) - uint32(2)`,
-		`f = (uint32(2) * uint32(25)) + uint32(3)`,
-		`f = uint32(3) + (uint32(2) * uint32(25))`,
-		`f = uint32(3) + (uint32(100) / uint32(2))`,
-		`f = (uint32(100) / uint32(2)) + uint32(3)`,
-
-		// int32
-		`f = int32(54) + int32(-1)`,
-		`f = int32(-53) * int32(-1)`,
-		`f = int32(-53) / int32(-1)`,
-
-		// float64
-		`f = uint64(53.0)`,
-		`f = uint64(51.0 + 2.0)`,
-		`f = uint64(55.0 - 2.0)`,
-		`f = uint64(3.0 + 25.0 * 2.0)`,
-		`f = uint64((2.0 * 25.0) + 3.0)`,
-		`f = uint64(3.0 + (2.0 * 25.0))`,
-		`f = uint64((100.0/ 2.0) + 3.0)`,
-		`f = uint64(3.0 + (100.0 / 2.0))`,
-		`h = 2.0; f = uint64((h * 25.0) + 3.0)`,
-		`h = 25.0; f = uint64((2.0 * h) + 3.0)`,
-		`h = 3.0; f = uint64((2.0 * 25.0) + h)`,
-		`f = uint64(-53.0 * -1.0)`,
-		`f = uint64(-53.0 / -1.0)`,
-
-		// []uint64
-		`f = []uint64{53}[0]`,
-		`f = []uint64{42,52,53}[2]`,
-		`f = ([]uint64{42,52,53})[2]`,
-		`g = []uint64{42,52,53}; f = g[2]`,
-		`g = []uint64{42,52,53}; h = []uint64{42,52,53}; f = g[2]`,
-		`g = []uint64{42,52,53}; h = []uint64{42,52,53}; f = h[2]`,
-		`g = []uint64{13,13}; i = 0; while i != 53 { i = i + 1} ; f = i`,
-		`g = []uint64{13,13}; i = 0; while i != 53 { h = 2; i = i + 1} ; f = 53`,
-		`g = []uint64{42,52,53}; f = g[2]`,
-		`g = []uint64{42,52,53}; g[2] = g[2]; f = g[2]`,
-		`g = []uint64{42,52,53}; f = g[0] + uint64(11)`,
-		`g = []uint64{42,52,53}; g[0] = 53; f = g[0]`, // TODO this shouldn't actually work without auto casting
-		`g = []uint64{42,52,53}; g[1] = 53; f = g[1]`,
-		`g = []uint64{42,52,33}; g[2] = 53; f = g[2]`,
-		`g = []uint64{42,52,53}; g[0] = 42 + 11; f = g[0]`,
-		`g = []uint64{42,52,53}; g[0] = uint64(11) + g[0]; f = g[0]`,
-		`g = []uint64{42,52,53}; g[0] = uint64(1) + g[1]; f = g[0]`,
-		`g = []uint64{42,52,53}; g[0] = g[0] + uint64(11); f = g[0]`,
-		`g = []uint64{42,52,53}; g[1] = g[1] + uint64(1); f = g[1]`,
-
-		// []uint8
-		`g = []uint8{42,52,53}; g[0] = uint8(42) + uint8(11); f = g[0]`,
-		`g = []uint8{42,52,53}; g[0] = g[0] + uint8(11); f = g[0]`,
-		`g = []uint8{53} ; f = uint64(g[0])`,
-		`g = []uint8{52,53} ; f = uint64(g[1])`,
-		`g = []uint8{51} ; g[0] = g[0] + uint8(2); f = uint64(g[0])`,
-		`g = []uint8{51} ; f = uint64(2) + uint64(g[0])`,
-		// TODO `g = []uint8{51} ; f = 2 + uint64(g[0])`,
-
-		// []uint16
-		`g = []uint16{42,52,53}; g[0] = uint16(42) + uint16(11); f = g[0]`,
-		`g = []uint16{42,52,53}; g[0] = g[0] + uint16(11); f = g[0]`,
-		`g = []uint16{53} ; f = uint64(g[0])`,
-		`g = []uint16{52,53} ; f = uint64(g[1])`,
-		`g = []uint16{51} ; g[0] = g[0] + uint16(2); f = uint64(g[0])`,
-		`g = []uint16{51} ; f = uint64(2) + uint64(g[0])`,
-
-		// []uint32
-		`g = []uint32{42,52,53}; g[0] = uint32(42) + uint32(11); f = g[0]`,
-		`g = []uint32{42,52,53}; g[0] = g[0] + uint32(11); f = g[0]`,
-		`g = []uint32{53} ; f = uint64(g[0])`,
-		`g = []uint32{52,53} ; f = uint64(g[1])`,
-		`g = []uint32{51} ; g[0] = g[0] + uint32(2); f = uint64(g[0])`,
-		`g = []uint32{51} ; f = uint64(2) + uint64(g[0])`,
-
-		// []float64
-		`g = []float64{53.0}; h = uint64(g[0]) ; f = h`,
-		`g = []float64{53.0}; h =g[0] ; f = uint64(h)`,
-		`g = []float64{51.0}; g[0] = g[0] + 2.0 ; f = uint64(g[0])`,
-
-		// while loops with int64
-		`i = 0; while i != 53 { i = i + 1} ; f = i`,
-		`i = 0; while i < 53 { i = i + 1} ; f = i`,
-		`i = 0; while i <= 52 { i = i + 1} ; f = i`,
-		`i = 100; while i > 53 { i = i - 1} ; f = i`,
-		`i = 100; while i >= 54 { i = i - 1} ; f = i`,
-		`k = 2;j = 1; i = 0; while i != 53 { i = i + 1} ; f = i`,
-		`k = 2;j = 1; i = 0; while i != 53 { i = i + 1} ; f = 53`,
-		`f = 0; while f != 53 { f = f + 1 }`,
-		`j = 1; i = 5; while i == 5 { j = j + 1; if j == 5 { i = 53 } else { i = 5 }}; f = i`,
-
-		// if statements with int64
-		`if 15 == 15 { f = 53 } else { f = 100 }`,
-		`k = 21; j = 1; if 15 == 15 { f = 53 } else { f = 100 }`,
-		`if 13 != 15 { f = 53 } else { f = 100 }`,
-		`if 13 < 15 { f = 53 } else { f = 100 }`,
-		`if 14 <= 15 { f = 53 } else { f = 100 }`,
-		`if 15 <= 15 { f = 53 } else { f = 100 }`,
-		`if 13 == 15 { f = 100 } else { f = 53 }`,
-		`if 13 > 15 { f = 100 } else { f = 53 }`,
-		`if 13 >= 15 { f = 100 } else { f = 53 }`,
-		`if 16 > 15 { f = 53 } else { f = 100 }`,
-		`if 15 >= 15 { f = 53 } else { f = 100 }`,
-		`if (15 == 15) && (17 == 17) { f = 53 } else { f = 100 }`,
-		`if (14 < 15) && (14 <= 17) { f = 53 } else { f = 100 }`,
-		`if (16 > 15) && (19 >= 17) { f = 53 } else { f = 100 }`,
-		`if (15 == 15) && (17 == 14) { f = 100 } else { f = 53 }`,
-		`if (15 == 14) && (17 == 16) { f = 100 } else { f = 53 }`,
-		`if (15 == 14) && (17 == 17) { f = 100 } else { f = 53 }`,
-		`if (15 == 14) || (17 == 17) { f = 53 } else { f = 100 }`,
-		`if (15 == 15) || (17 == 14) { f = 53 } else { f = 100 }`,
-		`if (15 == 14) || (17 == 14) { f = 100} else { f = 53 }`,
-
-		// boolean variables and if
-		`b = true; if b { f = 53 } else { f = 100 }`,
-		`b = !false; if b { f = 53 } else { f = 100 }`,
-		`b = false; if !b { f = 53 } else { f = 100 }`,
-		`b = true || true; if b { f = 53 } else { f = 100 }`,
-		`b = true || false; if b { f = 53 } else { f = 100 }`,
-		`b = false || true; if b { f = 53 } else { f = 100 }`,
-		`b = false || false; if !b { f = 53 } else { f = 100 }`,
-		`b = true && true; if b { f = 53 } else { f = 100 }`,
-		`b = true && false; if !b { f = 53 } else { f = 100 }`,
-		`b = false && true; if !b { f = 53 } else { f = 100 }`,
-		`b = false && false; if !b { f = 53 } else { f = 100 }`,
-		`b = 10 > 9; if b { f = 53 } else { f = 100 }`,
-		`b = 10 >= 9; if b { f = 53 } else { f = 100 }`,
-		`b = 10 < 9; if !b { f = 53 } else { f = 100 }`,
-		`b = 10 <= 9; if !b { f = 53 } else { f = 100 }`,
-		`b = int8(15) < int8(-1); if !b { f = 53 } else { f = 100 }`,
-		`c = int8(127) <= int8(-127); if !c { f = 53 } else { f = 100 }`,
-		`b = int8(15) < int8(-1); c = int8(127) <= int8(-127); if (!b) && (!c) { f = 53 } else { f = 100 }`,
-		`b = int8(15) < int8(-1) ; c = !b ; d = int8(127) <= int8(-127) ; e = !d ; if c && e { f = 53 } else { f = 100 }`,
-
-		// if statements with uint8
-		`if uint8(13) < uint8(15) { f = 53 } else { f = 100 }`,
-		`if uint8(15) <= uint8(15) { f = 53 } else { f = 100 }`,
-		`if uint8(14) <= uint8(15) { f = 53 } else { f = 100 }`,
-		`if (uint8(13) < uint8(15)) && (uint8(15) <= uint8(15)) { f = 53 } else { f = 100 }`,
-
-		// if statements with uint16
-		`if uint16(13) < uint16(15) { f = 53 } else { f = 100 }`,
-		`if uint16(13) <= uint16(15) { f = 53 } else { f = 100 }`,
-		`if uint16(15) <= uint16(15) { f = 53 } else { f = 100 }`,
-
-		// if statements with uint32
-		`if uint32(13) < uint32(15) { f = 53 } else { f = 100 }`,
-		`if uint32(15) <= uint32(15) { f = 53 } else { f = 100 }`,
-		`if uint32(13) <= uint32(15) { f = 53 } else { f = 100 }`,
-
-		// if statements with int8
-		`if int8(13) < int8(15) { f = 53 } else { f = 100 }`,
-		`if int8(-1) < int8(15) { f = 53 } else { f = 100 }`,
-		`if int8(-1) <= int8(15) { f = 53 } else { f = 100 }`,
-		`if int8(15) <= int8(15) { f = 53 } else { f = 100 }`,
-		`if (int8(-1) < int8(15)) && (int8(-125) <= int8(15)) { f = 53 } else { f = 100 }`,
-		`if (int8(15) > int8(-1)) && (int8(127) >= int8(-127)) { f = 53 } else { f = 100 }`,
-		`if (!(int8(15) < int8(-1))) && (!(int8(127) <= int8(-127))) { f = 53 } else { f = 100 }`,
-
-		// if statements with int16
-		`if int16(13) < int16(15) { f = 53 } else { f = 100 }`,
-		`if int16(-1) < int16(15) { f = 53 } else { f = 100 }`,
-		`if int16(-1) <= int16(15) { f = 53 } else { f = 100 }`,
-		`if int16(15) <= int16(15) { f = 53 } else { f = 100 }`,
-		// TODO: fix operator precedence
-		`if (int16(-1) < int16(15)) && (int16(-127) <= int16(15)) { f = 53 } else { f = 100 }`,
-		`if (int16(15) > int16(-1)) && (int16(127) >= int16(-127)) { f = 53 } else { f = 100 }`,
-		`if (!(int16(15) < int16(-1))) && (!(int16(127) <= int16(-127))) { f = 53 } else { f = 100 }`,
-		`if (!(int16(-2) > int16(-1))) && (!(int16(17) >= int16(18))) { f = 53 } else { f = 100 }`,
-
-		// if statements with int32
-		`if int32(13) < int32(15) { f = 53 } else { f = 100 }`,
-		`if int32(-1) < int32(15) { f = 53 } else { f = 100 }`,
-		`if int32(15) <= int32(15) { f = 53 } else { f = 100 }`,
-		`if int32(-1) <= int32(15) { f = 53 } else { f = 100 }`,
-		`if (int32(-1) < int32(15)) && (int32(-127) <= int32(15)) { f = 53 } else { f = 100 }`,
-		`if (int32(15) > int32(-1)) && (int32(127) >= int32(-127)) { f = 53 } else { f = 100 }`,
-		`if (!(int32(15) < int32(-1))) && (!(int32(127) <= int32(-127))) { f = 53 } else { f = 100 }`,
-
-		// structs
-		`b = struct{Field int64}{53}; f = b.Field`,
-		`b = struct{Field int64
-		            Field2 int64}{51, 53}; f = b.Field2`,
-
-		// functions
-		`b = func(i uint64) uint64 { return i - uint64(2) }; f = b(55)`,
-		`func b(i uint64) uint64 { return i - uint64(2)}; f = b(55)`,
-	}
-	for _, ir := range units {
+	for _, ir := range HappyUnits {
 		i, err := ParseIR(ir + "; return f")
 		if err != nil {
 			t.Fatal(err, "in", ir)
 		}
 		debug := false
-		b, err := Compile(TargetArch, TargetABI, []IR{i}, debug)
+		b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{Debug: debug})
 		if err != nil {
 			if !debug {
-				Compile(TargetArch, TargetABI, []IR{i}, true)
+				Compile(TargetArch, TargetABI, []IR{i}, Options{Debug: true})
 			}
 			t.Fatal(err, "in", ir)
 		}
 		value := b.Execute(debug)
 		if value != 53 {
 			if !debug {
-				Compile(TargetArch, TargetABI, []IR{i}, true)
+				Compile(TargetArch, TargetABI, []IR{i}, Options{Debug: true})
 				b.Execute(true)
 			}
 			t.Fatal("Expecting 53 got", value, "in", ir, "\n", b)
 		}
 
 		transformed := i.SSA_Transform(NewSSA_Context())
-		b2, err := Compile(TargetArch, TargetABI, []IR{transformed}, debug)
+		b2, err := Compile(TargetArch, TargetABI, []IR{transformed}, Options{Debug: debug})
 		if err != nil {
 			t.Fatal(err)
 		}
 		value = b2.Execute(debug)
 		if value != 53 {
 			if !debug {
-				Compile(TargetArch, TargetABI, []IR{transformed}, true)
+				Compile(TargetArch, TargetABI, []IR{transformed}, Options{Debug: true})
 			}
 			t.Fatal("Expecting 53 got", value, "in", ir, " after SSA transform\n", transformed)
 		}
 
+		// SSA_Transform changes some statements in place.
+		i, _ = ParseIR(ir + "; return f")
+		roundTrip, err := ssa.Transform([]IR{i}, func(f *ssa.Func) error {
+			if err := ssa.Inline(f); err != nil {
+				return err
+			}
+			if err := ssa.FoldConstants(f); err != nil {
+				return err
+			}
+			if err := ssa.ReduceStrength(f); err != nil {
+				return err
+			}
+			if err := ssa.NumberValues(f); err != nil {
+				return err
+			}
+			if err := ssa.HoistLoopInvariants(f); err != nil {
+				return err
+			}
+			if err := ssa.EliminateDeadCode(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", ir)
+		}
+		b3, err := Compile(TargetArch, TargetABI, roundTrip, Options{Debug: debug})
+		if err != nil {
+			t.Fatal(err, "in", ir, "after SSA round trip\n", roundTrip)
+		}
+		value = b3.Execute(debug)
+		if value != 53 {
+			t.Fatal("Expecting 53 got", value, "in", ir, "after SSA round trip\n", roundTrip)
+		}
+	}
+}
+
+func Test_PassManager_Happy(t *testing.T) {
+	pipelines := []struct {
+		level   OptimisationLevel
+		enable  []string
+		disable []string
+	}{
+		{O0, nil, nil},
+		{O1, nil, nil},
+		{O2, nil, nil},
+		{O2, nil, []string{"flatten", "peephole"}},
+		{O0, []string{"inline", "eliminate-dead-code"}, nil},
+	}
+	for _, pipeline := range pipelines {
+		for _, ir := range HappyUnits {
+			passes, err := NewPassManager(pipeline.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := passes.Enable(pipeline.enable...); err != nil {
+				t.Fatal(err)
+			}
+			if err := passes.Disable(pipeline.disable...); err != nil {
+				t.Fatal(err)
+			}
+			i, err := ParseIR(ir + "; return f")
+			if err != nil {
+				t.Fatal(err, "in", ir)
+			}
+			b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{Passes: passes})
+			if err != nil {
+				t.Fatal(err, "in", ir, "with", passes.Passes())
+			}
+			if value := b.Execute(false); value != 53 {
+				t.Fatal("Expecting 53 got", value, "in", ir, "with", passes.Passes())
+			}
+		}
+	}
+}
+
+func Test_PassManager(t *testing.T) {
+	passes, err := NewPassManager(O2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := passes.Disable("flatten", "inline", "reduce-strength"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"fold-constants", "number-values", "hoist-loop-invariants", "eliminate-dead-code", "remove-unused-functions", "peephole"}
+	if !reflect.DeepEqual(passes.Passes(), expected) {
+		t.Errorf("Expecting %v got %v", expected, passes.Passes())
+	}
+	if err := passes.Enable("unroll"); err == nil {
+		t.Error("Expecting unknown pass error")
+	}
+	if _, err := NewPassManager(3); err == nil {
+		t.Error("Expecting unknown level error")
+	}
+
+	dump := &strings.Builder{}
+	passes.Dump = dump
+	program := MustParseIR(Stdlib + "a = 3 * 4; f = Max(a, 53); return f")
+	b, err := Compile(TargetArch, TargetABI, []IR{program}, Options{Passes: passes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := b.Execute(false); value != 53 {
+		t.Error("Expecting 53 got", value)
+	}
+	for _, pass := range expected[:len(expected)-1] {
+		if !strings.Contains(dump.String(), "# after "+pass+"\n") {
+			t.Errorf("Expecting the IR after %s in\n%s", pass, dump)
+		}
+	}
+	last := dump.String()[strings.LastIndex(dump.String(), "# after remove-unused-functions"):]
+	if strings.Contains(last, "func Close") || !strings.Contains(last, "f = Max(12, 53)") {
+		t.Errorf("Expecting the unused functions to be removed and the constants folded in\n%s", last)
+	}
+
+	// The peephole optimiser shortens the code.
+	sizes := map[bool]int{}
+	for _, peephole := range []bool{true, false} {
+		passes, _ := NewPassManager(O0)
+		if peephole {
+			_ = passes.Enable("peephole")
+		}
+		b, err := Compile(TargetArch, TargetABI, []IR{MustParseIR(`f = 0; while f != 53 { f = f + 1 }; return f`)}, Options{Passes: passes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[peephole] = len(b.MachineCode)
+	}
+	if sizes[true] >= sizes[false] {
+		t.Error("Expecting the peephole optimiser to shorten the code, got", sizes)
+	}
+
+	fn, err := ParseIRFunction(`func(a int64) int64 { b = a * 8; c = a * 8; return b + c }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passes, _ = NewPassManager(O2)
+	double, err := CompileFunc[func(int64) int64](TargetArch, TargetABI, fn, Options{Debug: true, Passes: passes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := double(3); value != 48 {
+		t.Error("Expecting 48 got", value)
+	}
+}
+
+// withoutPeephole is TargetArch without the peephole optimiser.
+type withoutPeephole struct {
+	*x86_64.X86_64
+}
+
+func (withoutPeephole) Peephole(code []lib.Instruction) ([]lib.Instruction, error) {
+	return code, nil
+}
+
+// Benchmark_Peephole_CodeSize reports the size of the code of HappyUnits,
+// with and without the peephole optimiser.
+func Benchmark_Peephole_CodeSize(b *testing.B) {
+	archs := []struct {
+		name string
+		arch Architecture
+	}{
+		{"peephole", TargetArch},
+		{"none", withoutPeephole{TargetArch}},
+	}
+	for _, a := range archs {
+		b.Run(a.name, func(b *testing.B) {
+			size := 0
+			for n := 0; n < b.N; n++ {
+				size = 0
+				for _, unit := range HappyUnits {
+					i, err := ParseIR(unit + "; return f")
+					if err != nil {
+						b.Fatal(err, "in", unit)
+					}
+					p, err := Compile(a.arch, TargetABI, []IR{i}, Options{})
+					if err != nil {
+						b.Fatal(err, "in", unit)
+					}
+					size += len(p.MachineCode) - p.DataEnd
+				}
+			}
+			b.ReportMetric(float64(size), "bytes")
+		})
 	}
 }
 
@@ -366,7 +613,7 @@ func Test_DbgExecute_Result(t *testing.T) {
 	for _, ir := range units {
 		i := append(ir, NewIR_Return(NewIR_Variable("f")))
 		debug := false
-		b, err := Compile(TargetArch, TargetABI, i, debug)
+		b, err := Compile(TargetArch, TargetABI, i, Options{Debug: debug})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -451,7 +698,7 @@ func Test_Execute_Result(t *testing.T) {
 	for _, ir := range units {
 		i := append(ir, NewIR_Return(NewIR_Variable("f")))
 		debug := false
-		b, err := Compile(TargetArch, TargetABI, i, debug)
+		b, err := Compile(TargetArch, TargetABI, i, Options{Debug: debug})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -462,6 +709,145 @@ func Test_Execute_Result(t *testing.T) {
 	}
 }
 
+// spillProgram assigns n variables that all stay live until they're summed,
+// which needs more registers than there are.
+func spillProgram(prefix string, n int, value func(i int) IRExpression) (IR, IRExpression) {
+	stmts := []IR{}
+	var sum IRExpression
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%s%d", prefix, i)
+		stmts = append(stmts, NewIR_Assignment(name, value(i)))
+		if sum == nil {
+			sum = NewIR_Variable(name)
+		} else {
+			sum = NewIR_Add(sum, NewIR_Variable(name))
+		}
+	}
+	return andThen(stmts), sum
+}
+
+func andThen(stmts []IR) IR {
+	if len(stmts) == 1 {
+		return stmts[0]
+	}
+	return NewIR_AndThen(stmts[0], andThen(stmts[1:]))
+}
+
+func Test_Execute_Spills(t *testing.T) {
+	ints := func() (IR, IRExpression) {
+		return spillProgram("v", 40, func(i int) IRExpression { return NewIR_Int64(int64(i + 1)) })
+	}
+	units := []struct {
+		name     string
+		program  func() IR
+		expected int
+	}{
+		{"ints", func() IR {
+			vars, sum := ints()
+			return NewIR_AndThen(vars, NewIR_Return(sum))
+		}, 820},
+		{"division", func() IR {
+			vars, sum := ints()
+			return andThen([]IR{vars,
+				NewIR_Assignment("d", NewIR_Div(NewIR_Variable("v39"), NewIR_Variable("v2"))),
+				NewIR_Assignment("m", NewIR_Mul(NewIR_Variable("v38"), NewIR_Variable("d"))),
+				NewIR_Return(NewIR_Add(sum, NewIR_Add(NewIR_Variable("d"), NewIR_Variable("m"))))})
+		}, 820 + 13 + 39*13},
+		{"floats", func() IR {
+			vars, sum := ints()
+			floats, fsum := spillProgram("f", 30, func(i int) IRExpression {
+				return NewIR_Mul(NewIR_Cast(NewIR_Int64(int64(i)), TFloat64), NewIR_Float64(1.5))
+			})
+			return andThen([]IR{floats, vars, NewIR_Return(NewIR_Add(NewIR_Cast(fsum, TInt64), sum))})
+		}, 652 + 820},
+		{"loop and call", func() IR {
+			locals, lsum := spillProgram("w", 30, func(i int) IRExpression { return NewIR_Add(NewIR_Variable("x"), NewIR_Int64(int64(i))) })
+			g := NewIR_Function(&TFunction{ReturnType: TInt64, Args: []Type{TInt64}, ArgNames: []string{"x"}},
+				NewIR_AndThen(locals, NewIR_Return(NewIR_Add(NewIR_Variable("x"), lsum))))
+			vars, sum := ints()
+			return andThen([]IR{
+				NewIR_Assignment("g", g),
+				vars,
+				NewIR_Assignment("i", NewIR_Int64(0)),
+				NewIR_While(NewIR_LT(NewIR_Variable("i"), NewIR_Int64(3)), NewIR_AndThen(
+					NewIR_Assignment("v0", NewIR_Add(NewIR_Variable("v0"), NewIR_Call("g", []IRExpression{NewIR_Variable("i")}))),
+					NewIR_Assignment("i", NewIR_Add(NewIR_Variable("i"), NewIR_Int64(1))),
+				)),
+				NewIR_Return(sum),
+			})
+		}, 820 + 31*(0+1+2) + 3*435},
+		{"spilled arguments", func() IR {
+			h := NewIR_Function(&TFunction{ReturnType: TInt64, Args: []Type{TInt64, TInt64, TInt64}, ArgNames: []string{"a", "b", "c"}},
+				NewIR_Return(NewIR_Add(NewIR_Mul(NewIR_Variable("a"), NewIR_Int64(100)), NewIR_Add(NewIR_Mul(NewIR_Variable("b"), NewIR_Int64(10)), NewIR_Variable("c")))))
+			vars, sum := ints()
+			args := []IRExpression{NewIR_Variable("v37"), NewIR_Variable("v38"), NewIR_Variable("v39")}
+			return andThen([]IR{NewIR_Assignment("h", h), vars, NewIR_Return(NewIR_Add(sum, NewIR_Call("h", args)))})
+		}, 820 + 3800 + 390 + 40},
+	}
+	for _, unit := range units {
+		for _, transform := range []bool{false, true} {
+			i := unit.program()
+			if transform {
+				i = i.SSA_Transform(NewSSA_Context())
+			}
+			b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{})
+			if err != nil {
+				t.Fatal(err, "in", unit.name)
+			}
+			value, err := b.Run(false)
+			if err != nil {
+				t.Fatal(err, "in", unit.name)
+			}
+			if value != unit.expected {
+				t.Errorf("Expecting %d got %d in %s (SSA: %v)", unit.expected, value, unit.name, transform)
+			}
+		}
+	}
+}
+
+func Test_Func_Call_Spills(t *testing.T) {
+	// More live values than registers, so that the function spills to the
+	// frame on the stack that CallFunction runs it on.
+	ints, sum := spillProgram("v", 40, func(i int) IRExpression { return NewIR_Add(NewIR_Variable("x"), NewIR_Int64(int64(i))) })
+	floats, fsum := spillProgram("f", 30, func(i int) IRExpression {
+		return NewIR_Mul(NewIR_Variable("y"), NewIR_Cast(NewIR_Int64(int64(i)), TFloat64))
+	})
+	fn := NewIR_Function(&TFunction{ReturnType: TFloat64, Args: []Type{TInt64, TFloat64}, ArgNames: []string{"x", "y"}},
+		andThen([]IR{floats, ints, NewIR_Return(NewIR_Add(NewIR_Cast(sum, TFloat64), fsum))}))
+	f, err := CompileFunction(TargetArch, TargetABI, fn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for x := int64(0); x < 3; x++ {
+		expected := float64(40*x+780) + 2.5*435
+		if value, err := f.Call(x, 2.5); err != nil || value != expected {
+			t.Errorf("Expecting %v got %v, %v", expected, value, err)
+		}
+	}
+}
+
+func Test_Func_Call_StackOverflow(t *testing.T) {
+	mod, err := CompileModule(TargetArch, TargetABI, []IR{MustParseIR(
+		`func r(n int64) int64 { if n == 0 { return 0 } else { x = r(n - 1); return x + 1 } }`)}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	r, _ := mod.Func("r")
+	for _, n := range []int64{100, 3000, 1 << 20, 10} {
+		value, err := r.Call(n)
+		var trap *lib.TrapError
+		if n > 1000 {
+			if !errors.As(err, &trap) || !errors.Is(err, lib.ErrStackOverflow) {
+				t.Errorf("Expecting a %v trap for r(%d) got %v, %v", lib.ErrStackOverflow, n, value, err)
+			}
+		} else if err != nil || value != n {
+			t.Errorf("Expecting %d got %v, %v", n, value, err)
+		}
+	}
+}
+
 func Test_IR_Length(t *testing.T) {
 
 	ctx := NewIRContext(TargetArch, TargetABI)
@@ -488,3 +874,1173 @@ func Test_IR_Length_does_not_affect_instruction_pointer(t *testing.T) {
 		t.Fatal("InstructionPointer changed")
 	}
 }
+
+func castLiteral(v interface{}) IRExpression {
+	switch v := v.(type) {
+	case uint8:
+		return NewIR_Uint8(v)
+	case uint16:
+		return NewIR_Uint16(v)
+	case uint32:
+		return NewIR_Uint32(v)
+	case uint64:
+		return NewIR_Uint64(v)
+	case int8:
+		return NewIR_Int8(v)
+	case int16:
+		return NewIR_Int16(v)
+	case int32:
+		return NewIR_Int32(v)
+	case int64:
+		return NewIR_Int64(v)
+	case float64:
+		return NewIR_Float64(v)
+	case bool:
+		return NewIR_Bool(v)
+	}
+	panic("unsupported literal")
+}
+
+// goCast converts v like Go does, with non-zero values converting to true.
+// Conversions of floats that don't fit in the integer type are implementation
+// defined in Go and are reported as not ok.
+func goCast(v interface{}, to reflect.Type) (reflect.Value, bool) {
+	rv := reflect.ValueOf(v)
+	if to.Kind() == reflect.Bool {
+		switch rv.Kind() {
+		case reflect.Bool:
+			return rv, true
+		case reflect.Float64:
+			return reflect.ValueOf(rv.Float() != 0), true
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return reflect.ValueOf(rv.Int() != 0), true
+		default:
+			return reflect.ValueOf(rv.Uint() != 0), true
+		}
+	}
+	if rv.Kind() == reflect.Bool {
+		if rv.Bool() {
+			rv = reflect.ValueOf(uint8(1))
+		} else {
+			rv = reflect.ValueOf(uint8(0))
+		}
+	}
+	if rv.Kind() == reflect.Float64 && to.Kind() != reflect.Float64 {
+		f := math.Trunc(rv.Float())
+		lo, hi := 0.0, math.Ldexp(1, to.Bits())
+		if to.Kind() >= reflect.Int8 && to.Kind() <= reflect.Int64 {
+			lo, hi = -math.Ldexp(1, to.Bits()-1), math.Ldexp(1, to.Bits()-1)
+		}
+		if f < lo || f >= hi {
+			return rv, false
+		}
+	}
+	return rv.Convert(to), true
+}
+
+// castResultBits returns the value as it's returned from compiled code: zero
+// extended integers and bools, and the bit pattern of floats.
+func castResultBits(v reflect.Value) uint64 {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return 1
+		}
+		return 0
+	case reflect.Float64:
+		return math.Float64bits(v.Float())
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(v.Int()) & (math.MaxUint64 >> (64 - v.Type().Bits()))
+	}
+	return v.Uint()
+}
+
+func Test_Cast_Matrix(t *testing.T) {
+	types := []struct {
+		typ    Type
+		goType reflect.Type
+	}{
+		{TUint8, reflect.TypeOf(uint8(0))},
+		{TUint16, reflect.TypeOf(uint16(0))},
+		{TUint32, reflect.TypeOf(uint32(0))},
+		{TUint64, reflect.TypeOf(uint64(0))},
+		{TInt8, reflect.TypeOf(int8(0))},
+		{TInt16, reflect.TypeOf(int16(0))},
+		{TInt32, reflect.TypeOf(int32(0))},
+		{TInt64, reflect.TypeOf(int64(0))},
+		{TFloat64, reflect.TypeOf(float64(0))},
+		{TBool, reflect.TypeOf(false)},
+	}
+	values := []interface{}{
+		uint8(0), uint8(7), uint8(200),
+		uint16(7), uint16(0xfff1),
+		uint32(7), uint32(4000000000),
+		uint64(7), uint64(1<<63 + 4097), uint64(math.MaxUint64),
+		int8(0), int8(7), int8(-3), int8(math.MinInt8),
+		int16(-300), int16(math.MaxInt16),
+		int32(-70000), int32(math.MinInt32),
+		int64(-5000000000000), int64(math.MaxInt64),
+		0.0, math.Copysign(0, -1), 0.75, -3.7, 255.9, 3e9, -2e9, float64(1<<63 + 4096), 1e19,
+		true, false,
+	}
+	for _, to := range types {
+		for _, v := range values {
+			expected, ok := goCast(v, to.goType)
+			if !ok {
+				continue
+			}
+			program := []IR{
+				NewIR_Assignment("v", castLiteral(v)),
+				NewIR_Assignment("w", NewIR_Cast(NewIR_Variable("v"), to.typ)),
+				NewIR_Return(NewIR_Variable("w")),
+			}
+			description := fmt.Sprintf("%T(%v) -> %s", v, v, to.typ)
+			b, err := Compile(TargetArch, TargetABI, program, Options{})
+			if err != nil {
+				t.Error(err, "in", description)
+				continue
+			}
+			value := uint64(b.Execute(false))
+			if value != castResultBits(expected) {
+				t.Errorf("Expecting %#x got %#x in %s", castResultBits(expected), value, description)
+			}
+
+			folded, err := ssa.Transform(program, ssa.FoldConstants)
+			if err != nil {
+				t.Fatal(err, "in", description)
+			}
+			b, err = Compile(TargetArch, TargetABI, folded, Options{})
+			if err != nil {
+				t.Error(err, "in", description, "after folding")
+				continue
+			}
+			value = uint64(b.Execute(false))
+			if value != castResultBits(expected) {
+				t.Errorf("Expecting %#x got %#x in %s after folding", castResultBits(expected), value, description)
+			}
+		}
+	}
+}
+
+func Test_RemoveUnusedFunctions_from_Stdlib(t *testing.T) {
+	i := MustParseIR(Stdlib + "f = Max(53, 3); return f")
+	b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts := ssa.RemoveUnusedFunctions([]IR{MustParseIR(Stdlib + "f = Max(53, 3); return f")})
+	b2, err := Compile(TargetArch, TargetABI, stmts, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := b2.Execute(false); value != 53 {
+		t.Fatal("Expecting 53 got", value)
+	}
+	if len(b2.MachineCode) >= len(b.MachineCode) {
+		t.Fatalf("Expecting less than %d bytes of code got %d", len(b.MachineCode), len(b2.MachineCode))
+	}
+}
+
+func Test_Inline_Stdlib(t *testing.T) {
+	program := Stdlib + "a = Max(3, 53); b = Max(a, 7); f = Max(b, b + 1); return f"
+	b, err := Compile(TargetArch, TargetABI, ssa.RemoveUnusedFunctions([]IR{MustParseIR(program)}), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts, err := ssa.Transform([]IR{MustParseIR(program)}, ssa.Inline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmts = ssa.RemoveUnusedFunctions(stmts)
+	for _, stmt := range stmts {
+		if _, ok := stmt.(*IR_FunctionDef); ok {
+			t.Fatal("Expecting Max to be inlined in", stmts)
+		}
+	}
+	b2, err := Compile(TargetArch, TargetABI, stmts, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := b2.Execute(false); value != 54 {
+		t.Fatal("Expecting 54 got", value)
+	}
+	if len(b2.MachineCode) >= len(b.MachineCode) {
+		t.Fatalf("Expecting less than %d bytes of code got %d", len(b.MachineCode), len(b2.MachineCode))
+	}
+}
+
+// Test_FoldConstants_matches_runtime checks that constant folding computes
+// the same results as the compiled code, including wraparound and traps.
+func Test_FoldConstants_matches_runtime(t *testing.T) {
+	values := [][]interface{}{
+		{uint8(0), uint8(1), uint8(7), uint8(200), uint8(math.MaxUint8)},
+		{uint16(0), uint16(3), uint16(700), uint16(math.MaxUint16)},
+		{uint32(0), uint32(5), uint32(65536), uint32(math.MaxUint32)},
+		{uint64(0), uint64(9), uint64(1 << 63), uint64(math.MaxUint64)},
+		{int8(0), int8(-1), int8(7), int8(-100), int8(math.MinInt8), int8(math.MaxInt8)},
+		{int16(0), int16(-1), int16(300), int16(-32768), int16(math.MaxInt16)},
+		{int32(0), int32(-1), int32(-70000), int32(math.MinInt32), int32(math.MaxInt32)},
+		{int64(0), int64(-1), int64(3037000500), int64(math.MinInt64), int64(math.MaxInt64)},
+	}
+	arithmetic := []func(a, b IRExpression) IRExpression{
+		func(a, b IRExpression) IRExpression { return NewIR_Add(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_Sub(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_Mul(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_Div(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_CheckedAdd(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_CheckedSub(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_CheckedMul(a, b) },
+	}
+	comparisons := []func(a, b IRExpression) IRExpression{
+		func(a, b IRExpression) IRExpression { return NewIR_Equals(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_LT(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_LTE(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_GT(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_GTE(a, b) },
+	}
+	run := func(program []IR) (int, error) {
+		b, err := Compile(TargetArch, TargetABI, program, Options{})
+		if err != nil {
+			return 0, err
+		}
+		return b.Run(false)
+	}
+	for _, typeValues := range values {
+		for _, x := range typeValues {
+			for _, y := range typeValues {
+				for _, operator := range append(arithmetic, comparisons...) {
+					op := operator(NewIR_Variable("a"), NewIR_Variable("b"))
+					program := []IR{
+						NewIR_Assignment("a", castLiteral(x)),
+						NewIR_Assignment("b", castLiteral(y)),
+						NewIR_Assignment("f", NewIR_Cast(op, TUint64)),
+						NewIR_Return(NewIR_Variable("f")),
+					}
+					description := fmt.Sprintf("%s with a = %T(%v), b = %v", op, x, x, y)
+					expected, expectedErr := run(program)
+					folded, err := ssa.Transform(program, ssa.FoldConstants)
+					if err != nil {
+						t.Fatal(err, "in", description)
+					}
+					value, err := run(folded)
+					if fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+						t.Errorf("Expecting error %v got %v in %s", expectedErr, err, description)
+					} else if value != expected {
+						t.Errorf("Expecting %d got %d in %s", expected, value, description)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_ReduceStrength_matches_runtime(t *testing.T) {
+	values := [][]interface{}{
+		{uint8(0), uint8(1), uint8(7), uint8(200), uint8(math.MaxUint8)},
+		{uint16(0), uint16(3), uint16(700), uint16(math.MaxUint16)},
+		{uint32(0), uint32(5), uint32(65536), uint32(2863311531), uint32(math.MaxUint32)},
+		{uint64(0), uint64(9), uint64(1 << 63), uint64(12297829382473034411), uint64(math.MaxUint64)},
+		{int8(0), int8(-1), int8(7), int8(-100), int8(math.MinInt8), int8(math.MaxInt8)},
+		{int16(0), int16(-1), int16(300), int16(-32768), int16(math.MaxInt16)},
+		{int32(0), int32(-1), int32(-70000), int32(math.MinInt32), int32(math.MaxInt32)},
+		{int64(0), int64(-1), int64(3037000500), int64(-7), int64(math.MinInt64), int64(math.MaxInt64)},
+	}
+	constants := [][]interface{}{
+		{uint8(0), uint8(1), uint8(2), uint8(3), uint8(7), uint8(8), uint8(10), uint8(128), uint8(255)},
+		{uint16(1), uint16(2), uint16(5), uint16(7), uint16(1024), uint16(641), uint16(65535)},
+		{uint32(1), uint32(3), uint32(7), uint32(16), uint32(1000), uint32(641), uint32(1 << 31), uint32(math.MaxUint32)},
+		{uint64(1), uint64(2), uint64(3), uint64(7), uint64(64), uint64(1000), uint64(641), uint64(1 << 63), uint64(math.MaxUint64)},
+		{int8(1), int8(-1), int8(2), int8(-2), int8(3), int8(-7), int8(8), int8(64), int8(math.MinInt8), int8(127)},
+		{int16(2), int16(-4), int16(3), int16(10), int16(-641), int16(16384), int16(math.MinInt16)},
+		{int32(2), int32(5), int32(-6), int32(7), int32(1024), int32(-1000000), int32(math.MinInt32)},
+		{int64(2), int64(3), int64(-3), int64(7), int64(-8), int64(1000), int64(641), int64(1 << 62), int64(math.MinInt64), int64(math.MaxInt64)},
+	}
+	arithmetic := []func(a, b IRExpression) IRExpression{
+		func(a, b IRExpression) IRExpression { return NewIR_Add(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_Sub(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_Mul(a, b) },
+		func(a, b IRExpression) IRExpression { return NewIR_Mul(b, a) },
+		func(a, b IRExpression) IRExpression { return NewIR_Div(a, b) },
+	}
+	run := func(program []IR) (int, error) {
+		b, err := Compile(TargetArch, TargetABI, program, Options{})
+		if err != nil {
+			return 0, err
+		}
+		return b.Run(false)
+	}
+	for i, typeValues := range values {
+		for _, x := range typeValues {
+			for _, c := range constants[i] {
+				for _, operator := range arithmetic {
+					op := operator(NewIR_Variable("a"), castLiteral(c))
+					program := []IR{
+						NewIR_Assignment("a", castLiteral(x)),
+						NewIR_Assignment("f", NewIR_Cast(op, TUint64)),
+						NewIR_Return(NewIR_Variable("f")),
+					}
+					description := fmt.Sprintf("%s with a = %T(%v)", op, x, x)
+					expected, expectedErr := run(program)
+					// Folding the result checks the folding of the
+					// operations that the division is reduced to.
+					for _, fold := range []bool{false, true} {
+						reduced, err := ssa.Transform(program, func(f *ssa.Func) error {
+							if err := ssa.ReduceStrength(f); err != nil || !fold {
+								return err
+							}
+							return ssa.FoldConstants(f)
+						})
+						if err != nil {
+							t.Fatal(err, "in", description)
+						}
+						value, err := run(reduced)
+						if fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+							t.Errorf("Expecting error %v got %v in %s", expectedErr, err, description)
+						} else if value != expected {
+							t.Errorf("Expecting %d got %d in %s (folded: %v)", expected, value, description, fold)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_CheckedArithmetic(t *testing.T) {
+	var units = []struct {
+		program  string
+		checked  bool
+		expected int
+		err      error
+		position string
+	}{
+		{`a = int8(100); f = a + int8(27); return f`, true, 127, nil, ""},
+		{`a = int8(100); f = a + int8(28); return f`, false, 128, nil, ""},
+		{`a = int8(100); f = a + int8(28); return f`, true, 0, lib.ErrIntegerOverflow, "1:20"},
+		{`a = uint8(1); f = a - uint8(2); return f`, true, 0, lib.ErrIntegerOverflow, "1:19"},
+		{`a = int64(-9223372036854775807); f = a - 2; return f`, true, 0, lib.ErrIntegerOverflow, "1:38"},
+		{`a = uint32(65536); f = a * uint32(65536); return f`, true, 0, lib.ErrIntegerOverflow, "1:24"},
+		{`a = uint32(65535); f = a * uint32(65535); return f`, true, 4294836225, nil, ""},
+		{`a = int16(-200); f = a * int16(-200); return f`, true, 0, lib.ErrIntegerOverflow, "1:22"},
+		{`a = int64(9223372036854775807); f = a + 1; return f`, false, -9223372036854775808, nil, ""},
+		{`a = uint64(0) - uint64(1); f = checked_add(a, uint64(1)); return f`, false, 0, lib.ErrIntegerOverflow, "1:32"},
+		{`a = uint64(5); f = checked_sub(a, uint64(3)); return f`, false, 2, nil, ""},
+		{`a = int64(3037000500); f = checked_mul(a, a); return f`, false, 0, lib.ErrIntegerOverflow, "1:28"},
+		{"func sq(x int64) int64 {\n  return checked_mul(x, x)\n}\nf = sq(4) + sq(3037000500); return f", false, 0, lib.ErrIntegerOverflow, "2:10"},
+	}
+	for _, unit := range units {
+		// The constants are folded at O2, which has to keep the traps.
+		for _, level := range []OptimisationLevel{O0, O2} {
+			i, err := ParseIR(unit.program)
+			if err != nil {
+				t.Fatal(err, "in", unit.program)
+			}
+			passes, err := NewPassManager(level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{CheckedArithmetic: unit.checked, Passes: passes})
+			if err != nil {
+				t.Fatal(err, "in", unit.program)
+			}
+			value, err := b.Run(false)
+			if !errors.Is(err, unit.err) {
+				t.Errorf("Expecting error %v got %v in %s at O%d", unit.err, err, unit.program, level)
+				continue
+			}
+			if err != nil {
+				trap := err.(*lib.TrapError)
+				position := fmt.Sprintf("%d:%d", trap.Line, trap.Column)
+				if position != unit.position {
+					t.Errorf("Expecting trap at %s got %s in %s at O%d", unit.position, position, unit.program, level)
+				}
+			} else if value != unit.expected {
+				t.Errorf("Expecting %d got %d in %s at O%d", unit.expected, value, unit.program, level)
+			}
+		}
+	}
+}
+
+func Test_DivisionGuards(t *testing.T) {
+	var units = []struct {
+		program  string
+		expected int
+		err      error
+		position string
+	}{
+		{`a = int64(7); b = int64(0); c = a / b; return c`, 0, lib.ErrDivideByZero, "1:33"},
+		{`a = uint8(200); b = uint8(0); c = a / b; return c`, 0, lib.ErrDivideByZero, "1:35"},
+		{`a = uint16(700); b = uint16(7); c = a / b; return c`, 100, nil, ""},
+		{`a = int32(-7); b = int32(-1); c = a / b; return c`, 7, nil, ""},
+		{`a = int8(-128); b = int8(-1); c = a / b; return c`, 0, lib.ErrIntegerOverflow, "1:35"},
+		{`a = int16(-32768); b = int16(-1); c = a / b; return c`, 0, lib.ErrIntegerOverflow, "1:39"},
+		{`a = int16(-32768); b = int16(2); c = a / b; return c`, 49152, nil, ""},
+		{`a = int64(-9223372036854775807) - 1; c = a / -1; return c`, 0, lib.ErrIntegerOverflow, "1:42"},
+		{`a = int64(-9223372036854775807) - 1; c = a / 2; return c`, -4611686018427387904, nil, ""},
+		{"func div(x uint64, y uint64) uint64 {\n  return x / y\n}\nc = div(10, 5) + div(3, 0); return c", 0, lib.ErrDivideByZero, "2:10"},
+	}
+	for _, unit := range units {
+		i, err := ParseIR(unit.program)
+		if err != nil {
+			t.Fatal(err, "in", unit.program)
+		}
+		b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{})
+		if err != nil {
+			t.Fatal(err, "in", unit.program)
+		}
+		value, err := b.Run(false)
+		if !errors.Is(err, unit.err) {
+			t.Errorf("Expecting error %v got %v in %s", unit.err, err, unit.program)
+			continue
+		}
+		if err != nil {
+			trap := err.(*lib.TrapError)
+			position := fmt.Sprintf("%d:%d", trap.Line, trap.Column)
+			if position != unit.position {
+				t.Errorf("Expecting trap at %s got %s in %s", unit.position, position, unit.program)
+			}
+		} else if value != unit.expected {
+			t.Errorf("Expecting %d got %d in %s", unit.expected, value, unit.program)
+		}
+	}
+}
+
+func Test_Fuel(t *testing.T) {
+	var units = []struct {
+		program  string
+		fuel     int64
+		expected int
+		err      error
+	}{
+		{`i = 0; while true { i = i + 1 }; return i`, 1000, 0, lib.ErrFuelExhausted},
+		{`i = 0; while i != 1 { i = i * 1 }; return i`, 1 << 20, 0, lib.ErrFuelExhausted},
+		{`i = 0; while i < 10 { i = i + 1 }; return i`, 10, 10, nil},
+		{`i = 0; while i < 10 { i = i + 1 }; return i`, 9, 0, lib.ErrFuelExhausted},
+		{`i = 0; while i < 10 { j = 0; while j < 10 { j = j + 1 }; i = i + j }; return i`, 11, 10, nil},
+		{`i = 0; while i < 10 { j = 0; while j < 10 { j = j + 1 }; i = i + j }; return i`, 10, 0, lib.ErrFuelExhausted},
+		{"func f(x int64) int64 {\n  return x + 1\n}\ni = 0; while i < 10 { i = f(i) }; return i", 20, 10, nil},
+		{"func f(x int64) int64 {\n  return x + 1\n}\ni = 0; while i < 10 { i = f(i) }; return i", 19, 0, lib.ErrFuelExhausted},
+	}
+	for _, unit := range units {
+		i, err := ParseIR(unit.program)
+		if err != nil {
+			t.Fatal(err, "in", unit.program)
+		}
+		b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{Fuel: true})
+		if err != nil {
+			t.Fatal(err, "in", unit.program)
+		}
+		value, err := b.RunWithFuel(unit.fuel, false)
+		if !errors.Is(err, unit.err) {
+			t.Errorf("Expecting error %v got %v in %s", unit.err, err, unit.program)
+		} else if err == nil && value != unit.expected {
+			t.Errorf("Expecting %d got %d in %s", unit.expected, value, unit.program)
+		}
+	}
+}
+
+func Test_CompileFunc(t *testing.T) {
+	fn, err := ParseIRFunction(`func(a int64, b float64) float64 { return float64(a) * b }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scale, err := CompileFunc[func(int64, float64) float64](TargetArch, TargetABI, fn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := scale(3, 1.5); value != 4.5 {
+		t.Error("Expecting 4.5 got", value)
+	}
+	if value := scale(-2, 0.25); value != -0.5 {
+		t.Error("Expecting -0.5 got", value)
+	}
+
+	fn, err = ParseIRFunction(`func(a int64, b int64) int64 { return a / b }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	div, err := CompileFunc[func(int64, int64) (int64, error)](TargetArch, TargetABI, fn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := div(-42, 5); err != nil || value != -8 {
+		t.Error("Expecting -8 got", value, err)
+	}
+	if _, err := div(1, 0); !errors.Is(err, lib.ErrDivideByZero) {
+		t.Error("Expecting divide by zero got", err)
+	}
+
+	if _, err := CompileFunc[func(int64) float64](TargetArch, TargetABI, fn, Options{}); err == nil {
+		t.Error("Expecting mismatched signature error")
+	}
+	if _, err := CompileFunc[func(int64, int64) int32](TargetArch, TargetABI, fn, Options{}); err == nil {
+		t.Error("Expecting mismatched result error")
+	}
+}
+
+func Test_Func_Call(t *testing.T) {
+	var units = []struct {
+		function string
+		args     []interface{}
+		expected interface{}
+	}{
+		{`func(a int64, b int64) int64 { return a - b }`, []interface{}{int64(5), int64(8)}, int64(-3)},
+		{`func(a int64, b int64) int64 { return a - b }`, []interface{}{5, 8}, int64(-3)},
+		{`func(a int8, b int8) int8 { return a + b }`, []interface{}{int8(-100), int8(-20)}, int8(-120)},
+		{`func(a uint32, b uint16) uint32 { return a + uint32(b) }`, []interface{}{uint32(1 << 31), uint16(7)}, uint32(1<<31 + 7)},
+		{`func(a float64, b float64, c float64) float64 { return a - b - c }`, []interface{}{10.0, 4.0, 1.0}, 7.0},
+		{`func(a int64, b float64, c int64, d float64) float64 { return float64(a + c) * (b - d) }`, []interface{}{int64(2), 3.5, int64(1), 1.0}, 7.5},
+		{`func(a bool) bool { return !a }`, []interface{}{false}, true},
+		{`func(a int64, b int64) bool { return a < b }`, []interface{}{int64(-1), int64(1)}, true},
+		{`func(a int64, b int64, c int64, d int64, e int64, f int64) int64 { return f - a }`, []interface{}{int64(1), int64(2), int64(3), int64(4), int64(5), int64(9)}, int64(8)},
+		{`func(a float64, b float64, c float64, d float64, e float64, f float64, g float64, h float64) float64 { return h - a }`, []interface{}{1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 9.5}, 8.5},
+	}
+	for _, unit := range units {
+		fn, err := ParseIRFunction(unit.function)
+		if err != nil {
+			t.Fatal(err, "in", unit.function)
+		}
+		f, err := CompileFunction(TargetArch, TargetABI, fn, Options{})
+		if err != nil {
+			t.Fatal(err, "in", unit.function)
+		}
+		value, err := f.Call(unit.args...)
+		if err != nil {
+			t.Error(err, "in", unit.function)
+		} else if value != unit.expected {
+			t.Errorf("Expecting %v (%T) got %v (%T) in %s", unit.expected, unit.expected, value, value, unit.function)
+		}
+		if err := f.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func Test_Func_Call_pointers_and_errors(t *testing.T) {
+	fn, err := ParseIRFunction(`func(p uint64, offset uint64) uint64 { return p + offset }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := CompileFunction(TargetArch, TargetABI, fn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 16)
+	value, err := f.Call(&buf[0], uint64(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := uint64(uintptr(unsafe.Pointer(&buf[8]))); value != expected {
+		t.Errorf("Expecting 0x%x got 0x%x", expected, value)
+	}
+	if _, err := f.Call(int64(1), uint64(8)); err == nil {
+		t.Error("Expecting argument type error")
+	}
+	if _, err := f.Call(uint64(1)); err == nil {
+		t.Error("Expecting argument count error")
+	}
+}
+
+func Test_Func_CallWithFuel(t *testing.T) {
+	source := `func count(n int64) int64 { i = 0; while i < n { i = i + 1 }; return i }`
+	fn, err := ParseIRFunction(strings.Replace(source, "count", "", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := CompileFunction(TargetArch, TargetABI, fn, Options{Fuel: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	mod, err := CompileModule(TargetArch, TargetABI, []IR{MustParseIR(source)}, Options{Fuel: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	count, err := mod.Func("count")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*Func{f, count} {
+		if _, err := f.CallWithFuel(100, int64(1000)); !errors.Is(err, lib.ErrFuelExhausted) {
+			t.Errorf("Expecting %v got %v", lib.ErrFuelExhausted, err)
+		}
+		if value, err := f.CallWithFuel(2000, int64(1000)); err != nil || value != int64(1000) {
+			t.Errorf("Expecting 1000 got %v, %v", value, err)
+		}
+		// Every call gets its own budget.
+		if value, err := f.CallWithFuel(100, int64(10)); err != nil || value != int64(10) {
+			t.Errorf("Expecting 10 got %v, %v", value, err)
+		}
+		if value, err := f.Call(int64(1000)); err != nil || value != int64(1000) {
+			t.Errorf("Expecting 1000 got %v, %v", value, err)
+		}
+	}
+}
+
+func Test_Func_buffers(t *testing.T) {
+	fn, err := ParseIRFunction(`func(buf []float64, gain float64) int64 {
+  i = 0
+  while i != len(buf) {
+    buf[i] = float64(i) * gain
+    i = i + 1
+  }
+  return i
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fill, err := CompileFunc[func([]float64, float64) int64](TargetArch, TargetABI, fn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]float64, 64)
+	if n := fill(buf, 0.5); n != 64 {
+		t.Fatal("Expecting 64 items got", n)
+	}
+	for i, v := range buf {
+		if v != float64(i)*0.5 {
+			t.Fatalf("Expecting %v at %d got %v", float64(i)*0.5, i, v)
+		}
+	}
+	if n := fill(nil, 0.5); n != 0 {
+		t.Error("Expecting 0 items got", n)
+	}
+
+	fn, err = ParseIRFunction(`func(in []float32, out []float32) float64 {
+  i = 0
+  sum = 0.0
+  while i != len(out) {
+    out[i] = in[i] * 2.0
+    sum = sum + in[i]
+    i = i + 1
+  }
+  return sum
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := CompileFunction(TargetArch, TargetABI, fn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	in := []float32{1, 2.5, 0.1}
+	out := make([]float32, 3)
+	if sum, err := f.Call(in, out); err != nil || sum != float64(in[0])+float64(in[1])+float64(in[2]) {
+		t.Error("Expecting the sum of the inputs got", sum, err)
+	}
+	for i := range in {
+		if out[i] != in[i]*2 {
+			t.Errorf("Expecting %v at %d got %v", in[i]*2, i, out[i])
+		}
+	}
+	if _, err := f.Call([]float64{1}, out); err == nil {
+		t.Error("Expecting an error passing []float64 for []float32")
+	}
+}
+
+func Test_Func_buffers_bounds(t *testing.T) {
+	units := []struct {
+		function string
+		args     []interface{}
+		err      error
+	}{
+		{`func(buf []float64) int64 { buf[3] = 1.0; return len(buf) }`, []interface{}{make([]float64, 1)}, lib.ErrIndexOutOfRange},
+		{`func(buf []float64) int64 { buf[3] = 1.0; return len(buf) }`, []interface{}{make([]float64, 4)}, nil},
+		{`func(buf []int64, i int64) int64 { return buf[i] }`, []interface{}{make([]int64, 2), int64(2)}, lib.ErrIndexOutOfRange},
+		{`func(buf []int64, i int64) int64 { return buf[i] }`, []interface{}{make([]int64, 2), int64(-1)}, lib.ErrIndexOutOfRange},
+		{`func(buf []int64, i int64) int64 { return buf[i] }`, []interface{}{make([]int64, 2), int64(1)}, nil},
+		{`func(buf []uint8) uint8 { return buf[uint64(0)] }`, []interface{}{[]uint8{}}, lib.ErrIndexOutOfRange},
+		{`func(buf []uint8) uint8 { return buf[uint64(0)] }`, []interface{}{[]uint8{7}}, nil},
+		{`func(in []float32, out []float32) int64 { out[len(in)] = in[0]; return 0 }`, []interface{}{[]float32{1}, []float32{0}}, lib.ErrIndexOutOfRange},
+		{`func(in []float32, out []float32) int64 { out[0] = in[len(out)]; return 0 }`, []interface{}{[]float32{1}, []float32{0}}, lib.ErrIndexOutOfRange},
+	}
+	for _, unit := range units {
+		fn, err := ParseIRFunction(unit.function)
+		if err != nil {
+			t.Fatal(err, "in", unit.function)
+		}
+		f, err := CompileFunction(TargetArch, TargetABI, fn, Options{})
+		if err != nil {
+			t.Fatal(err, "in", unit.function)
+		}
+		if _, err := f.Call(unit.args...); !errors.Is(err, unit.err) {
+			t.Errorf("Expecting error %v got %v in %s", unit.err, err, unit.function)
+		}
+		f.Close()
+	}
+}
+
+func Test_Func_Close(t *testing.T) {
+	fn, err := ParseIRFunction(`func(a int64) int64 { return a + 1 }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := CompileFunction(TargetArch, TargetABI, fn, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		if value, err := f.Call(i); err != nil || value != i+1 {
+			t.Fatal("Expecting", i+1, "got", value, err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Call(int64(1)); !errors.Is(err, lib.ErrClosed) {
+		t.Error("Expecting lib.ErrClosed got", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Error("Expecting a second Close to succeed, got", err)
+	}
+}
+
+func Test_CompileFunction_in_Arena(t *testing.T) {
+	arena, err := lib.NewArena(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer arena.Close()
+	var funcs []*Func
+	for i := 0; i < 200; i++ {
+		fn, err := ParseIRFunction(fmt.Sprintf(`func(a int64) int64 { return a + %d }`, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := CompileFunction(TargetArch, TargetABI, fn, Options{Arena: arena})
+		if err != nil {
+			t.Fatal(err)
+		}
+		funcs = append(funcs, f)
+	}
+	for i, f := range funcs {
+		if value, err := f.Call(int64(1)); err != nil || value != int64(i+1) {
+			t.Fatal("Expecting", i+1, "got", value, err)
+		}
+		f.Close()
+	}
+	if arena.Size() >= 200*os.Getpagesize() {
+		t.Errorf("Expecting the functions to share pages, got a %d byte arena", arena.Size())
+	}
+}
+
+func Test_CompileModule(t *testing.T) {
+	stmts, err := ParseIR(`func init(seed int64) int64 { return seed * 2 }
+
+func noteOn(key int64, velocity float64) float64 {
+  return float64(key) * velocity
+}
+func process(n uint64) uint64 { g = []uint64{42,52,53}; return g[n] }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := CompileModule(TargetArch, TargetABI, []IR{stmts}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	if names := mod.Functions(); fmt.Sprint(names) != "[init noteOn process]" {
+		t.Errorf("Expecting [init noteOn process] got %v", names)
+	}
+	calls := []struct {
+		name     string
+		args     []interface{}
+		expected interface{}
+	}{
+		{"init", []interface{}{int64(21)}, int64(42)},
+		{"noteOn", []interface{}{int64(3), 0.5}, 1.5},
+		{"process", []interface{}{uint64(2)}, uint64(53)},
+	}
+	for _, call := range calls {
+		f, err := mod.Func(call.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := f.Call(call.args...); err != nil || value != call.expected {
+			t.Errorf("Expecting %v from %s got %v, %v", call.expected, call.name, value, err)
+		}
+	}
+	if _, err := mod.Func("noteOff"); err == nil {
+		t.Error("Expecting an error for an undefined function")
+	}
+	if err := mod.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := mod.Func("init")
+	if _, err := f.Call(int64(1)); !errors.Is(err, lib.ErrClosed) {
+		t.Error("Expecting lib.ErrClosed got", err)
+	}
+
+	for _, src := range []string{
+		`func f(a int64) int64 { return a }; func f(a int64) int64 { return a }`,
+		`a = 1; func f(a int64) int64 { return a }`,
+	} {
+		if _, err := CompileModule(TargetArch, TargetABI, []IR{MustParseIR(src)}, Options{}); err == nil {
+			t.Error("Expecting an error compiling", src)
+		}
+	}
+}
+
+func Test_Module_globals(t *testing.T) {
+	stmts, err := ParseIR(`var phase float64 = 0.25
+var calls uint64
+var offset int8 = -3
+var enabled bool = true
+func process(step float64) float64 {
+  phase = phase + step
+  calls = calls + uint64(1)
+  if !enabled { return 0.0 } else { return phase }
+}
+func noteOn(n int8) int8 { offset = offset + n; return offset }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := CompileModule(TargetArch, TargetABI, []IR{stmts}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	process, _ := mod.Func("process")
+	for _, expected := range []float64{0.75, 1.25} {
+		if value, err := process.Call(0.5); err != nil || value != expected {
+			t.Errorf("Expecting %v got %v, %v", expected, value, err)
+		}
+	}
+	if phase, calls := mod.Global("phase").Float64(), mod.Global("calls").Uint64(); phase != 1.25 || calls != 2 {
+		t.Errorf("Expecting phase 1.25 after 2 calls, got %v after %d", phase, calls)
+	}
+	mod.Global("phase").SetFloat64(10)
+	mod.Global("enabled").SetBool(false)
+	if value, err := process.Call(0.5); err != nil || value != 0.0 {
+		t.Errorf("Expecting 0 got %v, %v", value, err)
+	}
+	if phase := mod.Global("phase").Float64(); phase != 10.5 {
+		t.Errorf("Expecting phase 10.5 got %v", phase)
+	}
+	noteOn, _ := mod.Func("noteOn")
+	if value, err := noteOn.Call(int8(1)); err != nil || value != int8(-2) {
+		t.Errorf("Expecting -2 got %v, %v", value, err)
+	}
+	if offset := mod.Global("offset").Int64(); offset != -2 {
+		t.Errorf("Expecting -2 got %d", offset)
+	}
+	if mod.Global("undefined") != nil {
+		t.Error("Expecting nil for an undefined global")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expecting a panic reading a float64 global as an integer")
+			}
+		}()
+		mod.Global("phase").Int64()
+	}()
+
+	for _, src := range []string{
+		`var a int64; var a int64; func f() int64 { return a }`,
+		`var a int64 = 1.5; func f() int64 { return a }`,
+		`var a int64 = b; func f() int64 { return a }`,
+		`var a uint64; func f(b int64) int64 { a = b; return b }`,
+	} {
+		if _, err := CompileModule(TargetArch, TargetABI, []IR{MustParseIR(src)}, Options{}); err == nil {
+			t.Error("Expecting an error compiling", src)
+		}
+	}
+}
+
+func Test_CompileModule_passes(t *testing.T) {
+	stmts, err := ParseIR(`var total int64
+func double(x int64) int64 { return x * 2 }
+func process(n int64) int64 {
+  i = 0
+  while i < n { total = total + double(3 * 4); i = i + 1 }
+  return total
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passes, err := NewPassManager(O2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := &strings.Builder{}
+	passes.Dump = dump
+	mod, err := CompileModule(TargetArch, TargetABI, []IR{stmts}, Options{Passes: passes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	// The functions are optimised, but double isn't inlined into process.
+	for _, expected := range []string{"func double(x int64) int64 { return x + x }", "__ssa_2 = double(12) ;"} {
+		if !strings.Contains(dump.String(), expected) {
+			t.Errorf("Expecting %q in the dump:\n%s", expected, dump.String())
+		}
+	}
+	process, _ := mod.Func("process")
+	if value, err := process.Call(int64(2)); err != nil || value != int64(48) {
+		t.Errorf("Expecting 48 got %v, %v", value, err)
+	}
+	if err := mod.Replace("double", `func(x int64) int64 { return x * 4 }`); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := process.Call(int64(1)); err != nil || value != int64(96) {
+		t.Errorf("Expecting 96 got %v, %v", value, err)
+	}
+	if total := mod.Global("total").Int64(); total != 96 {
+		t.Errorf("Expecting total 96 got %d", total)
+	}
+	if !strings.Contains(dump.String(), "func double(x int64) int64 { return x << 2 }") {
+		t.Errorf("Expecting the replacement to be optimised:\n%s", dump.String())
+	}
+}
+
+func Test_Module_externs(t *testing.T) {
+	stmts, err := ParseIR(`extern func log(x float64)
+extern func lookup(note int64, velocity uint8) float64
+var total float64
+func play(n int64) float64 {
+  i = 0
+  sum = 0.0
+  while i < n {
+    v = lookup(60 + i, uint8(100))
+    log(v)
+    sum = sum + v
+    i = i + 1
+  }
+  total = sum
+  return sum * 2.0
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logged []float64
+	imports := map[string]interface{}{
+		"log": func(x float64) {
+			logged = append(logged, x)
+		},
+		"lookup": func(note int64, velocity uint8) float64 {
+			return float64(note) + float64(velocity)/1000
+		},
+	}
+	mod, err := CompileModule(TargetArch, TargetABI, []IR{stmts}, Options{Imports: imports})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	play, _ := mod.Func("play")
+	value, err := play.Call(int64(3))
+	if err != nil || value != 2*(60.1+61.1+62.1) {
+		t.Errorf("Expecting %v got %v, %v", 2*(60.1+61.1+62.1), value, err)
+	}
+	if !reflect.DeepEqual(logged, []float64{60.1, 61.1, 62.1}) {
+		t.Errorf("Expecting 3 logged values, got %v", logged)
+	}
+	if total := mod.Global("total").Float64(); total != 60.1+61.1+62.1 {
+		t.Errorf("Expecting %v got %v", 60.1+61.1+62.1, total)
+	}
+
+	// Host functions can call compiled code themselves.
+	imports["log"] = func(x float64) {
+		value, err := play.Call(int64(0))
+		logged = append(logged, x, value.(float64))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	nested, err := CompileModule(TargetArch, TargetABI, []IR{stmts}, Options{Imports: imports})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nested.Close()
+	logged = nil
+	f, _ := nested.Func("play")
+	if value, err := f.Call(int64(1)); err != nil || value != 120.2 {
+		t.Errorf("Expecting 120.2 got %v, %v", value, err)
+	}
+	if !reflect.DeepEqual(logged, []float64{60.1, 0}) {
+		t.Errorf("Expecting the nested call to return 0, got %v", logged)
+	}
+
+	for _, c := range []struct {
+		src     string
+		imports map[string]interface{}
+	}{
+		{`extern func log(x float64); func f() int64 { log(1.0); return 1 }`, nil},
+		{`extern func log(x float64); func f() int64 { log(1.0); return 1 }`, map[string]interface{}{"log": func(x int64) {}}},
+		{`extern func log(x float64); func f() int64 { log(1.0); return 1 }`, map[string]interface{}{"log": func(x float64) float64 { return x }}},
+		{`extern func log(x float64); func f() int64 { return log(1.0) }`, map[string]interface{}{"log": func(x float64) {}}},
+		{`extern func log(x float64); extern func log(x float64); func f() int64 { return 1 }`, map[string]interface{}{"log": func(x float64) {}}},
+		{`extern func log(x float64); func f() int64 { log(1.0, 2.0); return 1 }`, map[string]interface{}{"log": func(x float64) {}}},
+	} {
+		if _, err := CompileModule(TargetArch, TargetABI, []IR{MustParseIR(c.src)}, Options{Imports: c.imports}); err == nil {
+			t.Error("Expecting an error compiling", c.src)
+		}
+	}
+	if _, err := Compile(TargetArch, TargetABI, []IR{MustParseIR(`extern func log(x float64); log(1.0); return 1`)}, Options{}); err == nil {
+		t.Error("Expecting an error calling an extern from a program")
+	}
+}
+
+func Test_Module_Replace(t *testing.T) {
+	stmts, err := ParseIR(`var calls int64
+func gain(x int64) int64 {
+  return x * 2
+}
+func process(x int64) int64 {
+  calls = calls + 1
+  return gain(x) + 1
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod, err := CompileModule(TargetArch, TargetABI, []IR{stmts}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mod.Close()
+	process, _ := mod.Func("process")
+	gain, _ := mod.Func("gain")
+	if value, err := process.Call(int64(5)); err != nil || value != int64(11) {
+		t.Errorf("Expecting 11 got %v, %v", value, err)
+	}
+	if err := mod.Replace("gain", `func(x int64) int64 { return x * 3 }`); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := process.Call(int64(5)); err != nil || value != int64(16) {
+		t.Errorf("Expecting the caller to use the new version, got %v, %v", value, err)
+	}
+	if value, err := gain.Call(int64(5)); err != nil || value != int64(15) {
+		t.Errorf("Expecting 15 got %v, %v", value, err)
+	}
+	if err := mod.Replace("process", `func(y int64) int64 { calls = calls + 1; return gain(y) - 1 }`); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := process.Call(int64(5)); err != nil || value != int64(14) {
+		t.Errorf("Expecting 14 got %v, %v", value, err)
+	}
+	if calls := mod.Global("calls").Int64(); calls != 3 {
+		t.Errorf("Expecting 3 calls got %d", calls)
+	}
+
+	// Hammer the functions while gain is replaced far more often than
+	// there's room for, which only works if the old code is released.
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for g := 0; g < 4; g++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+				value, err := process.Call(int64(5))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if value != int64(9) && value != int64(14) {
+					errs <- fmt.Errorf("Expecting 9 or 14 got %v", value)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 200; i++ {
+		src := `func(x int64) int64 { return x * 2 }`
+		if i%2 == 1 {
+			src = `func(x int64) int64 { return x * 3 }`
+		}
+		err := mod.Replace("gain", src)
+		for errors.Is(err, lib.ErrNoPatchSpace) {
+			// A call that's still running holds on to the old code.
+			runtime.Gosched()
+			err = mod.Replace("gain", src)
+		}
+		if err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	for g := 0; g < 4; g++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name string
+		src  string
+	}{
+		{"missing", `func(x int64) int64 { return x }`},
+		{"gain", `func(x float64) int64 { return 1 }`},
+		{"gain", `func(x int64) float64 { return 1.0 }`},
+		{"gain", `func(x int64) int64 { a = []int64{1, 2}; return a[x] }`},
+		{"gain", `func(x int64) int64 { return y }`},
+	} {
+		if err := mod.Replace(c.name, c.src); err == nil {
+			t.Error("Expecting an error replacing", c.name, "with", c.src)
+		}
+	}
+	if value, err := process.Call(int64(5)); err != nil || value != int64(14) {
+		t.Errorf("Expecting 14 got %v, %v", value, err)
+	}
+}
+
+// residentSetSize returns the resident set size of the process in bytes.
+func residentSetSize(t *testing.T) int {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		t.Skip("Can't read the resident set size:", err)
+	}
+	var size, resident int
+	if _, err := fmt.Sscan(string(statm), &size, &resident); err != nil {
+		t.Fatal(err)
+	}
+	return resident * os.Getpagesize()
+}
+
+func Test_CompileExecuteClose_keeps_RSS_constant(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping stress test in short mode")
+	}
+	program := MustParseIR("func f(x int64) int64 {\n  return x * 3\n}\ni = 0; s = 0; while i < 10 { s = s + f(i); i = i + 1 }; return s")
+	cycle := func() {
+		code, err := Compile(TargetArch, TargetABI, []IR{program}, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := code.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if value := e.Execute(false); value != 135 {
+				t.Fatal("Expecting 135 got", value)
+			}
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Warm up, so that the heap and the fault handler are settled.
+	for i := 0; i < 200; i++ {
+		cycle()
+	}
+	runtime.GC()
+	before := residentSetSize(t)
+	// Leaking a page per cycle would grow the RSS by 12MB.
+	for i := 0; i < 3000; i++ {
+		cycle()
+	}
+	runtime.GC()
+	after := residentSetSize(t)
+	if growth := after - before; growth > 4<<20 {
+		t.Errorf("Expecting a constant RSS, but it grew by %d bytes from %d bytes", growth, before)
+	}
+}
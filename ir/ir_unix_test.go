@@ -0,0 +1,58 @@
+//go:build unix
+
+package ir
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+//goland:noinspection GoBoolExpressions
+func Test_ShortCircuit_skips_side_effects(t *testing.T) {
+	var units = []struct {
+		program     string
+		shouldClose bool
+	}{
+		{`if (fd == uint64(0)) && (Close(fd) == 0) { f = 100 } else { f = 53 }`, false},
+		{`if (fd != uint64(0)) || (Close(fd) == 0) { f = 53 } else { f = 100 }`, false},
+		{`b = (fd == uint64(0)) && (Close(fd) == 0); if b { f = 100 } else { f = 53 }`, false},
+		{`b = (fd != uint64(0)) || (Close(fd) == 0); if b { f = 53 } else { f = 100 }`, false},
+		{`if (fd != uint64(0)) && (Close(fd) == 0) { f = 53 } else { f = 100 }`, true},
+		{`if (fd == uint64(0)) || (Close(fd) == 0) { f = 53 } else { f = 100 }`, true},
+	}
+	for _, unit := range units {
+		var pipe [2]int
+		if err := syscall.Pipe(pipe[:]); err != nil {
+			t.Fatal(err)
+		}
+		fd, err := syscall.Dup(pipe[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		program := fmt.Sprintf("%sfd = uint64(%d); %s; return f", Stdlib, fd, unit.program)
+		i, err := ParseIR(program)
+		if err != nil {
+			t.Fatal(err, "in", unit.program)
+		}
+		b, err := Compile(TargetArch, TargetABI, []IR{i}, Options{})
+		if err != nil {
+			t.Fatal(err, "in", unit.program)
+		}
+		if value := b.Execute(false); value != 53 {
+			t.Error("Expecting 53 got", value, "in", unit.program)
+		}
+		var stat syscall.Stat_t
+		closed := syscall.Fstat(fd, &stat) == syscall.EBADF
+		if closed != unit.shouldClose {
+			t.Error("Expecting fd closed to be", unit.shouldClose, "got", closed, "in", unit.program)
+		}
+		if !closed {
+			syscall.Close(fd)
+		}
+		syscall.Close(pipe[0])
+		syscall.Close(pipe[1])
+	}
+}
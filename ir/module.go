@@ -0,0 +1,384 @@
+package ir
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+	"github.com/bspaans/jit-compiler/lib"
+)
+
+// Module is a set of named functions that were compiled together. The
+// functions share the module's code and data segments, and are exposed as
+// a Func each. Global variables declared with var keep their value between
+// calls, and can be read and written from Go with Global.
+//
+// The functions call each other through a table of function pointers in the
+// data segment, which lets Replace swap in new code for a function while the
+// module is running.
+type Module struct {
+	code    *lib.Executable
+	funcs   map[string]*Func
+	globals map[string]*Global
+
+	// ctx holds the globals and externs that replacements are compiled
+	// against, and context declares them for the passes. segments is the
+	// data layout, and slots are the offsets of the function table entries.
+	ctx      *IR_Context
+	context  []IR
+	opts     Options
+	segments *Segments
+	codeEnd  int
+	slots    map[string]int
+	// replaceMu serializes Replace.
+	replaceMu sync.Mutex
+
+	// mu guards the entry points of the functions and the epochs. Every
+	// Replace starts a new epoch. Calls from Go are counted by the epoch
+	// that they started in, so that code that was replaced in an epoch can
+	// be released once the calls that started in it or before have
+	// returned.
+	mu      sync.Mutex
+	epoch   uint64
+	calls   map[uint64]int
+	patches map[string]int
+	retired []retiredPatch
+}
+
+// retiredPatch is replaced code that may still be running.
+type retiredPatch struct {
+	offset int
+	epoch  uint64
+}
+
+// moduleReserve is the number of bytes that modules reserve for the code
+// of replaced functions.
+const moduleReserve = 256 * 1024
+
+// CompileModule compiles the top-level function definitions, global
+// variables and externs in stmts, e.g. the result of parsing
+//
+//	extern func log(x float64)
+//	var phase float64 = 0.25
+//	func init(seed int64) int64 { ... }
+//	func process(n int64) float64 { ... }
+//
+// The externs are bound to the Go functions in opts.Imports. The module
+// should be closed when it's no longer needed.
+//
+//goland:noinspection GoErrorStringFormat
+func CompileModule(targetArchitecture Architecture, abi ABI, stmts []IR, opts Options) (*Module, error) {
+	var defs []*statements.IR_FunctionDef
+	// The globals and externs are declared before the functions use them.
+	var decls []IR
+	for _, stmt := range flattenStatements(stmts) {
+		switch stmt.(type) {
+		case *statements.IR_Var, *statements.IR_Extern:
+			decls = append(decls, stmt)
+			continue
+		}
+		def, ok := stmt.(*statements.IR_FunctionDef)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported top-level statement in module: %s", stmt)
+		}
+		for _, other := range defs {
+			if other.Name == def.Name {
+				return nil, fmt.Errorf("Function %s is defined more than once", def.Name)
+			}
+		}
+		if err := checkSignature(def.Expr.Signature); err != nil {
+			return nil, fmt.Errorf("Function %s: %s", def.Name, err.Error())
+		}
+		defs = append(defs, def)
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("Module doesn't define any functions")
+	}
+	// Every function gets a slot in the function table, which is filled in
+	// once the code is loaded.
+	var context []IR
+	for _, def := range defs {
+		context = append(context, statements.NewIR_Var(def.Name, def.Expr.Signature, nil))
+	}
+	context = append(context, decls...)
+	// The passes run on every function on its own, with the others only
+	// declared, so that they call each other through the function table
+	// instead of getting inlined, and can still be replaced.
+	passes := opts.passManager()
+	for i, def := range defs {
+		fn, err := optimiseFunction(def.Name, def.Expr, context, passes, opts)
+		if err != nil {
+			return nil, fmt.Errorf("Function %s: %s", def.Name, err.Error())
+		}
+		defs[i] = statements.NewIR_FunctionDef(def.Name, fn)
+	}
+	irs := append([]IR{}, context...)
+	for _, def := range defs {
+		irs = append(irs, def)
+	}
+	ctx := NewIRContext(targetArchitecture, abi, func(c *IR_Context) *IR_Context {
+		c.Debug = opts.Debug
+		c.CheckedArithmetic = opts.CheckedArithmetic
+		c.Fuel = opts.Fuel
+		c.SkipPeephole = !passes.Enabled("peephole")
+		return c
+	})
+	segments, err := ctx.Architecture.EncodeDataSection(irs, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Debug {
+		fmt.Println(segments.String())
+	}
+	hosts, err := hostFunctions(ctx.Externs, opts.Imports)
+	if err != nil {
+		return nil, err
+	}
+	program := &lib.Program{
+		MachineCode: segments.Encode(),
+		DataEnd:     segments.CodeStart(),
+		Entry:       segments.GetAddress(defs[0].Expr.Address),
+
+		HostFunctions: hosts,
+	}
+	if opts.Arena == nil {
+		program.Reserve = moduleReserve
+	}
+	code, err := load(program, opts)
+	if err != nil {
+		return nil, err
+	}
+	mod := &Module{
+		code:     code,
+		funcs:    map[string]*Func{},
+		globals:  map[string]*Global{},
+		ctx:      ctx,
+		context:  context,
+		opts:     opts,
+		segments: segments,
+		codeEnd:  roundUp(len(program.MachineCode), segments.PageSize),
+		slots:    map[string]int{},
+		calls:    map[uint64]int{},
+		patches:  map[string]int{},
+	}
+	for name, global := range ctx.Globals {
+		if global.Type.Type() == T_Function {
+			mod.slots[name] = segments.GetAddress(global.Address)
+			continue
+		}
+		mod.globals[name] = &Global{
+			Name:   name,
+			Type:   global.Type,
+			code:   code,
+			offset: segments.GetAddress(global.Address),
+		}
+	}
+	for _, def := range defs {
+		mod.funcs[def.Name] = &Func{
+			Signature: def.Expr.Signature,
+			code:      code,
+			entry:     segments.GetAddress(def.Expr.Address),
+			module:    mod,
+		}
+		if err := mod.storeSlot(def.Name, mod.funcs[def.Name].entry); err != nil {
+			_ = code.Close()
+			return nil, err
+		}
+	}
+	// Only the layout of the data is needed from here on.
+	segments.Segments[Executable] = NewSegment()
+	return mod, nil
+}
+
+func roundUp(n, multiple int) int {
+	return (n + multiple - 1) / multiple * multiple
+}
+
+// storeSlot points the function table slot of the function at entry.
+func (m *Module) storeSlot(name string, entry int) error {
+	slot := m.slots[name]
+	return m.code.StoreUint64(slot, uint64(entry-slot))
+}
+
+// flattenStatements returns the statements in stmts, with the statements of
+// IR_AndThen listed separately.
+func flattenStatements(stmts []IR) []IR {
+	var result []IR
+	for _, stmt := range stmts {
+		if then, ok := stmt.(*statements.IR_AndThen); ok {
+			result = append(result, flattenStatements([]IR{then.Stmt1, then.Stmt2})...)
+		} else {
+			result = append(result, stmt)
+		}
+	}
+	return result
+}
+
+// Func returns the function with the given name.
+//
+//goland:noinspection GoErrorStringFormat
+func (m *Module) Func(name string) (*Func, error) {
+	f, ok := m.funcs[name]
+	if !ok {
+		return nil, fmt.Errorf("Module doesn't define function %s", name)
+	}
+	return f, nil
+}
+
+// Global returns the global variable with the given name, or nil when the
+// module doesn't declare it.
+func (m *Module) Global(name string) *Global {
+	return m.globals[name]
+}
+
+// Functions returns the names of the functions in the module, sorted.
+func (m *Module) Functions() []string {
+	names := make([]string, 0, len(m.funcs))
+	for name := range m.funcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Replace compiles source, e.g. "func(step float64) float64 { ... }", and
+// swaps it in for the function called name, while the module's functions
+// may be running on other goroutines. The signature has to stay the same.
+// Calls that already started finish in the old code, while calls that
+// start afterwards, from Go or from the other functions of the module, run
+// the new code. The old code is released once the calls that may still be
+// running it have returned.
+//
+// The replacement can use the module's globals, externs and functions, but
+// can't add data of its own, like array literals. Replacing fails with
+// lib.ErrNoPatchSpace when there's no room left for the new code, which may
+// be temporary while old code is still running. Modules compiled into an
+// Arena can't be replaced.
+//
+//goland:noinspection GoErrorStringFormat
+func (m *Module) Replace(name, source string) error {
+	fn, err := ParseIRFunction(source)
+	if err != nil {
+		return err
+	}
+	m.replaceMu.Lock()
+	defer m.replaceMu.Unlock()
+	f, ok := m.funcs[name]
+	if !ok {
+		return fmt.Errorf("Module doesn't define function %s", name)
+	}
+	if fn.Signature.String() != f.Signature.String() {
+		return fmt.Errorf("Replacement for %s has type %s, expecting %s", name, fn.Signature, f.Signature)
+	}
+	fn, err = optimiseFunction(name, fn, m.context, m.opts.passManager(), m.opts)
+	if err != nil {
+		return err
+	}
+	var entry int
+	encode := func(offset int) ([]byte, error) {
+		segments := m.segmentsAt(offset)
+		ctx := m.ctx.Copy()
+		ctx.VariableMap = map[string]lib.Operand{}
+		ctx.VariableTypes = map[string]Type{}
+		if err := ctx.Architecture.EncodeFunction(fn, ctx, segments); err != nil {
+			return nil, err
+		}
+		if segments.CodeStart() != m.segments.CodeStart() || len(segments.Segments[ReadWrite].Data) != len(m.segments.Segments[ReadWrite].Data) {
+			return nil, fmt.Errorf("Replacement for %s can't add data", name)
+		}
+		entry = segments.GetAddress(fn.Address)
+		return segments.Segments[Executable].Data[offset-segments.CodeStart():], nil
+	}
+	// The code has the same size at every offset, so it's encoded at the
+	// start of the reserve first to find out how much room it needs.
+	code, err := encode(m.codeEnd)
+	if err != nil {
+		return err
+	}
+	offset, err := m.code.Patch(len(code), encode)
+	if err != nil {
+		return err
+	}
+	if m.opts.Debug {
+		fmt.Printf("Replaced %s at 0x%x\n", name, entry)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.storeSlot(name, entry); err != nil {
+		_ = m.code.FreePatch(offset)
+		return err
+	}
+	f.entry = entry
+	if old, ok := m.patches[name]; ok {
+		m.retired = append(m.retired, retiredPatch{offset: old, epoch: m.epoch})
+	}
+	m.patches[name] = offset
+	m.epoch++
+	m.reclaim()
+	return nil
+}
+
+// segmentsAt returns segments with the data layout of the module and the
+// executable segment filled up to offset, so that code added to it ends up
+// at offset.
+func (m *Module) segmentsAt(offset int) *Segments {
+	segments := NewSegments()
+	segments.PageSize = m.segments.PageSize
+	for _, ty := range []SegmentType{ReadOnly, ReadWrite} {
+		segments.Segments[ty].Data = append([]uint8{}, m.segments.Segments[ty].Data...)
+	}
+	segments.Segments[Executable].Data = make([]uint8, offset-segments.CodeStart())
+	return segments
+}
+
+// enter counts a call of f from Go in the current epoch, and returns the
+// epoch and the entry point of f.
+func (m *Module) enter(f *Func) (uint64, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[m.epoch]++
+	return m.epoch, f.entry
+}
+
+// exit is called when a call that started in epoch returns.
+func (m *Module) exit(epoch uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls[epoch]--
+	if m.calls[epoch] == 0 {
+		delete(m.calls, epoch)
+	}
+	m.reclaim()
+}
+
+// reclaim releases the code that was replaced before the oldest running
+// call started, which no call can be running anymore.
+func (m *Module) reclaim() {
+	if len(m.retired) == 0 {
+		return
+	}
+	oldest := m.epoch
+	for epoch := range m.calls {
+		if epoch < oldest {
+			oldest = epoch
+		}
+	}
+	retired := m.retired[:0]
+	for _, patch := range m.retired {
+		if patch.epoch < oldest {
+			_ = m.code.FreePatch(patch.offset)
+		} else {
+			retired = append(retired, patch)
+		}
+	}
+	m.retired = retired
+}
+
+// Close releases the memory of the module. Calls to its functions return
+// lib.ErrClosed afterwards.
+func (m *Module) Close() error {
+	return m.code.Close()
+}
@@ -3,6 +3,7 @@ package ir
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 
@@ -200,6 +201,8 @@ func ParseSimpleType() Parser {
 		"int32":   shared.TInt32,
 		"int64":   shared.TInt64,
 		"float64": shared.TFloat64,
+		"float32": shared.TFloat32,
+		"bool":    shared.TBool,
 	}
 	return func(str string) *ParseResult {
 		for tyStr, typ := range types {
@@ -250,6 +253,10 @@ func ConvertInteger(typ shared.Type, v int64) shared.IRExpression {
 		return expr.NewIR_Int16(int16(v))
 	case shared.TInt32:
 		return expr.NewIR_Int32(int32(v))
+	case shared.TFloat64:
+		return expr.NewIR_Float64(float64(v))
+	case shared.TBool:
+		return expr.NewIR_Bool(v != 0)
 	}
 	return expr.NewIR_Int64(v)
 }
@@ -371,11 +378,13 @@ func ParseIdent() Parser {
 	return OneOf([]Parser{
 		ParseByteRange('a', 'z'),
 		ParseByteRange('A', 'Z'),
+		ParseByte('_'),
 	}).AndThen(func(sub1 *ParseResult) Parser {
 		return OneOf([]Parser{
 			ParseByteRange('a', 'z'),
 			ParseByteRange('A', 'Z'),
 			ParseByteRange('0', '9'),
+			ParseByte('_'),
 		}).Many().Fmap(func(sub2 *ParseResult) *ParseResult {
 			chars := InterfaceArrayToByteArray(sub2.Result)
 			result := string(sub1.Result.(byte)) + string(chars)
@@ -469,7 +478,7 @@ func ParseSpace1() Parser {
 }
 
 func ParseSingleExpression() Parser {
-	return OneOf([]Parser{
+	return WithPosition(OneOf([]Parser{
 		ParseStructField(),
 		ParseStruct(),
 		ParseArrayIndex(),
@@ -482,7 +491,7 @@ func ParseSingleExpression() Parser {
 		ParseArray(),
 		ParseNotExpression(),
 		ParseEnclosedExpression(),
-	})
+	}))
 }
 
 func ParseNotExpression() Parser {
@@ -496,20 +505,78 @@ func ParseEnclosedExpression() Parser {
 }
 
 func ParseExpression() Parser {
-	return OneOf([]Parser{
+	return WithPosition(OneOf([]Parser{
 		ParseOperator(),
 		ParseSingleExpression(),
-	})
+	}))
+}
+
+type positioned interface {
+	Position() shared.Position
+	SetPosition(shared.Position)
+}
+
+// WithPosition records where the expression parsed by p starts. Parsers only
+// see the rest of the input, so the Offset is stored as the length of the
+// remaining input until ParseIR resolves it into an offset, line and column.
+// Expressions that already have a position (e.g. the same expression seen by
+// an enclosing parser) are left alone.
+func WithPosition(p Parser) Parser {
+	return func(str string) *ParseResult {
+		result := p(str)
+		if result.Error != nil {
+			return result
+		}
+		if e, ok := result.Result.(positioned); ok && e.Position().Offset == 0 {
+			e.SetPosition(shared.Position{Offset: len(str)})
+		}
+		return result
+	}
+}
+
+// resolvePositions turns the positions recorded by WithPosition in the parse
+// tree v into offsets, lines and columns in src.
+func resolvePositions(v reflect.Value, src string, seen map[*shared.BaseIRExpression]bool) {
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() || !v.CanInterface() {
+			return
+		}
+		if e, ok := v.Interface().(*shared.BaseIRExpression); ok {
+			if seen[e] {
+				return
+			}
+			seen[e] = true
+			if remaining := e.Position().Offset; remaining > 0 && remaining <= len(src) {
+				offset := len(src) - remaining
+				line := strings.Count(src[:offset], "\n") + 1
+				column := offset - strings.LastIndex(src[:offset], "\n")
+				e.SetPosition(shared.Position{Offset: offset, Line: line, Column: column})
+			}
+		}
+		resolvePositions(v.Elem(), src, seen)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			resolvePositions(v.Field(i), src, seen)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			resolvePositions(v.Index(i), src, seen)
+		}
+	}
 }
 
 func ParseSingleStatement() Parser {
 	return ParseSpace().And(OneOf([]Parser{
 		ParseIf(),
+		ParseVar(),
 		ParseAssignment(),
 		ParseArrayAssignment(),
 		ParseReturn(),
 		ParseWhile(),
 		ParseFunctionDef(),
+		ParseExtern(),
+		ParseCallStatement(),
 	}))
 }
 
@@ -529,6 +596,23 @@ func ParseAssignment() Parser {
 	})
 }
 
+func ParseVar() Parser {
+	return ParseString("var").And(ParseSpace1()).And(ParseVariable()).AndThen(func(variable *ParseResult) Parser {
+		return ParseSpace1().And(ParseType()).AndThen(func(typ *ParseResult) Parser {
+			name := variable.Result.(*expr.IR_Variable).Value
+			withValue := ParseSpace().And(ParseByte('=')).And(ParseSpace()).And(ParseExpression()).Fmap(func(value *ParseResult) *ParseResult {
+				return ParseSuccess(statements.NewIR_Var(name, typ.Result.(shared.Type), value.Result.(shared.IRExpression)), value.Rest)
+			})
+			return OneOf([]Parser{
+				withValue,
+				func(str string) *ParseResult {
+					return ParseSuccess(statements.NewIR_Var(name, typ.Result.(shared.Type), nil), str)
+				},
+			})
+		})
+	})
+}
+
 func ParseArrayAssignment() Parser {
 	return ParseVariable().AndThen(func(variable *ParseResult) Parser {
 		return ParseSpace().And(ParseByte('[')).And(ParseSpace()).And(ParseExpression()).AndThen(func(index *ParseResult) Parser {
@@ -551,31 +635,21 @@ func ParseFunctionDefArgs() Parser {
 	return ParseList(itemParser)
 }
 
-func ParseFunction() Parser {
-	return ParseString("func").And(ParseSpace()).And(ParseByte('(')).And(ParseFunctionDefArgs()).AndThen(func(args *ParseResult) Parser {
-		return ParseByte(')').And(ParseSpace()).And(ParseType()).AndThen(func(returns *ParseResult) Parser {
-			return ParseBlock().Fmap(func(body *ParseResult) *ParseResult {
-				var argNames []string
-				var argTypes []shared.Type
-				for _, pair := range args.Result.([]interface{}) {
-					lst := pair.([]interface{})
-					argNames = append(argNames, lst[0].(string))
-					argTypes = append(argTypes, lst[1].(shared.Type))
-				}
-				signature := &shared.TFunction{
-					ReturnType: returns.Result.(shared.Type),
-					Args:       argTypes,
-					ArgNames:   argNames,
-				}
-				return ParseSuccess(expr.NewIR_Function(signature, body.Result.(shared.IR)), body.Rest)
-			})
-		})
+// ParseInlineHint parses the inline or noinline annotation in front of a
+// function, if there is one.
+func ParseInlineHint() Parser {
+	return OneOf([]Parser{
+		ParseString("inline").And(ParseSpace1()).Success(expr.InlineAlways),
+		ParseString("noinline").And(ParseSpace1()).Success(expr.InlineNever),
+		func(str string) *ParseResult {
+			return ParseSuccess(expr.InlineAuto, str)
+		},
 	})
 }
 
-func ParseFunctionDef() Parser {
-	return ParseString("func").And(ParseSpace1()).And(ParseVariable()).AndThen(func(name *ParseResult) Parser {
-		return ParseSpace().And(ParseByte('(')).And(ParseFunctionDefArgs()).AndThen(func(args *ParseResult) Parser {
+func ParseFunction() Parser {
+	return ParseInlineHint().AndThen(func(hint *ParseResult) Parser {
+		return ParseString("func").And(ParseSpace()).And(ParseByte('(')).And(ParseFunctionDefArgs()).AndThen(func(args *ParseResult) Parser {
 			return ParseByte(')').And(ParseSpace()).And(ParseType()).AndThen(func(returns *ParseResult) Parser {
 				return ParseBlock().Fmap(func(body *ParseResult) *ParseResult {
 					var argNames []string
@@ -591,17 +665,91 @@ func ParseFunctionDef() Parser {
 						ArgNames:   argNames,
 					}
 					f := expr.NewIR_Function(signature, body.Result.(shared.IR))
-					return ParseSuccess(statements.NewIR_FunctionDef(name.Result.(*expr.IR_Variable).Value, f), body.Rest)
+					f.Inline = hint.Result.(expr.InlineHint)
+					return ParseSuccess(f, body.Rest)
 				})
 			})
 		})
 	})
 }
 
+func ParseFunctionDef() Parser {
+	return ParseInlineHint().AndThen(func(hint *ParseResult) Parser {
+		return ParseString("func").And(ParseSpace1()).And(ParseVariable()).AndThen(func(name *ParseResult) Parser {
+			return ParseSpace().And(ParseByte('(')).And(ParseFunctionDefArgs()).AndThen(func(args *ParseResult) Parser {
+				return ParseByte(')').And(ParseSpace()).And(ParseType()).AndThen(func(returns *ParseResult) Parser {
+					return ParseBlock().Fmap(func(body *ParseResult) *ParseResult {
+						var argNames []string
+						var argTypes []shared.Type
+						for _, pair := range args.Result.([]interface{}) {
+							lst := pair.([]interface{})
+							argNames = append(argNames, lst[0].(string))
+							argTypes = append(argTypes, lst[1].(shared.Type))
+						}
+						signature := &shared.TFunction{
+							ReturnType: returns.Result.(shared.Type),
+							Args:       argTypes,
+							ArgNames:   argNames,
+						}
+						f := expr.NewIR_Function(signature, body.Result.(shared.IR))
+						f.Inline = hint.Result.(expr.InlineHint)
+						return ParseSuccess(statements.NewIR_FunctionDef(name.Result.(*expr.IR_Variable).Value, f), body.Rest)
+					})
+				})
+			})
+		})
+	})
+}
+
+func ParseExtern() Parser {
+	return ParseString("extern").And(ParseSpace1()).And(ParseString("func")).And(ParseSpace1()).And(ParseVariable()).AndThen(func(name *ParseResult) Parser {
+		return ParseSpace().And(ParseByte('(')).And(ParseFunctionDefArgs()).AndThen(func(args *ParseResult) Parser {
+			returns := OneOf([]Parser{
+				ParseSpace().And(ParseType()),
+				func(str string) *ParseResult {
+					return ParseSuccess(shared.TVoid, str)
+				},
+			})
+			return ParseByte(')').And(returns).Fmap(func(returns *ParseResult) *ParseResult {
+				var argNames []string
+				var argTypes []shared.Type
+				for _, pair := range args.Result.([]interface{}) {
+					lst := pair.([]interface{})
+					argNames = append(argNames, lst[0].(string))
+					argTypes = append(argTypes, lst[1].(shared.Type))
+				}
+				signature := &shared.TFunction{
+					ReturnType: returns.Result.(shared.Type),
+					Args:       argTypes,
+					ArgNames:   argNames,
+				}
+				return ParseSuccess(statements.NewIR_Extern(name.Result.(*expr.IR_Variable).Value, signature), returns.Rest)
+			})
+		})
+	})
+}
+
+// ParseCallStatement parses a call whose result is discarded, e.g. of an
+// extern function that doesn't return a value.
+func ParseCallStatement() Parser {
+	return ParseFunctionCall().Fmap(func(call *ParseResult) *ParseResult {
+		if c, ok := call.Result.(*expr.IR_Call); ok {
+			return ParseSuccess(statements.NewIR_CallStatement(c), call.Rest)
+		}
+		return NilParseResult(call.Rest)
+	})
+}
+
 func ParseFunctionArgs() Parser {
 	return ParseList(ParseExpression())
 }
 
+var checkedBuiltins = map[string]func(op1, op2 shared.IRExpression) shared.IRExpression{
+	"checked_add": func(op1, op2 shared.IRExpression) shared.IRExpression { return expr.NewIR_CheckedAdd(op1, op2) },
+	"checked_sub": func(op1, op2 shared.IRExpression) shared.IRExpression { return expr.NewIR_CheckedSub(op1, op2) },
+	"checked_mul": func(op1, op2 shared.IRExpression) shared.IRExpression { return expr.NewIR_CheckedMul(op1, op2) },
+}
+
 //goland:noinspection GoErrorStringFormat
 func ParseFunctionCall() Parser {
 	return ParseIdent().AndThen(func(v *ParseResult) Parser {
@@ -612,11 +760,21 @@ func ParseFunctionCall() Parser {
 				var result shared.IRExpression
 				if function == "syscall" {
 					result = expr.NewIR_Syscall(args[0], args[1:])
+				} else if function == "len" {
+					if len(args) != 1 {
+						return ParseError(fmt.Errorf("Expecting one parameter in call to len"))
+					}
+					result = expr.NewIR_Len(args[0])
+				} else if checked, ok := checkedBuiltins[function]; ok {
+					if len(args) != 2 {
+						return ParseError(fmt.Errorf("Expecting two parameters in call to %v", function))
+					}
+					result = checked(args[0], args[1])
 				} else {
 					result = expr.NewIR_Call(function, args)
 				}
 
-				if ty := ParseType()(function); ty.Result != nil && ty.Error == nil {
+				if ty := ParseType()(function); ty.Result != nil && ty.Error == nil && ty.Rest == "" {
 					if len(args) == 1 {
 						if v, ok := args[0].(*expr.IR_Int64); ok && ty.Result.(shared.Type) != shared.TInt64 {
 							result = ConvertInteger(ty.Result.(shared.Type), v.Value)
@@ -662,8 +820,13 @@ func ParseBlock() Parser {
 func ParseIf() Parser {
 	return ParseString("if").And(ParseSpace1()).And(ParseExpression()).AndThen(func(cond *ParseResult) Parser {
 		return ParseBlock().AndThen(func(stmt1 *ParseResult) Parser {
-			return ParseString("else").And(ParseBlock()).Fmap(func(stmt2 *ParseResult) *ParseResult {
-				return ParseSuccess(statements.NewIR_If(cond.Result.(shared.IRExpression), stmt1.Result.(shared.IR), stmt2.Result.(shared.IR)), stmt2.Rest)
+			return OneOf([]Parser{
+				ParseString("else").And(ParseBlock()).Fmap(func(stmt2 *ParseResult) *ParseResult {
+					return ParseSuccess(statements.NewIR_If(cond.Result.(shared.IRExpression), stmt1.Result.(shared.IR), stmt2.Result.(shared.IR)), stmt2.Rest)
+				}),
+				func(str string) *ParseResult {
+					return ParseSuccess(statements.NewIR_If(cond.Result.(shared.IRExpression), stmt1.Result.(shared.IR), nil), str)
+				},
 			})
 		})
 	})
@@ -740,9 +903,30 @@ func ParseIR(str string) (shared.IR, error) {
 	if result.Result == nil {
 		return nil, fmt.Errorf("Nil parse result %s at %d", str, len(str)-len(result.Rest))
 	}
+	resolvePositions(reflect.ValueOf(result.Result), str, map[*shared.BaseIRExpression]bool{})
 	return result.Result.(shared.IR), nil
 }
 
+// ParseIRFunction parses a single function, e.g. "func(a int64) int64 { return a }",
+// for use with CompileFunction and CompileFunc. Named functions are accepted too.
+func ParseIRFunction(str string) (*expr.IR_Function, error) {
+	result := OneOf([]Parser{ParseFunction(), ParseFunctionDef()})(str)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.Rest != "" {
+		return nil, fmt.Errorf("Failed to parse: %s at %d", str, len(str)-len(result.Rest))
+	}
+	if result.Result == nil {
+		return nil, fmt.Errorf("Nil parse result %s at %d", str, len(str)-len(result.Rest))
+	}
+	resolvePositions(reflect.ValueOf(result.Result), str, map[*shared.BaseIRExpression]bool{})
+	if def, ok := result.Result.(*statements.IR_FunctionDef); ok {
+		return def.Expr, nil
+	}
+	return result.Result.(*expr.IR_Function), nil
+}
+
 func MustParseIR(str string) shared.IR {
 	result, err := ParseIR(str)
 	if err != nil {
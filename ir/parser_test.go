@@ -11,6 +11,7 @@ func Test_Parser_Happy(t *testing.T) {
 		"a123 = 1234 + z + b; z = a + 2",
 		"a123 = 1234 + z + b; z = a + 2; b = 3; return b",
 		"if a + 3 { b = 3 } else { z = 300 }",
+		"if a > 3 { b = 3 }; z = 300",
 		"while a != 3 { a = a * 1 }",
 		"while a != 3 { a = a * 1; b = 3.1415 }",
 		"a123 = 1234 + b[3]",
@@ -48,6 +49,17 @@ func Test_Parser_Happy(t *testing.T) {
 		`a = b.Field`,
 		`a = (5 + 4) * 6`,
 		`a = ([]uint64{1,2,3})[2]`,
+		`a = len(b)`,
+		`var phase float64`,
+		`var phase float64 = 0.5; phase = phase + 1.0`,
+		"a123 = func(buf []float32, gain float64) int64 { buf[0] = buf[1] * gain; return len(buf) }",
+		`extern func log(x float64)`,
+		`extern func lookup(note int64, velocity uint8) float64; a = lookup(60, 100)`,
+		`log(a); log(2.0)`,
+		`inline func Max(i int64, j int64) int64 { if i > j { return i }; return j }`,
+		`noinline func Max(i int64, j int64) int64 { if i > j { return i }; return j }`,
+		"a123 = inline func(a uint64) uint64 { return a * 2 }",
+		"inline = 3; a = inline + 1",
 	}
 	for _, p := range shouldParse {
 		_, err := ParseIR(p)
@@ -0,0 +1,197 @@
+package ir
+
+import (
+	"fmt"
+	"io"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/ssa"
+)
+
+// OptimisationLevel is a preset of the passes that a PassManager runs.
+type OptimisationLevel int
+
+const (
+	// O0 doesn't run any passes, not even the peephole optimiser.
+	O0 OptimisationLevel = iota
+	// O1 folds constants, removes dead code and unused functions, and runs
+	// the peephole optimiser.
+	O1
+	// O2 runs all the passes of O1, and flattens expressions, inlines
+	// functions, reduces the strength of arithmetic, numbers values and
+	// hoists loop invariants.
+	O2
+)
+
+// pass is a named transformation of the IR. function runs on the SSA form
+// of the program and of each of its functions, program on the statements.
+// The peephole pass has neither, and is run by the encoder.
+type pass struct {
+	name     string
+	function func(f *ssa.Func) error
+	program  func(stmts []IR, keep ...string) []IR
+}
+
+// passes are all the passes, in the order in which they run.
+var passes = []pass{
+	{name: "flatten", program: flatten},
+	{name: "inline", function: ssa.Inline},
+	{name: "fold-constants", function: ssa.FoldConstants},
+	{name: "reduce-strength", function: ssa.ReduceStrength},
+	{name: "number-values", function: ssa.NumberValues},
+	{name: "hoist-loop-invariants", function: ssa.HoistLoopInvariants},
+	{name: "eliminate-dead-code", function: ssa.EliminateDeadCode},
+	{name: "remove-unused-functions", program: ssa.RemoveUnusedFunctions},
+	{name: "peephole"},
+}
+
+var levels = map[OptimisationLevel][]string{
+	O0: {},
+	O1: {"fold-constants", "eliminate-dead-code", "remove-unused-functions", "peephole"},
+	O2: {"flatten", "inline", "fold-constants", "reduce-strength", "number-values",
+		"hoist-loop-invariants", "eliminate-dead-code", "remove-unused-functions", "peephole"},
+}
+
+// flatten is SSA_Transform, which assigns the nested expressions of the
+// statements to temporaries, so that the SSA passes can number and hoist
+// them.
+func flatten(stmts []IR, _ ...string) []IR {
+	ctx := NewSSA_Context()
+	result := make([]IR, len(stmts))
+	for i, stmt := range stmts {
+		result[i] = stmt.SSA_Transform(ctx)
+	}
+	return result
+}
+
+// PassNames returns the names of the passes that a PassManager can run.
+func PassNames() []string {
+	names := make([]string, len(passes))
+	for i, p := range passes {
+		names[i] = p.name
+	}
+	return names
+}
+
+// PassManager runs the passes that are enabled on the IR before it gets
+// compiled, in a fixed order. In debug builds the SSA form is verified
+// after every pass.
+type PassManager struct {
+	enabled map[string]bool
+	// Dump gets the IR after every pass that runs, if it's set.
+	Dump io.Writer
+}
+
+// NewPassManager returns a PassManager that runs the passes of level.
+func NewPassManager(level OptimisationLevel) (*PassManager, error) {
+	names, ok := levels[level]
+	if !ok {
+		return nil, fmt.Errorf("Unknown optimisation level %d", level)
+	}
+	p := &PassManager{enabled: map[string]bool{}}
+	return p, p.Enable(names...)
+}
+
+// Enable makes p run the passes with the given names.
+func (p *PassManager) Enable(names ...string) error {
+	return p.set(names, true)
+}
+
+// Disable makes p skip the passes with the given names.
+func (p *PassManager) Disable(names ...string) error {
+	return p.set(names, false)
+}
+
+//goland:noinspection GoErrorStringFormat
+func (p *PassManager) set(names []string, enabled bool) error {
+	for _, name := range names {
+		if !isPass(name) {
+			return fmt.Errorf("Unknown pass %s", name)
+		}
+		p.enabled[name] = enabled
+	}
+	return nil
+}
+
+func isPass(name string) bool {
+	for _, pass := range passes {
+		if pass.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Enabled returns whether p runs the pass with the given name.
+func (p *PassManager) Enabled(name string) bool {
+	return p.enabled[name]
+}
+
+// Passes returns the names of the passes that p runs, in order.
+func (p *PassManager) Passes() []string {
+	names := []string{}
+	for _, pass := range passes {
+		if p.enabled[pass.name] {
+			names = append(names, pass.name)
+		}
+	}
+	return names
+}
+
+// Run runs the passes on the program stmts. The functions in keep are
+// called from the outside, so they aren't removed. In debug builds the SSA
+// form is verified after every pass. With CheckedArithmetic the arithmetic
+// is marked as checked before the first SSA pass, so that the passes don't
+// fold away the overflow traps.
+//
+//goland:noinspection GoErrorStringFormat
+func (p *PassManager) Run(stmts []IR, opts Options, keep ...string) ([]IR, error) {
+	checked := opts.CheckedArithmetic
+	for _, pass := range passes {
+		if !p.enabled[pass.name] {
+			continue
+		}
+		switch {
+		case pass.function != nil:
+			run := pass.function
+			result, err := ssa.Transform(stmts, func(f *ssa.Func) error {
+				if checked {
+					if err := ssa.MarkChecked(f); err != nil {
+						return err
+					}
+				}
+				if err := run(f); err != nil {
+					return err
+				}
+				if opts.Debug {
+					return f.Verify()
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Error in %s pass: %s", pass.name, err.Error())
+			}
+			stmts, checked = result, false
+		case pass.program != nil:
+			stmts = pass.program(stmts, keep...)
+		default:
+			continue
+		}
+		if p.Dump != nil {
+			fmt.Fprintf(p.Dump, "# after %s\n", pass.name)
+			for _, stmt := range stmts {
+				fmt.Fprintln(p.Dump, stmt.String())
+			}
+		}
+	}
+	return stmts, nil
+}
+
+// passManager returns the PassManager of opts. Without one only the
+// peephole optimiser runs, which is what the encoders always did.
+func (opts Options) passManager() *PassManager {
+	if opts.Passes != nil {
+		return opts.Passes
+	}
+	return &PassManager{enabled: map[string]bool{"peephole": true}}
+}
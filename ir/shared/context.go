@@ -9,6 +9,12 @@ type Architecture interface {
 	EncodeExpression(expr IRExpression, ctx *IR_Context, target lib.Operand) ([]lib.Instruction, error)
 	EncodeStatement(stmt IR, ctx *IR_Context) ([]lib.Instruction, error)
 	EncodeDataSection(stmts []IR, ctx *IR_Context) (*Segments, error)
+	// EncodeFunction adds the data and code of fn, an expr.IR_Function, to
+	// segments after what's there already.
+	EncodeFunction(fn IRExpression, ctx *IR_Context, segments *Segments) error
+	// Peephole removes redundant instructions from the code of a statement
+	// or function before it's encoded.
+	Peephole(code []lib.Instruction) ([]lib.Instruction, error)
 	GetAllocator() Allocator
 }
 
@@ -24,18 +30,49 @@ type IR_Context struct {
 	ABI          ABI
 	Allocator    Allocator
 
-	VariableMap        map[string]lib.Operand
-	VariableTypes      map[string]Type
+	VariableMap   map[string]lib.Operand
+	VariableTypes map[string]Type
+	// Globals are the variables that live in the ReadWrite segment. They
+	// are shared by all the functions, and are shadowed by the variables in
+	// VariableMap.
+	Globals map[string]*GlobalVariable
+	// Externs are the host functions declared with extern func, which are
+	// shared by all the functions like Globals.
+	Externs            map[string]*ExternFunction
 	ReturnOperandStack []lib.Operand
 	Segments           *Segments
 	InstructionPointer uint
 	StackPointer       int
-	Commit             bool // if false turns AddInstruction into a noop
+	Commit             bool // if false AddInstruction only advances the InstructionPointer
 
 	instructions []lib.Instruction
 
 	LastReturn IR
 	Debug      bool
+
+	// CheckedArithmetic makes integer +, - and * trap on overflow, like the
+	// checked_add, checked_sub and checked_mul builtins.
+	CheckedArithmetic bool
+	// Fuel makes loops and functions take fuel from the callEngine on
+	// every iteration and call, and trap when it runs out.
+	Fuel bool
+	// SkipPeephole leaves the code of the statements and functions as it's
+	// encoded, instead of running it through Architecture.Peephole.
+	SkipPeephole bool
+}
+
+// GlobalVariable is a variable declared with var. It lives in the ReadWrite
+// segment, so that it keeps its value between calls.
+type GlobalVariable struct {
+	Type    Type
+	Address *SegmentPointer
+}
+
+// ExternFunction is a host function declared with extern func. Compiled
+// code calls it by its Index in the HostFunctions of the lib.Program.
+type ExternFunction struct {
+	Signature *TFunction
+	Index     int
 }
 
 func NewIRContext(arch Architecture, abi ABI, opts ...func(*IR_Context) *IR_Context) *IR_Context {
@@ -44,8 +81,10 @@ func NewIRContext(arch Architecture, abi ABI, opts ...func(*IR_Context) *IR_Cont
 		ABI:                abi,
 		VariableMap:        map[string]lib.Operand{},
 		VariableTypes:      map[string]Type{},
+		Globals:            map[string]*GlobalVariable{},
+		Externs:            map[string]*ExternFunction{},
 		ReturnOperandStack: []lib.Operand{&encoding.DisplacedRegister{Register: encoding.Rsp, Displacement: 8}},
-		InstructionPointer: 2,
+		InstructionPointer: 0,
 		StackPointer:       8,
 		Commit:             true,
 		instructions:       []lib.Instruction{},
@@ -60,6 +99,15 @@ func NewIRContext(arch Architecture, abi ABI, opts ...func(*IR_Context) *IR_Cont
 	return ctx
 }
 
+// Peephole runs the peephole optimiser of the architecture on code, unless
+// SkipPeephole is set.
+func (i *IR_Context) Peephole(code []lib.Instruction) ([]lib.Instruction, error) {
+	if i.SkipPeephole {
+		return code, nil
+	}
+	return i.Architecture.Peephole(code)
+}
+
 func (i *IR_Context) PushReturnOperand(op lib.Operand) {
 	i.ReturnOperandStack = append(i.ReturnOperandStack, op)
 }
@@ -96,22 +144,32 @@ func (i *IR_Context) Copy() *IR_Context {
 		Allocator:          i.Allocator.Copy(),
 		VariableMap:        variableMap,
 		VariableTypes:      variableTypes,
+		Globals:            i.Globals,
+		Externs:            i.Externs,
 		ReturnOperandStack: returns,
 		Segments:           i.Segments,
 		InstructionPointer: i.InstructionPointer,
 		StackPointer:       i.StackPointer,
 		Commit:             i.Commit,
 		instructions:       instructions,
+		Debug:              i.Debug,
+		CheckedArithmetic:  i.CheckedArithmetic,
+		Fuel:               i.Fuel,
+		SkipPeephole:       i.SkipPeephole,
 	}
 }
 
+// AddInstruction advances the InstructionPointer past instr and records
+// the instructions when Commit is set. The InstructionPointer is also
+// advanced when we're only measuring code, so that backward jumps get the
+// same encoding in both cases; see IR_Length.
 func (i *IR_Context) AddInstruction(instr ...lib.Instruction) {
-	if i.Commit {
-		for _, in := range instr {
+	for _, in := range instr {
+		if i.Commit {
 			i.instructions = append(i.instructions, in)
-			length, _ := lib.InstructionLength(in)
-			i.InstructionPointer += uint(length)
 		}
+		length, _ := lib.InstructionLength(in)
+		i.InstructionPointer += uint(length)
 	}
 }
 
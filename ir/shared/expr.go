@@ -1,6 +1,8 @@
 package shared
 
 import (
+	"fmt"
+
 	"github.com/bspaans/jit-compiler/lib"
 )
 
@@ -47,10 +49,27 @@ const (
 	Cast        IRExpressionType = iota
 	Function    IRExpressionType = iota
 	Call        IRExpressionType = iota
+	Len         IRExpressionType = iota
+	ShiftLeft   IRExpressionType = iota
+	ShiftRight  IRExpressionType = iota
+	MulHigh     IRExpressionType = iota
 )
 
 type BaseIRExpression struct {
-	typ IRExpressionType
+	typ      IRExpressionType
+	position Position
+}
+
+// Position is the location in the source code that an expression was parsed
+// from. Line and Column start at 1; the zero Position means unknown.
+type Position struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
 }
 
 func NewBaseIRExpression(typ IRExpressionType) *BaseIRExpression {
@@ -62,10 +81,25 @@ func NewBaseIRExpression(typ IRExpressionType) *BaseIRExpression {
 func (b *BaseIRExpression) Type() IRExpressionType {
 	return b.typ
 }
+func (b *BaseIRExpression) Position() Position {
+	return b.position
+}
+func (b *BaseIRExpression) SetPosition(p Position) {
+	b.position = p
+}
 func (b *BaseIRExpression) AddToDataSection(ctx *IR_Context) error {
 	return nil
 }
 
+// PositionOf returns the source position of e, or the zero Position when e
+// doesn't have one.
+func PositionOf(e IRExpression) Position {
+	if p, ok := e.(interface{ Position() Position }); ok {
+		return p.Position()
+	}
+	return Position{}
+}
+
 func IsLiteral(e IRExpression) bool {
 	t := e.Type()
 	return t == Uint8 || t == Uint16 || t == Uint32 || t == Uint64 ||
@@ -82,8 +116,11 @@ func IsLiteralOrVariable(e IRExpression) bool {
 }
 
 func IREXpression_length(expr IRExpression, ctx *IR_Context, target lib.Operand) (int, error) {
-	commit := ctx.Commit
+	commit, ip := ctx.Commit, ctx.InstructionPointer
 	ctx.Commit = false
+	defer func() {
+		ctx.Commit, ctx.InstructionPointer = commit, ip
+	}()
 	instr, err := ctx.Architecture.EncodeExpression(expr, ctx, target)
 	if err != nil {
 		return 0, err
@@ -92,6 +129,5 @@ func IREXpression_length(expr IRExpression, ctx *IR_Context, target lib.Operand)
 	if err != nil {
 		return 0, err
 	}
-	ctx.Commit = commit
 	return len(code), nil
 }
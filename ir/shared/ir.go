@@ -12,6 +12,9 @@ const (
 	Return          IRType = iota
 	AndThen         IRType = iota
 	FunctionDef     IRType = iota
+	Var             IRType = iota
+	Extern          IRType = iota
+	CallStatement   IRType = iota
 )
 
 type IR interface {
@@ -38,8 +41,11 @@ func (b *BaseIR) AddToDataSection(ctx *IR_Context) error {
 }
 
 func IR_Length(stmt IR, ctx *IR_Context) (int, error) {
-	commit := ctx.Commit
+	commit, ip := ctx.Commit, ctx.InstructionPointer
 	ctx.Commit = false
+	defer func() {
+		ctx.Commit, ctx.InstructionPointer = commit, ip
+	}()
 	instr, err := ctx.Architecture.EncodeStatement(stmt, ctx)
 	if err != nil {
 		return 0, err
@@ -48,6 +54,5 @@ func IR_Length(stmt IR, ctx *IR_Context) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	ctx.Commit = commit
 	return len(code), nil
 }
@@ -40,11 +40,15 @@ func _() {
 	_ = x[Cast-29]
 	_ = x[Function-30]
 	_ = x[Call-31]
+	_ = x[Len-32]
+	_ = x[ShiftLeft-33]
+	_ = x[ShiftRight-34]
+	_ = x[MulHigh-35]
 }
 
-const _IRExpressionType_name = "Uint8Uint16Uint32Uint64Int8Int16Int32Int64Float64ByteArrayStaticArrayArrayIndexBoolStructStructFieldAndOrNotAddSubMulDivVariableEqualsLTLTEGTGTESyscallCastFunctionCall"
+const _IRExpressionType_name = "Uint8Uint16Uint32Uint64Int8Int16Int32Int64Float64ByteArrayStaticArrayArrayIndexBoolStructStructFieldAndOrNotAddSubMulDivVariableEqualsLTLTEGTGTESyscallCastFunctionCallLenShiftLeftShiftRightMulHigh"
 
-var _IRExpressionType_index = [...]uint8{0, 5, 11, 17, 23, 27, 32, 37, 42, 49, 58, 69, 79, 83, 89, 100, 103, 105, 108, 111, 114, 117, 120, 128, 134, 136, 139, 141, 144, 151, 155, 163, 167}
+var _IRExpressionType_index = [...]uint8{0, 5, 11, 17, 23, 27, 32, 37, 42, 49, 58, 69, 79, 83, 89, 100, 103, 105, 108, 111, 114, 117, 120, 128, 134, 136, 139, 141, 144, 151, 155, 163, 167, 170, 179, 189, 196}
 
 func (i IRExpressionType) String() string {
 	if i < 0 || i >= IRExpressionType(len(_IRExpressionType_index)-1) {
@@ -2,6 +2,7 @@ package shared
 
 import (
 	"encoding/hex"
+	"os"
 	"strings"
 )
 
@@ -41,8 +42,13 @@ type SegmentPointer struct {
 	Offset uint
 }
 
+// Segments are laid out as the read-only data, followed by the read-write
+// data and then the executable code. The code starts at a page boundary, so
+// that the data can be mapped read-write and the code read-exec.
 type Segments struct {
 	Segments map[SegmentType]*Segment
+	// PageSize is the alignment of the executable segment.
+	PageSize int
 }
 
 func NewSegments() *Segments {
@@ -50,7 +56,7 @@ func NewSegments() *Segments {
 		ReadOnly:   NewSegment(),
 		ReadWrite:  NewSegment(),
 		Executable: NewSegment(),
-	}}
+	}, os.Getpagesize()}
 }
 
 func (s *Segments) Add(ty SegmentType, data ...uint8) *SegmentPointer {
@@ -63,21 +69,29 @@ func (s *Segments) Add(ty SegmentType, data ...uint8) *SegmentPointer {
 }
 
 func (s *Segments) Encode() []uint8 {
-	sub := append(s.Segments[ReadOnly].Data, s.Segments[ReadWrite].Data...)
-	return append(sub, s.Segments[Executable].Data...)
+	result := make([]uint8, s.CodeStart(), s.CodeStart()+len(s.Segments[Executable].Data))
+	copy(result, s.Segments[ReadOnly].Data)
+	copy(result[len(s.Segments[ReadOnly].Data):], s.Segments[ReadWrite].Data)
+	return append(result, s.Segments[Executable].Data...)
+}
+
+// CodeStart returns the offset of the executable segment, which is the size
+// of the data rounded up to a whole page.
+func (s *Segments) CodeStart() int {
+	data := len(s.Segments[ReadOnly].Data) + len(s.Segments[ReadWrite].Data)
+	return (data + s.PageSize - 1) / s.PageSize * s.PageSize
 }
 
 func (s *Segments) GetAddress(p *SegmentPointer) int {
 	if p.SegmentType == ReadOnly {
-		return int(p.Offset) + 2
+		return int(p.Offset)
 	}
 	readOnly := uint(len(s.Segments[ReadOnly].Data))
 	if p.SegmentType == ReadWrite {
-		return int(readOnly+p.Offset) + 2
+		return int(readOnly + p.Offset)
 	}
-	readWrite := uint(len(s.Segments[ReadWrite].Data))
 	if p.SegmentType == Executable {
-		return int(readOnly+readWrite+p.Offset) + 2
+		return s.CodeStart() + int(p.Offset)
 	}
 	panic("Unknown segment type")
 	return 0
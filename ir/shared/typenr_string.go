@@ -21,11 +21,13 @@ func _() {
 	_ = x[T_Array-10]
 	_ = x[T_Function-11]
 	_ = x[T_Struct-12]
+	_ = x[T_Float32-13]
+	_ = x[T_Void-14]
 }
 
-const _TypeNr_name = "T_Uint8T_Uint16T_Uint32T_Uint64T_Int8T_Int16T_Int32T_Int64T_Float64T_BoolT_ArrayT_FunctionT_Struct"
+const _TypeNr_name = "T_Uint8T_Uint16T_Uint32T_Uint64T_Int8T_Int16T_Int32T_Int64T_Float64T_BoolT_ArrayT_FunctionT_StructT_Float32T_Void"
 
-var _TypeNr_index = [...]uint8{0, 7, 15, 23, 31, 37, 44, 51, 58, 67, 73, 80, 90, 98}
+var _TypeNr_index = [...]uint8{0, 7, 15, 23, 31, 37, 44, 51, 58, 67, 73, 80, 90, 98, 107, 113}
 
 func (i TypeNr) String() string {
 	if i < 0 || i >= TypeNr(len(_TypeNr_index)-1) {
@@ -23,6 +23,12 @@ const (
 	T_Array    TypeNr = iota
 	T_Function TypeNr = iota
 	T_Struct   TypeNr = iota
+	// T_Float32 is only supported as the item type of arrays that are
+	// passed in from Go. Items are read as float64 and rounded when written.
+	T_Float32 TypeNr = iota
+	// T_Void is the return type of extern functions that don't return a
+	// value. They can only be called as statements.
+	T_Void TypeNr = iota
 )
 
 type Type interface {
@@ -63,9 +69,11 @@ func (b *BaseType) String() string {
 		T_Int32:    "int32",
 		T_Int64:    "int64",
 		T_Float64:  "float64",
+		T_Float32:  "float32",
 		T_Bool:     "bool",
 		T_Array:    "array",
 		T_Function: "func",
+		T_Void:     "void",
 	}[b.TypeNr]
 }
 
@@ -80,6 +88,7 @@ func (b *BaseType) Width() lib.Size {
 		T_Int32:   lib.DOUBLE,
 		T_Int64:   lib.QUADWORD,
 		T_Float64: lib.QUADWORD,
+		T_Float32: lib.DOUBLE,
 		T_Bool:    lib.BYTE,
 	}[b.TypeNr]
 }
@@ -95,6 +104,8 @@ var (
 	TInt64   = &BaseType{T_Int64}
 	TFloat64 = &BaseType{T_Float64}
 	TBool    = &BaseType{T_Bool}
+	TFloat32 = &BaseType{T_Float32}
+	TVoid    = &BaseType{T_Void}
 )
 
 type TArray struct {
@@ -132,6 +143,26 @@ func (b *TFunction) Width() lib.Size {
 	return lib.QUADWORD
 }
 
+// RegisterArgs returns the types of the values that get passed in registers
+// for the arguments. Arrays are passed as the address of their first item,
+// followed by their length.
+func (b *TFunction) RegisterArgs() []Type {
+	result := []Type{}
+	for _, arg := range b.Args {
+		result = append(result, arg)
+		if arg.Type() == T_Array {
+			result = append(result, TInt64)
+		}
+	}
+	return result
+}
+
+// LengthVariable is the name of the variable that holds the length of an
+// array argument. It can't clash with variables in the source.
+func LengthVariable(array string) string {
+	return "len(" + array + ")"
+}
+
 type TStruct struct {
 	FieldTypes []Type
 	Fields     []string
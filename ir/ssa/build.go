@@ -0,0 +1,300 @@
+package ssa
+
+import (
+	"sort"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// Build lowers body, the statements of a function with the arguments
+// params or of a program, into a Func in SSA form. Assignments to the
+// variables in globals are kept as stores. The bodies of the functions that
+// body defines aren't lowered; they're functions of their own.
+func Build(body IR, params []string, globals map[string]bool) *Func {
+	f := &Func{
+		Params:   params,
+		Pinned:   map[string]bool{},
+		globals:  globals,
+		names:    map[string]bool{},
+		versions: map[string]int{},
+		values:   map[string]bool{},
+	}
+	for name := range globals {
+		f.Pinned[name] = true
+	}
+	for _, param := range params {
+		f.names[param] = true
+		f.values[param] = true
+	}
+	b := &builder{f: f, ctx: NewSSA_Context()}
+	f.Entry = f.NewBlock(BlockJump)
+	b.current = f.Entry
+	if body != nil {
+		b.statement(body)
+	}
+	b.current.Kind = BlockExit
+	f.Update()
+	f.rename()
+	return f
+}
+
+type builder struct {
+	f       *Func
+	ctx     *SSA_Context
+	current *Block
+}
+
+// statement adds stmt to the current block, and starts new blocks for its
+// control flow.
+func (b *builder) statement(stmt IR) {
+	switch v := stmt.(type) {
+	case *statements.IR_AndThen:
+		b.statement(v.Stmt1)
+		b.statement(v.Stmt2)
+	case *statements.IR_Assignment:
+		if _, ok := v.Expr.(*expr.IR_Function); ok {
+			b.f.Pinned[v.Variable] = true
+			b.add(v)
+			return
+		}
+		b.flatten(v.SSA_Transform(b.ctx))
+	case *statements.IR_ArrayAssignment, *statements.IR_CallStatement:
+		b.flatten(v.SSA_Transform(b.ctx))
+	case *statements.IR_Return:
+		b.flatten(v.SSA_Transform(b.ctx))
+	case *statements.IR_If:
+		rewrites, condition := v.Condition.SSA_Transform(b.ctx)
+		b.rewrites(rewrites)
+		cond := b.current
+		cond.Kind, cond.Control = BlockIf, condition
+		join := b.f.NewBlock(BlockJump)
+		for _, branch := range []IR{v.Stmt1, v.Stmt2} {
+			b.current = b.f.NewBlock(BlockJump)
+			cond.AddEdge(b.current)
+			if branch != nil {
+				b.statement(branch)
+			}
+			b.current.AddEdge(join)
+		}
+		b.current = join
+	case *statements.IR_While:
+		header := b.f.NewBlock(BlockIf)
+		b.current.AddEdge(header)
+		b.current = header
+		rewrites, condition := v.Condition.SSA_Transform(b.ctx)
+		b.rewrites(rewrites)
+		header.Control = condition
+		body := b.f.NewBlock(BlockJump)
+		exit := b.f.NewBlock(BlockJump)
+		header.AddEdge(body)
+		header.AddEdge(exit)
+		b.current = body
+		b.statement(v.Stmt)
+		b.current.AddEdge(header)
+		b.current = exit
+	default:
+		switch v := stmt.(type) {
+		case *statements.IR_FunctionDef:
+			b.f.Pinned[v.Name] = true
+		case *statements.IR_Var:
+			b.f.Pinned[v.Name] = true
+		}
+		b.add(stmt)
+	}
+}
+
+// flatten adds the statements of the result of SSA_Transform.
+func (b *builder) flatten(stmt IR) {
+	switch v := stmt.(type) {
+	case *statements.IR_AndThen:
+		b.flatten(v.Stmt1)
+		b.flatten(v.Stmt2)
+	case *statements.IR_Return:
+		b.current.Kind, b.current.Control = BlockReturn, v.Expr
+		// Statements after a return are unreachable, and end up in a
+		// block without predecessors.
+		b.current = b.f.NewBlock(BlockJump)
+	default:
+		b.add(stmt)
+	}
+}
+
+func (b *builder) rewrites(rewrites SSA_Rewrites) {
+	for _, rw := range rewrites {
+		b.add(statements.NewIR_Assignment(rw.Variable, rw.Expr))
+	}
+}
+
+func (b *builder) add(stmt IR) {
+	b.current.Instrs = append(b.current.Instrs, stmt)
+}
+
+// rename puts f in SSA form. Phis are placed in the iterated dominance
+// frontiers of the assignments to a variable, where the variable is live,
+// and the assignments and uses are renamed walking the dominator tree.
+func (f *Func) rename() {
+	assigned := map[string][]*Block{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			f.recordNames(instr)
+			if v, ok := instr.(*statements.IR_Assignment); ok && !f.Pinned[v.Variable] {
+				assigned[v.Variable] = append(assigned[v.Variable], b)
+			}
+		}
+		if b.Control != nil {
+			Variables(b.Control, func(name string) { f.names[name] = true })
+		}
+	}
+	tree := f.Dominators()
+	frontiers := tree.Frontiers(f)
+	live := f.liveVariables(assigned)
+	variables := []string{}
+	for variable := range assigned {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+	phiVariable := map[*Phi]string{}
+	for _, variable := range variables {
+		blocks := assigned[variable]
+		hasPhi := map[*Block]bool{}
+		work := append([]*Block{}, blocks...)
+		for len(work) > 0 {
+			b := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, d := range frontiers[b] {
+				if hasPhi[d] || !live[d][variable] {
+					continue
+				}
+				hasPhi[d] = true
+				phi := &Phi{Args: make([]IRExpression, len(d.Preds))}
+				phiVariable[phi] = variable
+				d.Phis = append(d.Phis, phi)
+				work = append(work, d)
+			}
+		}
+	}
+
+	stacks := map[string][]string{}
+	current := func(name string) IRExpression {
+		if stack := stacks[name]; len(stack) > 0 {
+			return expr.NewIR_Variable(stack[len(stack)-1])
+		}
+		return expr.NewIR_Variable(name)
+	}
+	var walk func(b *Block)
+	walk = func(b *Block) {
+		pushed := []string{}
+		define := func(variable string) string {
+			name := f.NewValue(variable)
+			stacks[variable] = append(stacks[variable], name)
+			pushed = append(pushed, variable)
+			return name
+		}
+		for _, phi := range b.Phis {
+			phi.Dest = define(phiVariable[phi])
+		}
+		for i, instr := range b.Instrs {
+			instr = MapUses(instr, func(name string) IRExpression {
+				if _, ok := assigned[name]; ok {
+					return current(name)
+				}
+				return expr.NewIR_Variable(name)
+			})
+			if v, ok := instr.(*statements.IR_Assignment); ok {
+				if _, ok := assigned[v.Variable]; ok {
+					instr = statements.NewIR_Assignment(define(v.Variable), v.Expr)
+				}
+			}
+			b.Instrs[i] = instr
+		}
+		if b.Control != nil {
+			b.Control = MapVariables(b.Control, func(name string) IRExpression {
+				if _, ok := assigned[name]; ok {
+					return current(name)
+				}
+				return expr.NewIR_Variable(name)
+			})
+		}
+		for _, s := range b.Succs {
+			i := s.PredIndex(b)
+			for _, phi := range s.Phis {
+				phi.Args[i] = current(phiVariable[phi])
+			}
+		}
+		for _, c := range tree.Children(b) {
+			walk(c)
+		}
+		for _, variable := range pushed {
+			stacks[variable] = stacks[variable][:len(stacks[variable])-1]
+		}
+	}
+	walk(f.Entry)
+}
+
+// recordNames remembers the variables that instr uses, so that new values
+// don't clash with them.
+func (f *Func) recordNames(instr IR) {
+	Uses(instr, func(name string) { f.names[name] = true })
+	switch v := instr.(type) {
+	case *statements.IR_Assignment:
+		f.names[v.Variable] = true
+	case *statements.IR_FunctionDef:
+		f.names[v.Name] = true
+	case *statements.IR_Var:
+		f.names[v.Name] = true
+	}
+}
+
+// liveVariables returns the variables in assigned that are live at the
+// start of every block, before the function is in SSA form.
+func (f *Func) liveVariables(assigned map[string][]*Block) map[*Block]map[string]bool {
+	uses := map[*Block]map[string]bool{}
+	defs := map[*Block]map[string]bool{}
+	for _, b := range f.Blocks {
+		uses[b], defs[b] = map[string]bool{}, map[string]bool{}
+		use := func(name string) {
+			if _, ok := assigned[name]; ok && !defs[b][name] {
+				uses[b][name] = true
+			}
+		}
+		for _, instr := range b.Instrs {
+			Uses(instr, use)
+			if v, ok := instr.(*statements.IR_Assignment); ok {
+				defs[b][v.Variable] = true
+			}
+		}
+		if b.Control != nil {
+			Variables(b.Control, use)
+		}
+	}
+	live := map[*Block]map[string]bool{}
+	for _, b := range f.Blocks {
+		live[b] = map[string]bool{}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(f.Blocks) - 1; i >= 0; i-- {
+			b := f.Blocks[i]
+			in := live[b]
+			add := func(name string) {
+				if !in[name] {
+					in[name] = true
+					changed = true
+				}
+			}
+			for name := range uses[b] {
+				add(name)
+			}
+			for _, s := range b.Succs {
+				for name := range live[s] {
+					if !defs[b][name] {
+						add(name)
+					}
+				}
+			}
+		}
+	}
+	return live
+}
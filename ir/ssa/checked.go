@@ -0,0 +1,56 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// MarkChecked makes every +, - and * in f checked, like the checked_add,
+// checked_sub and checked_mul builtins. Compiling with the
+// CheckedArithmetic option does the same in the encoder, but the passes
+// that run before it would fold or reduce the unchecked operations, and
+// lose their overflow traps.
+func MarkChecked(f *Func) error {
+	for _, b := range f.Blocks {
+		for i, instr := range b.Instrs {
+			switch v := instr.(type) {
+			case *statements.IR_Assignment:
+				b.Instrs[i] = statements.NewIR_Assignment(v.Variable, checked(v.Expr))
+			case *statements.IR_ArrayAssignment:
+				b.Instrs[i] = statements.NewIR_ArrayAssignment(v.Variable, checked(v.Index), checked(v.Expr))
+			case *statements.IR_CallStatement:
+				b.Instrs[i] = statements.NewIR_CallStatement(checked(v.Call).(*expr.IR_Call))
+			}
+		}
+		if b.Control != nil {
+			b.Control = checked(b.Control)
+		}
+	}
+	return nil
+}
+
+// checked returns a copy of e in which the arithmetic is checked.
+func checked(e IRExpression) IRExpression {
+	ops := Operands(e)
+	if len(ops) == 0 {
+		return e
+	}
+	newOps := make([]IRExpression, len(ops))
+	for i, op := range ops {
+		newOps[i] = checked(op)
+	}
+	switch v := WithOperands(e, newOps).(type) {
+	case *expr.IR_Add:
+		v.Checked = true
+		return v
+	case *expr.IR_Sub:
+		v.Checked = true
+		return v
+	case *expr.IR_Mul:
+		v.Checked = true
+		return v
+	default:
+		return v
+	}
+}
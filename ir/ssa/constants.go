@@ -0,0 +1,594 @@
+package ssa
+
+import (
+	"math"
+	"math/bits"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// FoldConstants evaluates arithmetic, comparisons, casts and boolean logic
+// on literals at compile time, with the semantics of Go for every width, so
+// integers wrap around. Values that are assigned a literal are replaced by
+// the literal where they're used, and branches on a condition that becomes
+// a literal turn into jumps, which removes the branch that isn't taken.
+//
+// Values are assumed to be constant until shown otherwise, and only the
+// edges that can be taken count, so that a loop that doesn't change a
+// constant keeps it constant (sparse conditional constant propagation).
+//
+// Operations that trap at runtime are left alone: integer division by zero,
+// dividing the smallest signed integer by -1, and checked arithmetic that
+// overflows.
+func FoldConstants(f *Func) error {
+	c := &constantPropagation{
+		f:          f,
+		values:     map[string]lattice{},
+		executable: map[*Block]bool{f.Entry: true},
+		edges:      map[*Block][]bool{},
+	}
+	for _, param := range f.Params {
+		c.values[param] = lattice{varying: true}
+	}
+	for c.changed = true; c.changed; {
+		c.changed = false
+		for _, b := range f.Blocks {
+			if c.executable[b] {
+				c.block(b)
+			}
+		}
+	}
+	c.rewrite()
+	return nil
+}
+
+// lattice is what's known about a value: nothing yet, that it's always
+// the literal constant, or that it varies.
+type lattice struct {
+	constant IRExpression
+	varying  bool
+}
+
+type constantPropagation struct {
+	f          *Func
+	values     map[string]lattice
+	executable map[*Block]bool
+	// edges are the successors of a block that can be taken.
+	edges   map[*Block][]bool
+	changed bool
+}
+
+// block evaluates the phis, instructions and control of b.
+func (c *constantPropagation) block(b *Block) {
+	for _, phi := range b.Phis {
+		result := lattice{}
+		for i, arg := range phi.Args {
+			if !c.edgeTaken(b.Preds[i], b, i) {
+				continue
+			}
+			if v, ok := arg.(*expr.IR_Variable); ok && c.f.undefined(v.Value) {
+				continue
+			}
+			result = meet(result, c.evaluate(arg))
+		}
+		c.update(phi.Dest, result)
+	}
+	for _, instr := range b.Instrs {
+		if def, ok := c.f.Def(instr); ok {
+			c.update(def, c.evaluate(assignedExpression(instr)))
+		}
+	}
+	if c.edges[b] == nil {
+		c.edges[b] = make([]bool, len(b.Succs))
+	}
+	take := func(i int) {
+		if !c.edges[b][i] {
+			c.edges[b][i] = true
+			c.executable[b.Succs[i]] = true
+			c.changed = true
+		}
+	}
+	switch b.Kind {
+	case BlockJump:
+		take(0)
+	case BlockIf:
+		condition := c.evaluate(b.Control)
+		switch {
+		case condition.varying:
+			take(0)
+			take(1)
+		case condition.constant != nil:
+			if cond, ok := condition.constant.(*expr.IR_Bool); ok && !cond.Value {
+				take(1)
+			} else {
+				take(0)
+			}
+		}
+	}
+}
+
+// edgeTaken returns whether the edge from pred that is the i-th predecessor
+// of b can be taken.
+func (c *constantPropagation) edgeTaken(pred, b *Block, i int) bool {
+	// Count the earlier edges from pred to b, for blocks with both edges
+	// going to the same block.
+	n := 0
+	for j := 0; j < i; j++ {
+		if b.Preds[j] == pred {
+			n++
+		}
+	}
+	for j, s := range pred.Succs {
+		if s != b {
+			continue
+		}
+		if n == 0 {
+			return c.edges[pred] != nil && c.edges[pred][j]
+		}
+		n--
+	}
+	return false
+}
+
+// evaluate returns what's known about the value of e.
+func (c *constantPropagation) evaluate(e IRExpression) lattice {
+	folded := Fold(MapVariables(e, func(name string) IRExpression {
+		if value := c.values[name]; value.constant != nil {
+			return value.constant
+		}
+		return expr.NewIR_Variable(name)
+	}))
+	if isConstant(folded) {
+		return lattice{constant: folded}
+	}
+	unknown := false
+	Variables(folded, func(name string) {
+		if value := c.values[name]; c.f.IsValue(name) && !value.varying && value.constant == nil {
+			unknown = true
+		}
+	})
+	if unknown {
+		return lattice{}
+	}
+	return lattice{varying: true}
+}
+
+// update lowers the value of name to value. Values only ever go from
+// unknown to constant to varying.
+func (c *constantPropagation) update(name string, value lattice) {
+	old := c.values[name]
+	value = meet(old, value)
+	if value.varying != old.varying || (value.constant == nil) != (old.constant == nil) {
+		c.values[name] = value
+		c.changed = true
+	}
+}
+
+func meet(a, b lattice) lattice {
+	switch {
+	case a.varying || b.varying:
+		return lattice{varying: true}
+	case a.constant == nil:
+		return b
+	case b.constant == nil:
+		return a
+	case sameConstant(a.constant, b.constant):
+		return a
+	}
+	return lattice{varying: true}
+}
+
+// rewrite replaces the constant values by their literals, and the branches
+// that only go one way by jumps.
+func (c *constantPropagation) rewrite() {
+	substitute := func(name string) IRExpression {
+		if value := c.values[name]; value.constant != nil {
+			return value.constant
+		}
+		return expr.NewIR_Variable(name)
+	}
+	for _, b := range c.f.Blocks {
+		if !c.executable[b] {
+			continue
+		}
+		phis := b.Phis[:0]
+		for _, phi := range b.Phis {
+			if c.values[phi.Dest].constant == nil {
+				phis = append(phis, phi)
+			}
+		}
+		b.Phis = phis
+		for i, instr := range b.Instrs {
+			b.Instrs[i] = mapExpressions(MapUses(instr, substitute), Fold)
+		}
+		if b.Control != nil {
+			b.Control = Fold(MapVariables(b.Control, substitute))
+		}
+		if b.Kind == BlockIf && c.edges[b][0] != c.edges[b][1] {
+			taken, other := b.Succs[0], b.Succs[1]
+			if c.edges[b][1] {
+				taken, other = other, taken
+			}
+			other.RemovePred(b)
+			b.Kind, b.Control, b.Succs = BlockJump, nil, []*Block{taken}
+		}
+	}
+	c.f.Update()
+}
+
+// Fold returns e with the operations on literals evaluated.
+func Fold(e IRExpression) IRExpression {
+	ops := Operands(e)
+	if len(ops) == 0 {
+		return e
+	}
+	folded := make([]IRExpression, len(ops))
+	for i, op := range ops {
+		folded[i] = Fold(op)
+	}
+	e = WithOperands(e, folded)
+	switch v := e.(type) {
+	case *expr.IR_Add:
+		return foldArithmetic(e, v.Op1, v.Op2, v.Checked)
+	case *expr.IR_Sub:
+		return foldArithmetic(e, v.Op1, v.Op2, v.Checked)
+	case *expr.IR_Mul:
+		return foldArithmetic(e, v.Op1, v.Op2, v.Checked)
+	case *expr.IR_Div:
+		return foldArithmetic(e, v.Op1, v.Op2, false)
+	case *expr.IR_MulHigh:
+		return foldMulHigh(e, v.Op1, v.Op2)
+	case *expr.IR_ShiftLeft:
+		return foldShift(e, v.Op1, v.Shift, true)
+	case *expr.IR_ShiftRight:
+		return foldShift(e, v.Op1, v.Shift, false)
+	case *expr.IR_Equals, *expr.IR_LT, *expr.IR_LTE, *expr.IR_GT, *expr.IR_GTE:
+		return foldComparison(e, folded[0], folded[1])
+	case *expr.IR_Cast:
+		return foldCast(e, v.Value, v.CastToType)
+	case *expr.IR_Not:
+		if b, ok := v.Op1.(*expr.IR_Bool); ok {
+			return expr.NewIR_Bool(!b.Value)
+		}
+	case *expr.IR_And:
+		return foldLogic(e, v.Op1, v.Op2, false)
+	case *expr.IR_Or:
+		return foldLogic(e, v.Op1, v.Op2, true)
+	}
+	return e
+}
+
+// foldLogic folds && when shortCircuit is false and || when it's true: the
+// second operand isn't evaluated when the first one is shortCircuit.
+func foldLogic(e, op1, op2 IRExpression, shortCircuit bool) IRExpression {
+	if b, ok := op1.(*expr.IR_Bool); ok {
+		if b.Value == shortCircuit {
+			return b
+		}
+		return op2
+	}
+	if b, ok := op2.(*expr.IR_Bool); ok {
+		if b.Value != shortCircuit {
+			return op1
+		}
+		if IsPure(op1) {
+			return b
+		}
+	}
+	return e
+}
+
+// constant is the value of a literal. Integers and bools are stored in
+// bits, sign extended for signed types, and floats in float.
+type constant struct {
+	typ   Type
+	bits  uint64
+	float float64
+}
+
+func isConstant(e IRExpression) bool {
+	_, ok := constantOf(e)
+	return ok
+}
+
+func sameConstant(a, b IRExpression) bool {
+	c1, _ := constantOf(a)
+	c2, _ := constantOf(b)
+	if c1.typ == TFloat64 && c2.typ == TFloat64 {
+		// Compare the bits, so that -0.0 and NaN are told apart.
+		return math.Float64bits(c1.float) == math.Float64bits(c2.float)
+	}
+	return c1 == c2
+}
+
+func constantOf(e IRExpression) (constant, bool) {
+	switch v := e.(type) {
+	case *expr.IR_Uint8:
+		return constant{typ: TUint8, bits: uint64(v.Value)}, true
+	case *expr.IR_Uint16:
+		return constant{typ: TUint16, bits: uint64(v.Value)}, true
+	case *expr.IR_Uint32:
+		return constant{typ: TUint32, bits: uint64(v.Value)}, true
+	case *expr.IR_Uint64:
+		return constant{typ: TUint64, bits: v.Value}, true
+	case *expr.IR_Int8:
+		return constant{typ: TInt8, bits: uint64(v.Value)}, true
+	case *expr.IR_Int16:
+		return constant{typ: TInt16, bits: uint64(v.Value)}, true
+	case *expr.IR_Int32:
+		return constant{typ: TInt32, bits: uint64(v.Value)}, true
+	case *expr.IR_Int64:
+		return constant{typ: TInt64, bits: uint64(v.Value)}, true
+	case *expr.IR_Float64:
+		return constant{typ: TFloat64, float: v.Value}, true
+	case *expr.IR_Bool:
+		if v.Value {
+			return constant{typ: TBool, bits: 1}, true
+		}
+		return constant{typ: TBool}, true
+	}
+	return constant{}, false
+}
+
+// integer returns the literal of type typ for the lower bits of bits.
+func integer(typ Type, bits uint64) IRExpression {
+	switch typ {
+	case TUint8:
+		return expr.NewIR_Uint8(uint8(bits))
+	case TUint16:
+		return expr.NewIR_Uint16(uint16(bits))
+	case TUint32:
+		return expr.NewIR_Uint32(uint32(bits))
+	case TUint64:
+		return expr.NewIR_Uint64(bits)
+	case TInt8:
+		return expr.NewIR_Int8(int8(bits))
+	case TInt16:
+		return expr.NewIR_Int16(int16(bits))
+	case TInt32:
+		return expr.NewIR_Int32(int32(bits))
+	case TInt64:
+		return expr.NewIR_Int64(int64(bits))
+	case TBool:
+		return expr.NewIR_Bool(bits&1 != 0)
+	}
+	return nil
+}
+
+// widthBits returns the number of bits of the integer type typ.
+func widthBits(typ Type) uint {
+	return uint(typ.Width()) * 8
+}
+
+// truncate sign or zero extends the lower bits of bits for typ, which is
+// how constants are stored.
+func truncate(typ Type, bits uint64) uint64 {
+	shift := 64 - widthBits(typ)
+	if IsSignedInteger(typ) {
+		return uint64(int64(bits<<shift) >> shift)
+	}
+	return bits << shift >> shift
+}
+
+func foldArithmetic(e, op1, op2 IRExpression, checked bool) IRExpression {
+	c1, ok1 := constantOf(op1)
+	c2, ok2 := constantOf(op2)
+	if !ok1 || !ok2 || c1.typ != c2.typ {
+		return e
+	}
+	typ := c1.typ
+	if typ == TFloat64 {
+		switch e.(type) {
+		case *expr.IR_Add:
+			return expr.NewIR_Float64(c1.float + c2.float)
+		case *expr.IR_Sub:
+			return expr.NewIR_Float64(c1.float - c2.float)
+		case *expr.IR_Mul:
+			return expr.NewIR_Float64(c1.float * c2.float)
+		case *expr.IR_Div:
+			return expr.NewIR_Float64(c1.float / c2.float)
+		}
+		return e
+	}
+	if !IsInteger(typ) {
+		return e
+	}
+	signed := IsSignedInteger(typ)
+	var result uint64
+	switch e.(type) {
+	case *expr.IR_Add:
+		result = c1.bits + c2.bits
+	case *expr.IR_Sub:
+		result = c1.bits - c2.bits
+	case *expr.IR_Mul:
+		result = c1.bits * c2.bits
+	case *expr.IR_Div:
+		if c2.bits == 0 {
+			return e
+		}
+		if signed {
+			min := truncate(typ, 1<<(widthBits(typ)-1))
+			if c1.bits == min && int64(c2.bits) == -1 {
+				return e
+			}
+			result = uint64(int64(c1.bits) / int64(c2.bits))
+		} else {
+			result = c1.bits / c2.bits
+		}
+	default:
+		return e
+	}
+	if checked && overflows(e, typ, c1.bits, c2.bits, result) {
+		return e
+	}
+	return integer(typ, result)
+}
+
+// overflows returns whether the + - or * e of a and b doesn't fit in typ,
+// where result is the operation on the 64 bit values.
+func overflows(e IRExpression, typ Type, a, b, result uint64) bool {
+	if truncate(typ, result) != result {
+		return true
+	}
+	if widthBits(typ) < 64 {
+		// The 64 bit operation on the narrower values is exact.
+		return false
+	}
+	switch e.(type) {
+	case *expr.IR_Add:
+		if IsSignedInteger(typ) {
+			return (int64(a) >= 0) == (int64(b) >= 0) && (int64(result) >= 0) != (int64(a) >= 0)
+		}
+		return result < a
+	case *expr.IR_Sub:
+		if IsSignedInteger(typ) {
+			return (int64(a) >= 0) != (int64(b) >= 0) && (int64(result) >= 0) != (int64(a) >= 0)
+		}
+		return a < b
+	case *expr.IR_Mul:
+		if a == 0 || b == 0 {
+			return false
+		}
+		if IsSignedInteger(typ) {
+			x, y := int64(a), int64(b)
+			if (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+				return true
+			}
+			return int64(result)/y != x
+		}
+		return result/b != a
+	}
+	return false
+}
+
+// foldShift folds shifting the integer literal op shift bits to the left,
+// or to the right if left isn't set.
+func foldShift(e, op IRExpression, shift uint8, left bool) IRExpression {
+	c, ok := constantOf(op)
+	if !ok || !IsInteger(c.typ) {
+		return e
+	}
+	switch {
+	case left:
+		return integer(c.typ, c.bits<<shift)
+	case IsSignedInteger(c.typ):
+		return integer(c.typ, uint64(int64(c.bits)>>shift))
+	}
+	return integer(c.typ, c.bits>>shift)
+}
+
+// foldMulHigh folds the upper half of the product of two integer literals.
+func foldMulHigh(e, op1, op2 IRExpression) IRExpression {
+	c1, ok1 := constantOf(op1)
+	c2, ok2 := constantOf(op2)
+	if !ok1 || !ok2 || c1.typ != c2.typ || !IsInteger(c1.typ) {
+		return e
+	}
+	typ := c1.typ
+	width := widthBits(typ)
+	if width < 64 {
+		// The product fits in 64 bits.
+		if IsSignedInteger(typ) {
+			return integer(typ, uint64(int64(c1.bits*c2.bits)>>width))
+		}
+		return integer(typ, c1.bits*c2.bits>>width)
+	}
+	high, _ := bits.Mul64(c1.bits, c2.bits)
+	if IsSignedInteger(typ) {
+		// The unsigned product counts negative operands as 2^64 more.
+		if int64(c1.bits) < 0 {
+			high -= c2.bits
+		}
+		if int64(c2.bits) < 0 {
+			high -= c1.bits
+		}
+	}
+	return integer(typ, high)
+}
+
+func foldComparison(e, op1, op2 IRExpression) IRExpression {
+	c1, ok1 := constantOf(op1)
+	c2, ok2 := constantOf(op2)
+	if !ok1 || !ok2 || c1.typ != c2.typ {
+		return e
+	}
+	var less, equal bool
+	switch {
+	case c1.typ == TFloat64:
+		less, equal = c1.float < c2.float, c1.float == c2.float
+		if math.IsNaN(c1.float) || math.IsNaN(c2.float) {
+			// Every comparison with NaN is false.
+			return expr.NewIR_Bool(false)
+		}
+	case IsSignedInteger(c1.typ):
+		less, equal = int64(c1.bits) < int64(c2.bits), c1.bits == c2.bits
+	default:
+		less, equal = c1.bits < c2.bits, c1.bits == c2.bits
+	}
+	switch e.(type) {
+	case *expr.IR_Equals:
+		return expr.NewIR_Bool(equal)
+	case *expr.IR_LT:
+		if c1.typ == TBool {
+			return e
+		}
+		return expr.NewIR_Bool(less)
+	case *expr.IR_LTE:
+		if c1.typ == TBool {
+			return e
+		}
+		return expr.NewIR_Bool(less || equal)
+	case *expr.IR_GT:
+		if c1.typ == TBool {
+			return e
+		}
+		return expr.NewIR_Bool(!less && !equal)
+	case *expr.IR_GTE:
+		if c1.typ == TBool {
+			return e
+		}
+		return expr.NewIR_Bool(!less)
+	}
+	return e
+}
+
+// foldCast converts the literal value to typ like Go conversions do, where
+// bools are 0 or 1. Floats that don't fit in the integer type, for which Go
+// doesn't define the result, are left to the runtime.
+func foldCast(e, value IRExpression, typ Type) IRExpression {
+	c, ok := constantOf(value)
+	if !ok || (typ != TBool && !IsNumber(typ)) {
+		return e
+	}
+	if c.typ == typ {
+		return value
+	}
+	switch {
+	case typ == TBool && c.typ == TFloat64:
+		return expr.NewIR_Bool(c.float != 0)
+	case typ == TBool:
+		return expr.NewIR_Bool(c.bits != 0)
+	case typ == TFloat64 && c.typ == TUint64:
+		return expr.NewIR_Float64(float64(c.bits))
+	case typ == TFloat64:
+		return expr.NewIR_Float64(float64(int64(c.bits)))
+	case c.typ == TFloat64:
+		t := math.Trunc(c.float)
+		if math.IsNaN(t) {
+			return e
+		}
+		if IsSignedInteger(typ) {
+			min := -math.Ldexp(1, int(widthBits(typ))-1)
+			if t < min || t >= -min {
+				return e
+			}
+			return integer(typ, uint64(int64(t)))
+		}
+		if t < 0 || t >= math.Ldexp(1, int(widthBits(typ))) {
+			return e
+		}
+		return integer(typ, uint64(t))
+	}
+	return integer(typ, truncate(typ, c.bits))
+}
@@ -0,0 +1,250 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// EliminateDeadCode removes the assignments and phis whose values are never
+// read, and the branches that became empty, when their condition is only
+// computed for the branch. Statements after a return and branches that are
+// never taken are already gone, because they're not reachable. Calls,
+// syscalls and the operations that can trap are kept, and so are stores to
+// arrays and globals.
+func EliminateDeadCode(f *Func) error {
+	for changed := true; changed; {
+		changed = f.removeDeadValues()
+		for _, b := range f.Blocks {
+			if f.collapseBranch(b) {
+				changed = true
+			}
+		}
+		f.Update()
+	}
+	return nil
+}
+
+// removeDeadValues removes the assignments and phis that don't contribute
+// to the instructions that have to be kept, or to the control flow.
+func (f *Func) removeDeadValues() bool {
+	live := map[string]bool{}
+	work := []string{}
+	use := func(name string) {
+		if f.IsValue(name) && !live[name] {
+			live[name] = true
+			work = append(work, name)
+		}
+	}
+	defs := map[string]IRExpression{}
+	phis := map[string]*Phi{}
+	for _, b := range f.Blocks {
+		for _, phi := range b.Phis {
+			phis[phi.Dest] = phi
+		}
+		for _, instr := range b.Instrs {
+			if def, ok := f.Def(instr); ok && IsPure(assignedExpression(instr)) {
+				defs[def] = assignedExpression(instr)
+				continue
+			}
+			Uses(instr, use)
+		}
+		if b.Control != nil {
+			Variables(b.Control, use)
+		}
+	}
+	for len(work) > 0 {
+		name := work[len(work)-1]
+		work = work[:len(work)-1]
+		if e, ok := defs[name]; ok {
+			Variables(e, use)
+		}
+		if phi, ok := phis[name]; ok {
+			for _, arg := range phi.Args {
+				Variables(arg, use)
+			}
+		}
+	}
+	removed := false
+	for _, b := range f.Blocks {
+		keptPhis := b.Phis[:0]
+		for _, phi := range b.Phis {
+			if live[phi.Dest] {
+				keptPhis = append(keptPhis, phi)
+			} else {
+				removed = true
+			}
+		}
+		b.Phis = keptPhis
+		kept := b.Instrs[:0]
+		for _, instr := range b.Instrs {
+			if def, ok := f.Def(instr); ok && !live[def] && IsPure(assignedExpression(instr)) {
+				removed = true
+				continue
+			}
+			kept = append(kept, instr)
+		}
+		b.Instrs = kept
+	}
+	return removed
+}
+
+// collapseBranch turns the branch at the end of b into a jump when both
+// branches are empty and meet in the same block with the same values.
+func (f *Func) collapseBranch(b *Block) bool {
+	if b.Kind != BlockIf || !IsPure(b.Control) {
+		return false
+	}
+	// pass follows the edge from b to s while the blocks are empty. It
+	// returns the block where control ends up and the predecessor it comes
+	// from.
+	pass := func(s *Block) (*Block, *Block) {
+		if len(s.Preds) == 1 && len(s.Phis) == 0 && len(s.Instrs) == 0 && s.Kind == BlockJump {
+			return s.Succs[0], s
+		}
+		return s, b
+	}
+	join0, pred0 := pass(b.Succs[0])
+	join1, pred1 := pass(b.Succs[1])
+	if join0 != join1 || join0 == b {
+		return false
+	}
+	i0, i1 := join0.PredIndex(pred0), join0.PredIndex(pred1)
+	if pred0 == pred1 {
+		// Both edges of b go to the join.
+		for i1 = i0 + 1; join0.Preds[i1] != b; i1++ {
+		}
+	}
+	for _, phi := range join0.Phis {
+		if phi.Args[i0].String() != phi.Args[i1].String() {
+			return false
+		}
+	}
+	join0.RemovePred(pred1)
+	join0.Preds[join0.PredIndex(pred0)] = b
+	b.Kind, b.Control, b.Succs = BlockJump, nil, []*Block{join0}
+	return true
+}
+
+// RemoveUnusedFunctions removes the definitions of the functions that the
+// program stmts never calls or refers to, like the parts of the Stdlib that
+// a program doesn't use. The functions in keep are used from the outside.
+func RemoveUnusedFunctions(stmts []IR, keep ...string) []IR {
+	stmts = flattenAndThen(sequence(stmts))
+	globals := map[string]bool{}
+	functions := map[string][]IR{}
+	for _, stmt := range stmts {
+		switch v := stmt.(type) {
+		case *statements.IR_Var:
+			globals[v.Name] = true
+		case *statements.IR_FunctionDef:
+			functions[v.Name] = append(functions[v.Name], v)
+		case *statements.IR_Assignment:
+			if _, ok := v.Expr.(*expr.IR_Function); ok {
+				functions[v.Variable] = append(functions[v.Variable], v)
+			}
+		}
+	}
+	used := map[string]bool{}
+	work := []IR{}
+	var refer func(name string)
+	refer = func(name string) {
+		if used[name] {
+			return
+		}
+		used[name] = true
+		work = append(work, functions[name]...)
+	}
+	for _, name := range keep {
+		refer(name)
+	}
+	for name := range globals {
+		// Go code can read the functions that are stored in globals.
+		refer(name)
+	}
+	for _, stmt := range stmts {
+		if !isFunctionDefinition(stmt) {
+			references(stmt, refer)
+		}
+	}
+	for len(work) > 0 {
+		stmt := work[len(work)-1]
+		work = work[:len(work)-1]
+		references(stmt, refer)
+	}
+	result := []IR{}
+	for _, stmt := range stmts {
+		switch v := stmt.(type) {
+		case *statements.IR_FunctionDef:
+			if !used[v.Name] {
+				continue
+			}
+		case *statements.IR_Assignment:
+			if isFunctionDefinition(v) && !used[v.Variable] {
+				continue
+			}
+		}
+		result = append(result, stmt)
+	}
+	return result
+}
+
+func isFunctionDefinition(stmt IR) bool {
+	switch v := stmt.(type) {
+	case *statements.IR_FunctionDef:
+		return true
+	case *statements.IR_Assignment:
+		_, ok := v.Expr.(*expr.IR_Function)
+		return ok
+	}
+	return false
+}
+
+// references calls f for every name that stmt reads or calls, including in
+// the bodies of the functions that it defines.
+func references(stmt IR, f func(name string)) {
+	var visit func(e IRExpression)
+	visit = func(e IRExpression) {
+		switch v := e.(type) {
+		case *expr.IR_Variable:
+			f(v.Value)
+		case *expr.IR_Call:
+			f(v.Function)
+		case *expr.IR_Function:
+			references(v.Body, f)
+		}
+		for _, op := range Operands(e) {
+			visit(op)
+		}
+	}
+	switch v := stmt.(type) {
+	case *statements.IR_AndThen:
+		references(v.Stmt1, f)
+		references(v.Stmt2, f)
+	case *statements.IR_Assignment:
+		visit(v.Expr)
+	case *statements.IR_ArrayAssignment:
+		f(v.Variable)
+		visit(v.Index)
+		visit(v.Expr)
+	case *statements.IR_CallStatement:
+		visit(v.Call)
+	case *statements.IR_Return:
+		visit(v.Expr)
+	case *statements.IR_If:
+		visit(v.Condition)
+		references(v.Stmt1, f)
+		if v.Stmt2 != nil {
+			references(v.Stmt2, f)
+		}
+	case *statements.IR_While:
+		visit(v.Condition)
+		references(v.Stmt, f)
+	case *statements.IR_FunctionDef:
+		visit(v.Expr)
+	case *statements.IR_Var:
+		if v.Value != nil {
+			visit(v.Value)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// IR turns f back into statements for the encoders. The values of a
+// variable get the name of the variable again where their lifetimes don't
+// overlap, so that phis mostly disappear; the others become copies at the
+// end of the predecessors. The edges from blocks with several successors
+// to blocks with several predecessors are split for the copies, which
+// changes f.
+func (f *Func) IR() (IR, error) {
+	f.splitCriticalEdges()
+	names := f.valueNames()
+	code := map[*Block][]IR{}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			instr = MapUses(instr, func(name string) IRExpression {
+				return expr.NewIR_Variable(names.of(name))
+			})
+			if v, ok := instr.(*statements.IR_Assignment); ok {
+				dest := names.of(v.Variable)
+				if src, ok := v.Expr.(*expr.IR_Variable); ok && src.Value == dest {
+					continue
+				}
+				instr = statements.NewIR_Assignment(dest, v.Expr)
+			}
+			code[b] = append(code[b], instr)
+		}
+		if len(b.Succs) == 1 {
+			code[b] = append(code[b], f.phiCopies(b, b.Succs[0], names)...)
+		}
+	}
+	s := &structurer{
+		f:       f,
+		code:    code,
+		tree:    f.Dominators(),
+		names:   names,
+		emitted: map[*Block]bool{},
+	}
+	result := s.block(f.Entry)
+	for _, b := range f.Blocks {
+		if !s.emitted[b] {
+			return nil, unstructuredError(b)
+		}
+	}
+	return sequence(result), nil
+}
+
+// splitCriticalEdges adds an empty block on every edge from a block with
+// several successors to a block with several predecessors.
+func (f *Func) splitCriticalEdges() {
+	split := false
+	for _, b := range f.Blocks {
+		if len(b.Succs) < 2 {
+			continue
+		}
+		for i, s := range b.Succs {
+			if len(s.Preds) < 2 {
+				continue
+			}
+			middle := f.NewBlock(BlockJump)
+			middle.Preds = []*Block{b}
+			middle.Succs = []*Block{s}
+			b.Succs[i] = middle
+			s.Preds[s.PredIndex(b)] = middle
+			split = true
+		}
+	}
+	if split {
+		f.Update()
+	}
+}
+
+// valueNames maps the values of a function to the names of the variables
+// that they're stored in.
+type valueNames map[string]string
+
+func (n valueNames) of(name string) string {
+	if newName, ok := n[name]; ok {
+		return newName
+	}
+	return name
+}
+
+// valueNames gives every value the name of its variable, unless the value
+// is live at the same time as another value with that name. Those get new
+// names.
+func (f *Func) valueNames() valueNames {
+	interference := f.interference()
+	names := valueNames{}
+	assigned := map[string][]string{}
+	fresh := map[string][]string{}
+	assign := func(value string) {
+		variable := VariableOf(value)
+		candidates := append([]string{variable}, fresh[variable]...)
+		for _, name := range candidates {
+			free := true
+			for _, other := range assigned[name] {
+				if interference[value][other] {
+					free = false
+					break
+				}
+			}
+			if free {
+				names[value] = name
+				assigned[name] = append(assigned[name], value)
+				return
+			}
+		}
+		name := f.NewValue(variable)
+		fresh[variable] = append(fresh[variable], name)
+		names[value] = name
+		assigned[name] = append(assigned[name], value)
+	}
+	for _, param := range f.Params {
+		names[param] = param
+		assigned[param] = append(assigned[param], param)
+	}
+	for _, b := range f.Blocks {
+		for _, phi := range b.Phis {
+			assign(phi.Dest)
+		}
+		for _, instr := range b.Instrs {
+			if def, ok := f.Def(instr); ok {
+				assign(def)
+			}
+		}
+	}
+	return names
+}
+
+// interference returns which values of the same variable are live at the
+// same time, and so can't share the name of the variable. A copy doesn't
+// make its destination interfere with its source, because they have the
+// same value.
+func (f *Func) interference() map[string]map[string]bool {
+	result := map[string]map[string]bool{}
+	interfere := func(a, b string) {
+		if a == b || VariableOf(a) != VariableOf(b) {
+			return
+		}
+		if result[a] == nil {
+			result[a] = map[string]bool{}
+		}
+		if result[b] == nil {
+			result[b] = map[string]bool{}
+		}
+		result[a][b], result[b][a] = true, true
+	}
+	liveness := f.Liveness()
+	for _, b := range f.Blocks {
+		live := map[string]bool{}
+		for _, s := range b.Succs {
+			for name := range liveness.In[s] {
+				live[name] = true
+			}
+		}
+		if len(b.Succs) == 1 {
+			// The phi copies at the end of b happen at the same time.
+			s := b.Succs[0]
+			j := s.PredIndex(b)
+			for _, phi := range s.Phis {
+				live[phi.Dest] = true
+			}
+			for _, phi := range s.Phis {
+				src := ""
+				if v, ok := phi.Args[j].(*expr.IR_Variable); ok {
+					src = v.Value
+				}
+				for name := range live {
+					if name != src {
+						interfere(phi.Dest, name)
+					}
+				}
+			}
+			for _, phi := range s.Phis {
+				delete(live, phi.Dest)
+			}
+			for _, phi := range s.Phis {
+				Variables(phi.Args[j], func(name string) {
+					if f.IsValue(name) {
+						live[name] = true
+					}
+				})
+			}
+		}
+		use := func(name string) {
+			if f.IsValue(name) {
+				live[name] = true
+			}
+		}
+		if b.Control != nil {
+			Variables(b.Control, use)
+		}
+		for i := len(b.Instrs) - 1; i >= 0; i-- {
+			instr := b.Instrs[i]
+			if def, ok := f.Def(instr); ok {
+				src := ""
+				if v, ok := instr.(*statements.IR_Assignment).Expr.(*expr.IR_Variable); ok {
+					src = v.Value
+				}
+				for name := range live {
+					if name != src {
+						interfere(def, name)
+					}
+				}
+				delete(live, def)
+			}
+			Uses(instr, use)
+		}
+	}
+	return result
+}
+
+// phiCopies returns the assignments at the end of pred for the phis of
+// succ. They're ordered so that no copy overwrites a variable that a later
+// one still reads, with a temporary to break cycles.
+func (f *Func) phiCopies(pred, succ *Block, names valueNames) []IR {
+	j := succ.PredIndex(pred)
+	type phiCopy struct {
+		dest string
+		src  IRExpression
+	}
+	pending := []phiCopy{}
+	for _, phi := range succ.Phis {
+		arg := phi.Args[j]
+		if v, ok := arg.(*expr.IR_Variable); ok && f.undefined(v.Value) {
+			continue
+		}
+		src := MapVariables(arg, func(name string) IRExpression {
+			return expr.NewIR_Variable(names.of(name))
+		})
+		dest := names.of(phi.Dest)
+		if v, ok := src.(*expr.IR_Variable); ok && v.Value == dest {
+			continue
+		}
+		pending = append(pending, phiCopy{dest, src})
+	}
+	result := []IR{}
+	for len(pending) > 0 {
+		ready := -1
+		for i, c := range pending {
+			read := false
+			for _, other := range pending {
+				Variables(other.src, func(name string) {
+					if name == c.dest {
+						read = true
+					}
+				})
+			}
+			if !read {
+				ready = i
+				break
+			}
+		}
+		if ready < 0 {
+			// Every destination is still read by another copy, so they form
+			// cycles. Saving one destination breaks its cycle.
+			c := pending[0]
+			tmp := f.NewValue(VariableOf(c.dest))
+			result = append(result, statements.NewIR_Assignment(tmp, expr.NewIR_Variable(c.dest)))
+			for i := range pending {
+				pending[i].src = MapVariables(pending[i].src, func(name string) IRExpression {
+					if name == c.dest {
+						return expr.NewIR_Variable(tmp)
+					}
+					return expr.NewIR_Variable(name)
+				})
+			}
+			continue
+		}
+		c := pending[ready]
+		result = append(result, statements.NewIR_Assignment(c.dest, c.src))
+		pending = append(pending[:ready:ready], pending[ready+1:]...)
+	}
+	return result
+}
+
+// undefined returns whether name is a variable in SSA form that is read
+// before it's assigned.
+func (f *Func) undefined(name string) bool {
+	return !f.IsValue(name) && f.versions[name] > 0 && !f.Pinned[name]
+}
+
+// sequence returns the statements as a chain of IR_AndThen, or nil when
+// there are none.
+func sequence(stmts []IR) IR {
+	if len(stmts) == 0 {
+		return nil
+	}
+	result := stmts[len(stmts)-1]
+	for i := len(stmts) - 2; i >= 0; i-- {
+		result = statements.NewIR_AndThen(stmts[i], result)
+	}
+	return result
+}
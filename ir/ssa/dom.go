@@ -0,0 +1,126 @@
+package ssa
+
+// DomTree is the dominator tree of a function. A block dominates another
+// one when every path from the entry to the other block goes through it.
+type DomTree struct {
+	idom     map[*Block]*Block
+	children map[*Block][]*Block
+	// order numbers the blocks in a preorder walk of the tree, and last is
+	// the highest number in the subtree of a block, so that dominance is a
+	// range check.
+	order map[*Block]int
+	last  map[*Block]int
+}
+
+// Dominators computes the dominator tree of f, with the algorithm of
+// Cooper, Harvey and Kennedy. f.Blocks has to be up to date.
+func (f *Func) Dominators() *DomTree {
+	rpo := map[*Block]int{}
+	for i, b := range f.Blocks {
+		rpo[b] = i
+	}
+	idom := map[*Block]*Block{f.Entry: f.Entry}
+	intersect := func(a, b *Block) *Block {
+		for a != b {
+			for rpo[a] > rpo[b] {
+				a = idom[a]
+			}
+			for rpo[b] > rpo[a] {
+				b = idom[b]
+			}
+		}
+		return a
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range f.Blocks[1:] {
+			var newIdom *Block
+			for _, p := range b.Preds {
+				if _, ok := idom[p]; !ok {
+					continue
+				}
+				if newIdom == nil {
+					newIdom = p
+				} else {
+					newIdom = intersect(p, newIdom)
+				}
+			}
+			if idom[b] != newIdom {
+				idom[b] = newIdom
+				changed = true
+			}
+		}
+	}
+	t := &DomTree{
+		idom:     idom,
+		children: map[*Block][]*Block{},
+		order:    map[*Block]int{},
+		last:     map[*Block]int{},
+	}
+	for _, b := range f.Blocks[1:] {
+		t.children[idom[b]] = append(t.children[idom[b]], b)
+	}
+	n := 0
+	var number func(b *Block)
+	number = func(b *Block) {
+		t.order[b] = n
+		n++
+		for _, c := range t.children[b] {
+			number(c)
+		}
+		t.last[b] = n - 1
+	}
+	number(f.Entry)
+	return t
+}
+
+// Idom returns the immediate dominator of b, or nil for the entry.
+func (t *DomTree) Idom(b *Block) *Block {
+	if idom := t.idom[b]; idom != b {
+		return idom
+	}
+	return nil
+}
+
+// Children returns the blocks that b immediately dominates, in reverse
+// postorder.
+func (t *DomTree) Children(b *Block) []*Block {
+	return t.children[b]
+}
+
+// Dominates returns whether a dominates b. Every block dominates itself.
+func (t *DomTree) Dominates(a, b *Block) bool {
+	return t.order[a] <= t.order[b] && t.order[b] <= t.last[a]
+}
+
+// Frontiers returns the dominance frontier of every block: the blocks where
+// the dominance of the block ends, which is where a definition in the block
+// meets other definitions.
+func (t *DomTree) Frontiers(f *Func) map[*Block][]*Block {
+	frontiers := map[*Block][]*Block{}
+	for _, b := range f.Blocks {
+		if len(b.Preds) < 2 {
+			continue
+		}
+		for _, p := range b.Preds {
+			for runner := p; runner != t.idom[b]; runner = t.idom[runner] {
+				if !containsBlock(frontiers[runner], b) {
+					frontiers[runner] = append(frontiers[runner], b)
+				}
+				if runner == f.Entry {
+					break
+				}
+			}
+		}
+	}
+	return frontiers
+}
+
+func containsBlock(blocks []*Block, b *Block) bool {
+	for _, c := range blocks {
+		if c == b {
+			return true
+		}
+	}
+	return false
+}
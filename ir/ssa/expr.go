@@ -0,0 +1,355 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// Operands returns the subexpressions of e. Function literals don't have
+// any, because their body is a function of its own.
+func Operands(e IRExpression) []IRExpression {
+	switch v := e.(type) {
+	case *expr.IR_Add:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_And:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_ArrayIndex:
+		return []IRExpression{v.Array, v.Index}
+	case *expr.IR_Call:
+		return v.Args
+	case *expr.IR_Cast:
+		return []IRExpression{v.Value}
+	case *expr.IR_Div:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_Equals:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_GT:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_GTE:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_Len:
+		return []IRExpression{v.Array}
+	case *expr.IR_LT:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_LTE:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_Mul:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_MulHigh:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_Not:
+		return []IRExpression{v.Op1}
+	case *expr.IR_Or:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_ShiftLeft:
+		return []IRExpression{v.Op1}
+	case *expr.IR_ShiftRight:
+		return []IRExpression{v.Op1}
+	case *expr.IR_StructField:
+		return []IRExpression{v.Struct}
+	case *expr.IR_Sub:
+		return []IRExpression{v.Op1, v.Op2}
+	case *expr.IR_Syscall:
+		return append([]IRExpression{v.Syscall}, v.Args...)
+	}
+	return nil
+}
+
+// WithOperands returns a copy of e with ops as its subexpressions, in the
+// order of Operands.
+func WithOperands(e IRExpression, ops []IRExpression) IRExpression {
+	switch v := e.(type) {
+	case *expr.IR_Add:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_And:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_ArrayIndex:
+		c := *v
+		c.Array, c.Index = ops[0], ops[1]
+		return &c
+	case *expr.IR_Call:
+		c := *v
+		c.Args = ops
+		return &c
+	case *expr.IR_Cast:
+		c := *v
+		c.Value = ops[0]
+		return &c
+	case *expr.IR_Div:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_Equals:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_GT:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_GTE:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_Len:
+		c := *v
+		c.Array = ops[0]
+		return &c
+	case *expr.IR_LT:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_LTE:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_Mul:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_MulHigh:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_Not:
+		c := *v
+		c.Op1 = ops[0]
+		return &c
+	case *expr.IR_Or:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_ShiftLeft:
+		c := *v
+		c.Op1 = ops[0]
+		return &c
+	case *expr.IR_ShiftRight:
+		c := *v
+		c.Op1 = ops[0]
+		return &c
+	case *expr.IR_StructField:
+		c := *v
+		c.Struct = ops[0]
+		return &c
+	case *expr.IR_Sub:
+		c := *v
+		c.Op1, c.Op2 = ops[0], ops[1]
+		return &c
+	case *expr.IR_Syscall:
+		c := *v
+		c.Syscall, c.Args = ops[0], ops[1:]
+		return &c
+	}
+	return e
+}
+
+// MapVariables returns e with every variable replaced by the result of f
+// for its name.
+func MapVariables(e IRExpression, f func(name string) IRExpression) IRExpression {
+	if v, ok := e.(*expr.IR_Variable); ok {
+		result := f(v.Value)
+		if r, ok := result.(*expr.IR_Variable); ok {
+			// Keep the position of the variable.
+			c := *v
+			c.Value = r.Value
+			return &c
+		}
+		return result
+	}
+	ops := Operands(e)
+	if len(ops) == 0 {
+		return e
+	}
+	newOps := make([]IRExpression, len(ops))
+	for i, op := range ops {
+		newOps[i] = MapVariables(op, f)
+	}
+	return WithOperands(e, newOps)
+}
+
+// Variables calls f for every variable that e reads.
+func Variables(e IRExpression, f func(name string)) {
+	if v, ok := e.(*expr.IR_Variable); ok {
+		f(v.Value)
+		return
+	}
+	for _, op := range Operands(e) {
+		Variables(op, f)
+	}
+}
+
+// Uses calls f for every variable that instr reads.
+func Uses(instr IR, f func(name string)) {
+	switch v := instr.(type) {
+	case *statements.IR_Assignment:
+		Variables(v.Expr, f)
+	case *statements.IR_ArrayAssignment:
+		f(v.Variable)
+		Variables(v.Index, f)
+		Variables(v.Expr, f)
+	case *statements.IR_CallStatement:
+		Variables(v.Call, f)
+	case *statements.IR_Return:
+		Variables(v.Expr, f)
+	}
+}
+
+// Def returns the SSA value that instr defines, if any.
+func (f *Func) Def(instr IR) (string, bool) {
+	if v, ok := instr.(*statements.IR_Assignment); ok && f.IsValue(v.Variable) {
+		return v.Variable, true
+	}
+	return "", false
+}
+
+// MapUses returns instr with the variables that it reads replaced by the
+// result of fn, or instr itself if it doesn't read any.
+func MapUses(instr IR, fn func(name string) IRExpression) IR {
+	switch v := instr.(type) {
+	case *statements.IR_Assignment:
+		return statements.NewIR_Assignment(v.Variable, MapVariables(v.Expr, fn))
+	case *statements.IR_ArrayAssignment:
+		array := v.Variable
+		if e, ok := fn(array).(*expr.IR_Variable); ok {
+			array = e.Value
+		}
+		return statements.NewIR_ArrayAssignment(array, MapVariables(v.Index, fn), MapVariables(v.Expr, fn))
+	case *statements.IR_CallStatement:
+		return statements.NewIR_CallStatement(MapVariables(v.Call, fn).(*expr.IR_Call))
+	case *statements.IR_Return:
+		return statements.NewIR_Return(MapVariables(v.Expr, fn))
+	}
+	return instr
+}
+
+// HasSideEffects returns whether evaluating e can do more than compute a
+// value: calls and syscalls.
+func HasSideEffects(e IRExpression) bool {
+	switch e.(type) {
+	case *expr.IR_Call, *expr.IR_Syscall:
+		return true
+	}
+	for _, op := range Operands(e) {
+		if HasSideEffects(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanTrap returns whether evaluating e can stop the program with a trap:
+// integer division, checked arithmetic and reading arrays, which faults
+// outside of them.
+func CanTrap(e IRExpression) bool {
+	switch v := e.(type) {
+	case *expr.IR_Div:
+		if _, ok := v.Op1.(*expr.IR_Float64); !ok {
+			if _, ok := v.Op2.(*expr.IR_Float64); !ok {
+				return true
+			}
+		}
+	case *expr.IR_Add:
+		if v.Checked {
+			return true
+		}
+	case *expr.IR_Sub:
+		if v.Checked {
+			return true
+		}
+	case *expr.IR_Mul:
+		if v.Checked {
+			return true
+		}
+	case *expr.IR_ArrayIndex:
+		return true
+	}
+	for _, op := range Operands(e) {
+		if CanTrap(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPure returns whether e only computes a value, so that it can be
+// evaluated fewer times or not at all.
+func IsPure(e IRExpression) bool {
+	return !HasSideEffects(e) && !CanTrap(e)
+}
+
+// writesMemory returns whether instr can change what array loads and
+// globals read.
+func (f *Func) writesMemory(instr IR) bool {
+	switch v := instr.(type) {
+	case *statements.IR_ArrayAssignment:
+		return true
+	case *statements.IR_CallStatement:
+		return !f.isPureCall(v.Call)
+	case *statements.IR_Assignment:
+		return !f.IsValue(v.Variable) || HasSideEffects(v.Expr) && !f.isPureCall(v.Expr)
+	}
+	return false
+}
+
+// isPureCall returns whether e is a call to a function in f.Pure.
+func (f *Func) isPureCall(e IRExpression) bool {
+	call, ok := e.(*expr.IR_Call)
+	if !ok || !f.Pure[call.Function] {
+		return false
+	}
+	for _, arg := range call.Args {
+		if HasSideEffects(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// readsMemory returns whether e reads arrays or globals, or calls a
+// function that can.
+func (f *Func) readsMemory(e IRExpression) bool {
+	switch v := e.(type) {
+	case *expr.IR_Variable:
+		return f.Pinned[v.Value]
+	case *expr.IR_ArrayIndex, *expr.IR_Call:
+		return true
+	}
+	for _, op := range Operands(e) {
+		if f.readsMemory(op) {
+			return true
+		}
+	}
+	return false
+}
+
+// mapExpressions returns instr with fn applied to the expressions that it
+// evaluates.
+func mapExpressions(instr IR, fn func(e IRExpression) IRExpression) IR {
+	switch v := instr.(type) {
+	case *statements.IR_Assignment:
+		return statements.NewIR_Assignment(v.Variable, fn(v.Expr))
+	case *statements.IR_ArrayAssignment:
+		return statements.NewIR_ArrayAssignment(v.Variable, fn(v.Index), fn(v.Expr))
+	case *statements.IR_CallStatement:
+		if call, ok := fn(v.Call).(*expr.IR_Call); ok {
+			return statements.NewIR_CallStatement(call)
+		}
+	case *statements.IR_Return:
+		return statements.NewIR_Return(fn(v.Expr))
+	}
+	return instr
+}
+
+// assignedExpression returns the expression that the assignment instr
+// evaluates.
+func assignedExpression(instr IR) IRExpression {
+	if v, ok := instr.(*statements.IR_Assignment); ok {
+		return v.Expr
+	}
+	return nil
+}
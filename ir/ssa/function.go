@@ -0,0 +1,244 @@
+// Package ssa is the mid-level IR that the optimisations work on. It lowers
+// the statements of a function, or of a program, into a control flow graph
+// of basic blocks in static single assignment form, and turns the graph
+// back into statements for the encoders.
+//
+// The instructions of the blocks are the statements of the shared.IR, with
+// nested expressions flattened into temporaries like SSA_Transform does.
+// Every assignment to a local variable defines a new SSA value, which is
+// named after the variable and a version, like x.2. Where the versions of a
+// variable meet, phi nodes pick the version of the edge that control came
+// from. Global variables and variables holding functions live in memory
+// instead, and keep their name.
+package ssa
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// Func is the control flow graph of a function body, or of the
+// top-level statements of a program.
+type Func struct {
+	// Params are the arguments of the function. They're the values of the
+	// variables with the same name at the entry of the function.
+	Params []string
+	// ParamTypes are the types of Params, when they're known.
+	ParamTypes []Type
+	Entry      *Block
+	// Blocks are the blocks that are reachable from Entry, in reverse
+	// postorder.
+	Blocks []*Block
+	// Pinned are the variables that aren't in SSA form: globals, and
+	// variables holding functions.
+	Pinned map[string]bool
+	// Pure are the functions of the program that don't have side effects.
+	// Calls to them only read memory, and can trap.
+	Pure map[string]bool
+	// Functions are the functions of the program that can be inlined.
+	Functions map[string]*expr.IR_Function
+
+	globals   map[string]bool
+	nextBlock int
+	// names are all the variable names used in the function, so that new
+	// values get names of their own.
+	names    map[string]bool
+	versions map[string]int
+	values   map[string]bool
+}
+
+// BlockKind is the way control leaves a block.
+type BlockKind int
+
+const (
+	// BlockJump continues with the only successor.
+	BlockJump BlockKind = iota
+	// BlockIf continues with the first successor when Control is true, and
+	// with the second one otherwise.
+	BlockIf
+	// BlockReturn returns Control from the function.
+	BlockReturn
+	// BlockExit falls off the end of a program or function.
+	BlockExit
+)
+
+// Block is a basic block.
+type Block struct {
+	ID   int
+	Kind BlockKind
+	Phis []*Phi
+	// Instrs are the statements of the block: assignments, array
+	// assignments, call statements and declarations.
+	Instrs []IR
+	// Control is the condition of a BlockIf, and the value of a
+	// BlockReturn.
+	Control IRExpression
+	Preds   []*Block
+	Succs   []*Block
+}
+
+// Phi defines Dest as the argument for the predecessor that control came
+// from. Args are in the order of the predecessors of the block.
+type Phi struct {
+	Dest string
+	Args []IRExpression
+}
+
+// NewBlock adds an empty block without edges to f. It's only part of
+// f.Blocks after the next call to Update.
+func (f *Func) NewBlock(kind BlockKind) *Block {
+	b := &Block{ID: f.nextBlock, Kind: kind}
+	f.nextBlock++
+	return b
+}
+
+// AddEdge adds an edge from b to succ, after the existing ones.
+func (b *Block) AddEdge(succ *Block) {
+	b.Succs = append(b.Succs, succ)
+	succ.Preds = append(succ.Preds, b)
+}
+
+// PredIndex returns the index of pred in the predecessors of b, which is
+// the index of its argument in the phis of b.
+func (b *Block) PredIndex(pred *Block) int {
+	for i, p := range b.Preds {
+		if p == pred {
+			return i
+		}
+	}
+	return -1
+}
+
+// RemovePred removes the edge from pred to b from the predecessors of b,
+// and the arguments of the phis for it. The successors of pred aren't
+// changed.
+func (b *Block) RemovePred(pred *Block) {
+	i := b.PredIndex(pred)
+	if i < 0 {
+		return
+	}
+	b.Preds = append(b.Preds[:i:i], b.Preds[i+1:]...)
+	for _, phi := range b.Phis {
+		phi.Args = append(phi.Args[:i:i], phi.Args[i+1:]...)
+	}
+}
+
+// NewValue returns an unused name for a new value of variable.
+func (f *Func) NewValue(variable string) string {
+	for {
+		f.versions[variable]++
+		name := fmt.Sprintf("%s.%d", variable, f.versions[variable])
+		if !f.names[name] {
+			f.names[name] = true
+			f.values[name] = true
+			return name
+		}
+	}
+}
+
+// VariableOf returns the variable that the value name is a version of.
+func VariableOf(name string) string {
+	if i := strings.LastIndexByte(name, '.'); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// IsValue returns whether name is an SSA value of f, rather than a pinned
+// or undefined variable.
+func (f *Func) IsValue(name string) bool {
+	return f.values[name]
+}
+
+// Update removes the blocks that aren't reachable from Entry, and orders
+// f.Blocks in reverse postorder. Passes that change the edges call it
+// afterwards.
+func (f *Func) Update() {
+	seen := map[*Block]bool{}
+	var postorder []*Block
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		seen[b] = true
+		for _, s := range b.Succs {
+			if !seen[s] {
+				visit(s)
+			}
+		}
+		postorder = append(postorder, b)
+	}
+	visit(f.Entry)
+	for _, b := range postorder {
+		for _, p := range append([]*Block{}, b.Preds...) {
+			if !seen[p] {
+				b.RemovePred(p)
+			}
+		}
+	}
+	f.Blocks = f.Blocks[:0]
+	for i := len(postorder) - 1; i >= 0; i-- {
+		f.Blocks = append(f.Blocks, postorder[i])
+	}
+}
+
+func (f *Func) String() string {
+	result := []string{}
+	if len(f.Params) > 0 {
+		result = append(result, "params "+strings.Join(f.Params, ", "))
+	}
+	for _, b := range f.Blocks {
+		result = append(result, b.String())
+	}
+	return strings.Join(result, "\n")
+}
+
+func (b *Block) String() string {
+	header := fmt.Sprintf("b%d:", b.ID)
+	if len(b.Preds) > 0 {
+		header += " ; preds " + blockList(b.Preds)
+	}
+	result := []string{header}
+	for _, phi := range b.Phis {
+		args := []string{}
+		for i, arg := range phi.Args {
+			// The dump of a broken function shows which arguments don't
+			// have a predecessor.
+			pred := "?"
+			if i < len(b.Preds) {
+				pred = fmt.Sprintf("b%d", b.Preds[i].ID)
+			}
+			args = append(args, fmt.Sprintf("%s: %s", pred, arg))
+		}
+		result = append(result, fmt.Sprintf("\t%s = phi(%s)", phi.Dest, strings.Join(args, ", ")))
+	}
+	for _, instr := range b.Instrs {
+		result = append(result, "\t"+instr.String())
+	}
+	switch b.Kind {
+	case BlockJump:
+		result = append(result, fmt.Sprintf("\tjump b%d", b.Succs[0].ID))
+	case BlockIf:
+		result = append(result, fmt.Sprintf("\tif %s then b%d else b%d", b.Control, b.Succs[0].ID, b.Succs[1].ID))
+	case BlockReturn:
+		result = append(result, fmt.Sprintf("\treturn %s", b.Control))
+	case BlockExit:
+		result = append(result, "\texit")
+	}
+	return strings.Join(result, "\n")
+}
+
+func blockList(blocks []*Block) string {
+	ids := []int{}
+	for _, b := range blocks {
+		ids = append(ids, b.ID)
+	}
+	sort.Ints(ids)
+	names := []string{}
+	for _, id := range ids {
+		names = append(names, fmt.Sprintf("b%d", id))
+	}
+	return strings.Join(names, " ")
+}
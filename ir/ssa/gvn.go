@@ -0,0 +1,253 @@
+package ssa
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// NumberValues finds the values that are computed more than once (global
+// value numbering) and replaces them by the value that is computed first,
+// in a block that dominates the others. Copies and phis that always pick
+// the same value are replaced as well.
+//
+// Array loads and expressions that read globals are only reused when no
+// store, call or syscall can happen in between. Calls and syscalls are
+// never reused.
+func NumberValues(f *Func) error {
+	n := &numbering{
+		f:       f,
+		tree:    f.Dominators(),
+		leaders: map[string]IRExpression{},
+		table:   map[string]IRExpression{},
+		writes:  map[*Block]bool{},
+		memory:  map[*Block]int{},
+	}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			if f.writesMemory(instr) {
+				n.writes[b] = true
+			}
+		}
+	}
+	n.block(f.Entry)
+	n.rewrite()
+	return nil
+}
+
+type numbering struct {
+	f    *Func
+	tree *DomTree
+	// leaders are the values that are replaced, and what they're replaced
+	// by.
+	leaders map[string]IRExpression
+	// table maps the key of an expression to the value that computes it,
+	// for the blocks that dominate the current one.
+	table map[string]IRExpression
+	// writes are the blocks that write memory, and memory is the
+	// generation of memory at the end of a block.
+	writes     map[*Block]bool
+	memory     map[*Block]int
+	generation int
+}
+
+// leader returns the expression that name is replaced by.
+func (n *numbering) leader(name string) IRExpression {
+	if e, ok := n.leaders[name]; ok {
+		return e
+	}
+	return expr.NewIR_Variable(name)
+}
+
+func (n *numbering) block(b *Block) {
+	var memory int
+	if idom := n.tree.Idom(b); idom != nil && !n.writesBetween(idom, b) {
+		memory = n.memory[idom]
+	} else {
+		n.generation++
+		memory = n.generation
+	}
+	added := []string{}
+	add := func(key string, e IRExpression) {
+		if _, ok := n.table[key]; !ok {
+			n.table[key] = e
+			added = append(added, key)
+		}
+	}
+	for _, phi := range b.Phis {
+		if e := n.redundantPhi(phi); e != nil {
+			n.leaders[phi.Dest] = e
+		}
+	}
+	for _, instr := range b.Instrs {
+		if def, ok := n.f.Def(instr); ok {
+			e := MapVariables(assignedExpression(instr), n.leader)
+			switch {
+			case isConstant(e) || n.isValue(e):
+				// A copy.
+				n.leaders[def] = e
+			case !HasSideEffects(e):
+				key := n.key(e, memory)
+				if leader, ok := n.table[key]; ok {
+					n.leaders[def] = leader
+				} else {
+					add(key, expr.NewIR_Variable(def))
+				}
+			}
+		}
+		if n.f.writesMemory(instr) {
+			n.generation++
+			memory = n.generation
+		}
+	}
+	n.memory[b] = memory
+	for _, c := range n.tree.Children(b) {
+		n.block(c)
+	}
+	for _, key := range added {
+		delete(n.table, key)
+	}
+}
+
+// writesBetween returns whether memory can be written on a path from the
+// end of idom to the start of b, which idom dominates.
+func (n *numbering) writesBetween(idom, b *Block) bool {
+	seen := map[*Block]bool{}
+	work := append([]*Block{}, b.Preds...)
+	for len(work) > 0 {
+		p := work[len(work)-1]
+		work = work[:len(work)-1]
+		if p == idom || seen[p] {
+			continue
+		}
+		seen[p] = true
+		if n.writes[p] {
+			return true
+		}
+		work = append(work, p.Preds...)
+	}
+	return false
+}
+
+// redundantPhi returns the value that all the arguments of phi are, other
+// than the phi itself.
+func (n *numbering) redundantPhi(phi *Phi) IRExpression {
+	var result IRExpression
+	for _, arg := range phi.Args {
+		arg = MapVariables(arg, n.leader)
+		if v, ok := arg.(*expr.IR_Variable); ok && v.Value == phi.Dest {
+			continue
+		}
+		if !n.isValue(arg) {
+			// Undefined variables and globals don't have one value.
+			return nil
+		}
+		if result != nil && result.(*expr.IR_Variable).Value != arg.(*expr.IR_Variable).Value {
+			return nil
+		}
+		result = arg
+	}
+	return result
+}
+
+// isValue returns whether e is an SSA value.
+func (n *numbering) isValue(e IRExpression) bool {
+	v, ok := e.(*expr.IR_Variable)
+	return ok && n.f.IsValue(v.Value)
+}
+
+// key returns a string that is the same for expressions that compute the
+// same value. Expressions that read memory include its generation.
+func (n *numbering) key(e IRExpression, memory int) string {
+	readsMemory := false
+	var key func(e IRExpression) string
+	key = func(e IRExpression) string {
+		switch v := e.(type) {
+		case *expr.IR_Variable:
+			if !n.f.IsValue(v.Value) {
+				readsMemory = true
+			}
+			return v.Value
+		case *expr.IR_ArrayIndex:
+			readsMemory = true
+		}
+		extra := ""
+		switch v := e.(type) {
+		case *expr.IR_Cast:
+			extra = v.CastToType.String()
+		case *expr.IR_StructField:
+			extra = v.Field
+		case *expr.IR_Add:
+			extra = fmt.Sprint(v.Checked)
+		case *expr.IR_Sub:
+			extra = fmt.Sprint(v.Checked)
+		case *expr.IR_Mul:
+			extra = fmt.Sprint(v.Checked)
+		case *expr.IR_ShiftLeft:
+			extra = fmt.Sprint(v.Shift)
+		case *expr.IR_ShiftRight:
+			extra = fmt.Sprint(v.Shift)
+		}
+		ops := Operands(e)
+		if len(ops) == 0 {
+			return fmt.Sprintf("%T(%s)", e, e.String())
+		}
+		keys := make([]string, len(ops))
+		for i, op := range ops {
+			keys[i] = key(op)
+		}
+		return fmt.Sprintf("%T%s(%s)", e, extra, strings.Join(keys, ", "))
+	}
+	result := key(e)
+	if readsMemory {
+		result += fmt.Sprintf("@%d", memory)
+	}
+	return result
+}
+
+// rewrite replaces the values that have a leader, and removes their
+// assignments and phis.
+func (n *numbering) rewrite() {
+	resolve := func(name string) IRExpression {
+		e := n.leader(name)
+		for {
+			v, ok := e.(*expr.IR_Variable)
+			if !ok {
+				return e
+			}
+			next, ok := n.leaders[v.Value]
+			if !ok {
+				return e
+			}
+			e = next
+		}
+	}
+	for _, b := range n.f.Blocks {
+		phis := b.Phis[:0]
+		for _, phi := range b.Phis {
+			if _, ok := n.leaders[phi.Dest]; ok {
+				continue
+			}
+			for i, arg := range phi.Args {
+				phi.Args[i] = MapVariables(arg, resolve)
+			}
+			phis = append(phis, phi)
+		}
+		b.Phis = phis
+		instrs := b.Instrs[:0]
+		for _, instr := range b.Instrs {
+			if def, ok := n.f.Def(instr); ok {
+				if _, ok := n.leaders[def]; ok {
+					continue
+				}
+			}
+			instrs = append(instrs, MapUses(instr, resolve))
+		}
+		b.Instrs = instrs
+		if b.Control != nil {
+			b.Control = MapVariables(b.Control, resolve)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// InlineThreshold is the size up to which functions are inlined when they
+// aren't annotated: the number of phis, instructions, branches and returns
+// of their body.
+const InlineThreshold = 10
+
+// Inline replaces the calls to the functions in f.Functions that are small
+// enough, or annotated with inline, by their body, unless they're annotated
+// with noinline. The arguments are copied into the parameters, the values
+// of the body get names of their own, and every return becomes an
+// assignment to the result of the call and a jump to the code after it.
+// Calls in the inlined bodies are inlined as well, but recursive functions
+// aren't inlined.
+func Inline(f *Func) error {
+	in := &inliner{f: f}
+	work := []inlineSite{}
+	for _, b := range f.Blocks {
+		work = append(work, inlineSite{block: b})
+	}
+	changed := false
+	for len(work) > 0 {
+		site := work[len(work)-1]
+		work = work[:len(work)-1]
+		more := in.block(site)
+		if more != nil {
+			changed = true
+			work = append(work, more...)
+		}
+	}
+	if changed {
+		f.Update()
+	}
+	return nil
+}
+
+// inlineSite is a block to inline the calls of, and the functions that it
+// has been inlined from.
+type inlineSite struct {
+	block    *Block
+	inlining []string
+}
+
+type inliner struct {
+	f *Func
+}
+
+// block inlines the first call of site that can be inlined, and returns the
+// blocks that are left to look at: the body of the function and the block
+// with the code after the call. It returns nil when there's no call to
+// inline.
+func (in *inliner) block(site inlineSite) []inlineSite {
+	b := site.block
+	if call, ok := b.Control.(*expr.IR_Call); ok && in.callee(call, site) != nil {
+		// Returning or branching on the result of a call.
+		result := in.f.NewValue("__" + call.Function)
+		b.Instrs = append(b.Instrs, statements.NewIR_Assignment(result, call))
+		b.Control = expr.NewIR_Variable(result)
+	}
+	for i, instr := range b.Instrs {
+		var call *expr.IR_Call
+		result := ""
+		switch v := instr.(type) {
+		case *statements.IR_Assignment:
+			if def, ok := in.f.Def(v); ok {
+				call, _ = v.Expr.(*expr.IR_Call)
+				result = def
+			}
+		case *statements.IR_CallStatement:
+			call = v.Call
+		}
+		if call == nil {
+			continue
+		}
+		callee := in.callee(call, site)
+		if callee == nil || result != "" && callee.falls {
+			continue
+		}
+		after, body := in.inline(b, i, call, result, callee)
+		inlining := append(append([]string{}, site.inlining...), call.Function)
+		sites := []inlineSite{{block: after, inlining: site.inlining}}
+		for _, c := range body {
+			sites = append(sites, inlineSite{block: c, inlining: inlining})
+		}
+		return sites
+	}
+	return nil
+}
+
+// inlinedFunc is a body to inline, in SSA form of its own.
+type inlinedFunc struct {
+	name string
+	fn   *expr.IR_Function
+	body *Func
+	// falls is whether the body can end without a return.
+	falls bool
+}
+
+// callee returns the body of the function that call calls, if it can be
+// inlined at site.
+func (in *inliner) callee(call *expr.IR_Call, site inlineSite) *inlinedFunc {
+	fn, ok := in.f.Functions[call.Function]
+	if !ok || fn.Inline == expr.InlineNever || in.f.IsValue(call.Function) {
+		return nil
+	}
+	if len(call.Args) != len(fn.Signature.ArgNames) {
+		return nil
+	}
+	for _, name := range site.inlining {
+		if name == call.Function {
+			return nil
+		}
+	}
+	body := Build(fn.Body, fn.Signature.ArgNames, in.f.globals)
+	if len(body.Entry.Preds) > 0 {
+		// The parameters have to be defined on the way in.
+		return nil
+	}
+	for name := range body.Pinned {
+		if !in.f.globals[name] {
+			// Functions defined in the body.
+			return nil
+		}
+	}
+	size := 0
+	falls := false
+	for _, b := range body.Blocks {
+		size += len(b.Phis) + len(b.Instrs)
+		switch b.Kind {
+		case BlockIf, BlockReturn:
+			size++
+		case BlockExit:
+			falls = true
+		}
+		for _, instr := range b.Instrs {
+			switch v := instr.(type) {
+			case *statements.IR_Assignment:
+				if _, ok := v.Expr.(*expr.IR_Function); ok {
+					return nil
+				}
+			case *statements.IR_ArrayAssignment, *statements.IR_CallStatement:
+			default:
+				return nil
+			}
+		}
+	}
+	if calls(body, call.Function) {
+		return nil
+	}
+	if fn.Inline != expr.InlineAlways && size > InlineThreshold {
+		return nil
+	}
+	return &inlinedFunc{name: call.Function, fn: fn, body: body, falls: falls}
+}
+
+// inline replaces the call at instruction i of b by the body of callee,
+// and assigns what it returns to result, if that's not empty. It returns
+// the block with the instructions after the call and the blocks of the
+// body.
+func (in *inliner) inline(b *Block, i int, call *expr.IR_Call, result string, callee *inlinedFunc) (*Block, []*Block) {
+	f := in.f
+	after := f.NewBlock(b.Kind)
+	after.Instrs = append([]IR{}, b.Instrs[i+1:]...)
+	after.Control = b.Control
+	after.Succs = b.Succs
+	for _, s := range after.Succs {
+		for j, p := range s.Preds {
+			if p == b {
+				s.Preds[j] = after
+			}
+		}
+	}
+	b.Instrs = b.Instrs[:i]
+	b.Kind, b.Control, b.Succs = BlockJump, nil, nil
+
+	names := map[string]IRExpression{}
+	rename := func(name string) IRExpression {
+		if e, ok := names[name]; ok {
+			return e
+		}
+		var e IRExpression = expr.NewIR_Variable(name)
+		switch {
+		case callee.body.IsValue(name):
+			e = expr.NewIR_Variable(f.NewValue("__" + callee.name + "_" + VariableOf(name)))
+		case !in.f.globals[name]:
+			// Undefined variables of the body.
+			e = expr.NewIR_Variable("__" + callee.name + "_" + name)
+		}
+		names[name] = e
+		return e
+	}
+	for j, param := range callee.fn.Signature.ArgNames {
+		arg := call.Args[j]
+		if isConstant(arg) {
+			arg = Fold(expr.NewIR_Cast(arg, callee.fn.Signature.Args[j]))
+		}
+		dest := rename(param).(*expr.IR_Variable).Value
+		b.Instrs = append(b.Instrs, statements.NewIR_Assignment(dest, arg))
+	}
+
+	blocks := map[*Block]*Block{}
+	body := []*Block{}
+	for _, cb := range callee.body.Blocks {
+		blocks[cb] = f.NewBlock(cb.Kind)
+		body = append(body, blocks[cb])
+	}
+	results := []IRExpression{}
+	for _, cb := range callee.body.Blocks {
+		nb := blocks[cb]
+		for _, phi := range cb.Phis {
+			args := make([]IRExpression, len(phi.Args))
+			for j, arg := range phi.Args {
+				args[j] = MapVariables(arg, rename)
+			}
+			nb.Phis = append(nb.Phis, &Phi{Dest: rename(phi.Dest).(*expr.IR_Variable).Value, Args: args})
+		}
+		for _, instr := range cb.Instrs {
+			instr = MapUses(instr, rename)
+			if v, ok := instr.(*statements.IR_Assignment); ok {
+				instr = statements.NewIR_Assignment(rename(v.Variable).(*expr.IR_Variable).Value, v.Expr)
+			}
+			nb.Instrs = append(nb.Instrs, instr)
+		}
+		for _, p := range cb.Preds {
+			nb.Preds = append(nb.Preds, blocks[p])
+		}
+		for _, s := range cb.Succs {
+			nb.Succs = append(nb.Succs, blocks[s])
+		}
+		switch cb.Kind {
+		case BlockIf:
+			nb.Control = MapVariables(cb.Control, rename)
+		case BlockReturn, BlockExit:
+			if cb.Kind == BlockReturn && result != "" {
+				value := MapVariables(cb.Control, rename)
+				if callee.returns() > 1 {
+					name := f.NewValue(VariableOf(result))
+					nb.Instrs = append(nb.Instrs, statements.NewIR_Assignment(name, value))
+					value = expr.NewIR_Variable(name)
+				} else {
+					nb.Instrs = append(nb.Instrs, statements.NewIR_Assignment(result, value))
+				}
+				results = append(results, value)
+			} else if cb.Kind == BlockReturn && !IsPure(cb.Control) {
+				// The value isn't used, but it can have side effects or trap.
+				nb.Instrs = append(nb.Instrs, statements.NewIR_Assignment(f.NewValue("__discard"), MapVariables(cb.Control, rename)))
+			}
+			nb.Kind = BlockJump
+			nb.AddEdge(after)
+		}
+	}
+	entry := blocks[callee.body.Entry]
+	b.Succs = []*Block{entry}
+	entry.Preds = []*Block{b}
+	if len(results) > 1 {
+		after.Phis = []*Phi{{Dest: result, Args: results}}
+	}
+	return after, body
+}
+
+// calls returns whether f calls the function name.
+func calls(f *Func, name string) bool {
+	found := false
+	find := func(e IRExpression) IRExpression {
+		if call, ok := e.(*expr.IR_Call); ok && call.Function == name {
+			found = true
+		}
+		return e
+	}
+	for _, b := range f.Blocks {
+		for _, instr := range b.Instrs {
+			mapExpressions(instr, find)
+		}
+		if b.Control != nil {
+			find(b.Control)
+		}
+	}
+	return found
+}
+
+// returns returns the number of return blocks of the body.
+func (c *inlinedFunc) returns() int {
+	n := 0
+	for _, b := range c.body.Blocks {
+		if b.Kind == BlockReturn {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,341 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// HoistLoopInvariants moves the values that every iteration of a loop
+// computes in the same way out of the loop, into a pre-header block that
+// runs once before it. Inner loops go first, so that what's moved out of
+// them can be moved out of the loops around them as well.
+//
+// Values that only compute something are always moved. Array loads, calls
+// to pure functions and the operations that can trap are only moved when
+// the loop doesn't store to memory or have other side effects, and when
+// the loop would compute them in its first iteration anyway. That's the
+// case for the header of the loop, and for the blocks of the body that
+// every iteration goes through, which are moved into a second pre-header
+// that only runs when the condition of the loop holds.
+func HoistLoopInvariants(f *Func) error {
+	tree := f.Dominators()
+	headers := []*Block{}
+	for _, b := range f.Blocks {
+		for _, p := range b.Preds {
+			if tree.Dominates(b, p) {
+				headers = append(headers, b)
+				break
+			}
+		}
+	}
+	for i := len(headers) - 1; i >= 0; i-- {
+		f.hoistLoop(headers[i])
+	}
+	return nil
+}
+
+// loop is the natural loop of a header: the blocks that reach one of its
+// latches, the ends of the body, without going through the header.
+type loop struct {
+	header  *Block
+	blocks  map[*Block]bool
+	latches []*Block
+	// defs are the blocks where the values of the loop are defined, and
+	// hoisted is the pre-header that they've been moved to, 1 for the one
+	// that always runs and 2 for the guarded one.
+	defs    map[string]*Block
+	hoisted map[string]int
+	// writes is whether the loop stores to memory or has side effects, and
+	// exits whether it can be left from another block than the header.
+	writes bool
+	exits  bool
+}
+
+func (f *Func) findLoop(header *Block, tree *DomTree) *loop {
+	l := &loop{
+		header:  header,
+		blocks:  map[*Block]bool{header: true},
+		defs:    map[string]*Block{},
+		hoisted: map[string]int{},
+	}
+	work := []*Block{}
+	for _, p := range header.Preds {
+		if tree.Dominates(header, p) {
+			l.latches = append(l.latches, p)
+			work = append(work, p)
+		}
+	}
+	for len(work) > 0 {
+		b := work[len(work)-1]
+		work = work[:len(work)-1]
+		if l.blocks[b] {
+			continue
+		}
+		l.blocks[b] = true
+		work = append(work, b.Preds...)
+	}
+	for _, b := range f.Blocks {
+		if !l.blocks[b] {
+			continue
+		}
+		for _, phi := range b.Phis {
+			l.defs[phi.Dest] = b
+		}
+		for _, instr := range b.Instrs {
+			if def, ok := f.Def(instr); ok {
+				l.defs[def] = b
+			}
+			if f.writesMemory(instr) {
+				l.writes = true
+			}
+		}
+		for _, s := range b.Succs {
+			if !l.blocks[s] && b != header {
+				l.exits = true
+			}
+		}
+	}
+	return l
+}
+
+// level returns the pre-header that the expression e can be computed in, or
+// 0 if it has to stay in the loop.
+func (l *loop) level(e IRExpression) int {
+	level := 1
+	Variables(e, func(name string) {
+		if _, ok := l.defs[name]; !ok {
+			return
+		}
+		if l.hoisted[name] == 0 || level == 0 {
+			level = 0
+		} else if l.hoisted[name] > level {
+			level = l.hoisted[name]
+		}
+	})
+	return level
+}
+
+// everyIteration returns whether every iteration that doesn't leave the
+// loop goes through b.
+func (l *loop) everyIteration(b *Block, tree *DomTree) bool {
+	for _, latch := range l.latches {
+		if !tree.Dominates(b, latch) {
+			return false
+		}
+	}
+	return !l.exits
+}
+
+func (f *Func) hoistLoop(header *Block) {
+	tree := f.Dominators()
+	l := f.findLoop(header, tree)
+	var hoisted [3][]IR
+	guarded, checked := false, false
+	for _, b := range f.Blocks {
+		if !l.blocks[b] {
+			continue
+		}
+		if b != header && !checked {
+			// The guarded pre-header needs a copy of the condition, so the
+			// header can't keep any instructions.
+			guarded = len(header.Instrs) == 0 && f.canGuard(l)
+			checked = true
+		}
+		// sideEffects is whether an instruction of the block that stays in
+		// the loop has already done more than computing a value.
+		sideEffects := false
+		kept := b.Instrs[:0]
+		for _, instr := range b.Instrs {
+			def, ok := f.Def(instr)
+			if !ok {
+				kept = append(kept, instr)
+				sideEffects = true
+				continue
+			}
+			e := assignedExpression(instr)
+			level := l.level(e)
+			switch {
+			case level == 0, l.writes && f.readsMemory(e):
+				level = 0
+			case IsPure(e):
+			case HasSideEffects(e) && !f.isPureCall(e), l.writes:
+				level = 0
+			case b == header && !sideEffects:
+			case guarded && l.everyIteration(b, tree):
+				level = 2
+			default:
+				level = 0
+			}
+			if level == 0 {
+				kept = append(kept, instr)
+				if !IsPure(e) {
+					sideEffects = true
+				}
+				continue
+			}
+			l.hoisted[def] = level
+			hoisted[level] = append(hoisted[level], instr)
+		}
+		b.Instrs = kept
+	}
+	if len(hoisted[1]) == 0 && len(hoisted[2]) == 0 {
+		return
+	}
+	pre := f.preheader(l)
+	pre.Instrs = hoisted[1]
+	if len(hoisted[2]) > 0 {
+		f.guard(l, tree, pre).Instrs = hoisted[2]
+	}
+	f.Update()
+}
+
+// canGuard returns whether the loop can get a pre-header that only runs
+// when its condition holds: the header only computes the condition, and
+// leaves the loop to a block that doesn't have other predecessors.
+func (f *Func) canGuard(l *loop) bool {
+	h := l.header
+	if h.Kind != BlockIf || !IsPure(h.Control) || l.exits {
+		return false
+	}
+	exit := l.exit()
+	return exit != nil && len(exit.Preds) == 1 && len(exit.Phis) == 0
+}
+
+// exit returns the successor of the header outside of the loop.
+func (l *loop) exit() *Block {
+	var exit *Block
+	for _, s := range l.header.Succs {
+		if !l.blocks[s] {
+			if exit != nil {
+				return nil
+			}
+			exit = s
+		}
+	}
+	return exit
+}
+
+// preheader adds a block in front of the header of l that the edges from
+// outside of the loop go to. It gets the phi arguments for those edges.
+func (f *Func) preheader(l *loop) *Block {
+	h := l.header
+	pre := f.NewBlock(BlockJump)
+	preds := []*Block{pre}
+	args := make([][]IRExpression, len(h.Phis))
+	for i, phi := range h.Phis {
+		args[i] = []IRExpression{nil}
+		outside := []IRExpression{}
+		for j, p := range h.Preds {
+			if l.blocks[p] {
+				args[i] = append(args[i], phi.Args[j])
+			} else {
+				outside = append(outside, phi.Args[j])
+			}
+		}
+		if len(outside) == 1 {
+			args[i][0] = outside[0]
+		} else {
+			dest := f.NewValue(VariableOf(phi.Dest))
+			pre.Phis = append(pre.Phis, &Phi{Dest: dest, Args: outside})
+			args[i][0] = expr.NewIR_Variable(dest)
+		}
+	}
+	for _, p := range h.Preds {
+		if l.blocks[p] {
+			preds = append(preds, p)
+			continue
+		}
+		pre.Preds = append(pre.Preds, p)
+		for i, s := range p.Succs {
+			if s == h {
+				p.Succs[i] = pre
+			}
+		}
+	}
+	for i, phi := range h.Phis {
+		phi.Args = args[i]
+	}
+	h.Preds = preds
+	pre.Succs = []*Block{h}
+	return pre
+}
+
+// guard adds a block after the pre-header pre that checks the condition of
+// the loop, and a second pre-header after it that only runs when it holds.
+// The values of the header that are read after the loop get phis in its
+// exit, which the guard jumps to otherwise.
+func (f *Func) guard(l *loop, tree *DomTree, pre *Block) *Block {
+	h, exit := l.header, l.exit()
+	entry := map[string]IRExpression{}
+	for _, phi := range h.Phis {
+		entry[phi.Dest] = phi.Args[0]
+	}
+	g := f.NewBlock(BlockIf)
+	g.Control = MapVariables(h.Control, func(name string) IRExpression {
+		if e, ok := entry[name]; ok {
+			return e
+		}
+		return expr.NewIR_Variable(name)
+	})
+	guarded := f.NewBlock(BlockJump)
+	pre.Succs = []*Block{g}
+	g.Preds = []*Block{pre}
+	if h.Succs[0] == exit {
+		g.Succs = []*Block{exit, guarded}
+	} else {
+		g.Succs = []*Block{guarded, exit}
+	}
+	guarded.Preds = []*Block{g}
+	guarded.Succs = []*Block{h}
+	h.Preds[0] = guarded
+
+	after := []*Block{}
+	used := map[string]bool{}
+	for _, b := range f.Blocks {
+		if !l.blocks[b] && tree.Dominates(h, b) {
+			after = append(after, b)
+			for _, phi := range b.Phis {
+				for _, arg := range phi.Args {
+					Variables(arg, func(name string) { used[name] = true })
+				}
+			}
+			for _, instr := range b.Instrs {
+				Uses(instr, func(name string) { used[name] = true })
+			}
+			if b.Control != nil {
+				Variables(b.Control, func(name string) { used[name] = true })
+			}
+		}
+	}
+	replace := map[string]IRExpression{}
+	phis := []*Phi{}
+	for _, phi := range h.Phis {
+		if used[phi.Dest] {
+			dest := f.NewValue(VariableOf(phi.Dest))
+			phis = append(phis, &Phi{Dest: dest, Args: []IRExpression{expr.NewIR_Variable(phi.Dest), phi.Args[0]}})
+			replace[phi.Dest] = expr.NewIR_Variable(dest)
+		}
+	}
+	rename := func(name string) IRExpression {
+		if e, ok := replace[name]; ok {
+			return e
+		}
+		return expr.NewIR_Variable(name)
+	}
+	for _, b := range after {
+		for _, phi := range b.Phis {
+			for i, arg := range phi.Args {
+				phi.Args[i] = MapVariables(arg, rename)
+			}
+		}
+		for i, instr := range b.Instrs {
+			b.Instrs[i] = MapUses(instr, rename)
+		}
+		if b.Control != nil {
+			b.Control = MapVariables(b.Control, rename)
+		}
+	}
+	exit.Preds = append(exit.Preds, g)
+	exit.Phis = phis
+	return guarded
+}
@@ -0,0 +1,74 @@
+package ssa
+
+// Liveness holds the SSA values that are live at the start and at the end
+// of every block. The values that phis define aren't live at the start of
+// their block, and the arguments of the phis of a successor are live at the
+// end of the predecessor that they're for.
+type Liveness struct {
+	In  map[*Block]map[string]bool
+	Out map[*Block]map[string]bool
+}
+
+// Liveness computes which values of f are live where.
+func (f *Func) Liveness() *Liveness {
+	uses := map[*Block]map[string]bool{}
+	defs := map[*Block]map[string]bool{}
+	for _, b := range f.Blocks {
+		uses[b], defs[b] = map[string]bool{}, map[string]bool{}
+		for _, phi := range b.Phis {
+			defs[b][phi.Dest] = true
+		}
+		use := func(name string) {
+			if f.IsValue(name) && !defs[b][name] {
+				uses[b][name] = true
+			}
+		}
+		for _, instr := range b.Instrs {
+			Uses(instr, use)
+			if def, ok := f.Def(instr); ok {
+				defs[b][def] = true
+			}
+		}
+		if b.Control != nil {
+			Variables(b.Control, use)
+		}
+	}
+	l := &Liveness{In: map[*Block]map[string]bool{}, Out: map[*Block]map[string]bool{}}
+	for _, b := range f.Blocks {
+		l.In[b], l.Out[b] = map[string]bool{}, map[string]bool{}
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(f.Blocks) - 1; i >= 0; i-- {
+			b := f.Blocks[i]
+			add := func(set map[string]bool, name string) {
+				if !set[name] {
+					set[name] = true
+					changed = true
+				}
+			}
+			for _, s := range b.Succs {
+				for name := range l.In[s] {
+					add(l.Out[b], name)
+				}
+				j := s.PredIndex(b)
+				for _, phi := range s.Phis {
+					Variables(phi.Args[j], func(name string) {
+						if f.IsValue(name) {
+							add(l.Out[b], name)
+						}
+					})
+				}
+			}
+			for name := range uses[b] {
+				add(l.In[b], name)
+			}
+			for name := range l.Out[b] {
+				if !defs[b][name] {
+					add(l.In[b], name)
+				}
+			}
+		}
+	}
+	return l
+}
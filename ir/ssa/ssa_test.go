@@ -0,0 +1,368 @@
+package ssa_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bspaans/jit-compiler/ir"
+	"github.com/bspaans/jit-compiler/ir/expr"
+	"github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/ssa"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+func Test_Build_Dump(t *testing.T) {
+	f := ssa.Build(ir.MustParseIR(`i = 0; while i < 53 { i = i + 1 }; return i`), nil, nil)
+	expected := `b0:
+	i.1 = 0
+	jump b1
+b1: ; preds b0 b2
+	i.2 = phi(b0: i.1, b2: i.3)
+	if i.2 < 53 then b2 else b3
+b3: ; preds b1
+	return i.2
+b2: ; preds b1
+	i.3 = i.2 + 1
+	jump b1`
+	if f.String() != expected {
+		t.Fatalf("Expecting\n%s\ngot\n%s", expected, f)
+	}
+	if err := f.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Build_Params(t *testing.T) {
+	f := ssa.Build(ir.MustParseIR(`if a > 3 { a = 3 }; return a`), []string{"a"}, nil)
+	if err := f.Verify(); err != nil {
+		t.Fatal(err, "\n", f)
+	}
+	join := f.Blocks[len(f.Blocks)-1]
+	if len(join.Phis) != 1 || join.Phis[0].Args[0].String() != "a.1" || join.Phis[0].Args[1].String() != "a" {
+		t.Fatal("Expecting a phi of a.1 and the parameter a\n", f)
+	}
+}
+
+func Test_Dominators(t *testing.T) {
+	f := ssa.Build(ir.MustParseIR(`if a > 3 { b = 3 } else { b = 4 }; return b`), []string{"a"}, nil)
+	tree := f.Dominators()
+	entry, join := f.Entry, f.Blocks[len(f.Blocks)-1]
+	for _, b := range f.Blocks[1:] {
+		if tree.Idom(b) != entry {
+			t.Fatalf("Expecting b%d to be dominated by the entry\n%s", b.ID, f)
+		}
+		if b != join && tree.Dominates(b, join) {
+			t.Fatalf("b%d shouldn't dominate the join b%d\n%s", b.ID, join.ID, f)
+		}
+	}
+	if tree.Idom(entry) != nil || !tree.Dominates(entry, join) {
+		t.Fatal("Expecting the entry to dominate every block")
+	}
+	frontiers := tree.Frontiers(f)
+	for _, branch := range entry.Succs {
+		if len(frontiers[branch]) != 1 || frontiers[branch][0] != join {
+			t.Fatalf("Expecting b%d to be the frontier of b%d\n%s", join.ID, branch.ID, f)
+		}
+	}
+}
+
+func Test_Verify_Errors(t *testing.T) {
+	program := `i = 0; while i < 53 { i = i + 1 }; return i`
+	breakages := map[string]func(f *ssa.Func){
+		"has 2 successors": func(f *ssa.Func) {
+			f.Entry.Succs = append(f.Entry.Succs, f.Entry.Succs[0])
+		},
+		"arguments for 2 predecessors": func(f *ssa.Func) {
+			phi := f.Blocks[1].Phis[0]
+			phi.Args = phi.Args[:1]
+		},
+		"doesn't dominate it": func(f *ssa.Func) {
+			// i.3 is assigned in the loop body, and so isn't defined on the
+			// way from the entry into the loop.
+			f.Blocks[1].Phis[0].Args[0] = expr.NewIR_Variable("i.3")
+		},
+		"is assigned more than once": func(f *ssa.Func) {
+			body := f.Blocks[3]
+			body.Instrs = append(body.Instrs, body.Instrs[0])
+		},
+		"isn't in the predecessors": func(f *ssa.Func) {
+			f.Blocks[2].Preds = nil
+		},
+	}
+	for message, breakage := range breakages {
+		f := ssa.Build(ir.MustParseIR(program), nil, nil)
+		breakage(f)
+		err := f.Verify()
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Fatalf("Expecting an error that %s, got %v\n%s", message, err, f)
+		}
+	}
+}
+
+func Test_Transform_RoundTrip(t *testing.T) {
+	units := map[string]string{
+		`i = 0; while i < 53 { i = i + 1 }; return i`:                  `i = 0 ; while i < 53 { i = i + 1 } ; return i`,
+		`x = 1; y = 2; while x < 10 { t = x; x = y; y = t }; return x`: `x = 1 ; y = 2 ; while x < 10 { t = x ; x = y ; y = t } ; return x`,
+		`if a > 3 { b = 3 }; return b`:                                 `if a > 3 { b = 3 } ; return b`,
+	}
+	for program, expected := range units {
+		stmts, err := ssa.Transform([]shared.IR{ir.MustParseIR(program)}, (*ssa.Func).Verify)
+		if err != nil {
+			t.Fatal(err, "in", program)
+		}
+		result := []string{}
+		for _, stmt := range stmts {
+			result = append(result, stmt.String())
+		}
+		if strings.Join(result, " ; ") != expected {
+			t.Fatalf("Expecting %s got %s", expected, strings.Join(result, " ; "))
+		}
+	}
+}
+
+func Test_FoldConstants(t *testing.T) {
+	units := map[string]string{
+		`f = 2.0 * 3.5 / 7.0; return f`:                                 `__ssa_1 = 0.500000 ; f = 1.000000 ; return 1.000000`,
+		`a = int8(100); b = a + int8(28); return b`:                     `a = 100 ; b = -128 ; return -128`,
+		`a = uint8(3); b = a - uint8(4); return b`:                      `a = 3 ; b = 255 ; return 255`,
+		`a = uint16(300); b = a * uint16(300); return b`:                `a = 300 ; b = 24464 ; return 24464`,
+		`a = int32(-7); b = a / int32(2); return b`:                     `a = -7 ; b = -3 ; return -3`,
+		`a = uint64(7); b = a / uint64(0); return b`:                    `a = 7 ; b = 7 / 0 ; return b`,
+		`a = int8(-128); b = a / int8(-1); return b`:                    `a = -128 ; b = -128 / -1 ; return b`,
+		`a = int8(100); b = checked_add(a, int8(28)); return b`:         `a = 100 ; b = checked_add(100, 28) ; return b`,
+		`a = int8(-1); b = uint8(a) > uint8(3); return b`:               `a = -1 ; __ssa_1 = 255 ; b = true ; return true`,
+		`a = int8(-1); b = a > int8(3); return b`:                       `a = -1 ; b = false ; return false`,
+		`a = uint64(-1.5); return a`:                                    `a = uint64(-1.500000) ; return a`,
+		`a = int16(-1.5); return a`:                                     `a = -1 ; return -1`,
+		`a = 0.0 / 0.0; b = a == a; return b`:                           `a = NaN ; b = false ; return false`,
+		`a = false; b = a && (g[3] == 0); return b`:                     `a = false ; b = false ; return false`,
+		`b = (g[3] == 0) && false; return b`:                            `__ssa_1 = g[3] ; __ssa_2 = __ssa_1 == 0 ; b = false ; return false`,
+		`a = 3; if a > 2 { b = 1 } else { b = 2 }; return b`:            `a = 3 ; b = 1 ; return 1`,
+		`a = 3; while a < 2 { a = a + 1 }; return a`:                    `a = 3 ; return 3`,
+		`a = 3; i = 0; while i < a { i = i + 1; a = 3 }; return i`:      `a = 3 ; i = 0 ; while i < 3 { i = i + 1 ; a = 3 } ; return i`,
+		`a = 3; if x > 2 { b = a } else { b = a }; c = b + 1; return c`: `a = 3 ; if x > 2 { b = 3 } else { b = 3 } ; c = 4 ; return 4`,
+		`b = true; while b { f = 53; return f }; return 0`:              `b = true ; f = 53 ; return 53`,
+	}
+	for program, expected := range units {
+		stmts, err := ssa.Transform([]shared.IR{ir.MustParseIR(program)}, func(f *ssa.Func) error {
+			if err := ssa.FoldConstants(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", program)
+		}
+		result := []string{}
+		for _, stmt := range stmts {
+			result = append(result, stmt.String())
+		}
+		if strings.Join(result, " ; ") != expected {
+			t.Errorf("Expecting %s got %s in %s", expected, strings.Join(result, " ; "), program)
+		}
+	}
+}
+
+func Test_EliminateDeadCode(t *testing.T) {
+	units := map[string]string{
+		`a = 1; b = a + 2; c = 3; return c`:                             `c = 3 ; return c`,
+		`a = 1; f = a; return f; a = 2; f = 3`:                          `a = 1 ; f = a ; return f`,
+		`a = x(); b = syscall(1, 2); c = g[4]; return 3`:                `a = x() ; b = syscall(1, [2]) ; c = g[4] ; return 3`,
+		`a = 3; if x > 2 { b = a } else { b = 4 }; return 1`:            `return 1`,
+		`if x > 2 { b = 3 } else { b = 3 }; return b`:                   `if x > 2 { b = 3 } else { b = 3 } ; return b`,
+		`if x > 2 { g[0] = 3 } else { b = 4 }; return 1`:                `if x > 2 { g[0] = 3 } ; return 1`,
+		`i = 0; j = 0; while i < 10 { i = i + 1; j = j + i }; return i`: `i = 0 ; while i < 10 { i = i + 1 } ; return i`,
+		`i = 0; while i < 10 { i = i + 1 }; return 0`:                   `i = 0 ; while i < 10 { i = i + 1 } ; return 0`,
+	}
+	for program, expected := range units {
+		stmts, err := ssa.Transform([]shared.IR{ir.MustParseIR(program)}, func(f *ssa.Func) error {
+			if err := ssa.EliminateDeadCode(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", program)
+		}
+		result := []string{}
+		for _, stmt := range stmts {
+			result = append(result, stmt.String())
+		}
+		if strings.Join(result, " ; ") != expected {
+			t.Errorf("Expecting %s got %s in %s", expected, strings.Join(result, " ; "), program)
+		}
+	}
+}
+
+func Test_RemoveUnusedFunctions(t *testing.T) {
+	units := []struct {
+		program  string
+		keep     []string
+		expected []string
+	}{
+		{ir.Stdlib + `f = Max(3, 4); return f`, nil, []string{"Max"}},
+		{ir.Stdlib + `f = 3; return f`, nil, []string{}},
+		{ir.Stdlib + `f = 3; return f`, []string{"Close"}, []string{"Close"}},
+		{`func a() int64 { return b() }; func b() int64 { return 1 }; func c() int64 { return a() }; return a()`, nil, []string{"a", "b"}},
+		{`d = func(i int64) int64 { return i }; e = func(i int64) int64 { return d(i) }; return 1`, nil, []string{}},
+		{`d = func(i int64) int64 { return i }; e = func(i int64) int64 { return d(i) }; return e(1)`, nil, []string{"d", "e"}},
+	}
+	for _, unit := range units {
+		stmts := ssa.RemoveUnusedFunctions([]shared.IR{ir.MustParseIR(unit.program)}, unit.keep...)
+		functions := []string{}
+		for _, stmt := range stmts {
+			switch v := stmt.(type) {
+			case *statements.IR_FunctionDef:
+				functions = append(functions, v.Name)
+			case *statements.IR_Assignment:
+				if _, ok := v.Expr.(*expr.IR_Function); ok {
+					functions = append(functions, v.Variable)
+				}
+			}
+		}
+		if strings.Join(functions, ", ") != strings.Join(unit.expected, ", ") {
+			t.Errorf("Expecting functions %v got %v in %s", unit.expected, functions, unit.program)
+		}
+	}
+}
+
+func Test_NumberValues(t *testing.T) {
+	units := map[string]string{
+		`f = (p * w) + (p * w); return f`:                                         `__ssa_1 = p * w ; f = __ssa_1 + __ssa_1 ; return f`,
+		`a = p * w; b = a; c = b * 2; d = (p * w) * 2; return c + d`:              `a = p * w ; c = a * 2 ; return c + c`,
+		`a = g[i]; b = g[i]; return a + b`:                                        `a = g[i] ; return a + a`,
+		`a = g[i]; g[j] = 3; b = g[i]; return a + b`:                              `a = g[i] ; g[j] = 3 ; b = g[i] ; return a + b`,
+		`a = g[i]; h(); b = g[i]; return a + b`:                                   `a = g[i] ; h() ; b = g[i] ; return a + b`,
+		`a = g[i]; if x > 1 { b = g[i] } else { b = 1 }; return a + b`:            `a = g[i] ; if x > 1 { b = a } else { b = 1 } ; return a + b`,
+		`a = g[i]; if x > 1 { c = 2 } else { c = 1 }; b = g[i]; return a + b + c`: `a = g[i] ; if x > 1 { c = 2 } else { c = 1 } ; __ssa_1 = a + c ; return a + __ssa_1`,
+		`a = g[i]; if x > 1 { g[0] = 2 }; b = g[i]; return a + b`:                 `a = g[i] ; if x > 1 { g[0] = 2 } ; b = g[i] ; return a + b`,
+		`a = g[i]; while x > 1 { x = x - 1; b = g[i] }; return a + b`:             `a = g[i] ; while x > 1 { x = x - 1 ; b = a } ; return a + b`,
+		`a = g[i]; while x > 1 { x = x - 1; g[x] = 1 }; b = g[i]; return a + b`:   `a = g[i] ; while x > 1 { x = x - 1 ; g[x] = 1 } ; b = g[i] ; return a + b`,
+		`a = h(); b = h(); return a + b`:                                          `a = h() ; b = h() ; return a + b`,
+		`a = uint8(1) + uint8(2); b = 1 + 2; return b`:                            `a = 1 + 2 ; b = 1 + 2 ; return b`,
+	}
+	for program, expected := range units {
+		stmts, err := ssa.Transform([]shared.IR{ir.MustParseIR(program)}, func(f *ssa.Func) error {
+			if err := ssa.NumberValues(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", program)
+		}
+		result := []string{}
+		for _, stmt := range stmts {
+			result = append(result, stmt.String())
+		}
+		if strings.Join(result, " ; ") != expected {
+			t.Errorf("Expecting %s got %s in %s", expected, strings.Join(result, " ; "), program)
+		}
+	}
+}
+
+func Test_HoistLoopInvariants(t *testing.T) {
+	units := map[string]string{
+		`i = 0; while i < n { a = p * w; i = i + a }; return i`:                                                  `i = 0 ; a = p * w ; while i < n { i = i + a } ; return i`,
+		`i = 0; while i < n { a = g[k]; i = i + a }; return i`:                                                   `i = 0 ; if i < n { a = g[k] ; while i < n { i = i + a } } ; return i`,
+		`i = 0; while i < n { a = g[k]; g[i] = a; i = i + 1 }; return i`:                                         `i = 0 ; while i < n { a = g[k] ; g[i] = a ; i = i + 1 } ; return i`,
+		`i = 0; while i < n { if i > 2 { a = g[k] } else { a = 1 }; i = i + a }; return i`:                       `i = 0 ; a = 1 ; while i < n { if i > 2 { a.4 = g[k] } else { a.4 = a } ; i = i + a.4 } ; return i`,
+		`i = 0; while i < n { a = p / w; i = i + a }; return i`:                                                  `i = 0 ; if i < n { a = p / w ; while i < n { i = i + a } } ; return i`,
+		`i = 0; while i < n { j = 0; while j < n { a = p * w; j = j + a }; i = i + j }; return i`:                `i = 0 ; j = 0 ; a = p * w ; while i < n { j.4 = j ; while j.4 < n { j.4 = j.4 + a } ; i = i + j.4 } ; return i`,
+		`d = func(i int64) int64 { return i * 2 }; i = 0; while i < n { a = d(p); i = i + a }; return i`:         `d = func(i int64) int64 { return i * 2 } ; i = 0 ; if i < n { a = d(p) ; while i < n { i = i + a } } ; return i`,
+		`d = func(i int64) int64 { return i * 2 }; i = 0; while i < n { a = d(i); i = i + a }; return i`:         `d = func(i int64) int64 { return i * 2 } ; i = 0 ; while i < n { a = d(i) ; i = i + a } ; return i`,
+		`d = func(i int64) int64 { return syscall(1, i) }; i = 0; while i < n { a = d(p); i = i + a }; return i`: `d = func(i int64) int64 { return syscall(1, [i]) } ; i = 0 ; while i < n { a = d(p) ; i = i + a } ; return i`,
+		`i = 0; while i < (p * w) { i = i + 1 }; return i`:                                                       `i = 0 ; __ssa_1 = p * w ; while i < __ssa_1 { i = i + 1 } ; return i`,
+		`i = 0; while i < g[k] { i = i + 1 }; return i`:                                                          `i = 0 ; __ssa_1 = g[k] ; while i < __ssa_1 { i = i + 1 } ; return i`,
+		`i = 0; while i < n { if i > 5 { return 0 }; a = g[k]; i = i + a }; return i`:                            `i = 0 ; while i < n { if i > 5 { return 0 } else { a = g[k] ; i = i + a } } ; return i`,
+	}
+	for program, expected := range units {
+		stmts, err := ssa.Transform([]shared.IR{ir.MustParseIR(program)}, func(f *ssa.Func) error {
+			if err := ssa.HoistLoopInvariants(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", program)
+		}
+		result := []string{}
+		for _, stmt := range stmts {
+			result = append(result, stmt.String())
+		}
+		if strings.Join(result, " ; ") != expected {
+			t.Errorf("Expecting %s got %s in %s", expected, strings.Join(result, " ; "), program)
+		}
+	}
+}
+
+func Test_Inline(t *testing.T) {
+	units := map[string]string{
+		`d = func(i int64) int64 { return i * 2 }; return d(p)`:                                          `d = func(i int64) int64 { return i * 2 } ; __d_i = p ; __d = __d_i * 2 ; return __d`,
+		`func Max(i int64, j int64) int64 { if i > j { return i } else { return j } }; return Max(p, 3)`: `func Max(i int64, j int64) int64 { if i > j { return i } else { return j } } ; __Max_i = p ; __Max_j = 3 ; if __Max_i > __Max_j { __Max = __Max_i } else { __Max = __Max_j } ; return __Max`,
+		`noinline func d(i int64) int64 { return i * 2 }; return d(p)`:                                   `noinline func d(i int64) int64 { return i * 2 } ; return d(p)`,
+		`inline func d(i int64) int64 { a = i * 2; b = a * 2; c = b * 2; e = c * 2; g = e * 2; h = g * 2; k = h * 2; m = k * 2; n = m * 2; o = n * 2; return o * 2 }; return d(p)`: `inline func d(i int64) int64 { a = i * 2 ; b = a * 2 ; c = b * 2 ; e = c * 2 ; g = e * 2 ; h = g * 2 ; k = h * 2 ; m = k * 2 ; n = m * 2 ; o = n * 2 ; return o * 2 } ; __d_i = p ; __d_a = __d_i * 2 ; __d_b = __d_a * 2 ; __d_c = __d_b * 2 ; __d_e = __d_c * 2 ; __d_g = __d_e * 2 ; __d_h = __d_g * 2 ; __d_k = __d_h * 2 ; __d_m = __d_k * 2 ; __d_n = __d_m * 2 ; __d_o = __d_n * 2 ; __d = __d_o * 2 ; return __d`,
+		`func d(i int64) int64 { a = i * 2; b = a * 2; c = b * 2; e = c * 2; g = e * 2; h = g * 2; k = h * 2; m = k * 2; n = m * 2; o = n * 2; return o * 2 }; return d(p)`:        `func d(i int64) int64 { a = i * 2 ; b = a * 2 ; c = b * 2 ; e = c * 2 ; g = e * 2 ; h = g * 2 ; k = h * 2 ; m = k * 2 ; n = m * 2 ; o = n * 2 ; return o * 2 } ; return d(p)`,
+		`func r(i int64) int64 { if i > 0 { return r(i - 1) }; return 0 }; return r(p)`:                                                                                            `func r(i int64) int64 { if i > 0 { __ssa_1 = i - 1 ; return r(__ssa_1) } else { return 0 } } ; return r(p)`,
+		`func w(i int64) int64 { return syscall(1, i) }; w(p); return 1`:                                                                                                           `func w(i int64) int64 { return syscall(1, [i]) } ; __w_i = p ; __discard = syscall(1, [__w_i]) ; return 1`,
+		`func d(i int64) int64 { j = i + 1; return j * i }; i = 5; j = d(i); return i + j`:                                                                                         `func d(i int64) int64 { j = i + 1 ; return j * i } ; i = 5 ; __d_i = i ; __d_j = __d_i + 1 ; j = __d_j * __d_i ; return i + j`,
+		`func d(i uint8) uint8 { return i + 1 }; return d(3)`:                                                                                                                      `func d(i uint8) uint8 { return i + 1 } ; __d_i = 3 ; __d = __d_i + 1 ; return __d`,
+		`func d(i int64) int64 { return i + 1 }; func e(i int64) int64 { return d(i) * 2 }; if e(p) > 2 { return 1 }; return 0`:                                                    `func d(i int64) int64 { return i + 1 } ; func e(i int64) int64 { __d_i = i ; __ssa_1 = __d_i + 1 ; return __ssa_1 * 2 } ; __e_i = p ; __d_i = __e_i ; __e___ssa_1 = __d_i + 1 ; __ssa_1 = __e___ssa_1 * 2 ; if __ssa_1 > 2 { return 1 } else { return 0 }`,
+	}
+	for program, expected := range units {
+		stmts, err := ssa.Transform([]shared.IR{ir.MustParseIR(program)}, func(f *ssa.Func) error {
+			if err := ssa.Inline(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", program)
+		}
+		result := []string{}
+		for _, stmt := range stmts {
+			result = append(result, stmt.String())
+		}
+		if strings.Join(result, " ; ") != expected {
+			t.Errorf("Expecting %s got %s in %s", expected, strings.Join(result, " ; "), program)
+		}
+	}
+}
+
+func Test_ReduceStrength(t *testing.T) {
+	units := map[string]string{
+		`a = p * 1; b = a + 0; c = 0 + b; return c - 0`:                  `a = p ; b = a ; c = b ; return c`,
+		`a = p * 0; return a`:                                            `a = 0 ; return a`,
+		`a = p * 2; return a * 16`:                                       `a = p + p ; return a << 4`,
+		`a = 8 * p; return a`:                                            `a = p << 3 ; return a`,
+		`a = p * 3; return a`:                                            `a = p * 3 ; return a`,
+		`a = checked_mul(p, 8); return a`:                                `a = checked_mul(p, 8) ; return a`,
+		`a = p / 1; b = p / -1; c = p / 0; return a + b + c`:             `a = p ; b = p / -1 ; c = p / 0 ; __ssa_1 = b + c ; return a + __ssa_1`,
+		`func d(i int64) int64 { return i - i }; return d(p)`:            `func d(i int64) int64 { return 0 } ; return d(p)`,
+		`func d(i float64) float64 { return i * 1.0 }; return d(p)`:      `func d(i float64) float64 { return i * 1.000000 } ; return d(p)`,
+		`func d(i uint32) uint32 { return i / uint32(8) }; return d(p)`:  `func d(i uint32) uint32 { return i >> 3 } ; return d(p)`,
+		`func d(i uint32) uint32 { return i / uint32(10) }; return d(p)`: `func d(i uint32) uint32 { __reduced_uint64 = uint64(i) ; __reduced_uint64 = mul_high(__reduced_uint64, 1844674407370955162) ; return uint32(__reduced_uint64) } ; return d(p)`,
+		`func d(i uint64) uint64 { return i / uint64(7) }; return d(p)`:  `func d(i uint64) uint64 { __reduced_uint64 = mul_high(i, 2635249153387078803) ; __reduced_uint64.5 = i - __reduced_uint64 ; __reduced_uint64.5 = __reduced_uint64.5 >> 1 ; __reduced_uint64 = __reduced_uint64 + __reduced_uint64.5 ; return __reduced_uint64 >> 2 } ; return d(p)`,
+		`func d(i int64) int64 { return i / 4 }; return d(p)`:            `func d(i int64) int64 { __reduced_int64 = i >> 63 ; __reduced_uint64 = uint64(__reduced_int64) ; __reduced_uint64 = __reduced_uint64 >> 62 ; __reduced_int64 = int64(__reduced_uint64) ; __reduced_int64 = i + __reduced_int64 ; return __reduced_int64 >> 2 } ; return d(p)`,
+		`func d(i int64) int64 { return i / 7 }; return d(p)`:            `func d(i int64) int64 { __reduced_int64 = mul_high(i, 5270498306774157605) ; __reduced_int64 = __reduced_int64 >> 1 ; __reduced_int64.4 = i >> 63 ; return __reduced_int64 - __reduced_int64.4 } ; return d(p)`,
+		`func d(i int8) int8 { return i / int8(-3) }; return d(p)`:       `func d(i int8) int8 { __reduced_int64 = int64(i) ; __reduced_int64.5 = mul_high(__reduced_int64, 6148914691236517206) ; __reduced_int64 = __reduced_int64 >> 63 ; __reduced_int64 = __reduced_int64.5 - __reduced_int64 ; __reduced_int8 = int8(__reduced_int64) ; return 0 - __reduced_int8 } ; return d(p)`,
+	}
+	for program, expected := range units {
+		stmts, err := ssa.Transform([]shared.IR{ir.MustParseIR(program)}, func(f *ssa.Func) error {
+			if err := ssa.ReduceStrength(f); err != nil {
+				return err
+			}
+			return f.Verify()
+		})
+		if err != nil {
+			t.Fatal(err, "in", program)
+		}
+		result := []string{}
+		for _, stmt := range stmts {
+			result = append(result, stmt.String())
+		}
+		if strings.Join(result, " ; ") != expected {
+			t.Errorf("Expecting %s got %s in %s", expected, strings.Join(result, " ; "), program)
+		}
+	}
+}
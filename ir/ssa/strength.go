@@ -0,0 +1,271 @@
+package ssa
+
+import (
+	"math/big"
+	"math/bits"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// ReduceStrength replaces integer arithmetic by cheaper operations that
+// compute the same value:
+//
+//   - x * 1, x + 0, x - 0 and x / 1 become x, and x * 0 and x - x become 0;
+//   - x * 2 becomes x + x, and multiplying by other powers of two becomes a
+//     shift to the left;
+//   - unsigned division by a power of two becomes a shift to the right, and
+//     signed division one that rounds towards zero;
+//   - division by other constants becomes a multiplication by their
+//     inverse, of which only the upper half of the product is used (magic
+//     numbers, as in Hacker's Delight). Narrow integers are divided as 64
+//     bit integers, which takes fewer steps.
+//
+// Checked arithmetic, floats, and dividing by 0 or -1, which can trap, are
+// left alone. Multiplying by 3, 5 or 9 is left to the encoders, which can
+// do that with a single LEA.
+func ReduceStrength(f *Func) error {
+	s := &reducer{f: f, types: f.valueTypes()}
+	for _, b := range f.Blocks {
+		instrs := []IR{}
+		for _, instr := range b.Instrs {
+			def, ok := f.Def(instr)
+			if !ok {
+				instrs = append(instrs, instr)
+				continue
+			}
+			s.instrs = nil
+			e := s.reduce(assignedExpression(instr))
+			if e != assignedExpression(instr) {
+				instr = statements.NewIR_Assignment(def, e)
+			}
+			instrs = append(instrs, s.instrs...)
+			instrs = append(instrs, instr)
+		}
+		if b.Control != nil {
+			s.instrs = nil
+			b.Control = s.reduce(b.Control)
+			instrs = append(instrs, s.instrs...)
+		}
+		b.Instrs = instrs
+	}
+	return nil
+}
+
+type reducer struct {
+	f     *Func
+	types map[string]Type
+	// instrs are the instructions that compute the temporaries of the
+	// expression that is reduced.
+	instrs []IR
+}
+
+// temporary assigns e of type typ to a new value and returns it. The values
+// are named after their type, so that the values that get the same variable
+// when the function leaves SSA form have the same type.
+func (s *reducer) temporary(typ Type, e IRExpression) IRExpression {
+	name := s.f.NewValue("__reduced_" + typ.String())
+	s.instrs = append(s.instrs, statements.NewIR_Assignment(name, e))
+	return expr.NewIR_Variable(name)
+}
+
+// reduce returns the cheaper expression for e, or e itself.
+func (s *reducer) reduce(e IRExpression) IRExpression {
+	switch v := e.(type) {
+	case *expr.IR_Add:
+		if v.Checked {
+			return e
+		}
+		if s.isZero(v.Op2) {
+			return v.Op1
+		}
+		if s.isZero(v.Op1) {
+			return v.Op2
+		}
+	case *expr.IR_Sub:
+		if v.Checked {
+			return e
+		}
+		if s.isZero(v.Op2) {
+			return v.Op1
+		}
+		if a, ok := v.Op1.(*expr.IR_Variable); ok && s.f.IsValue(a.Value) {
+			if b, ok := v.Op2.(*expr.IR_Variable); ok && a.Value == b.Value {
+				if typ := s.types[a.Value]; typ != nil && IsInteger(typ) {
+					return integer(typ, 0)
+				}
+			}
+		}
+	case *expr.IR_Mul:
+		if v.Checked {
+			return e
+		}
+		op1, op2 := v.Op1, v.Op2
+		if isConstant(op1) && !isConstant(op2) {
+			op1, op2 = op2, op1
+		}
+		return s.multiply(e, op1, op2)
+	case *expr.IR_Div:
+		return s.divide(e, v.Op1, v.Op2)
+	}
+	return e
+}
+
+// isZero returns whether e is the integer literal 0.
+func (s *reducer) isZero(e IRExpression) bool {
+	c, ok := constantOf(e)
+	return ok && IsInteger(c.typ) && c.bits == 0
+}
+
+// multiply reduces e, which is x * the literal c.
+func (s *reducer) multiply(e, x, c IRExpression) IRExpression {
+	typ, value, ok := integerConstant(c)
+	if !ok {
+		return e
+	}
+	switch {
+	case value == 0:
+		return integer(typ, 0)
+	case value == 1:
+		return x
+	case value == 2:
+		return expr.NewIR_Add(x, x)
+	case bits.OnesCount64(value) == 1:
+		return expr.NewIR_ShiftLeft(x, uint8(bits.TrailingZeros64(value)))
+	}
+	return e
+}
+
+// integerConstant returns the type of the integer literal c, and its value
+// as an unsigned integer of the same width.
+func integerConstant(c IRExpression) (Type, uint64, bool) {
+	k, ok := constantOf(c)
+	if !ok || !IsInteger(k.typ) {
+		return nil, 0, false
+	}
+	width := widthBits(k.typ)
+	return k.typ, k.bits << (64 - width) >> (64 - width), true
+}
+
+// divide reduces e, which is x / the literal c.
+func (s *reducer) divide(e, x, c IRExpression) IRExpression {
+	typ, value, ok := integerConstant(c)
+	if !ok || value == 0 {
+		return e
+	}
+	if value == 1 {
+		return x
+	}
+	if !IsSignedInteger(typ) {
+		if bits.OnesCount64(value) == 1 {
+			return expr.NewIR_ShiftRight(x, uint8(bits.TrailingZeros64(value)))
+		}
+		return s.divideUnsigned(x, typ, value)
+	}
+	divisor := int64(truncate(typ, value))
+	negative := divisor < 0
+	if negative {
+		divisor = -divisor
+	}
+	if divisor <= 1 {
+		// -1, and the smallest integer, which doesn't have a positive
+		// counterpart.
+		return e
+	}
+	var q IRExpression
+	if bits.OnesCount64(uint64(divisor)) == 1 {
+		q = s.dividePowerOfTwo(x, typ, uint8(bits.TrailingZeros64(uint64(divisor))))
+	} else {
+		q = s.divideSigned(x, typ, uint64(divisor))
+	}
+	if negative {
+		return expr.NewIR_Sub(integer(typ, 0), s.temporary(typ, q))
+	}
+	return q
+}
+
+// dividePowerOfTwo divides the signed x by 2^k. Shifting to the right rounds
+// towards negative infinity, so 2^k - 1 is added to negative numbers first,
+// which makes it round towards zero.
+func (s *reducer) dividePowerOfTwo(x IRExpression, typ Type, k uint8) IRExpression {
+	width := uint8(widthBits(typ))
+	unsigned := unsignedType(typ)
+	sign := s.temporary(typ, expr.NewIR_ShiftRight(x, width-1))
+	ones := s.temporary(unsigned, expr.NewIR_Cast(sign, unsigned))
+	bias := s.temporary(unsigned, expr.NewIR_ShiftRight(ones, width-k))
+	biased := s.temporary(typ, expr.NewIR_Add(x, s.temporary(typ, expr.NewIR_Cast(bias, typ))))
+	return expr.NewIR_ShiftRight(biased, k)
+}
+
+// divideUnsigned divides the unsigned x by d, which isn't a power of two.
+func (s *reducer) divideUnsigned(x IRExpression, typ Type, d uint64) IRExpression {
+	if typ != TUint64 {
+		// x < 2^32, so the error of rounding up 2^64 / d, which is less than
+		// d, is less than 2^64 / x, and doesn't add up to a whole d.
+		wide := s.temporary(TUint64, expr.NewIR_Cast(x, TUint64))
+		m := (^uint64(0))/d + 1
+		q := s.temporary(TUint64, expr.NewIR_MulHigh(wide, expr.NewIR_Uint64(m)))
+		return expr.NewIR_Cast(q, typ)
+	}
+	// The inverse 2^(64 + s) / d, rounded up, needs 65 bits. The product
+	// with its lower 64 bits is x less than the product with the inverse,
+	// which is added back without overflowing by averaging.
+	shift := bits.Len64(d)
+	m := magic(d, shift).Uint64()
+	t := s.temporary(TUint64, expr.NewIR_MulHigh(x, expr.NewIR_Uint64(m)))
+	half := s.temporary(TUint64, expr.NewIR_ShiftRight(s.temporary(TUint64, expr.NewIR_Sub(x, t)), 1))
+	average := s.temporary(TUint64, expr.NewIR_Add(t, half))
+	return expr.NewIR_ShiftRight(average, uint8(shift-1))
+}
+
+// divideSigned divides the signed x by d, which is positive and not a power
+// of two. The product with the inverse rounds towards negative infinity,
+// so 1 is added to the quotient of negative numbers.
+func (s *reducer) divideSigned(x IRExpression, typ Type, d uint64) IRExpression {
+	if typ != TInt64 {
+		wide := s.temporary(TInt64, expr.NewIR_Cast(x, TInt64))
+		m := (^uint64(0))/d + 1
+		q := s.temporary(TInt64, expr.NewIR_MulHigh(wide, expr.NewIR_Int64(int64(m))))
+		sign := s.temporary(TInt64, expr.NewIR_ShiftRight(wide, 63))
+		return expr.NewIR_Cast(s.temporary(TInt64, expr.NewIR_Sub(q, sign)), typ)
+	}
+	shift := bits.Len64(d) - 1
+	m := magic(d, shift).Uint64()
+	var q IRExpression
+	if m&1 == 0 {
+		high := s.temporary(TInt64, expr.NewIR_MulHigh(x, expr.NewIR_Int64(int64(m/2))))
+		q = s.temporary(TInt64, expr.NewIR_ShiftRight(high, uint8(shift-1)))
+	} else {
+		// The inverse doesn't fit in a signed integer, so the product is
+		// with the inverse - 2^64, which is x less.
+		high := s.temporary(TInt64, expr.NewIR_MulHigh(x, expr.NewIR_Int64(int64(m))))
+		sum := s.temporary(TInt64, expr.NewIR_Add(high, x))
+		q = s.temporary(TInt64, expr.NewIR_ShiftRight(sum, uint8(shift)))
+	}
+	sign := s.temporary(TInt64, expr.NewIR_ShiftRight(x, 63))
+	return expr.NewIR_Sub(q, sign)
+}
+
+// magic returns 2^(64 + shift) / d rounded up, without its 65th bit.
+func magic(d uint64, shift int) *big.Int {
+	divisor := new(big.Int).SetUint64(d)
+	m := new(big.Int).Lsh(big.NewInt(1), uint(64+shift))
+	m.Add(m, divisor)
+	m.Sub(m, big.NewInt(1))
+	m.Div(m, divisor)
+	return m.SetBit(m, 64, 0)
+}
+
+// unsignedType returns the unsigned integer type with the width of typ.
+func unsignedType(typ Type) Type {
+	switch widthBits(typ) {
+	case 8:
+		return TUint8
+	case 16:
+		return TUint16
+	case 32:
+		return TUint32
+	}
+	return TUint64
+}
@@ -0,0 +1,186 @@
+package ssa
+
+import (
+	"fmt"
+
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// structurer turns the blocks back into if and while statements. Blocks
+// with a single predecessor are emitted where control comes from. Blocks
+// where control flow meets are emitted after the statement of the block
+// that dominates them, which is where the branches that lead to them end.
+// Loop headers become while loops, with the code of the header repeated
+// at the end of the body to compute the condition again.
+type structurer struct {
+	f       *Func
+	code    map[*Block][]IR
+	tree    *DomTree
+	names   valueNames
+	emitted map[*Block]bool
+}
+
+//goland:noinspection GoErrorStringFormat
+func unstructuredError(b *Block) error {
+	return fmt.Errorf("Control flow at b%d can't be expressed with if and while statements", b.ID)
+}
+
+// block returns the statements for b, and the blocks that it dominates.
+func (s *structurer) block(b *Block) []IR {
+	if s.emitted[b] {
+		return nil
+	}
+	s.emitted[b] = true
+	if s.isLoopHeader(b) {
+		return s.loop(b)
+	}
+	result := append([]IR{}, s.code[b]...)
+	switch b.Kind {
+	case BlockJump:
+		result = append(result, s.follow(b, b.Succs[0])...)
+	case BlockIf:
+		then := s.follow(b, b.Succs[0])
+		otherwise := s.follow(b, b.Succs[1])
+		result = append(result, s.ifStatement(s.control(b), then, otherwise)...)
+	case BlockReturn:
+		result = append(result, statements.NewIR_Return(s.control(b)))
+	}
+	return append(result, s.joins(b, nil)...)
+}
+
+// follow returns the statements for the edge from b to succ: the
+// statements of succ if b is its only predecessor. Control continues
+// after the statement that b is part of otherwise.
+func (s *structurer) follow(b, succ *Block) []IR {
+	if len(succ.Preds) == 1 && !s.isLoopHeader(succ) {
+		return s.block(succ)
+	}
+	return nil
+}
+
+// joins returns the statements of the blocks that b dominates where control
+// flow meets, if they're in the loop with the header loop, or outside of it
+// when loop is nil.
+func (s *structurer) joins(b *Block, loop *Block) []IR {
+	result := []IR{}
+	for _, c := range s.tree.Children(b) {
+		inLoop := loop != nil && s.reaches(c, loop)
+		if (len(c.Preds) > 1 || s.isLoopHeader(c)) && inLoop == (loop != nil) {
+			result = append(result, s.block(c)...)
+		}
+	}
+	return result
+}
+
+// isLoopHeader returns whether b has a predecessor that it dominates, which
+// is the end of a loop body.
+func (s *structurer) isLoopHeader(b *Block) bool {
+	for _, p := range b.Preds {
+		if s.tree.Dominates(b, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// loop returns the while loop for the header b.
+func (s *structurer) loop(b *Block) []IR {
+	header := s.code[b]
+	var condition IRExpression = expr.NewIR_Bool(true)
+	var body, exit []IR
+	switch b.Kind {
+	case BlockJump:
+		body = s.loopBody(b, b.Succs[0])
+	case BlockIf:
+		inLoop := func(c *Block) bool { return s.reaches(c, b) }
+		switch {
+		case inLoop(b.Succs[0]) && !inLoop(b.Succs[1]):
+			condition = s.control(b)
+			body = s.loopBody(b, b.Succs[0])
+			exit = s.follow(b, b.Succs[1])
+		case inLoop(b.Succs[1]) && !inLoop(b.Succs[0]):
+			condition = expr.NewIR_Not(s.control(b))
+			body = s.loopBody(b, b.Succs[1])
+			exit = s.follow(b, b.Succs[0])
+		default:
+			// Both branches stay in the loop.
+			then := s.loopBody(b, b.Succs[0])
+			otherwise := s.loopBody(b, b.Succs[1])
+			body = s.ifStatement(s.control(b), then, otherwise)
+		}
+	case BlockReturn:
+		// A loop header has a successor.
+		return nil
+	}
+	body = append(body, s.joins(b, b)...)
+	body = append(body, header...)
+	if len(body) == 0 {
+		body = []IR{s.discard(condition)}
+	}
+	result := append([]IR{}, header...)
+	result = append(result, statements.NewIR_While(condition, sequence(body)))
+	result = append(result, exit...)
+	return append(result, s.joins(b, nil)...)
+}
+
+// loopBody returns the statements on the edge from the header b into its
+// loop.
+func (s *structurer) loopBody(b, succ *Block) []IR {
+	if succ == b {
+		return nil
+	}
+	return s.follow(b, succ)
+}
+
+// reaches returns whether there's a path from b to the loop header without
+// leaving the loop, i.e. through blocks that the header dominates.
+func (s *structurer) reaches(b, header *Block) bool {
+	seen := map[*Block]bool{}
+	var visit func(c *Block) bool
+	visit = func(c *Block) bool {
+		if c == header {
+			return true
+		}
+		if seen[c] || !s.tree.Dominates(header, c) {
+			return false
+		}
+		seen[c] = true
+		for _, succ := range c.Succs {
+			if visit(succ) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(b)
+}
+
+// ifStatement returns the if statement with the branches then and
+// otherwise, which can be empty.
+func (s *structurer) ifStatement(condition IRExpression, then, otherwise []IR) []IR {
+	switch {
+	case len(then) > 0:
+		return []IR{statements.NewIR_If(condition, sequence(then), sequence(otherwise))}
+	case len(otherwise) > 0:
+		return []IR{statements.NewIR_If(expr.NewIR_Not(condition), sequence(otherwise), nil)}
+	case HasSideEffects(condition):
+		return []IR{s.discard(condition)}
+	}
+	return nil
+}
+
+// discard returns an assignment of e to a variable that isn't used, for
+// when only its evaluation matters.
+func (s *structurer) discard(e IRExpression) IR {
+	return statements.NewIR_Assignment(s.f.NewValue("__discard"), e)
+}
+
+// control returns the control expression of b with the names of the
+// values.
+func (s *structurer) control(b *Block) IRExpression {
+	return MapVariables(b.Control, func(name string) IRExpression {
+		return expr.NewIR_Variable(s.names.of(name))
+	})
+}
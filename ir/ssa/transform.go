@@ -0,0 +1,223 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// Transform lowers the program stmts and the functions that it defines into
+// SSA form, calls pass on each of them, and turns the result back into
+// statements for the encoders. The variables that the program declares
+// with var are globals, which the functions assign to as they are.
+func Transform(stmts []IR, pass func(*Func) error) ([]IR, error) {
+	globals := map[string]bool{}
+	for _, stmt := range stmts {
+		switch v := stmt.(type) {
+		case *statements.IR_Var:
+			globals[v.Name] = true
+		case *statements.IR_FunctionDef:
+			globals[v.Name] = true
+		}
+	}
+	functions := definedFunctions(stmts)
+	t := &transformer{
+		globals:   globals,
+		inlinable: functions,
+		pure:      pureFunctions(functions, globals),
+		pass:      pass,
+	}
+	f := Build(sequence(stmts), nil, globals)
+	f.Pure, f.Functions = t.pure, t.inlinable
+	if err := t.functions(f); err != nil {
+		return nil, err
+	}
+	body, err := t.run(f)
+	if err != nil {
+		return nil, err
+	}
+	return flattenAndThen(body), nil
+}
+
+type transformer struct {
+	globals   map[string]bool
+	inlinable map[string]*expr.IR_Function
+	pure      map[string]bool
+	pass      func(*Func) error
+}
+
+// run calls the pass on f and turns it back into statements.
+func (t *transformer) run(f *Func) (IR, error) {
+	if t.pass != nil {
+		if err := t.pass(f); err != nil {
+			return nil, err
+		}
+	}
+	return f.IR()
+}
+
+// functions transforms the bodies of the functions that f defines.
+func (t *transformer) functions(f *Func) error {
+	for _, b := range f.Blocks {
+		for i, instr := range b.Instrs {
+			switch v := instr.(type) {
+			case *statements.IR_FunctionDef:
+				fn, err := t.function(v.Expr)
+				if err != nil {
+					return err
+				}
+				def := statements.NewIR_FunctionDef(v.Name, fn)
+				def.Address = v.Address
+				b.Instrs[i] = def
+			case *statements.IR_Assignment:
+				if e, ok := v.Expr.(*expr.IR_Function); ok {
+					fn, err := t.function(e)
+					if err != nil {
+						return err
+					}
+					b.Instrs[i] = statements.NewIR_Assignment(v.Variable, fn)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (t *transformer) function(e *expr.IR_Function) (*expr.IR_Function, error) {
+	f := Build(e.Body, e.Signature.ArgNames, t.globals)
+	f.ParamTypes = e.Signature.Args
+	f.Pure, f.Functions = t.pure, t.inlinable
+	if err := t.functions(f); err != nil {
+		return nil, err
+	}
+	body, err := t.run(f)
+	if err != nil {
+		return nil, err
+	}
+	fn := expr.NewIR_Function(e.Signature, body)
+	fn.Inline = e.Inline
+	return fn, nil
+}
+
+// definedFunctions returns the functions that the program stmts defines at
+// the top, and that nothing else is assigned to anywhere in the program, so
+// that a call by their name always calls them.
+func definedFunctions(stmts []IR) map[string]*expr.IR_Function {
+	assigned := map[string]int{}
+	var visit func(stmt IR)
+	visit = func(stmt IR) {
+		switch v := stmt.(type) {
+		case *statements.IR_AndThen:
+			visit(v.Stmt1)
+			visit(v.Stmt2)
+		case *statements.IR_Assignment:
+			assigned[v.Variable]++
+			if e, ok := v.Expr.(*expr.IR_Function); ok {
+				visit(e.Body)
+			}
+		case *statements.IR_FunctionDef:
+			assigned[v.Name]++
+			visit(v.Expr.Body)
+		case *statements.IR_Var:
+			assigned[v.Name]++
+		case *statements.IR_If:
+			visit(v.Stmt1)
+			if v.Stmt2 != nil {
+				visit(v.Stmt2)
+			}
+		case *statements.IR_While:
+			visit(v.Stmt)
+		}
+	}
+	functions := map[string]*expr.IR_Function{}
+	for _, stmt := range flattenAndThen(sequence(stmts)) {
+		visit(stmt)
+		switch v := stmt.(type) {
+		case *statements.IR_FunctionDef:
+			functions[v.Name] = v.Expr
+		case *statements.IR_Assignment:
+			if e, ok := v.Expr.(*expr.IR_Function); ok {
+				functions[v.Variable] = e
+			}
+		}
+	}
+	for name := range functions {
+		if assigned[name] != 1 {
+			delete(functions, name)
+		}
+	}
+	return functions
+}
+
+// pureFunctions returns the functions that don't store to arrays or
+// globals, and only call functions that are pure as well. Recursive
+// functions are pure when nothing else in them isn't.
+func pureFunctions(functions map[string]*expr.IR_Function, globals map[string]bool) map[string]bool {
+	pure := map[string]bool{}
+	for name := range functions {
+		pure[name] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for name, fn := range functions {
+			if pure[name] && !pureStatement(fn.Body, pure, globals) {
+				pure[name] = false
+				changed = true
+			}
+		}
+	}
+	for name, ok := range pure {
+		if !ok {
+			delete(pure, name)
+		}
+	}
+	return pure
+}
+
+func pureStatement(stmt IR, pure, globals map[string]bool) bool {
+	switch v := stmt.(type) {
+	case *statements.IR_AndThen:
+		return pureStatement(v.Stmt1, pure, globals) && pureStatement(v.Stmt2, pure, globals)
+	case *statements.IR_Assignment:
+		return !globals[v.Variable] && pureExpression(v.Expr, pure)
+	case *statements.IR_CallStatement:
+		return pureExpression(v.Call, pure)
+	case *statements.IR_Return:
+		return pureExpression(v.Expr, pure)
+	case *statements.IR_If:
+		return pureExpression(v.Condition, pure) && pureStatement(v.Stmt1, pure, globals) &&
+			(v.Stmt2 == nil || pureStatement(v.Stmt2, pure, globals))
+	case *statements.IR_While:
+		return pureExpression(v.Condition, pure) && pureStatement(v.Stmt, pure, globals)
+	}
+	// Array assignments, declarations and function definitions.
+	return false
+}
+
+func pureExpression(e IRExpression, pure map[string]bool) bool {
+	switch v := e.(type) {
+	case *expr.IR_Syscall, *expr.IR_Function:
+		return false
+	case *expr.IR_Call:
+		if !pure[v.Function] {
+			return false
+		}
+	}
+	for _, op := range Operands(e) {
+		if !pureExpression(op, pure) {
+			return false
+		}
+	}
+	return true
+}
+
+// flattenAndThen returns the statements in the chain of IR_AndThen stmt.
+func flattenAndThen(stmt IR) []IR {
+	if stmt == nil {
+		return nil
+	}
+	if v, ok := stmt.(*statements.IR_AndThen); ok {
+		return append(flattenAndThen(v.Stmt1), flattenAndThen(v.Stmt2)...)
+	}
+	return []IR{stmt}
+}
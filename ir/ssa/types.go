@@ -0,0 +1,73 @@
+package ssa
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// valueTypes returns the types of the values of f that follow from the
+// types of the parameters and of the literals and casts that they're
+// computed from. Values that depend on globals, calls or arrays don't get
+// one.
+func (f *Func) valueTypes() map[string]Type {
+	types := map[string]Type{}
+	for i, param := range f.Params {
+		if i < len(f.ParamTypes) {
+			types[param] = f.ParamTypes[i]
+		}
+	}
+	set := func(name string, typ Type) bool {
+		if _, ok := types[name]; ok || typ == nil {
+			return false
+		}
+		types[name] = typ
+		return true
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, b := range f.Blocks {
+			for _, phi := range b.Phis {
+				for _, arg := range phi.Args {
+					if set(phi.Dest, typeOf(arg, types)) {
+						changed = true
+					}
+				}
+			}
+			for _, instr := range b.Instrs {
+				if def, ok := f.Def(instr); ok && set(def, typeOf(assignedExpression(instr), types)) {
+					changed = true
+				}
+			}
+		}
+	}
+	return types
+}
+
+// typeOf returns the type of e, or nil if it isn't known.
+func typeOf(e IRExpression, types map[string]Type) Type {
+	if c, ok := constantOf(e); ok {
+		return c.typ
+	}
+	switch v := e.(type) {
+	case *expr.IR_Variable:
+		return types[v.Value]
+	case *expr.IR_Cast:
+		return v.CastToType
+	case *expr.IR_Add, *expr.IR_Sub, *expr.IR_Mul, *expr.IR_Div, *expr.IR_MulHigh:
+		for _, op := range Operands(e) {
+			if typ := typeOf(op, types); typ != nil {
+				return typ
+			}
+		}
+	case *expr.IR_ShiftLeft:
+		return typeOf(v.Op1, types)
+	case *expr.IR_ShiftRight:
+		return typeOf(v.Op1, types)
+	case *expr.IR_Equals, *expr.IR_LT, *expr.IR_LTE, *expr.IR_GT, *expr.IR_GTE,
+		*expr.IR_Not, *expr.IR_And, *expr.IR_Or:
+		return TBool
+	case *expr.IR_Len:
+		return TInt64
+	}
+	return nil
+}
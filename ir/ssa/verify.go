@@ -0,0 +1,163 @@
+package ssa
+
+import (
+	"fmt"
+
+	"github.com/bspaans/jit-compiler/ir/statements"
+)
+
+// Verify checks that f is a well-formed control flow graph in SSA form:
+// the edges of the blocks match up, every value is defined once, and the
+// definition of every value dominates its uses. Passes run it on their
+// result in debug builds.
+//
+//goland:noinspection GoErrorStringFormat
+func (f *Func) Verify() error {
+	if f.Entry == nil || len(f.Blocks) == 0 || f.Blocks[0] != f.Entry {
+		return fmt.Errorf("The entry isn't the first block")
+	}
+	if len(f.Entry.Preds) > 0 {
+		return fmt.Errorf("The entry b%d has predecessors", f.Entry.ID)
+	}
+	inFunc := map[*Block]bool{}
+	ids := map[int]bool{}
+	for _, b := range f.Blocks {
+		if ids[b.ID] {
+			return fmt.Errorf("Block b%d appears more than once", b.ID)
+		}
+		ids[b.ID] = true
+		inFunc[b] = true
+	}
+	reachable := map[*Block]bool{}
+	var visit func(b *Block)
+	visit = func(b *Block) {
+		reachable[b] = true
+		for _, s := range b.Succs {
+			if !reachable[s] {
+				visit(s)
+			}
+		}
+	}
+	visit(f.Entry)
+
+	for _, b := range f.Blocks {
+		if !reachable[b] {
+			return fmt.Errorf("Block b%d isn't reachable", b.ID)
+		}
+		expected := map[BlockKind]int{BlockJump: 1, BlockIf: 2, BlockReturn: 0, BlockExit: 0}[b.Kind]
+		if len(b.Succs) != expected {
+			return fmt.Errorf("Block b%d has %d successors, expecting %d", b.ID, len(b.Succs), expected)
+		}
+		if b.Kind == BlockIf && b.Control == nil {
+			return fmt.Errorf("Block b%d doesn't have a condition", b.ID)
+		}
+		for _, s := range b.Succs {
+			if !inFunc[s] {
+				return fmt.Errorf("Successor b%d of b%d isn't in the function", s.ID, b.ID)
+			}
+			if countBlock(s.Preds, b) != countBlock(b.Succs, s) {
+				return fmt.Errorf("Edge from b%d to b%d isn't in the predecessors", b.ID, s.ID)
+			}
+		}
+		for _, p := range b.Preds {
+			if !inFunc[p] {
+				return fmt.Errorf("Predecessor b%d of b%d isn't in the function", p.ID, b.ID)
+			}
+			if countBlock(p.Succs, b) != countBlock(b.Preds, p) {
+				return fmt.Errorf("Edge from b%d to b%d isn't in the successors", p.ID, b.ID)
+			}
+		}
+		for _, phi := range b.Phis {
+			if len(phi.Args) != len(b.Preds) {
+				return fmt.Errorf("Phi for %s in b%d has %d arguments for %d predecessors", phi.Dest, b.ID, len(phi.Args), len(b.Preds))
+			}
+			for _, arg := range phi.Args {
+				if arg == nil {
+					return fmt.Errorf("Phi for %s in b%d is missing an argument", phi.Dest, b.ID)
+				}
+			}
+		}
+	}
+
+	// Find the definitions.
+	type definition struct {
+		block *Block
+		index int // -1 for phis and parameters
+	}
+	defs := map[string]definition{}
+	define := func(name string, def definition) error {
+		if !f.IsValue(name) {
+			return fmt.Errorf("%s is assigned in b%d, but isn't an SSA value", name, def.block.ID)
+		}
+		if _, ok := defs[name]; ok {
+			return fmt.Errorf("%s is assigned more than once", name)
+		}
+		defs[name] = def
+		return nil
+	}
+	for _, param := range f.Params {
+		defs[param] = definition{f.Entry, -1}
+	}
+	for _, b := range f.Blocks {
+		for _, phi := range b.Phis {
+			if err := define(phi.Dest, definition{b, -1}); err != nil {
+				return err
+			}
+		}
+		for i, instr := range b.Instrs {
+			if v, ok := instr.(*statements.IR_Assignment); ok && !f.Pinned[v.Variable] {
+				if err := define(v.Variable, definition{b, i}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Check that they dominate the uses.
+	tree := f.Dominators()
+	var err error
+	check := func(b *Block, index int, where string) func(name string) {
+		return func(name string) {
+			if err != nil || !f.IsValue(name) {
+				return
+			}
+			def, ok := defs[name]
+			switch {
+			case !ok:
+				err = fmt.Errorf("%s is used in %s, but never assigned", name, where)
+			case def.block == b && def.index >= index:
+				err = fmt.Errorf("%s is used in %s before it's assigned", name, where)
+			case !tree.Dominates(def.block, b):
+				err = fmt.Errorf("%s is used in %s, where its assignment in b%d doesn't dominate it", name, where, def.block.ID)
+			}
+		}
+	}
+	for _, b := range f.Blocks {
+		for i, instr := range b.Instrs {
+			Uses(instr, check(b, i, fmt.Sprintf("b%d: %s", b.ID, instr)))
+		}
+		if b.Control != nil {
+			Variables(b.Control, check(b, len(b.Instrs), fmt.Sprintf("the control of b%d", b.ID)))
+		}
+		for _, phi := range b.Phis {
+			for i, arg := range phi.Args {
+				p := b.Preds[i]
+				Variables(arg, check(p, len(p.Instrs)+1, fmt.Sprintf("the phi for %s in b%d", phi.Dest, b.ID)))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func countBlock(blocks []*Block, b *Block) int {
+	n := 0
+	for _, c := range blocks {
+		if c == b {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,37 @@
+package statements
+
+import (
+	"github.com/bspaans/jit-compiler/ir/expr"
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// IR_CallStatement calls a function for its side effects and discards the
+// result, if there is one.
+//
+//goland:noinspection GoSnakeCaseUsage
+type IR_CallStatement struct {
+	*BaseIR
+	Call *expr.IR_Call
+}
+
+//goland:noinspection GoSnakeCaseUsage
+func NewIR_CallStatement(call *expr.IR_Call) *IR_CallStatement {
+	return &IR_CallStatement{
+		BaseIR: NewBaseIR(CallStatement),
+		Call:   call,
+	}
+}
+
+func (i *IR_CallStatement) String() string {
+	return i.Call.String()
+}
+
+//goland:noinspection GoSnakeCaseUsage
+func (i *IR_CallStatement) SSA_Transform(ctx *SSA_Context) IR {
+	rewrites, call := i.Call.SSA_Transform(ctx)
+	ir := SSA_Rewrites_to_IR(rewrites)
+	if ir == nil {
+		return i
+	}
+	return NewIR_AndThen(ir, NewIR_CallStatement(call.(*expr.IR_Call)))
+}
@@ -0,0 +1,43 @@
+package statements
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// IR_Extern declares a host function, which is bound to a Go function when
+// the code is compiled. Functions that don't return a value have TVoid as
+// their return type.
+//
+//goland:noinspection GoSnakeCaseUsage
+type IR_Extern struct {
+	*BaseIR
+	Name      string
+	Signature *TFunction
+}
+
+//goland:noinspection GoSnakeCaseUsage
+func NewIR_Extern(name string, signature *TFunction) *IR_Extern {
+	return &IR_Extern{
+		BaseIR:    NewBaseIR(Extern),
+		Name:      name,
+		Signature: signature,
+	}
+}
+
+func (i *IR_Extern) String() string {
+	args := []string{}
+	for j, arg := range i.Signature.ArgNames {
+		args = append(args, arg+" "+i.Signature.Args[j].String())
+	}
+	if i.Signature.ReturnType == TVoid {
+		return fmt.Sprintf("extern func %s(%s)", i.Name, strings.Join(args, ", "))
+	}
+	return fmt.Sprintf("extern func %s(%s) %s", i.Name, strings.Join(args, ", "), i.Signature.ReturnType)
+}
+
+func (i *IR_Extern) SSA_Transform(ctx *SSA_Context) IR {
+	return i
+}
@@ -28,7 +28,7 @@ func (i *IR_FunctionDef) String() string {
 	for j, arg := range i.Expr.Signature.ArgNames {
 		args = append(args, arg+" "+i.Expr.Signature.Args[j].String())
 	}
-	return fmt.Sprintf("func %s(%s) %s { %s }", i.Name, strings.Join(args, ", "), i.Expr.Signature.ReturnType.String(), i.Expr.Body.String())
+	return fmt.Sprintf("%sfunc %s(%s) %s { %s }", i.Expr.Inline, i.Name, strings.Join(args, ", "), i.Expr.Signature.ReturnType.String(), i.Expr.Body.String())
 }
 
 func (i *IR_FunctionDef) SSA_Transform(ctx *SSA_Context) IR {
@@ -10,7 +10,8 @@ type IR_If struct {
 	*BaseIR
 	Condition IRExpression
 	Stmt1     IR
-	Stmt2     IR
+	// Stmt2 is the else branch, or nil if there's none.
+	Stmt2 IR
 }
 
 func NewIR_If(condition IRExpression, stmt1, stmt2 IR) *IR_If {
@@ -23,15 +24,22 @@ func NewIR_If(condition IRExpression, stmt1, stmt2 IR) *IR_If {
 }
 
 func (i *IR_If) String() string {
+	if i.Stmt2 == nil {
+		return fmt.Sprintf("if %s { %s }", i.Condition.String(), i.Stmt1.String())
+	}
 	return fmt.Sprintf("if %s { %s } else { %s }", i.Condition.String(), i.Stmt1.String(), i.Stmt2.String())
 }
 
 func (i *IR_If) SSA_Transform(ctx *SSA_Context) IR {
 	rewrites, expr := i.Condition.SSA_Transform(ctx)
 	ir := SSA_Rewrites_to_IR(rewrites)
+	var stmt2 IR
+	if i.Stmt2 != nil {
+		stmt2 = i.Stmt2.SSA_Transform(ctx)
+	}
 	if ir == nil {
-		return NewIR_If(i.Condition, i.Stmt1.SSA_Transform(ctx), i.Stmt2.SSA_Transform(ctx))
+		return NewIR_If(i.Condition, i.Stmt1.SSA_Transform(ctx), stmt2)
 	} else {
-		return NewIR_AndThen(ir, NewIR_If(expr, i.Stmt1.SSA_Transform(ctx), i.Stmt2.SSA_Transform(ctx)))
+		return NewIR_AndThen(ir, NewIR_If(expr, i.Stmt1.SSA_Transform(ctx), stmt2))
 	}
 }
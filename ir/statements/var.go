@@ -0,0 +1,39 @@
+package statements
+
+import (
+	"fmt"
+
+	. "github.com/bspaans/jit-compiler/ir/shared"
+)
+
+// IR_Var declares a global variable, which is initialised with Value, or
+// zero when Value is nil.
+//
+//goland:noinspection GoSnakeCaseUsage
+type IR_Var struct {
+	*BaseIR
+	Name         string
+	VariableType Type
+	Value        IRExpression
+}
+
+//goland:noinspection GoSnakeCaseUsage
+func NewIR_Var(name string, typ Type, value IRExpression) *IR_Var {
+	return &IR_Var{
+		BaseIR:       NewBaseIR(Var),
+		Name:         name,
+		VariableType: typ,
+		Value:        value,
+	}
+}
+
+func (i *IR_Var) String() string {
+	if i.Value == nil {
+		return fmt.Sprintf("var %s %s", i.Name, i.VariableType)
+	}
+	return fmt.Sprintf("var %s %s = %s", i.Name, i.VariableType, i.Value)
+}
+
+func (i *IR_Var) SSA_Transform(ctx *SSA_Context) IR {
+	return i
+}
@@ -4,10 +4,68 @@ package lib
 // This must be initialized in init() function in architecture-specific arch_*.go file which is guarded by build tag.
 var newArchContext func() archContext
 
+// callEngine holds the state shared between the Go caller and the compiled
+// code. The compiled code keeps a pointer to it in a reserved register (R13
+// on amd64) and accesses its fields at the CallEngine*Offset constants below.
 type callEngine struct {
-	i64 int64
+	// stackPointer is the stack pointer on entry of nativecall. The trap
+	// handler restores it to return to the Go caller from anywhere in the
+	// compiled code.
+	stackPointer uintptr
+	// trapHandler is the address of the shared code that returns to the Go
+	// caller after a trap; see trapHandler in arch_amd64.s.
+	trapHandler uintptr
+	// trapCode and trapPosition are set by compiled code before it jumps to
+	// the trap handler.
+	trapCode     TrapCode
+	trapPosition uint64
+	// faultSignal and faultOffset are set by the fault handler when the
+	// compiled code raises a hardware fault (trapCode is TrapFault then);
+	// see fault_linux_amd64.s.
+	faultSignal uint64
+	faultOffset uint64
+	// fuel is decremented by code compiled with fuel checks, which traps
+	// when it drops below zero.
+	fuel int64
+	// hostExit is the address of the code that compiled code calls to run
+	// the host function with index hostFunction; see hostExit in
+	// arch_amd64.s.
+	hostExit     uintptr
+	hostFunction uint64
+	// jitStackPointer is the stack that callFunction switches to before
+	// calling the compiled code. hostExit saves the stack pointer of the
+	// compiled code in it, so that resumeFunction can switch back to it.
+	jitStackPointer uintptr
+	// intArgs and floatArgs are loaded into the argument registers by
+	// callFunction, which stores the return registers in intResult and
+	// floatResult after the call.
+	intArgs     [6]uint64
+	floatArgs   [8]float64
+	intResult   uint64
+	floatResult float64
+	// faultAddress is the address that the compiled code accessed when it
+	// raised a hardware fault, set by the fault handler with faultSignal.
+	faultAddress uintptr
 }
 
+// Offsets of the callEngine fields that compiled code accesses.
+const (
+	CallEngineStackPointerOffset = 0
+	CallEngineTrapHandlerOffset  = 8
+	CallEngineTrapCodeOffset     = 16
+	CallEngineTrapPositionOffset = 24
+	CallEngineFuelOffset         = 48
+	CallEngineHostExitOffset     = 56
+	CallEngineHostFunctionOffset = 64
+)
+
+// Values returned by nativecall, callFunction and resumeFunction.
+const (
+	exitTrap     = 0
+	exitReturn   = 1
+	exitHostCall = 2
+)
+
 type ModuleInstance struct {
 	i64 int64
 }
@@ -17,3 +75,22 @@ type ModuleInstance struct {
 //
 // Note: this is implemented in per-arch Go assembler file. For example, arch_amd64.s implements this for amd64.
 func nativecall(codeSegment uintptr, ce *callEngine) int
+
+// callFunction calls the function at codeSegment following the System V AMD64
+// calling convention, with the arguments in ce.intArgs and ce.floatArgs. The
+// results are stored in ce.intResult and ce.floatResult. Like nativecall it
+// returns exitTrap when the code trapped, and it returns exitHostCall when the
+// code called a host function, with its arguments in ce.intArgs and
+// ce.floatArgs.
+//
+// Note: this is implemented in per-arch Go assembler file, but only supported on
+// amd64.
+func callFunction(codeSegment uintptr, ce *callEngine) int
+
+// resumeFunction continues running the compiled code at stackPointer after a
+// host function returned with the results in ce.intResult and
+// ce.floatResult. It returns like the callFunction that it continues.
+//
+// Note: this is implemented in per-arch Go assembler file, but only supported on
+// amd64.
+func resumeFunction(stackPointer uintptr, ce *callEngine) int
@@ -11,3 +11,10 @@ type archContext struct{}
 
 // newArchContextImpl implements newArchContext for amd64 architecture.
 func newArchContextImpl() (ret archContext) { return }
+
+// trapHandler is implemented in arch_amd64.s and is never called from Go.
+func trapHandler()
+
+// hostExit is implemented in arch_amd64.s and is only called from compiled
+// code.
+func hostExit()
@@ -4,5 +4,84 @@
 // nativecall(codeSegment, ce)
 TEXT ·nativecall(SB), NOSPLIT|NOFRAME, $0-24
 	MOVQ ce+8(FP), R13                     // Load the address of *callEngine. into amd64ReservedRegisterForCallEngine.
+	MOVQ SP, 0(R13)                        // Save the stack pointer in callEngine.stackPointer for the trap handler.
+	LEAQ ·trapHandler(SB), AX
+	MOVQ AX, 8(R13)                        // Store the address of the trap handler in callEngine.trapHandler.
 	MOVQ codeSegment+0(FP), AX             // Load the address of native code.
 	JMP  AX                                // Jump to native code.
+
+// trapHandler is jumped to by compiled code that traps, after it stored the
+// trap code and position in the callEngine. It unwinds the stack back to the
+// caller of nativecall, which then finds the trap in the callEngine.
+TEXT ·trapHandler(SB), NOSPLIT|NOFRAME, $0-0
+	MOVQ 0(R13), SP                        // Restore the stack pointer from callEngine.stackPointer.
+	MOVQ $0, 24(SP)                        // Return 0 from nativecall or callFunction.
+	RET
+
+// callFunction(codeSegment, ce)
+TEXT ·callFunction(SB), NOSPLIT|NOFRAME, $0-24
+	MOVQ ce+8(FP), R13                     // Load the address of *callEngine.
+	MOVQ SP, 0(R13)                        // Save the stack pointer in callEngine.stackPointer for the trap handler.
+	LEAQ ·trapHandler(SB), AX
+	MOVQ AX, 8(R13)                        // Store the address of the trap handler in callEngine.trapHandler.
+	LEAQ ·hostExit(SB), AX
+	MOVQ AX, 56(R13)                       // Store the address of hostExit in callEngine.hostExit.
+	MOVQ 80(R13), DI                       // Load callEngine.intArgs into the integer argument registers.
+	MOVQ 88(R13), SI
+	MOVQ 96(R13), DX
+	MOVQ 104(R13), CX
+	MOVQ 112(R13), R8
+	MOVQ 120(R13), R9
+	MOVSD 128(R13), X0                     // Load callEngine.floatArgs into the float argument registers.
+	MOVSD 136(R13), X1
+	MOVSD 144(R13), X2
+	MOVSD 152(R13), X3
+	MOVSD 160(R13), X4
+	MOVSD 168(R13), X5
+	MOVSD 176(R13), X6
+	MOVSD 184(R13), X7
+	MOVQ codeSegment+0(FP), AX             // Load the address of the function.
+	MOVQ 72(R13), SP                       // Switch to the stack at callEngine.jitStackPointer.
+	ANDQ $~15, SP                          // Align the stack to 16 bytes for the call.
+	CALL AX
+	MOVQ AX, 192(R13)                      // Store the results in callEngine.intResult and floatResult.
+	MOVSD X0, 200(R13)
+	MOVQ 0(R13), SP                        // Restore the stack pointer, of callFunction or resumeFunction.
+	MOVQ $1, ret+16(FP)
+	RET
+
+// hostExit is called by compiled code to call the host function whose index
+// it stored in callEngine.hostFunction. It stores the argument registers in
+// the callEngine and returns exitHostCall to the caller of callFunction or
+// resumeFunction, which calls the host function and then resumes the
+// compiled code with resumeFunction. The stack of the compiled code is left
+// as it is, so this only works when it isn't the goroutine's stack.
+TEXT ·hostExit(SB), NOSPLIT|NOFRAME, $0-0
+	MOVQ DI, 80(R13)                       // Store the integer argument registers in callEngine.intArgs.
+	MOVQ SI, 88(R13)
+	MOVQ DX, 96(R13)
+	MOVQ CX, 104(R13)
+	MOVQ R8, 112(R13)
+	MOVQ R9, 120(R13)
+	MOVSD X0, 128(R13)                     // Store the float argument registers in callEngine.floatArgs.
+	MOVSD X1, 136(R13)
+	MOVSD X2, 144(R13)
+	MOVSD X3, 152(R13)
+	MOVSD X4, 160(R13)
+	MOVSD X5, 168(R13)
+	MOVSD X6, 176(R13)
+	MOVSD X7, 184(R13)
+	MOVQ SP, 72(R13)                       // Save the stack pointer of the compiled code in callEngine.jitStackPointer.
+	MOVQ 0(R13), SP                        // Restore the stack pointer of the Go caller.
+	MOVQ $2, 24(SP)                        // Return exitHostCall from callFunction or resumeFunction.
+	RET
+
+// resumeFunction(stackPointer, ce)
+TEXT ·resumeFunction(SB), NOSPLIT|NOFRAME, $0-24
+	MOVQ $0, ret+16(FP)                    // Overwritten when the code returns or exits again.
+	MOVQ ce+8(FP), R13                     // Load the address of *callEngine.
+	MOVQ SP, 0(R13)                        // Save the stack pointer; the code returns here from now on.
+	MOVQ 192(R13), AX                      // Load the results of the host function.
+	MOVSD 200(R13), X0
+	MOVQ stackPointer+0(FP), SP            // Switch back to the stack of the compiled code.
+	RET                                    // Return from hostExit.
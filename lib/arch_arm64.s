@@ -16,3 +16,15 @@ TEXT ·nativecall(SB), NOSPLIT|NOFRAME, $0-24
 
 	// Jump to native code.
 	JMP (R1)
+
+// callFunction(codeSegment, ce) is not supported on arm64.
+TEXT ·callFunction(SB), NOSPLIT|NOFRAME, $0-24
+	MOVD $0, R0
+	MOVD R0, ret+16(FP)
+	RET
+
+// resumeFunction(stackPointer, ce) is not supported on arm64.
+TEXT ·resumeFunction(SB), NOSPLIT|NOFRAME, $0-24
+	MOVD $0, R0
+	MOVD R0, ret+16(FP)
+	RET
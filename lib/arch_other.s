@@ -1,3 +1,7 @@
 //go:build !arm64 && !amd64
 
 TEXT ·nativecall(SB), $0-16
+
+TEXT ·callFunction(SB), $0-24
+
+TEXT ·resumeFunction(SB), $0-24
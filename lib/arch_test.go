@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+func Test_CallEngineOffsets(t *testing.T) {
+	var ce callEngine
+	offsets := []struct {
+		name     string
+		actual   uintptr
+		expected uintptr
+	}{
+		{"stackPointer", unsafe.Offsetof(ce.stackPointer), CallEngineStackPointerOffset},
+		{"trapHandler", unsafe.Offsetof(ce.trapHandler), CallEngineTrapHandlerOffset},
+		{"trapCode", unsafe.Offsetof(ce.trapCode), CallEngineTrapCodeOffset},
+		{"trapPosition", unsafe.Offsetof(ce.trapPosition), CallEngineTrapPositionOffset},
+		{"fuel", unsafe.Offsetof(ce.fuel), CallEngineFuelOffset},
+		{"hostExit", unsafe.Offsetof(ce.hostExit), CallEngineHostExitOffset},
+		{"hostFunction", unsafe.Offsetof(ce.hostFunction), CallEngineHostFunctionOffset},
+		// The following offsets are hard coded in callFunction.
+		{"jitStackPointer", unsafe.Offsetof(ce.jitStackPointer), 72},
+		{"intArgs", unsafe.Offsetof(ce.intArgs), 80},
+		{"floatArgs", unsafe.Offsetof(ce.floatArgs), 128},
+		{"intResult", unsafe.Offsetof(ce.intResult), 192},
+		{"floatResult", unsafe.Offsetof(ce.floatResult), 200},
+	}
+	for _, o := range offsets {
+		if o.actual != o.expected {
+			t.Errorf("Expecting callEngine.%s at offset %d, got %d", o.name, o.expected, o.actual)
+		}
+	}
+}
+
+func Test_CallFunction(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("CallFunction is only supported on amd64")
+	}
+	code := MachineCode{
+		// mov %rdi, %rax; add %r9, %rax; ret
+		0x48, 0x89, 0xf8, 0x4c, 0x01, 0xc8, 0xc3,
+		// addsd %xmm7, %xmm0; ret
+		0xf2, 0x0f, 0x58, 0xc7, 0xc3,
+	}
+	intResult, _, err := code.CallFunction(0, []uint64{40, 0, 0, 0, 0, 2}, nil)
+	if err != nil || intResult != 42 {
+		t.Errorf("Expecting 42 got %d, %v", intResult, err)
+	}
+	_, floatResult, err := code.CallFunction(7, nil, []float64{1.5, 0, 0, 0, 0, 0, 0, 2.25})
+	if err != nil || floatResult != 3.75 {
+		t.Errorf("Expecting 3.75 got %f, %v", floatResult, err)
+	}
+	if _, _, err := code.CallFunction(0, make([]uint64, MaxIntArgs+1), nil); err == nil {
+		t.Error("Expecting an error for too many arguments")
+	}
+}
+
+func Test_CallFunction_HostFunctions(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("CallFunction is only supported on amd64")
+	}
+	program := &Program{
+		MachineCode: MachineCode{
+			// push %rdi
+			0x57,
+			// movq $0, 0x40(%r13); call *0x38(%r13)
+			0x49, 0xc7, 0x45, 0x40, 0x00, 0x00, 0x00, 0x00, 0x41, 0xff, 0x55, 0x38,
+			// mov %rax, %rdi
+			0x48, 0x89, 0xc7,
+			// movq $1, 0x40(%r13); call *0x38(%r13)
+			0x49, 0xc7, 0x45, 0x40, 0x01, 0x00, 0x00, 0x00, 0x41, 0xff, 0x55, 0x38,
+			// pop %rdi; add %rdi, %rax; ret
+			0x5f, 0x48, 0x01, 0xf8, 0xc3,
+		},
+		HostFunctions: []HostFunction{
+			func(intArgs []uint64, floatArgs []float64) (uint64, float64) {
+				return intArgs[0] * 2, 0
+			},
+			func(intArgs []uint64, floatArgs []float64) (uint64, float64) {
+				return intArgs[0] + 1, 0
+			},
+		},
+	}
+	intResult, _, err := program.CallFunction(0, []uint64{20}, nil)
+	if err != nil || intResult != 61 {
+		t.Errorf("Expecting 61 got %d, %v", intResult, err)
+	}
+}
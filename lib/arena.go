@@ -0,0 +1,197 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/bspaans/jit-compiler/platform"
+)
+
+// ErrArenaClosed is returned when loading code into a closed Arena.
+var ErrArenaClosed = errors.New("Arena is closed")
+
+// SlotAlignment is the alignment of code in an Arena. Code that embeds data
+// starts at a page boundary instead.
+const SlotAlignment = 64
+
+// Arena is a single code mapping that holds many programs, so that small
+// functions don't each take up a page of their own. Programs get a slot in
+// the arena when they're loaded, and the slot is reused after the returned
+// Executable is closed.
+//
+// The arena grows with platform.RemapCodeSegment when it runs out of space,
+// which moves the mapping. Compiled code only addresses itself relative to
+// the instruction pointer, so slots keep working at their new address; entry
+// points are given out as offsets into the slot for that reason. Loading
+// waits for running calls in the arena to return.
+type Arena struct {
+	// mu is held for reading during calls, and for writing while code is
+	// copied in or the mapping moves.
+	mu     sync.RWMutex
+	code   []byte
+	unused freeList
+	// live holds the ranges of the loaded programs and where their code
+	// starts.
+	live   map[int]arenaRange
+	closed bool
+}
+
+type arenaRange struct {
+	offset, size int
+	// codeStart is the offset at which the read-exec part of a live range
+	// starts.
+	codeStart int
+}
+
+func (r arenaRange) end() int {
+	return r.offset + r.size
+}
+
+// NewArena maps an arena of at least size bytes.
+func NewArena(size int) (*Arena, error) {
+	size = roundUp(size, os.Getpagesize())
+	code, err := platform.MmapCodeSegment(size)
+	if err != nil {
+		return nil, fmt.Errorf("mmap err: %v", err)
+	}
+	return &Arena{
+		code:   code,
+		unused: freeList{{offset: 0, size: size}},
+		live:   map[int]arenaRange{},
+	}, nil
+}
+
+// Size returns the size of the mapping in bytes.
+func (a *Arena) Size() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.code)
+}
+
+// Load copies the program into a free slot, growing the arena if there is
+// none.
+//
+//goland:noinspection GoErrorStringFormat
+func (a *Arena) Load(p *Program) (*Executable, error) {
+	if err := validateLayout(p.MachineCode, p.DataEnd, p.Entry); err != nil {
+		return nil, err
+	}
+	if p.Reserve > 0 {
+		return nil, fmt.Errorf("Can't reserve space for patches in an arena")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, ErrArenaClosed
+	}
+	alignment := SlotAlignment
+	if p.DataEnd > 0 {
+		alignment = os.Getpagesize()
+	}
+	offset, ok := a.unused.allocate(len(p.MachineCode), alignment)
+	if !ok {
+		if err := a.grow(len(p.MachineCode) + alignment); err != nil {
+			return nil, err
+		}
+		offset, _ = a.unused.allocate(len(p.MachineCode), alignment)
+	}
+	slot := arenaRange{offset: offset, size: len(p.MachineCode), codeStart: offset + p.DataEnd}
+	if err := a.write(slot, p.MachineCode); err != nil {
+		a.unused.release(offset, slot.size)
+		return nil, err
+	}
+	a.live[offset] = slot
+	e := &Executable{
+		arena:   a,
+		offset:  offset,
+		size:    slot.size,
+		dataEnd: p.DataEnd,
+		entry:   p.Entry,
+
+		capacity:      slot.size,
+		hostFunctions: p.HostFunctions,
+	}
+	runtime.SetFinalizer(e, (*Executable).Close)
+	return e, nil
+}
+
+// Close unmaps the arena. Executables that are still loaded return ErrClosed
+// afterwards.
+func (a *Arena) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	return platform.MunmapCodeSegment(a.code)
+}
+
+// free returns the slot at offset to the arena.
+func (a *Arena) free(offset, size int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	delete(a.live, offset)
+	a.unused.release(offset, size)
+}
+
+// grow remaps the arena so that it has a free range of at least size bytes
+// at the end.
+func (a *Arena) grow(size int) error {
+	oldSize := len(a.code)
+	newSize := roundUp(oldSize+size, os.Getpagesize())
+	if newSize < 2*oldSize {
+		newSize = 2 * oldSize
+	}
+	code, err := platform.RemapCodeSegment(a.code, newSize)
+	if err != nil {
+		return fmt.Errorf("mremap err: %v", err)
+	}
+	a.code = code
+	// The new mapping is read-write, so the code has to be made read-exec
+	// again.
+	for _, slot := range a.live {
+		if err := a.protectCode(slot); err != nil {
+			return err
+		}
+	}
+	a.unused.release(oldSize, newSize-oldSize)
+	return nil
+}
+
+// write copies m into slot. The pages it touches are made writable first;
+// they may hold code of other slots, but nothing runs while the arena is
+// locked for writing.
+func (a *Arena) write(slot arenaRange, m MachineCode) error {
+	pages := a.pages(slot.offset, slot.end())
+	if err := platform.MprotectRW(pages); err != nil {
+		return fmt.Errorf("mprotect err: %v", err)
+	}
+	copy(a.code[slot.offset:], m)
+	return a.protectCode(slot)
+}
+
+// protectCode makes the code of slot read-exec. Data only ever takes up
+// whole pages of its own, so this never affects the data of another slot.
+func (a *Arena) protectCode(slot arenaRange) error {
+	if err := platform.MprotectRX(a.pages(slot.codeStart, slot.end())); err != nil {
+		return fmt.Errorf("mprotect err: %v", err)
+	}
+	return nil
+}
+
+// pages returns the pages that overlap [start, end).
+func (a *Arena) pages(start, end int) []byte {
+	pageSize := os.Getpagesize()
+	return a.code[start/pageSize*pageSize : roundUp(end, pageSize)]
+}
+
+func roundUp(n, alignment int) int {
+	return (n + alignment - 1) / alignment * alignment
+}
@@ -0,0 +1,172 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"unsafe"
+)
+
+// addFunction returns code that returns its first argument plus n.
+func addFunction(n uint8) *Program {
+	// mov %rdi, %rax; add $n, %rax; ret
+	return &Program{MachineCode: MachineCode{0x48, 0x89, 0xf8, 0x48, 0x83, 0xc0, n, 0xc3}}
+}
+
+func Test_Arena(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("CallFunction is only supported on amd64")
+	}
+	arena, err := NewArena(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer arena.Close()
+	pageSize := os.Getpagesize()
+	if arena.Size() != pageSize {
+		t.Fatalf("Expecting a page, got %d bytes", arena.Size())
+	}
+
+	// Load enough functions to make the arena grow a couple of times.
+	var functions []*Executable
+	for i := 0; i < 4*pageSize/SlotAlignment; i++ {
+		e, err := arena.Load(addFunction(uint8(i % 100)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		functions = append(functions, e)
+	}
+	size := arena.Size()
+	if size < 4*pageSize {
+		t.Fatalf("Expecting the arena to grow to at least %d bytes, got %d", 4*pageSize, size)
+	}
+	for i, e := range functions {
+		if result, _, err := e.CallFunction(0, []uint64{1000}, nil); err != nil || result != uint64(1000+i%100) {
+			t.Fatalf("Expecting %d got %d, %v", 1000+i%100, result, err)
+		}
+	}
+
+	// Closed slots get reused.
+	for _, e := range functions[:len(functions)/2] {
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < len(functions)/2; i++ {
+		e, err := arena.Load(addFunction(7))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, _, err := e.CallFunction(0, []uint64{1}, nil); err != nil || result != 8 {
+			t.Fatalf("Expecting 8 got %d, %v", result, err)
+		}
+	}
+	if arena.Size() != size {
+		t.Errorf("Expecting closed slots to be reused, but the arena grew from %d to %d bytes", size, arena.Size())
+	}
+
+	// Data gets pages of its own.
+	program := &Program{
+		MachineCode: append(make(MachineCode, pageSize), addFunction(2).MachineCode...),
+		DataEnd:     pageSize,
+		Entry:       pageSize,
+	}
+	e, err := arena.Load(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, _, err := e.CallFunction(pageSize, []uint64{40}, nil); err != nil || result != 42 {
+		t.Errorf("Expecting 42 got %d, %v", result, err)
+	}
+	code, release, err := e.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPerms := mappingPermissions(t, uintptr(unsafe.Pointer(&code[0])))
+	codePerms := mappingPermissions(t, uintptr(unsafe.Pointer(&code[pageSize])))
+	release()
+	if dataPerms[:3] != "rw-" || codePerms[:3] != "r-x" {
+		t.Errorf("Expecting rw- data and r-x code, got %s and %s", dataPerms, codePerms)
+	}
+
+	if err := arena.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.CallFunction(pageSize, nil, nil); !errors.Is(err, ErrClosed) {
+		t.Error("Expecting ErrClosed got", err)
+	}
+	if _, err := arena.Load(addFunction(1)); !errors.Is(err, ErrArenaClosed) {
+		t.Error("Expecting ErrArenaClosed got", err)
+	}
+}
+
+func Benchmark_LoadClose(b *testing.B) {
+	const functions = 256
+	b.Run("mmap", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			loaded := make([]*Executable, functions)
+			for j := range loaded {
+				e, err := addFunction(uint8(j)).Load()
+				if err != nil {
+					b.Fatal(err)
+				}
+				loaded[j] = e
+			}
+			for _, e := range loaded {
+				e.Close()
+			}
+		}
+		b.ReportMetric(float64(os.Getpagesize()), "mapped-bytes/func")
+	})
+	b.Run("arena", func(b *testing.B) {
+		arena, err := NewArena(1)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer arena.Close()
+		for i := 0; i < b.N; i++ {
+			loaded := make([]*Executable, functions)
+			for j := range loaded {
+				e, err := arena.Load(addFunction(uint8(j)))
+				if err != nil {
+					b.Fatal(err)
+				}
+				loaded[j] = e
+			}
+			for _, e := range loaded {
+				e.Close()
+			}
+		}
+		b.ReportMetric(float64(arena.Size())/functions, "mapped-bytes/func")
+	})
+}
+
+func Benchmark_Call(b *testing.B) {
+	if runtime.GOARCH != "amd64" {
+		b.Skip("CallFunction is only supported on amd64")
+	}
+	arena, err := NewArena(1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer arena.Close()
+	inArena, err := arena.Load(addFunction(1))
+	if err != nil {
+		b.Fatal(err)
+	}
+	mapped, err := addFunction(1).Load()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer mapped.Close()
+	for name, e := range map[string]*Executable{"mmap": mapped, "arena": inArena} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := e.CallFunction(0, []uint64{1}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
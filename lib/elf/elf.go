@@ -112,33 +112,51 @@ func (e *ELF) GetSection(name string) *Section {
 	return nil
 }
 
+// PageSize is the alignment of the segments in binaries made by
+// CreateTinyBinary.
+const PageSize = 0x1000
+
 // CreateTinyBinary Demo function.
-// Don't use this in anything serious: it puts data in an executable segment.
-func CreateTinyBinary(m []uint8, path string) error {
+// The machine code m holds writable data up to dataEnd, which gets mapped
+// read-write, followed by code that gets mapped read-exec; no segment is ever
+// writable and executable. dataEnd must be a multiple of PageSize. The
+// program starts at entry.
+//
+//goland:noinspection GoErrorStringFormat
+func CreateTinyBinary(m []uint8, dataEnd, entry int, path string) error {
+	if dataEnd%PageSize != 0 || dataEnd > len(m) || entry < dataEnd || entry >= len(m) {
+		return fmt.Errorf("Invalid layout: data ends at 0x%x and code starts at 0x%x in %d bytes", dataEnd, entry, len(m))
+	}
 	elf := NewELF()
 	elf.ELFHeader = NewELFHeader()
 
-	programHeaderEntrySize := ProgramHeaderSize64
-	headerSize := uint16(64)
-	addr := Elf64_Addr(0x400000)
-	size := uint64(headerSize+programHeaderEntrySize) + uint64(len(m))
-
-	elf.Entry = addr + Elf64_Addr(headerSize+programHeaderEntrySize)
-
-	ph := NewProgramHeader(PT_LOAD, PF_RWX)
-	ph.Offset = Elf64_Off(0)
-	ph.SegmentVirtualAddress = addr
-	ph.SegmentPhysicalAddress = addr
-	ph.Filesize = size
-	ph.Memsize = size
-	ph.Align = size
-	elf.ProgramHeaders = ProgramHeaderTable{ph}
+	// The headers take up the first page of the file and aren't loaded;
+	// m follows at the next page.
+	offset := Elf64_Off(PageSize)
+	addr := Elf64_Addr(0x400000) + Elf64_Addr(offset)
+	elf.Entry = addr + Elf64_Addr(entry)
+
+	segment := func(flags PHFlags, start, end int) *ProgramHeader {
+		ph := NewProgramHeader(PT_LOAD, flags)
+		ph.Offset = offset + Elf64_Off(start)
+		ph.SegmentVirtualAddress = addr + Elf64_Addr(start)
+		ph.SegmentPhysicalAddress = addr + Elf64_Addr(start)
+		ph.Filesize = uint64(end - start)
+		ph.Memsize = uint64(end - start)
+		ph.Align = PageSize
+		return ph
+	}
+	if dataEnd > 0 {
+		elf.ProgramHeaders = append(elf.ProgramHeaders, segment(PF_RW, 0, dataEnd))
+	}
+	elf.ProgramHeaders = append(elf.ProgramHeaders, segment(PF_RX, dataEnd, len(m)))
+
 	result, err := elf.EncodeHeaders()
 	if err != nil {
 		return err
 	}
+	result = append(result, make([]uint8, int(offset)-len(result))...)
 	result = append(result, m...)
-	fmt.Println(len(result), size)
 
 	elfReloaded, err := ParseELF(bytes.NewReader(result))
 	if err != nil {
@@ -3,6 +3,9 @@ package elf
 import (
 	"bytes"
 	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -106,3 +109,36 @@ func Test_ELF_encode(t *testing.T) {
 		t.Errorf("Wrong ph offset %v", parsedHeader.ProgramHeaderTableOffset)
 	}
 }
+
+func Test_CreateTinyBinary_is_never_writable_and_executable(t *testing.T) {
+	// A page of data followed by: mov $60, %eax; xor %edi, %edi; syscall
+	code := append(make([]uint8, PageSize), 0xb8, 0x3c, 0x00, 0x00, 0x00, 0x31, 0xff, 0x0f, 0x05)
+	path := filepath.Join(t.TempDir(), "tiny")
+	if err := CreateTinyBinary(code, PageSize, PageSize, path); err != nil {
+		t.Fatal(err)
+	}
+	elf, err := ParseELFFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(elf.ProgramHeaders) != 2 {
+		t.Fatalf("Expecting a data and a code segment, got %v", elf.ProgramHeaders)
+	}
+	if flags := elf.ProgramHeaders[0].Flags; flags != PF_RW {
+		t.Errorf("Expecting the data segment to be %v, got %v", PF_RW, flags)
+	}
+	if flags := elf.ProgramHeaders[1].Flags; flags != PF_RX {
+		t.Errorf("Expecting the code segment to be %v, got %v", PF_RX, flags)
+	}
+	if entry := elf.ProgramHeaders[1].SegmentVirtualAddress; elf.Entry != Elf64_Addr(entry) {
+		t.Errorf("Expecting the entry point at 0x%x, got 0x%x", entry, elf.Entry)
+	}
+	if err := CreateTinyBinary(code, 1, PageSize, path); err == nil {
+		t.Error("Expecting an error for unaligned data")
+	}
+	if runtime.GOOS == "linux" && runtime.GOARCH == "amd64" {
+		if err := exec.Command(path).Run(); err != nil {
+			t.Error("Expecting the binary to exit cleanly, got", err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/bspaans/jit-compiler/platform"
+)
+
+// ErrClosed is returned when calling into an Executable after Close.
+var ErrClosed = errors.New("Executable is closed")
+
+// Executable is machine code that has been mapped into executable memory
+// once, so that it can be run many times. Close releases the memory; an
+// Executable that becomes unreachable without being closed is released by
+// the garbage collector.
+type Executable struct {
+	// mu is held for reading during calls, so that Close waits for them.
+	mu     sync.RWMutex
+	closed bool
+	// code is the memory that the Executable mapped, or nil when it
+	// lives in an Arena, at offset.
+	code   []byte
+	arena  *Arena
+	offset int
+	size   int
+	// dataEnd is the offset at which the read-exec pages start.
+	dataEnd int
+	// entry is the offset that Run starts executing at.
+	entry int
+	// hostFunctions are called by the code on exitHostCall.
+	hostFunctions []HostFunction
+	// patchMu guards the reserve, the pages after the code that hold the
+	// code added by Patch.
+	patchMu   sync.Mutex
+	capacity  int
+	reserve   freeList
+	patchSize map[int]int
+}
+
+// Load maps the code into executable memory. The memory is read-only.
+func (m MachineCode) Load() (*Executable, error) {
+	return load(m, 0, 0, 0)
+}
+
+// load maps m with the pages before dataEnd read-write and the pages after it
+// read-exec, so that no page is ever writable and executable at once. The
+// reserve is mapped after the code, read-write until Patch uses it.
+func load(m MachineCode, dataEnd, entry, reserve int) (*Executable, error) {
+	if err := validateLayout(m, dataEnd, entry); err != nil {
+		return nil, err
+	}
+	codeEnd := len(m)
+	if reserve > 0 {
+		codeEnd = roundUp(len(m), os.Getpagesize())
+	}
+	capacity := codeEnd + roundUp(reserve, os.Getpagesize())
+	code, err := platform.MmapCodeSegment(capacity)
+	if err != nil {
+		return nil, fmt.Errorf("mmap err: %v", err)
+	}
+	copy(code, m)
+	// The pages are mapped read-write; make the code read-exec before the
+	// first call.
+	if err := platform.MprotectRX(code[dataEnd:codeEnd]); err != nil {
+		_ = platform.MunmapCodeSegment(code)
+		return nil, fmt.Errorf("mprotect err: %v", err)
+	}
+	e := &Executable{code: code, size: len(m), dataEnd: dataEnd, entry: entry, capacity: capacity}
+	if capacity > codeEnd {
+		e.reserve = freeList{{offset: codeEnd, size: capacity - codeEnd}}
+	}
+	runtime.SetFinalizer(e, (*Executable).Close)
+	return e, nil
+}
+
+//goland:noinspection GoErrorStringFormat
+func validateLayout(m MachineCode, dataEnd, entry int) error {
+	if len(m) == 0 {
+		return fmt.Errorf("Can't load empty machine code")
+	}
+	if dataEnd < 0 || dataEnd%os.Getpagesize() != 0 || entry < dataEnd || entry >= len(m) {
+		return fmt.Errorf("Invalid layout: data ends at 0x%x and code starts at 0x%x in %d bytes", dataEnd, entry, len(m))
+	}
+	return nil
+}
+
+// Size returns the size of the code in bytes.
+func (e *Executable) Size() int {
+	return e.size
+}
+
+// Close unmaps the code, or returns its slot to the Arena. It waits for
+// running calls to return, and is a no-op when the Executable has already
+// been closed.
+func (e *Executable) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	runtime.SetFinalizer(e, nil)
+	if e.arena != nil {
+		e.arena.free(e.offset, e.size)
+		return nil
+	}
+	err := platform.MunmapCodeSegment(e.code)
+	e.code = nil
+	return err
+}
+
+// acquire returns the memory of the code, which stays valid until release
+// is called.
+func (e *Executable) acquire() (code []byte, release func(), err error) {
+	e.mu.RLock()
+	if e.closed {
+		e.mu.RUnlock()
+		return nil, nil, ErrClosed
+	}
+	if e.arena == nil {
+		return e.code, e.mu.RUnlock, nil
+	}
+	// The arena moves when it grows, which it doesn't do during calls.
+	e.arena.mu.RLock()
+	if e.arena.closed {
+		e.arena.mu.RUnlock()
+		e.mu.RUnlock()
+		return nil, nil, ErrClosed
+	}
+	return e.arena.code[e.offset : e.offset+e.size], func() {
+		e.arena.mu.RUnlock()
+		e.mu.RUnlock()
+	}, nil
+}
+
+// StoreUint64 atomically stores value in the 8 byte aligned data at offset,
+// so that running code reads either the old or the new value.
+//
+//goland:noinspection GoErrorStringFormat
+func (e *Executable) StoreUint64(offset int, value uint64) error {
+	if offset < 0 || offset%8 != 0 || offset+8 > e.dataEnd {
+		return fmt.Errorf("Data at 0x%x isn't an aligned uint64 in the data segment", offset)
+	}
+	code, release, err := e.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	atomic.StoreUint64((*uint64)(unsafe.Pointer(&code[offset])), value)
+	return nil
+}
+
+// ReadData copies the data at offset into p. Reading data that running code
+// writes to at the same time is a data race.
+//
+//goland:noinspection GoErrorStringFormat
+func (e *Executable) ReadData(offset int, p []byte) error {
+	if offset < 0 || offset+len(p) > e.dataEnd {
+		return fmt.Errorf("Data at 0x%x-0x%x is outside of the data segment", offset, offset+len(p))
+	}
+	code, release, err := e.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	copy(p, code[offset:])
+	return nil
+}
+
+// WriteData copies p into the data at offset, like ReadData.
+//
+//goland:noinspection GoErrorStringFormat
+func (e *Executable) WriteData(offset int, p []byte) error {
+	if offset < 0 || offset+len(p) > e.dataEnd {
+		return fmt.Errorf("Data at 0x%x-0x%x is outside of the data segment", offset, offset+len(p))
+	}
+	code, release, err := e.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	copy(code[offset:], p)
+	return nil
+}
+
+// Execute runs the code from its entry point and returns its result. It
+// panics when the code traps or the Executable is closed.
+func (e *Executable) Execute(debug bool) int {
+	value, err := e.Run(debug)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Run runs the code from its entry point like MachineCode.Run.
+func (e *Executable) Run(debug bool) (int, error) {
+	return e.RunWithFuel(math.MaxInt64, debug)
+}
+
+// RunWithFuel runs the code from its entry point like
+// MachineCode.RunWithFuel.
+func (e *Executable) RunWithFuel(fuel int64, debug bool) (int, error) {
+	code, release, err := e.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	unprotect := protectCodeRegion(code)
+	defer unprotect()
+	ce := &callEngine{fuel: fuel}
+	value := nativecall(
+		uintptr(unsafe.Pointer(&code[e.entry])),
+		ce,
+	)
+
+	if debug {
+		fmt.Println("\nResult :", value)
+		fmt.Printf("Hex    : %x\n", value)
+		fmt.Printf("Size   : %d bytes\n\n", e.size)
+	}
+	return value, ce.trapError()
+}
+
+// CallFunction calls the function at offset entry like
+// MachineCode.CallFunction.
+func (e *Executable) CallFunction(entry int, intArgs []uint64, floatArgs []float64) (uint64, float64, error) {
+	return e.CallFunctionWithFuel(entry, math.MaxInt64, intArgs, floatArgs)
+}
+
+// CallFunctionWithFuel calls the function at offset entry like
+// MachineCode.CallFunctionWithFuel.
+//
+//goland:noinspection GoErrorStringFormat
+func (e *Executable) CallFunctionWithFuel(entry int, fuel int64, intArgs []uint64, floatArgs []float64) (uint64, float64, error) {
+	if runtime.GOARCH != "amd64" {
+		return 0, 0, fmt.Errorf("CallFunction is not supported on %s", runtime.GOARCH)
+	}
+	if len(intArgs) > MaxIntArgs || len(floatArgs) > MaxFloatArgs {
+		return 0, 0, fmt.Errorf("Too many arguments: %d integer and %d float arguments, expecting at most %d and %d", len(intArgs), len(floatArgs), MaxIntArgs, MaxFloatArgs)
+	}
+	if entry < e.dataEnd || entry >= e.capacity {
+		return 0, 0, fmt.Errorf("Entry point 0x%x is outside of the code", entry)
+	}
+	code, release, err := e.acquire()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer release()
+	unprotect := protectCodeRegion(code)
+	defer unprotect()
+	ce := &callEngine{fuel: fuel}
+	copy(ce.intArgs[:], intArgs)
+	copy(ce.floatArgs[:], floatArgs)
+	// The code runs on a stack of its own, because nothing checks that the
+	// frames it pushes fit on the goroutine's stack. Overflowing it faults
+	// on its guard.
+	stack, err := getJITStack()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer jitStacks.Put(stack)
+	ce.jitStackPointer = stack.top()
+	exit := callFunction(uintptr(unsafe.Pointer(&code[entry])), ce)
+	for exit == exitHostCall {
+		if ce.hostFunction >= uint64(len(e.hostFunctions)) {
+			return 0, 0, fmt.Errorf("Call to unknown host function %d", ce.hostFunction)
+		}
+		ce.intResult, ce.floatResult = e.hostFunctions[ce.hostFunction](ce.intArgs[:], ce.floatArgs[:])
+		exit = resumeFunction(ce.jitStackPointer, ce)
+	}
+	if ce.trapCode == TrapFault && stack.isGuard(ce.faultAddress) {
+		ce.trapCode, ce.trapPosition = TrapStackOverflow, 0
+	}
+	if err := ce.trapError(); err != nil {
+		return 0, 0, err
+	}
+	return ce.intResult, ce.floatResult, nil
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+)
+
+func Test_Executable(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("CallFunction is only supported on amd64")
+	}
+	// mov %rdi, %rax; ret
+	e, err := MachineCode{0x48, 0x89, 0xf8, 0xc3}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < 100; i++ {
+		if result, _, err := e.CallFunction(0, []uint64{i}, nil); err != nil || result != i {
+			t.Fatalf("Expecting %d got %d, %v", i, result, err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.CallFunction(0, []uint64{1}, nil); !errors.Is(err, ErrClosed) {
+		t.Error("Expecting ErrClosed got", err)
+	}
+	if _, err := e.Run(false); !errors.Is(err, ErrClosed) {
+		t.Error("Expecting ErrClosed got", err)
+	}
+	if err := e.Close(); err != nil {
+		t.Error("Expecting a second Close to succeed, got", err)
+	}
+	if _, err := (MachineCode{}).Load(); err == nil {
+		t.Error("Expecting an error when loading empty code")
+	}
+}
+
+// mappingPermissions returns the permissions of the mapping that contains
+// addr, e.g. "r-xp", from /proc/self/maps.
+func mappingPermissions(t *testing.T, addr uintptr) string {
+	maps, err := os.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Skip("Can't read the memory mappings:", err)
+	}
+	for _, line := range strings.Split(string(maps), "\n") {
+		var start, end uintptr
+		var perms string
+		if _, err := fmt.Sscanf(line, "%x-%x %s", &start, &end, &perms); err != nil {
+			continue
+		}
+		if start <= addr && addr < end {
+			return perms
+		}
+	}
+	t.Fatalf("No mapping for 0x%x", addr)
+	return ""
+}
+
+func Test_Program_is_never_writable_and_executable(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("CallFunction is only supported on amd64")
+	}
+	pageSize := os.Getpagesize()
+	program := &Program{
+		// mov %rdi, %rax; ret
+		MachineCode: append(make(MachineCode, pageSize), 0x48, 0x89, 0xf8, 0xc3),
+		DataEnd:     pageSize,
+		Entry:       pageSize,
+	}
+	e, err := program.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if result, _, err := e.CallFunction(pageSize, []uint64{42}, nil); err != nil || result != 42 {
+		t.Errorf("Expecting 42 got %d, %v", result, err)
+	}
+	if perms := mappingPermissions(t, uintptr(unsafe.Pointer(&e.code[0]))); perms[:3] != "rw-" {
+		t.Errorf("Expecting the data to be mapped rw- got %s", perms)
+	}
+	if perms := mappingPermissions(t, uintptr(unsafe.Pointer(&e.code[pageSize]))); perms[:3] != "r-x" {
+		t.Errorf("Expecting the code to be mapped r-x got %s", perms)
+	}
+	if _, _, err := e.CallFunction(0, nil, nil); err == nil {
+		t.Error("Expecting an error when calling into the data")
+	}
+	if _, err := (&Program{MachineCode: program.MachineCode, DataEnd: 1, Entry: pageSize}).Load(); err == nil {
+		t.Error("Expecting an error for unaligned data")
+	}
+}
+
+func Test_Executable_Patch(t *testing.T) {
+	if runtime.GOARCH != "amd64" {
+		t.Skip("CallFunction is only supported on amd64")
+	}
+	pageSize := os.Getpagesize()
+	// mov %rdi, %rax; ret
+	program := &Program{MachineCode: MachineCode{0x48, 0x89, 0xf8, 0xc3}, Reserve: 2 * pageSize}
+	e, err := program.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	// lea 1(%rdi), %rax; ret
+	increment := func(offset int) ([]byte, error) {
+		return []byte{0x48, 0x8d, 0x47, 0x01, 0xc3}, nil
+	}
+	offset, err := e.Patch(5, increment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != pageSize {
+		t.Errorf("Expecting the patch at 0x%x, got 0x%x", pageSize, offset)
+	}
+	if result, _, err := e.CallFunction(offset, []uint64{41}, nil); err != nil || result != 42 {
+		t.Errorf("Expecting 42 got %d, %v", result, err)
+	}
+	if result, _, err := e.CallFunction(0, []uint64{41}, nil); err != nil || result != 41 {
+		t.Errorf("Expecting the original code to be unaffected, got %d, %v", result, err)
+	}
+	if perms := mappingPermissions(t, uintptr(unsafe.Pointer(&e.code[offset]))); perms != "r-xp" {
+		t.Errorf("Expecting the patch to be r-xp, got %s", perms)
+	}
+	second, err := e.Patch(5, increment)
+	if err != nil || second != 2*pageSize {
+		t.Errorf("Expecting a second patch at 0x%x, got 0x%x, %v", 2*pageSize, second, err)
+	}
+	if _, err := e.Patch(5, increment); !errors.Is(err, ErrNoPatchSpace) {
+		t.Error("Expecting ErrNoPatchSpace got", err)
+	}
+	if err := e.FreePatch(offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.FreePatch(offset); err == nil {
+		t.Error("Expecting an error freeing a patch twice")
+	}
+	if reused, err := e.Patch(5, increment); err != nil || reused != offset {
+		t.Errorf("Expecting the freed pages to be reused at 0x%x, got 0x%x, %v", offset, reused, err)
+	}
+	if _, err := e.Patch(5, func(int) ([]byte, error) { return nil, errors.New("failed") }); err == nil {
+		t.Error("Expecting the encoding error")
+	}
+	if err := e.StoreUint64(3, 0); err == nil {
+		t.Error("Expecting an error storing outside of the data")
+	}
+}
@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// initialFaultRegions is the number of code regions that can run at the
+// same time before the table of faultRegions has to grow.
+const initialFaultRegions = 64
+
+// faultRegion is the [start, end) address range of code that's running.
+// faultHandler in fault_linux_amd64.s scans the current faultTable without
+// locking, so the fields are only written atomically, and a zero start marks
+// a free slot.
+type faultRegion struct {
+	start uintptr
+	end   uintptr
+}
+
+// faultTable holds the faultRegions. It's replaced by a copy twice its size
+// when all of its slots are in use, so that any number of calls, e.g. calls
+// from host functions back into compiled code, can run at the same time.
+type faultTable struct {
+	regions []faultRegion
+}
+
+var (
+	// faultRegions points at the current faultTable, which faultHandler
+	// loads atomically. faultTables keeps the tables that were replaced
+	// alive, because faultHandler may still be scanning them.
+	faultRegions     unsafe.Pointer
+	faultTables      []*faultTable
+	freeFaultRegions []int
+	// faultRegionsMu guards faultTables, freeFaultRegions and writes to the
+	// current table.
+	faultRegionsMu sync.Mutex
+
+	// previousFaultHandlers holds the handlers that were installed before
+	// faultHandler, indexed by signal. faultHandler passes faults that
+	// didn't happen in compiled code on to them.
+	previousFaultHandlers [32]uintptr
+
+	installFaultHandlerOnce sync.Once
+)
+
+// faultSignals are the signals that compiled code raises when it faults.
+var faultSignals = []syscall.Signal{syscall.SIGSEGV, syscall.SIGBUS, syscall.SIGILL, syscall.SIGFPE}
+
+func init() {
+	growFaultTable(initialFaultRegions)
+}
+
+// growFaultTable replaces the current faultTable with a copy of size slots,
+// and adds the new slots to freeFaultRegions. faultRegionsMu must be held,
+// except during init.
+func growFaultTable(size int) {
+	table := &faultTable{regions: make([]faultRegion, size)}
+	used := 0
+	if len(faultTables) > 0 {
+		current := faultTables[len(faultTables)-1]
+		copy(table.regions, current.regions)
+		used = len(current.regions)
+	}
+	for i := size - 1; i >= used; i-- {
+		freeFaultRegions = append(freeFaultRegions, i)
+	}
+	faultTables = append(faultTables, table)
+	atomic.StorePointer(&faultRegions, unsafe.Pointer(table))
+}
+
+// sigaction is the kernel's struct sigaction for rt_sigaction on amd64.
+type sigaction struct {
+	handler  uintptr
+	flags    uint64
+	restorer uintptr
+	mask     uint64
+}
+
+// faultHandler is implemented in fault_linux_amd64.s and is only called by
+// the kernel.
+func faultHandler()
+
+// faultHandlerAddress returns the address of faultHandler.
+func faultHandlerAddress() uintptr
+
+// installFaultHandler puts faultHandler in front of the handlers that the Go
+// runtime installed for faultSignals. The flags, mask and restorer of the Go
+// handlers are kept, so that faults outside of compiled code get handled
+// exactly as before.
+func installFaultHandler() {
+	for _, sig := range faultSignals {
+		var old sigaction
+		if _, _, errno := syscall.RawSyscall6(syscall.SYS_RT_SIGACTION, uintptr(sig), 0, uintptr(unsafe.Pointer(&old)), 8, 0, 0); errno != 0 {
+			continue
+		}
+		if old.handler <= 1 {
+			// SIG_DFL or SIG_IGN: there's nothing to pass faults on to.
+			continue
+		}
+		previousFaultHandlers[sig] = old.handler
+		act := old
+		act.handler = faultHandlerAddress()
+		syscall.RawSyscall6(syscall.SYS_RT_SIGACTION, uintptr(sig), uintptr(unsafe.Pointer(&act)), 0, 8, 0, 0)
+	}
+}
+
+// protectCodeRegion makes faults in code[:size] return to the caller of
+// nativecall with a FaultError, until release is called.
+func protectCodeRegion(code []byte) (release func()) {
+	installFaultHandlerOnce.Do(installFaultHandler)
+	faultRegionsMu.Lock()
+	if len(freeFaultRegions) == 0 {
+		growFaultTable(2 * len(faultTables[len(faultTables)-1].regions))
+	}
+	slot := freeFaultRegions[len(freeFaultRegions)-1]
+	freeFaultRegions = freeFaultRegions[:len(freeFaultRegions)-1]
+	region := &faultTables[len(faultTables)-1].regions[slot]
+	start := uintptr(unsafe.Pointer(&code[0]))
+	atomic.StoreUintptr(&region.end, start+uintptr(len(code)))
+	atomic.StoreUintptr(&region.start, start)
+	faultRegionsMu.Unlock()
+	return func() {
+		faultRegionsMu.Lock()
+		defer faultRegionsMu.Unlock()
+		// The table may have grown since; the slot is the same in the copy.
+		region := &faultTables[len(faultTables)-1].regions[slot]
+		atomic.StoreUintptr(&region.start, 0)
+		atomic.StoreUintptr(&region.end, 0)
+		freeFaultRegions = append(freeFaultRegions, slot)
+	}
+}
@@ -0,0 +1,68 @@
+#include "textflag.h"
+
+// Offsets in the kernel's siginfo_t and ucontext_t.
+#define SIGINFO_CODE 8
+#define SIGINFO_ADDR 16
+#define UCONTEXT_R13 80
+#define UCONTEXT_RIP 168
+
+// Offsets in callEngine, see arch.go.
+#define CALLENGINE_TRAP_CODE 16
+#define CALLENGINE_FAULT_SIGNAL 32
+#define CALLENGINE_FAULT_OFFSET 40
+#define CALLENGINE_FAULT_ADDRESS 208
+#define TRAP_FAULT 3
+
+// faultHandler(signal DI, info SI, context DX) is installed as the handler for
+// SIGSEGV, SIGBUS, SIGILL and SIGFPE. It's called by the kernel, so it follows
+// the C calling convention and only uses caller saved registers.
+//
+// When the fault was raised by code in one of the regions of the current
+// faultTable, R13 holds the callEngine of that code. The fault gets recorded
+// there and the context is changed to resume at trapHandler, which returns to
+// the caller of nativecall.
+// All other faults, and signals that were sent by another process, are passed
+// on to the previous handler.
+TEXT ·faultHandler(SB), NOSPLIT|NOFRAME, $0-0
+	MOVL SIGINFO_CODE(SI), AX
+	CMPL AX, $0
+	JLE  chain                             // si_code <= 0: sent by kill(2) and friends.
+	MOVQ UCONTEXT_RIP(DX), AX
+	MOVQ ·faultRegions(SB), R10            // The current *faultTable.
+	MOVQ 8(R10), CX                        // len(faultTable.regions), never 0.
+	MOVQ 0(R10), R10                       // &faultTable.regions[0]
+
+loop:
+	MOVQ 0(R10), R8                        // faultRegion.start
+	TESTQ R8, R8
+	JZ   next
+	CMPQ AX, R8
+	JB   next
+	CMPQ AX, 8(R10)                        // faultRegion.end
+	JAE  next
+	SUBQ R8, AX                            // Offset of the faulting instruction.
+	MOVQ UCONTEXT_R13(DX), R11
+	MOVQ $TRAP_FAULT, CALLENGINE_TRAP_CODE(R11)
+	MOVQ DI, CALLENGINE_FAULT_SIGNAL(R11)
+	MOVQ AX, CALLENGINE_FAULT_OFFSET(R11)
+	MOVQ SIGINFO_ADDR(SI), AX
+	MOVQ AX, CALLENGINE_FAULT_ADDRESS(R11)
+	LEAQ ·trapHandler(SB), AX
+	MOVQ AX, UCONTEXT_RIP(DX)
+	RET
+
+next:
+	ADDQ $16, R10
+	DECQ CX
+	JNZ  loop
+
+chain:
+	LEAQ ·previousFaultHandlers(SB), R10
+	MOVQ (R10)(DI*8), AX
+	JMP  AX
+
+// func faultHandlerAddress() uintptr
+TEXT ·faultHandlerAddress(SB), NOSPLIT, $0-8
+	LEAQ ·faultHandler(SB), AX
+	MOVQ AX, ret+0(FP)
+	RET
@@ -0,0 +1,147 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func Test_FaultsInCompiledCode(t *testing.T) {
+	units := []struct {
+		name   string
+		code   MachineCode
+		signal syscall.Signal
+		offset uintptr
+	}{
+		// mov 0x0, %rax
+		{"SIGSEGV", MachineCode{0x48, 0x8b, 0x04, 0x25, 0x00, 0x00, 0x00, 0x00}, syscall.SIGSEGV, 0},
+		// nop; nop; ud2
+		{"SIGILL", MachineCode{0x90, 0x90, 0x0f, 0x0b}, syscall.SIGILL, 2},
+		// mov $7, %eax; xor %edx, %edx; xor %ecx, %ecx; div %ecx
+		{"SIGFPE", MachineCode{0xb8, 0x07, 0x00, 0x00, 0x00, 0x31, 0xd2, 0x31, 0xc9, 0xf7, 0xf1}, syscall.SIGFPE, 9},
+	}
+	for _, unit := range units {
+		_, err := unit.code.Run(false)
+		if !errors.Is(err, ErrFault) {
+			t.Fatalf("Expecting a fault in %s, got %v", unit.name, err)
+		}
+		fault := err.(*FaultError)
+		if fault.Signal != unit.signal || fault.Offset != unit.offset {
+			t.Errorf("Expecting %s at offset %d, got %s at offset %d", unit.signal, unit.offset, fault.Signal, fault.Offset)
+		}
+	}
+
+	// mov $5, 0x18(%rsp); ret
+	value, err := MachineCode{0x48, 0xc7, 0x44, 0x24, 0x18, 0x05, 0x00, 0x00, 0x00, 0xc3}.Run(false)
+	if err != nil || value != 5 {
+		t.Errorf("Expecting 5 after a fault, got %d, %v", value, err)
+	}
+}
+
+func Test_FaultsOutsideCompiledCode(t *testing.T) {
+	// Make sure the fault handler is installed.
+	if _, err := (MachineCode{0x0f, 0x0b}).Run(false); !errors.Is(err, ErrFault) {
+		t.Fatal("Expecting a fault, got", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Expecting a nil dereference in Go code to panic")
+		}
+	}()
+	var p *int
+	_ = *(*int)(unsafe.Pointer(p))
+}
+
+func Test_FaultHandlerConstants(t *testing.T) {
+	// fault_linux_amd64.s hard codes these.
+	var ce callEngine
+	if TrapFault != 3 {
+		t.Errorf("Expecting TrapFault to be 3, got %d", TrapFault)
+	}
+	if unsafe.Offsetof(ce.faultSignal) != 32 || unsafe.Offsetof(ce.faultOffset) != 40 {
+		t.Errorf("Expecting callEngine.faultSignal and faultOffset at offsets 32 and 40, got %d and %d",
+			unsafe.Offsetof(ce.faultSignal), unsafe.Offsetof(ce.faultOffset))
+	}
+	if unsafe.Offsetof(ce.faultAddress) != 208 {
+		t.Errorf("Expecting callEngine.faultAddress at offset 208, got %d", unsafe.Offsetof(ce.faultAddress))
+	}
+}
+
+func Test_ProtectCodeRegion_ManyCalls(t *testing.T) {
+	// More calls than the table of fault regions starts with wait in a host
+	// function until all of them are running.
+	calls := 2*initialFaultRegions + 1
+	var running sync.WaitGroup
+	running.Add(calls)
+	program := &Program{
+		MachineCode: MachineCode{
+			// movq $0, 0x40(%r13); call *0x38(%r13); ret
+			0x49, 0xc7, 0x45, 0x40, 0x00, 0x00, 0x00, 0x00, 0x41, 0xff, 0x55, 0x38, 0xc3,
+		},
+		HostFunctions: []HostFunction{
+			func(intArgs []uint64, floatArgs []float64) (uint64, float64) {
+				running.Done()
+				running.Wait()
+				return intArgs[0], 0
+			},
+		},
+	}
+	e, err := program.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	errs := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func(i uint64) {
+			result, _, err := e.CallFunction(0, []uint64{i}, nil)
+			if err == nil && result != i {
+				err = fmt.Errorf("Expecting %d, got %d", i, result)
+			}
+			errs <- err
+		}(uint64(i))
+	}
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < calls; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatalf("Only %d of %d calls returned", i, calls)
+		}
+	}
+
+	// Faults are still caught after the table grew.
+	if _, err := (MachineCode{0x0f, 0x0b}).Run(false); !errors.Is(err, ErrFault) {
+		t.Fatal("Expecting a fault, got", err)
+	}
+}
+
+func Test_CallFunction_StackOverflow(t *testing.T) {
+	e, err := MachineCode{
+		// test %rdi, %rdi; jz +5; call 0; ret
+		0x48, 0x85, 0xff, 0x74, 0x05, 0xe8, 0xf6, 0xff, 0xff, 0xff, 0xc3,
+	}.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	for i := 0; i < 3; i++ {
+		// The code recurses until %rdi is 0, which it never is.
+		_, _, err := e.CallFunction(0, []uint64{1}, nil)
+		var trap *TrapError
+		if !errors.As(err, &trap) || !errors.Is(err, ErrStackOverflow) {
+			t.Fatalf("Expecting %v got %v", ErrStackOverflow, err)
+		}
+		// The stack can be used again afterwards.
+		if _, _, err := e.CallFunction(0, []uint64{0}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !(linux && amd64)
+
+package lib
+
+// protectCodeRegion is a no-op on platforms without fault containment: faults
+// in compiled code crash the process.
+func protectCodeRegion(code []byte) (release func()) {
+	return func() {}
+}
@@ -0,0 +1,45 @@
+package lib
+
+import "sort"
+
+// freeList holds the free ranges of a mapping, sorted by offset.
+type freeList []arenaRange
+
+// allocate takes size bytes at the given alignment from the first free range
+// that fits.
+func (l *freeList) allocate(size, alignment int) (int, bool) {
+	for i, r := range *l {
+		start := roundUp(r.offset, alignment)
+		if start+size > r.end() {
+			continue
+		}
+		var replacement []arenaRange
+		if start > r.offset {
+			replacement = append(replacement, arenaRange{offset: r.offset, size: start - r.offset})
+		}
+		if start+size < r.end() {
+			replacement = append(replacement, arenaRange{offset: start + size, size: r.end() - start - size})
+		}
+		*l = append((*l)[:i], append(replacement, (*l)[i+1:]...)...)
+		return start, true
+	}
+	return 0, false
+}
+
+// release adds the range to the free list, merging it with its neighbours.
+func (l *freeList) release(offset, size int) {
+	ranges := append(*l, arenaRange{offset: offset, size: size})
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].offset < ranges[j].offset
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if last.end() == r.offset {
+			last.size += r.size
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	*l = merged
+}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+
+	"github.com/bspaans/jit-compiler/platform"
+)
+
+// HostFunction is a Go function that compiled code calls, e.g. through an
+// extern declaration. It receives the argument registers of the call, in the
+// same order as CallFunction passes them, and returns the values for rax and
+// xmm0.
+//
+// A HostFunction runs on the goroutine that called into the compiled code,
+// which is waiting for it to return. It may call other compiled code, but it
+// must not close or grow the Executable or Arena that's calling it.
+type HostFunction func(intArgs []uint64, floatArgs []float64) (uint64, float64)
+
+// JITStackSize is the size of the stack that CallFunction runs compiled code
+// on. The code can't run on the goroutine's stack, because the host
+// functions would overwrite it, and because the goroutine's stack only grows
+// for Go code.
+const JITStackSize = 64 * 1024
+
+// jitStackGuardSize is the size of the inaccessible memory below every JIT
+// stack. Code that overflows the stack faults on it, and traps with
+// ErrStackOverflow, as long as none of its frames is larger than the guard.
+const jitStackGuardSize = 64 * 1024
+
+// jitStack is a stack of JITStackSize bytes, mapped right above its guard.
+type jitStack struct {
+	memory []byte
+}
+
+// jitStacks are the stacks of code that's running. They are mapped outside
+// of the Go heap, so they stay put while the host functions run, and are
+// unmapped when the pool drops them.
+var jitStacks sync.Pool
+
+// getJITStack returns a stack from jitStacks, or maps a new one.
+//
+//goland:noinspection GoErrorStringFormat
+func getJITStack() (*jitStack, error) {
+	if stack, ok := jitStacks.Get().(*jitStack); ok {
+		return stack, nil
+	}
+	memory, err := platform.MmapMemory(jitStackGuardSize + JITStackSize)
+	if err != nil {
+		return nil, fmt.Errorf("mmap err: %v", err)
+	}
+	if err := platform.MprotectNone(memory[:jitStackGuardSize]); err != nil {
+		_ = platform.MunmapCodeSegment(memory)
+		return nil, fmt.Errorf("mprotect err: %v", err)
+	}
+	stack := &jitStack{memory: memory}
+	runtime.SetFinalizer(stack, func(stack *jitStack) {
+		_ = platform.MunmapCodeSegment(stack.memory)
+	})
+	return stack, nil
+}
+
+// top returns the address just past the end of the stack, where it starts
+// growing down from.
+func (s *jitStack) top() uintptr {
+	return uintptr(unsafe.Pointer(&s.memory[0])) + uintptr(len(s.memory))
+}
+
+// isGuard returns whether address is in the guard of the stack.
+func (s *jitStack) isGuard(address uintptr) bool {
+	start := uintptr(unsafe.Pointer(&s.memory[0]))
+	return address >= start && address < start+jitStackGuardSize
+}
@@ -2,9 +2,7 @@ package lib
 
 import (
 	"encoding/hex"
-	"fmt"
-	"github.com/bspaans/jit-compiler/platform"
-	"unsafe"
+	"math"
 )
 
 type MachineCode []uint8
@@ -24,26 +22,67 @@ func (m MachineCode) String() string {
 	return string(result)
 }
 
+// Execute runs the code and returns its result. It panics when the code
+// traps; use Run to get traps as errors instead.
 func (m MachineCode) Execute(debug bool) int {
-	mmapFunc, err := platform.MmapCodeSegment(len(m))
+	value, err := m.Run(debug)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
 
+// Run runs the code and returns its result, or a *TrapError when the code
+// trapped. On linux/amd64 hardware faults in the code, such as segmentation
+// faults, are returned as a *FaultError instead of crashing the process.
+func (m MachineCode) Run(debug bool) (int, error) {
+	return m.RunWithFuel(math.MaxInt64, debug)
+}
+
+// RunWithFuel is like Run, but code that was compiled with fuel checks traps
+// with ErrFuelExhausted after fuel loop iterations and function calls.
+//
+// The code gets mapped for this call only; use Load to run it more than once.
+func (m MachineCode) RunWithFuel(fuel int64, debug bool) (int, error) {
+	e, err := m.Load()
 	if err != nil {
-		fmt.Printf("mmap err: %v", err)
+		return 0, err
 	}
-	copy(mmapFunc, m)
+	defer e.Close()
+	return e.RunWithFuel(fuel, debug)
+}
 
-	value := nativecall(
-		uintptr(unsafe.Pointer(&mmapFunc[0])),
-		&callEngine{},
-	)
+// Registers that CallFunction passes arguments in.
+const (
+	MaxIntArgs   = 6
+	MaxFloatArgs = 8
+)
 
-	if debug {
-		fmt.Println("\nResult :", value)
-		fmt.Printf("Hex    : %x\n", value)
-		fmt.Printf("Size   : %d bytes\n\n", len(m))
+// CallFunction calls the function at offset entry of the code following the
+// System V AMD64 calling convention: intArgs are passed in rdi, rsi, rdx, rcx,
+// r8 and r9, and floatArgs in xmm0 to xmm7. It returns the contents of rax and
+// xmm0 after the call, or the same errors as Run. Only amd64 is supported.
+func (m MachineCode) CallFunction(entry int, intArgs []uint64, floatArgs []float64) (uint64, float64, error) {
+	e, err := m.Load()
+	if err != nil {
+		return 0, 0, err
 	}
-	return value
+	defer e.Close()
+	return e.CallFunction(entry, intArgs, floatArgs)
 }
+
+// CallFunctionWithFuel is like CallFunction, but code that was compiled with
+// fuel checks traps with ErrFuelExhausted after fuel loop iterations and
+// function calls, like RunWithFuel.
+func (m MachineCode) CallFunctionWithFuel(entry int, fuel int64, intArgs []uint64, floatArgs []float64) (uint64, float64, error) {
+	e, err := m.Load()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer e.Close()
+	return e.CallFunctionWithFuel(entry, fuel, intArgs, floatArgs)
+}
+
 func (m MachineCode) Add(m2 MachineCode) MachineCode {
 	return append(m, m2...)
 }
@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/bspaans/jit-compiler/platform"
+)
+
+// ErrNoPatchSpace is returned by Patch when the reserve of the Executable
+// doesn't have enough free pages left.
+var ErrNoPatchSpace = errors.New("Not enough space left in the reserve")
+
+// Patch adds code to the reserve that the Executable was loaded with, see
+// Program.Reserve, while the code in the Executable may be running. It takes
+// whole pages that no code runs on, so that they can be written to and then
+// made read-exec without affecting running code. encode is called with the
+// offset that the code will be placed at, which is page aligned, and has to
+// return at most size bytes. Patch returns the offset.
+//
+//goland:noinspection GoErrorStringFormat
+func (e *Executable) Patch(size int, encode func(offset int) ([]byte, error)) (int, error) {
+	e.patchMu.Lock()
+	defer e.patchMu.Unlock()
+	code, release, err := e.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	pageSize := os.Getpagesize()
+	pages := roundUp(size, pageSize)
+	offset, ok := e.reserve.allocate(pages, pageSize)
+	if !ok {
+		return 0, ErrNoPatchSpace
+	}
+	m, err := encode(offset)
+	if err == nil && len(m) > pages {
+		err = fmt.Errorf("Patch of %d bytes doesn't fit in %d bytes", len(m), pages)
+	}
+	if err == nil {
+		err = writePatch(code[offset:offset+pages], m)
+	}
+	if err != nil {
+		e.reserve.release(offset, pages)
+		return 0, err
+	}
+	if e.patchSize == nil {
+		e.patchSize = map[int]int{}
+	}
+	e.patchSize[offset] = pages
+	return offset, nil
+}
+
+// writePatch copies m into pages and makes them read-exec.
+func writePatch(pages []byte, m []byte) error {
+	if err := platform.MprotectRW(pages); err != nil {
+		return fmt.Errorf("mprotect err: %v", err)
+	}
+	copy(pages, m)
+	if err := platform.MprotectRX(pages); err != nil {
+		return fmt.Errorf("mprotect err: %v", err)
+	}
+	return nil
+}
+
+// FreePatch returns the pages of the patch at offset to the reserve. The
+// code of the patch must not be running anymore, and mustn't be called
+// again.
+//
+//goland:noinspection GoErrorStringFormat
+func (e *Executable) FreePatch(offset int) error {
+	e.patchMu.Lock()
+	defer e.patchMu.Unlock()
+	size, ok := e.patchSize[offset]
+	if !ok {
+		return fmt.Errorf("No patch at offset 0x%x", offset)
+	}
+	delete(e.patchSize, offset)
+	e.reserve.release(offset, size)
+	return nil
+}
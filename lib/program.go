@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"math"
+)
+
+// Program is machine code that embeds writable data. The data lives in the
+// pages before DataEnd, which stay read-write when the program is loaded,
+// while the code after it is mapped read-exec.
+type Program struct {
+	MachineCode
+	// DataEnd is the page aligned offset at which the code starts.
+	DataEnd int
+	// Entry is the offset that Run starts executing at.
+	Entry int
+	// HostFunctions are the Go functions that the code calls by their
+	// index, which are bound when the program is loaded. Only
+	// CallFunction supports them.
+	HostFunctions []HostFunction
+	// Reserve is the number of bytes to map after the code for code that
+	// gets added later with Executable.Patch. Arenas don't support it.
+	Reserve int
+}
+
+// Load maps the program into memory.
+func (p *Program) Load() (*Executable, error) {
+	e, err := load(p.MachineCode, p.DataEnd, p.Entry, p.Reserve)
+	if err != nil {
+		return nil, err
+	}
+	e.hostFunctions = p.HostFunctions
+	return e, nil
+}
+
+// Execute runs the program and returns its result. It panics when the code
+// traps; use Run to get traps as errors instead.
+func (p *Program) Execute(debug bool) int {
+	value, err := p.Run(debug)
+	if err != nil {
+		panic(err)
+	}
+	return value
+}
+
+// Run runs the program like MachineCode.Run.
+func (p *Program) Run(debug bool) (int, error) {
+	return p.RunWithFuel(math.MaxInt64, debug)
+}
+
+// RunWithFuel runs the program like MachineCode.RunWithFuel.
+func (p *Program) RunWithFuel(fuel int64, debug bool) (int, error) {
+	e, err := p.Load()
+	if err != nil {
+		return 0, err
+	}
+	defer e.Close()
+	return e.RunWithFuel(fuel, debug)
+}
+
+// CallFunction calls the function at offset entry of the program like
+// MachineCode.CallFunction.
+func (p *Program) CallFunction(entry int, intArgs []uint64, floatArgs []float64) (uint64, float64, error) {
+	e, err := p.Load()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer e.Close()
+	return e.CallFunction(entry, intArgs, floatArgs)
+}
+
+// CallFunctionWithFuel calls the function at offset entry of the program like
+// MachineCode.CallFunctionWithFuel.
+func (p *Program) CallFunctionWithFuel(entry int, fuel int64, intArgs []uint64, floatArgs []float64) (uint64, float64, error) {
+	e, err := p.Load()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer e.Close()
+	return e.CallFunctionWithFuel(entry, fuel, intArgs, floatArgs)
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// TrapCode identifies why compiled code stopped early. It's stored in the
+// callEngine by the code that jumps to the trap handler.
+type TrapCode uint64
+
+const (
+	TrapNone TrapCode = iota
+	TrapIntegerOverflow
+	TrapDivideByZero
+	// TrapFault is set by the fault handler instead of compiled code.
+	TrapFault
+	TrapFuelExhausted
+	TrapIndexOutOfRange
+	// TrapStackOverflow is set by CallFunction when the code faulted on the
+	// guard page of its stack.
+	TrapStackOverflow
+)
+
+var (
+	ErrIntegerOverflow = errors.New("integer overflow")
+	ErrDivideByZero    = errors.New("integer divide by zero")
+	ErrFault           = errors.New("fault in compiled code")
+	ErrFuelExhausted   = errors.New("fuel exhausted")
+	ErrIndexOutOfRange = errors.New("index out of range")
+	ErrStackOverflow   = errors.New("stack overflow")
+)
+
+var trapErrors = map[TrapCode]error{
+	TrapIntegerOverflow: ErrIntegerOverflow,
+	TrapDivideByZero:    ErrDivideByZero,
+	TrapFuelExhausted:   ErrFuelExhausted,
+	TrapIndexOutOfRange: ErrIndexOutOfRange,
+	TrapStackOverflow:   ErrStackOverflow,
+}
+
+// TrapError is returned when compiled code traps. Err is one of the Err*
+// values in this package, so that callers can use errors.Is. Line and Column
+// are the source position of the expression that trapped, or 0 when unknown.
+type TrapError struct {
+	Err    error
+	Line   int
+	Column int
+}
+
+func (t *TrapError) Error() string {
+	if t.Line == 0 {
+		return t.Err.Error()
+	}
+	return fmt.Sprintf("%s at %d:%d", t.Err.Error(), t.Line, t.Column)
+}
+
+func (t *TrapError) Unwrap() error {
+	return t.Err
+}
+
+// FaultError is returned when compiled code raises a hardware fault, such as
+// a segmentation fault or an illegal instruction. Offset is the offset of the
+// faulting instruction in the MachineCode.
+type FaultError struct {
+	Signal syscall.Signal
+	Offset uintptr
+}
+
+func (f *FaultError) Error() string {
+	return fmt.Sprintf("%s in compiled code at offset 0x%x", f.Signal, f.Offset)
+}
+
+func (f *FaultError) Unwrap() error {
+	return ErrFault
+}
+
+// PackTrapPosition packs a source position into the 32 bit immediate that
+// compiled code stores in the callEngine when it traps. Positions that don't
+// fit are reported as unknown.
+func PackTrapPosition(line, column int) uint32 {
+	if line <= 0 || line >= 1<<15 || column <= 0 || column >= 1<<16 {
+		return 0
+	}
+	return uint32(line)<<16 | uint32(column)
+}
+
+func unpackTrapPosition(position uint64) (line, column int) {
+	return int(position >> 16), int(position & 0xffff)
+}
+
+func (c *callEngine) trapError() error {
+	if c.trapCode == TrapNone {
+		return nil
+	}
+	if c.trapCode == TrapFault {
+		return &FaultError{Signal: syscall.Signal(c.faultSignal), Offset: uintptr(c.faultOffset)}
+	}
+	err, ok := trapErrors[c.trapCode]
+	if !ok {
+		err = fmt.Errorf("unknown trap code %d", c.trapCode)
+	}
+	line, column := unpackTrapPosition(c.trapPosition)
+	return &TrapError{Err: err, Line: line, Column: column}
+}
@@ -2,16 +2,55 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/bspaans/jit-compiler/ir"
 	"github.com/bspaans/jit-compiler/ir/encoding/x86_64"
 	"github.com/bspaans/jit-compiler/ir/shared"
 )
 
+var (
+	o0      = flag.Bool("O0", false, "don't optimise")
+	o1      = flag.Bool("O1", false, "run the cheap optimisations (default)")
+	o2      = flag.Bool("O2", false, "run all the optimisations")
+	enable  = flag.String("enable", "", "comma separated passes to run as well")
+	disable = flag.String("disable", "", "comma separated passes to skip")
+	dump    = flag.Bool("dump", false, "print the IR after every pass")
+)
+
+// passManager returns the PassManager for the flags.
+func passManager() (*ir.PassManager, error) {
+	level := ir.O1
+	if *o0 {
+		level = ir.O0
+	} else if *o2 {
+		level = ir.O2
+	}
+	passes, err := ir.NewPassManager(level)
+	if err != nil {
+		return nil, err
+	}
+	if *enable != "" {
+		if err := passes.Enable(strings.Split(*enable, ",")...); err != nil {
+			return nil, err
+		}
+	}
+	if *disable != "" {
+		if err := passes.Disable(strings.Split(*disable, ",")...); err != nil {
+			return nil, err
+		}
+	}
+	if *dump {
+		passes.Dump = os.Stdout
+	}
+	return passes, nil
+}
+
 //goland:noinspection GoBoolExpressions
-func REPL() {
+func REPL(passes *ir.PassManager) {
 	reader := bufio.NewReader(os.Stdin)
 	for {
 		fmt.Print("> ")
@@ -23,8 +62,7 @@ func REPL() {
 
 		}
 		debug := true
-		statements = statements.SSA_Transform(shared.NewSSA_Context())
-		instr, err := ir.Compile(&x86_64.X86_64{}, x86_64.NewABI_AMDSystemV(), []shared.IR{statements}, debug)
+		instr, err := ir.Compile(&x86_64.X86_64{}, x86_64.NewABI_AMDSystemV(), []shared.IR{statements}, ir.Options{Debug: debug, Passes: passes})
 		if err != nil {
 			fmt.Println("Compile error: ", err.Error())
 			continue
@@ -35,9 +73,9 @@ func REPL() {
 }
 
 //goland:noinspection GoBoolExpressions
-func CompileFiles() {
+func CompileFiles(passes *ir.PassManager) {
 	source := ""
-	for _, file := range os.Args[1:] {
+	for _, file := range flag.Args() {
 		text, err := os.ReadFile(file)
 		if err != nil {
 			panic(err)
@@ -50,17 +88,23 @@ func CompileFiles() {
 	}
 
 	debug := true
-	statements = statements.SSA_Transform(shared.NewSSA_Context())
-	if err := ir.CompileToBinary(&x86_64.X86_64{}, x86_64.NewABI_AMDSystemV(), []shared.IR{statements}, debug, "test.bin"); err != nil {
+	opts := ir.Options{Debug: debug, Passes: passes}
+	if err := ir.CompileToBinary(&x86_64.X86_64{}, x86_64.NewABI_AMDSystemV(), []shared.IR{statements}, opts, "test.bin"); err != nil {
 		panic(err)
 
 	}
 }
 
 func main() {
-	if len(os.Args) == 1 {
-		REPL()
+	flag.Parse()
+	passes, err := passManager()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if flag.NArg() == 0 {
+		REPL(passes)
 	} else {
-		CompileFiles()
+		CompileFiles(passes)
 	}
 }
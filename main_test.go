@@ -24,7 +24,7 @@ return current
 	machineCode, err := ir.Compile(&x86_64.X86_64{},
 		x86_64.NewABI_AMDSystemV(),
 		[]shared.IR{statements},
-		debug)
+		ir.Options{Debug: debug})
 	if err != nil {
 		panic(err)
 	}
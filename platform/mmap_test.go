@@ -1,6 +1,7 @@
 package platform
 
 import (
+	"os"
 	"testing"
 
 	"github.com/bspaans/jit-compiler/platform/sys/require"
@@ -43,3 +44,39 @@ func Test_MunmapCodeSegment(t *testing.T) {
 		require.EqualError(t, captured, "BUG: MunmapCodeSegment with zero length")
 	})
 }
+
+func Test_MprotectRX(t *testing.T) {
+	if !CompilerSupported() {
+		t.Skip()
+	}
+
+	code, err := MmapCodeSegment(100)
+	require.NoError(t, err)
+	defer MunmapCodeSegment(code)
+
+	// Code segments start out writable...
+	copy(code, []byte{0xc3})
+	require.NoError(t, MprotectRX(code))
+	require.Equal(t, byte(0xc3), code[0])
+	// ...and can be made writable again for patching.
+	require.NoError(t, MprotectRW(code))
+	code[0] = 0x90
+	require.NoError(t, MprotectRX(code))
+	require.Equal(t, byte(0x90), code[0])
+}
+
+func Test_MprotectNone(t *testing.T) {
+	if !CompilerSupported() {
+		t.Skip()
+	}
+
+	memory, err := MmapMemory(os.Getpagesize())
+	require.NoError(t, err)
+	defer MunmapCodeSegment(memory)
+
+	require.NoError(t, MprotectNone(memory))
+	// Inaccessible memory can be made accessible again.
+	require.NoError(t, MprotectRW(memory))
+	memory[0] = 1
+	require.Equal(t, byte(1), memory[0])
+}
@@ -7,8 +7,11 @@ import (
 	"unsafe"
 )
 
+// Code segments are never mapped writable and executable at the same time:
+// they start out read-write, and callers switch them to read-exec with
+// MprotectRX once the code has been copied in.
 const (
-	mmapProtAMD64 = syscall.PROT_READ | syscall.PROT_WRITE | syscall.PROT_EXEC
+	mmapProtAMD64 = syscall.PROT_READ | syscall.PROT_WRITE
 	mmapProtARM64 = syscall.PROT_READ | syscall.PROT_WRITE
 )
 
@@ -30,10 +33,11 @@ func munmapCodeSegment(code []byte) error {
 	return syscall.Munmap(code)
 }
 
-// mmapCodeSegmentAMD64 gives all read-write-exec permission to the mmap region
-// to enter the function. Otherwise, segmentation fault exception is raised.
+// mmapCodeSegmentAMD64 gives read-write permission to the mmap region so that
+// we can write contents at call-sites. Callers are responsible to execute
+// MprotectRX on the returned buffer before entering the code.
 func mmapCodeSegmentAMD64(size int) ([]byte, error) {
-	// The region must be RWX: RW for writing native codes, X for executing the region.
+	// The region must be RW: RW for writing native codes.
 	return mmapCodeSegment(size, mmapProtAMD64)
 }
 
@@ -48,11 +52,26 @@ func mmapCodeSegmentARM64(size int) ([]byte, error) {
 
 // MprotectRX is like syscall.Mprotect with RX permission, defined locally so that freebsd compiles.
 func MprotectRX(b []byte) (err error) {
+	return mprotect(b, syscall.PROT_READ|syscall.PROT_EXEC)
+}
+
+// MprotectRW makes code mapped by MmapCodeSegment writable again, so that it
+// can be patched. It's no longer executable until MprotectRX is called.
+func MprotectRW(b []byte) (err error) {
+	return mprotect(b, syscall.PROT_READ|syscall.PROT_WRITE)
+}
+
+// MprotectNone makes memory mapped by MmapMemory inaccessible, e.g. to guard
+// the end of a stack. Any access to it faults.
+func MprotectNone(b []byte) (err error) {
+	return mprotect(b, syscall.PROT_NONE)
+}
+
+func mprotect(b []byte, prot int) (err error) {
 	var _p0 unsafe.Pointer
 	if len(b) > 0 {
 		_p0 = unsafe.Pointer(&b[0])
 	}
-	const prot = syscall.PROT_READ | syscall.PROT_EXEC
 	_, _, e1 := syscall.Syscall(syscall.SYS_MPROTECT, uintptr(_p0), uintptr(len(b)), uintptr(prot))
 	if e1 != 0 {
 		err = syscall.Errno(e1)
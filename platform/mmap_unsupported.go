@@ -30,3 +30,11 @@ func mmapMemory(size int) ([]byte, error) {
 func MprotectRX(b []byte) (err error) {
 	panic(errUnsupported)
 }
+
+func MprotectRW(b []byte) (err error) {
+	panic(errUnsupported)
+}
+
+func MprotectNone(b []byte) (err error) {
+	panic(errUnsupported)
+}
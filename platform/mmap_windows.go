@@ -15,11 +15,11 @@ var (
 
 //goland:noinspection GoSnakeCaseUsage
 const (
-	windows_MEM_COMMIT             uintptr = 0x00001000
-	windows_MEM_RELEASE            uintptr = 0x00008000
-	windows_PAGE_READWRITE         uintptr = 0x00000004
-	windows_PAGE_EXECUTE_READ      uintptr = 0x00000020
-	windows_PAGE_EXECUTE_READWRITE uintptr = 0x00000040
+	windows_MEM_COMMIT        uintptr = 0x00001000
+	windows_MEM_RELEASE       uintptr = 0x00008000
+	windows_PAGE_NOACCESS     uintptr = 0x00000001
+	windows_PAGE_READWRITE    uintptr = 0x00000004
+	windows_PAGE_EXECUTE_READ uintptr = 0x00000020
 )
 
 //goland:noinspection GoUnusedConst
@@ -70,7 +70,7 @@ func mmapMemory(size int) ([]byte, error) {
 }
 
 func mmapCodeSegmentAMD64(size int) ([]byte, error) {
-	p, err := allocateMemory(uintptr(size), windows_PAGE_EXECUTE_READWRITE)
+	p, err := allocateMemory(uintptr(size), windows_PAGE_READWRITE)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +95,18 @@ func MprotectRX(b []byte) (err error) {
 	return
 }
 
+//goland:noinspection GoUnusedExportedFunction
+func MprotectRW(b []byte) (err error) {
+	err = virtualProtect(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), windows_PAGE_READWRITE, &old)
+	return
+}
+
+//goland:noinspection GoUnusedExportedFunction
+func MprotectNone(b []byte) (err error) {
+	err = virtualProtect(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), windows_PAGE_NOACCESS, &old)
+	return
+}
+
 // ensureErr returns syscall.EINVAL when the input error is nil.
 //
 // We are supposed to use "GetLastError" which is more precise, but it is not safe to execute in goroutines. While
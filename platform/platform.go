@@ -28,7 +28,9 @@ func CompilerSupported() bool {
 	return archRequirementsVerified
 }
 
-// MmapCodeSegment copies the code into the executable region and returns the byte slice of the region.
+// MmapCodeSegment maps a read-write region for code and returns the byte slice
+// of the region. Copy the code into it and call MprotectRX before executing
+// it, so that no page is ever writable and executable at the same time.
 //
 // See https://man7.org/linux/man-pages/man2/mmap.2.html for mmap API and flags.
 //
@@ -58,7 +60,8 @@ func MmapMemory(size int) ([]byte, error) {
 
 // RemapCodeSegment reallocates the memory mapping of an existing code segment
 // to increase its size. The previous code mapping is unmapped and must not be
-// reused after the function returns.
+// reused after the function returns. Like MmapCodeSegment the new mapping is
+// read-write, and needs MprotectRX before it can be executed.
 //
 // This is similar to mremap(2) on linux, and emulated on platforms which do not
 // have this syscall.